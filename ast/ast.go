@@ -0,0 +1,581 @@
+// Package ast is a front end for tools which need to look at the
+// structure of Lox code, such as linters, formatters and refactorings.
+// Parse() turns source into a typed syntax tree in which every node
+// knows where it came from, Print() turns a tree back into source, and
+// Generate() compiles a tree to bytecode.
+//
+// The compiler package is a single-pass compiler which emits bytecode
+// as it parses, and is what glox runs.  Generate() produces exactly
+// the same function as compiler.Compile() for the same source, down to
+// the line of every instruction, and the tests check that it does.
+package ast
+
+import "fmt"
+
+// A place in the source.  Lines and columns start from 1, and columns
+// count runes.  As in tokens, a string spanning several lines is given
+// the line it ends on.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// The positions of the first and last tokens of a node.
+type Span struct {
+	First Pos
+	Last  Pos
+}
+
+func (s Span) Pos() Pos { return s.First }
+func (s Span) End() Pos { return s.Last }
+
+type Node interface {
+	Pos() Pos // of the first token
+	End() Pos // of the last token
+}
+
+type Expr interface {
+	Node
+	exprNode()
+}
+
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// A whole script.  EOF is where the source ends.
+type File struct {
+	Stmts    []Stmt
+	Comments []*Comment // in the order they appear
+	EOF      Pos
+}
+
+// A comment, which runs from // to the end of the line.  Text
+// includes the // but not any white space at the end of the line.
+type Comment struct {
+	Pos  Pos
+	Text string
+}
+
+func (f *File) Pos() Pos { return Pos{Line: 1, Column: 1} }
+func (f *File) End() Pos { return f.EOF }
+
+// Expressions.
+
+type LiteralKind int
+
+const (
+	LITERAL_NIL LiteralKind = iota
+	LITERAL_TRUE
+	LITERAL_FALSE
+	LITERAL_NUMBER
+	LITERAL_STRING
+)
+
+// nil, true, false, a number or a string without interpolations.  Raw
+// is the literal as written, and Number or String its value.
+type Literal struct {
+	Span
+	Kind   LiteralKind
+	Raw    string
+	Number float64
+	String string
+}
+
+// A piece of the text of a string with interpolations, which starts
+// with the opening quote or the '}' closing an interpolation.
+type Segment struct {
+	Pos  Pos
+	Raw  string // as written, without the quotes, "${" or '}'
+	Text string // with the escape sequences translated
+}
+
+// "a${x}b${y}c" has the segments "a", "b" and "c", and the
+// expressions x and y which go between them.
+type Interpolation struct {
+	Span
+	Segments []Segment
+	Exprs    []Expr
+}
+
+type Variable struct {
+	Span
+	Name string
+}
+
+// target = value, or a compound assignment such as target += value.
+// The target is a *Variable, *Get or *Index, and Op is "=", "+=", "-=",
+// "*=", "/=" or "%=".
+type Assign struct {
+	Span
+	Target Expr
+	Op     string
+	OpPos  Pos
+	Value  Expr
+}
+
+// target++ or target--, or ++target or --target if Prefix is set.  Op
+// is "++" or "--".  The target is a *Variable, *Get or *Index.
+type Increment struct {
+	Span
+	Target Expr
+	Op     string
+	OpPos  Pos
+	Prefix bool
+}
+
+// !x, -x or ~x.
+type Unary struct {
+	Span
+	Op      string
+	Operand Expr
+}
+
+type Binary struct {
+	Span
+	Left  Expr
+	Op    string
+	OpPos Pos
+	Right Expr
+}
+
+// x and y, or x or y, which only evaluate y if they have to.
+type Logical struct {
+	Span
+	Left  Expr
+	Op    string
+	OpPos Pos
+	Right Expr
+}
+
+// cond ? then : else
+type Conditional struct {
+	Span
+	Cond        Expr
+	QuestionPos Pos
+	Then        Expr
+	ColonPos    Pos
+	Else        Expr
+}
+
+// An expression in parentheses.
+type Grouping struct {
+	Span
+	Expr Expr
+}
+
+// An argument of a call, which is named if Name is set.
+type Argument struct {
+	Name    string
+	NamePos Pos
+	Value   Expr
+}
+
+// A call ends with its ')'.
+type Call struct {
+	Span
+	Callee Expr
+	Args   []Argument
+}
+
+// object.name
+type Get struct {
+	Span
+	Object  Expr
+	Name    string
+	NamePos Pos
+}
+
+// object[index], which ends with its ']'.
+type Index struct {
+	Span
+	Object Expr
+	Index  Expr
+}
+
+// yield or yield value, which evaluates to the argument of the next()
+// call that resumes the generator.  Value is nil for a bare yield.
+type Yield struct {
+	Span
+	Value Expr
+}
+
+type List struct {
+	Span
+	Elements []Expr
+}
+
+// {key: value, ...}, which ends with its '}'.
+type Map struct {
+	Span
+	Entries []*Entry
+}
+
+type Entry struct {
+	Key   Expr
+	Value Expr
+}
+
+// A lambda, or an anonymous function declared with fun.
+type FunctionExpr struct {
+	Function *Function
+}
+
+func (e *FunctionExpr) Pos() Pos { return e.Function.Pos() }
+func (e *FunctionExpr) End() Pos { return e.Function.End() }
+
+func (*Literal) exprNode()       {}
+func (*Interpolation) exprNode() {}
+func (*Variable) exprNode()      {}
+func (*Assign) exprNode()        {}
+func (*Increment) exprNode()     {}
+func (*Unary) exprNode()         {}
+func (*Binary) exprNode()        {}
+func (*Logical) exprNode()       {}
+func (*Conditional) exprNode()   {}
+func (*Grouping) exprNode()      {}
+func (*Call) exprNode()          {}
+func (*Get) exprNode()           {}
+func (*Index) exprNode()         {}
+func (*Yield) exprNode()         {}
+func (*List) exprNode()          {}
+func (*Map) exprNode()           {}
+func (*FunctionExpr) exprNode()  {}
+
+// A function, method, lambda or anonymous function.  A lambda such as
+// (a) => a + 1 has a Result expression rather than a Body.  Star is
+// where the '*' of a generator is.
+type Function struct {
+	Span
+	Name        string // empty if anonymous
+	NamePos     Pos
+	IsGenerator bool
+	Star        Pos
+	IsLambda    bool
+	Params      []*Param
+	RParenPos   Pos
+	ArrowPos    Pos // of the '=>' of a lambda
+	Body        *BlockStmt
+	Result      Expr
+}
+
+// A parameter, which may have a default value after an '=', or be the
+// rest parameter which collects any further arguments.
+type Param struct {
+	Name     string
+	NamePos  Pos
+	Rest     bool
+	EqualPos Pos
+	Default  Expr
+}
+
+// Statements.  Statements which end with a ';' end there.
+
+type ExprStmt struct {
+	Span
+	Expr Expr
+}
+
+type PrintStmt struct {
+	Span
+	Expr Expr
+}
+
+// var name; or var name = init;
+type VarStmt struct {
+	Span
+	Name    string
+	NamePos Pos
+	Init    Expr
+}
+
+type ConstStmt struct {
+	Span
+	Name    string
+	NamePos Pos
+	Value   Expr
+}
+
+type FunStmt struct {
+	Function *Function
+}
+
+func (s *FunStmt) Pos() Pos { return s.Function.Pos() }
+func (s *FunStmt) End() Pos { return s.Function.End() }
+
+type ClassStmt struct {
+	Span
+	Name    string
+	NamePos Pos
+	Methods []*Function
+}
+
+type BlockStmt struct {
+	Span
+	Stmts []Stmt
+}
+
+// RParenPos is where the ')' after the condition is.
+type IfStmt struct {
+	Span
+	Cond      Expr
+	RParenPos Pos
+	Then      Stmt
+	Else      Stmt
+}
+
+type WhileStmt struct {
+	Span
+	Cond      Expr
+	RParenPos Pos
+	Body      Stmt
+}
+
+// for (init; cond; incr) body, where each clause may be left out.
+// The initializer is a *VarStmt or an *ExprStmt, which end with the
+// first ';'.  CondSemiPos is where the second ';' is.
+type ForStmt struct {
+	Span
+	Init        Stmt
+	Cond        Expr
+	CondSemiPos Pos
+	Incr        Expr
+	RParenPos   Pos
+	Body        Stmt
+}
+
+// for (var name in iterable) body.  The var is optional.
+type ForInStmt struct {
+	Span
+	HasVar    bool
+	Name      string
+	NamePos   Pos
+	Iterable  Expr
+	RParenPos Pos
+	Body      Stmt
+}
+
+// import "path"; or import "path" as name;
+type ImportStmt struct {
+	Span
+	Path     string
+	RawPath  string
+	PathPos  Pos
+	Alias    string
+	AliasPos Pos
+}
+
+// return; or return value;
+type ReturnStmt struct {
+	Span
+	Value Expr
+}
+
+type ThrowStmt struct {
+	Span
+	Value Expr
+}
+
+type BreakStmt struct {
+	Span
+}
+
+type ContinueStmt struct {
+	Span
+}
+
+// try { ... } catch (name) { ... } finally { ... }, where either the
+// catch or the finally clause may be left out.
+type TryStmt struct {
+	Span
+	Body       *BlockStmt
+	CatchName  string
+	CatchPos   Pos // of the name
+	Catch      *BlockStmt
+	FinallyPos Pos // of 'finally'
+	Finally    *BlockStmt
+}
+
+// switch (subject) { cases }
+type SwitchStmt struct {
+	Span
+	Subject   Expr
+	LBracePos Pos
+	Cases     []*Case
+}
+
+// case a, b: body, or default: body.  Each value comes after the
+// token at the same index in ValuePos, which is 'case' or a ','.
+type Case struct {
+	Span
+	IsDefault bool
+	Values    []Expr
+	ValuePos  []Pos
+	ColonPos  Pos
+	Body      []Stmt
+}
+
+func (*ExprStmt) stmtNode()     {}
+func (*PrintStmt) stmtNode()    {}
+func (*VarStmt) stmtNode()      {}
+func (*ConstStmt) stmtNode()    {}
+func (*FunStmt) stmtNode()      {}
+func (*ClassStmt) stmtNode()    {}
+func (*BlockStmt) stmtNode()    {}
+func (*IfStmt) stmtNode()       {}
+func (*WhileStmt) stmtNode()    {}
+func (*ForStmt) stmtNode()      {}
+func (*ForInStmt) stmtNode()    {}
+func (*ImportStmt) stmtNode()   {}
+func (*ReturnStmt) stmtNode()   {}
+func (*ThrowStmt) stmtNode()    {}
+func (*BreakStmt) stmtNode()    {}
+func (*ContinueStmt) stmtNode() {}
+func (*TryStmt) stmtNode()      {}
+func (*SwitchStmt) stmtNode()   {}
+
+// Call fn for node and each node inside it, in source order.  If fn
+// returns false, the nodes inside that node are skipped.
+func Inspect(node Node, fn func(Node) bool) {
+	if node == nil || !fn(node) {
+		return
+	}
+	for _, child := range children(node) {
+		if child != nil {
+			Inspect(child, fn)
+		}
+	}
+}
+
+// Return the nodes directly inside node.  Some may be nil.
+func children(node Node) []Node {
+	var nodes []Node
+	exprs := func(list []Expr) {
+		for _, e := range list {
+			nodes = append(nodes, e)
+		}
+	}
+	stmts := func(list []Stmt) {
+		for _, s := range list {
+			nodes = append(nodes, s)
+		}
+	}
+	function := func(f *Function) {
+		for _, p := range f.Params {
+			if p.Default != nil {
+				nodes = append(nodes, p.Default)
+			}
+		}
+		if f.Body != nil {
+			nodes = append(nodes, f.Body)
+		} else {
+			nodes = append(nodes, f.Result)
+		}
+	}
+
+	switch n := node.(type) {
+	case *File:
+		stmts(n.Stmts)
+	case *Interpolation:
+		exprs(n.Exprs)
+	case *Assign:
+		nodes = append(nodes, n.Target, n.Value)
+	case *Increment:
+		nodes = append(nodes, n.Target)
+	case *Unary:
+		nodes = append(nodes, n.Operand)
+	case *Binary:
+		nodes = append(nodes, n.Left, n.Right)
+	case *Logical:
+		nodes = append(nodes, n.Left, n.Right)
+	case *Conditional:
+		nodes = append(nodes, n.Cond, n.Then, n.Else)
+	case *Grouping:
+		nodes = append(nodes, n.Expr)
+	case *Call:
+		nodes = append(nodes, n.Callee)
+		for _, arg := range n.Args {
+			nodes = append(nodes, arg.Value)
+		}
+	case *Get:
+		nodes = append(nodes, n.Object)
+	case *Index:
+		nodes = append(nodes, n.Object, n.Index)
+	case *Yield:
+		if n.Value != nil {
+			nodes = append(nodes, n.Value)
+		}
+	case *List:
+		exprs(n.Elements)
+	case *Map:
+		for _, entry := range n.Entries {
+			nodes = append(nodes, entry.Key, entry.Value)
+		}
+	case *FunctionExpr:
+		function(n.Function)
+	case *ExprStmt:
+		nodes = append(nodes, n.Expr)
+	case *PrintStmt:
+		nodes = append(nodes, n.Expr)
+	case *VarStmt:
+		if n.Init != nil {
+			nodes = append(nodes, n.Init)
+		}
+	case *ConstStmt:
+		nodes = append(nodes, n.Value)
+	case *FunStmt:
+		function(n.Function)
+	case *ClassStmt:
+		for _, method := range n.Methods {
+			function(method)
+		}
+	case *BlockStmt:
+		stmts(n.Stmts)
+	case *IfStmt:
+		nodes = append(nodes, n.Cond, n.Then)
+		if n.Else != nil {
+			nodes = append(nodes, n.Else)
+		}
+	case *WhileStmt:
+		nodes = append(nodes, n.Cond, n.Body)
+	case *ForStmt:
+		if n.Init != nil {
+			nodes = append(nodes, n.Init)
+		}
+		if n.Cond != nil {
+			nodes = append(nodes, n.Cond)
+		}
+		if n.Incr != nil {
+			nodes = append(nodes, n.Incr)
+		}
+		nodes = append(nodes, n.Body)
+	case *ForInStmt:
+		nodes = append(nodes, n.Iterable, n.Body)
+	case *ReturnStmt:
+		if n.Value != nil {
+			nodes = append(nodes, n.Value)
+		}
+	case *ThrowStmt:
+		nodes = append(nodes, n.Value)
+	case *TryStmt:
+		nodes = append(nodes, n.Body)
+		if n.Catch != nil {
+			nodes = append(nodes, n.Catch)
+		}
+		if n.Finally != nil {
+			nodes = append(nodes, n.Finally)
+		}
+	case *SwitchStmt:
+		nodes = append(nodes, n.Subject)
+		for _, c := range n.Cases {
+			exprs(c.Values)
+			stmts(c.Body)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,584 @@
+package ast_test
+
+import (
+	"fmt"
+	goast "go/ast"
+	goparser "go/parser"
+	"go/token"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/davidfung/glox/ast"
+	"github.com/davidfung/glox/compiler"
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/value"
+)
+
+// Programs using every construct of the language, with statements
+// split across lines so that the lines of instructions are checked.
+var programs = []string{
+	`print 1 + 2 * 3 - -4 / 2 % 3 ~/ 1;
+print !true == false != nil;
+print 1 < 2 and 2 <= 3 or 3 > 4 and 4 >= 5;
+print (1 | 2) ^ 3 & ~4 << 1 >> 2;
+var a = "x" + "y"
+  + "z";
+var b;
+b = a;
+print b == nil ? "nil" : b == "" ? "empty"
+  : b;
+`,
+	`var s = "line
+break";
+var t = "a\tb\u{1F600}\$";
+var n = 3;
+print "n is ${n} and ${n + 1}${""}!";
+print "${n}";
+print "nested ${"in ${n}"} done";
+`,
+	`var x = 1;
+x += 2; x -= 1; x *= 3; x /= 2; x %= 5;
+x++; x--; ++x; --x;
+print x++ + ++x;
+var l = [1, 2, [3, 4]];
+l[0] = l[1];
+l[2][0] += 1;
+l[1]++;
+++l[2][1];
+print l[0] + l[
+  1];
+var m = {"k": l, 1: {}};
+m["k"] = m[1];
+m[true] = {
+  "a": 1,
+  2: [3]
+};
+print m[
+  "k"];
+`,
+	`class Counter {
+  init(start) { print start; }
+  add(n, step = 1) {
+    var total = n + step;
+    return total;
+  }
+}
+var c = Counter();
+c.count = 0;
+c.count += 1;
+c.count++;
+++c.count;
+++c.inner.count;
+print c.add(1) + c.add(1, step: 2);
+print c.add(n: 1,
+  step: 3);
+`,
+	`fun outer(a, b = a + 1, ...rest) {
+  var x = a;
+  fun middle() {
+    fun inner() {
+      x = x + b;
+      return x;
+    }
+    return inner;
+  }
+  return middle()();
+}
+print outer(1);
+var add = (a, b) => a + b;
+var block = (a) => {
+  var doubled = a * 2;
+  return doubled;
+};
+var anon = fun (n) { return n; };
+var gen = fun* (n) { yield n; };
+print add(1, 2) + block(3) + anon(4);
+`,
+	`{
+  const k = 1;
+  var y = k;
+  {
+    var z = y;
+    print z;
+  }
+}
+const g = 2;
+print g;
+`,
+	`var i = 0;
+while (i < 10) {
+  i = i + 1;
+  if (i == 2) continue;
+  if (i == 8) break;
+  print i;
+}
+for (var j = 0; j < 3; j++) print j;
+for (;;) { break; }
+var k = 0;
+for (k = 1; k < 3;) k++;
+for (; k < 5; k = k + 1) {
+  var captured = k;
+  fun f() { return captured; }
+}
+if (i > 1) print "big"; else print "small";
+if (i) {
+  print i;
+} else if (k) {
+  print k;
+}
+`,
+	`for (var item in [1, 2, 3]) {
+  fun f() { return item; }
+  print f();
+}
+var item;
+for (item in "abc") print item;
+fun* count(n) {
+  for (var i = 0; i < n; i++) yield i;
+  yield;
+  var sent = yield 1 + 2;
+  print [yield, f(yield sent)];
+  return;
+}
+for (var n in count(3)) if (n == 1) continue; else print n;
+`,
+	`fun risky(x) {
+  try {
+    if (x) throw "boom";
+    return 1;
+  } catch (e) {
+    print e;
+  }
+  try {
+    var inside = 1;
+    return inside;
+  } finally {
+    print "finally";
+  }
+}
+for (var i = 0; i < 3; i++) {
+  try {
+    if (i == 0) continue;
+    if (i == 2) break;
+    var v = i;
+  } catch (e) {
+    throw e;
+  } finally {
+    var w = i;
+    print w;
+  }
+}
+try { print 1; } finally { print 2; }
+`,
+	`fun classify(n) {
+  switch (n) {
+    case 1, 2:
+      return "small";
+    case 3:
+      var three = "three";
+      return three;
+    case 4:
+    case 5:
+      break;
+    default:
+      return "other";
+  }
+  switch (n + 1) {
+    case "a": print "a";
+    case n * 2:
+      print "double";
+  }
+  for (;;) {
+    switch (n) {
+      case 1: continue;
+      default: break;
+    }
+    break;
+  }
+  return nil;
+}
+print classify(3);
+`,
+	`import "lib/strings.lox";
+import "math" as m;
+var t = nil;
+t = [fun () {}, () => 1];
+print t;
+`,
+}
+
+// Compile the source with the compiler, with what it prints thrown
+// away, and report whether it compiled.
+func compile(source string) (object.ObjFunction, bool) {
+	stdout, stderr := os.Stdout, os.Stderr
+	devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	os.Stdout, os.Stderr = devNull, devNull
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		devNull.Close()
+	}()
+	function := compiler.Compile(&source)
+	return function, function.Arity != -1
+}
+
+func generate(t *testing.T, source string) (object.ObjFunction, bool) {
+	t.Helper()
+	file, err := ast.Parse(source)
+	if err != nil {
+		return object.ObjFunction{}, false
+	}
+	function, err := ast.Generate(file)
+	return function, err == nil
+}
+
+// Return a description of the first difference between two functions,
+// or "" if they are the same.
+func difference(path string, want, got object.ObjFunction) string {
+	switch {
+	case want.Name != got.Name:
+		return fmt.Sprintf("%s: name %q, want %q", path, got.Name, want.Name)
+	case want.Arity != got.Arity || want.MinArity != got.MinArity || want.MaxArity != got.MaxArity:
+		return fmt.Sprintf("%s: arity %d %d %d, want %d %d %d", path,
+			got.Arity, got.MinArity, got.MaxArity, want.Arity, want.MinArity, want.MaxArity)
+	case !reflect.DeepEqual(want.Chun.Code, got.Chun.Code):
+		return fmt.Sprintf("%s: code\n%v\nwant\n%v", path, got.Chun.Code, want.Chun.Code)
+	case !reflect.DeepEqual(want.Chun.Lines, got.Chun.Lines):
+		return fmt.Sprintf("%s: lines\n%v\nwant\n%v", path, got.Chun.Lines, want.Chun.Lines)
+	case len(want.Chun.Constants.Values) != len(got.Chun.Constants.Values):
+		return fmt.Sprintf("%s: %d constants, want %d", path, len(got.Chun.Constants.Values), len(want.Chun.Constants.Values))
+	}
+	for i, w := range want.Chun.Constants.Values {
+		g := got.Chun.Constants.Values[i]
+		wf, wok := function(w)
+		gf, gok := function(g)
+		if wok && gok {
+			if diff := difference(fmt.Sprintf("%s/%s", path, wf.Name), wf, gf); diff != "" {
+				return diff
+			}
+		} else if !reflect.DeepEqual(w, g) && !(isNaN(w) && isNaN(g)) {
+			return fmt.Sprintf("%s: constant %d is %v, want %v", path, i, g, w)
+		}
+	}
+	// The constants have been compared, and 0/0 is folded into a NaN
+	// which is not equal to itself.
+	want.Chun.Constants, got.Chun.Constants = value.ValueArray{}, value.ValueArray{}
+	if !reflect.DeepEqual(want, got) {
+		return fmt.Sprintf("%s: got\n%+v\nwant\n%+v", path, got, want)
+	}
+	return ""
+}
+
+func isNaN(v value.Value) bool {
+	n, ok := v.Val.(float64)
+	return ok && math.IsNaN(n)
+}
+
+func function(v value.Value) (object.ObjFunction, bool) {
+	obj, ok := v.Val.(object.Obj)
+	if !ok || obj.Type_ != object.OBJ_FUNCTION {
+		return object.ObjFunction{}, false
+	}
+	return obj.Val.(object.ObjFunction), true
+}
+
+// The Lox programs in the VM's tests, which exercise much more of the
+// language than the programs above.
+func vmPrograms(t *testing.T) []string {
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "../vm/vm_test.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sources []string
+	goast.Inspect(file, func(n goast.Node) bool {
+		if lit, ok := n.(*goast.BasicLit); ok && lit.Kind == token.STRING && strings.HasPrefix(lit.Value, "`") {
+			s, _ := strconv.Unquote(lit.Value)
+			sources = append(sources, s)
+		}
+		return true
+	})
+	return sources
+}
+
+func TestGenerateMatchesCompiler(t *testing.T) {
+	sources := append(programs, vmPrograms(t)...)
+	compiled := 0
+	for i, source := range sources {
+		want, wantOK := compile(source)
+		got, gotOK := generate(t, source)
+		if wantOK != gotOK {
+			t.Errorf("program %d compiles: %v, but generates: %v\n%s", i, wantOK, gotOK, source)
+			continue
+		}
+		if !wantOK {
+			continue
+		}
+		compiled++
+		if diff := difference("<script>", want, got); diff != "" {
+			t.Errorf("program %d: %s\n%s", i, diff, source)
+		}
+	}
+	if compiled < len(programs) {
+		t.Errorf("only %d programs compiled", compiled)
+	}
+	t.Logf("%d of %d programs compiled", compiled, len(sources))
+}
+
+func TestPrint(t *testing.T) {
+	source := `var  x=1 ;
+fun  f(a,b=2,...rest){return a+b;}
+
+
+class C{
+  m(){}
+
+  n() { if(x)return;else{x++;} }
+}
+var l=[
+1,2];
+if (x) { print -  -x; } else if (x) print x; else { }
+switch(x){case 1,2:print "a${x}b";default:}
+try{x=f(a:1);}catch(e){throw e;}finally{}
+for(var i=0;i<3;i++)print i;
+for(;;)break;
+`
+	want := `var x = 1;
+fun f(a, b = 2, ...rest) {
+  return a + b;
+}
+
+class C {
+  m() {}
+
+  n() {
+    if (x) return;
+    else {
+      x++;
+    }
+  }
+}
+var l = [
+  1,
+  2
+];
+if (x) {
+  print - -x;
+} else if (x) print x;
+else {}
+switch (x) {
+  case 1, 2:
+    print "a${x}b";
+  default:
+}
+try {
+  x = f(a: 1);
+} catch (e) {
+  throw e;
+} finally {}
+for (var i = 0; i < 3; i++) print i;
+for (;;) break;
+`
+	file, err := ast.Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ast.Print(file); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrintComments(t *testing.T) {
+	source := `// Header.
+
+// Second paragraph.
+var a = 1;   // trailing
+var b = [
+  1, // one
+  2  // two
+];
+fun f(x) { // opening
+  // leading
+  print x;
+
+  // before the end
+}
+if (a) { print a; } // after then
+else print b;
+class C {
+  // nothing yet
+}
+switch (a) { // subject
+  case 1: // one
+    print 1;
+}
+print a +
+  // inside
+  b;
+// The end.
+`
+	want := `// Header.
+
+// Second paragraph.
+var a = 1; // trailing
+var b = [
+  1, // one
+  2 // two
+];
+fun f(x) { // opening
+  // leading
+  print x;
+
+  // before the end
+}
+if (a) {
+  print a;
+} // after then
+else print b;
+class C {
+  // nothing yet
+}
+switch (a) { // subject
+  case 1: // one
+    print 1;
+}
+print a +
+  // inside
+  b;
+// The end.
+`
+	file, err := ast.Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ast.Print(file)
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if file, _ = ast.Parse(got); ast.Print(file) != got {
+		t.Errorf("printed again as\n%s", ast.Print(file))
+	}
+}
+
+// A comment inside a statement stays after the token it follows, and
+// what comes after it goes on a new line.
+func TestPrintCommentsInside(t *testing.T) {
+	tests := []struct {
+		source, want string
+	}{
+		{"var a = 1 + // one\n  2;", "var a = 1 + // one\n  2;\n"},
+		{"var a = 1\n  // one\n  + 2;", "var a = 1\n  // one\n  + 2;\n"},
+		{"fun g(x, // p\n  y) { return x; }", "fun g(x, // p\n  y) {\n  return x;\n}\n"},
+		{"fun g(x // p\n) {}", "fun g(x // p\n  ) {}\n"},
+		{"fun g(x) // p\n{ return x; }", "fun g(x) { // p\n  return x;\n}\n"},
+		{"print [1, // first\n  2];", "print [1, // first\n  2];\n"},
+		{"print [ // list\n  1,\n  2\n  // end\n];", "print [ // list\n  1,\n  2\n  // end\n];\n"},
+		{"f(a, // first\n  b: 2);", "f(a, // first\n  b: 2);\n"},
+		{"print a // get\n  .b;", "print a // get\n  .b;\n"},
+		{"print -(a // x\n);", "print -(a // x\n  );\n"},
+		{"var c = a ? // then\n  1 : 2;", "var c = a ? // then\n  1 : 2;\n"},
+		{"if (a) // then\n  print a;", "if (a) // then\n  print a;\n"},
+		{
+			"if (a > b) return a; else { return b; } // after",
+			"if (a > b) return a;\nelse {\n  return b;\n} // after\n",
+		},
+		{
+			"try { f(); } catch (e) { print e; } // after",
+			"try {\n  f();\n} catch (e) {\n  print e;\n} // after\n",
+		},
+	}
+	for _, test := range tests {
+		file, err := ast.Parse(test.source)
+		if err != nil {
+			t.Errorf("%q: %v", test.source, err)
+			continue
+		}
+		got := ast.Print(file)
+		if got != test.want {
+			t.Errorf("%q printed as\n%s\nwant\n%s", test.source, got, test.want)
+			continue
+		}
+		again, err := ast.Parse(got)
+		if err != nil {
+			t.Errorf("%q: printed code doesn't parse: %v", test.source, err)
+			continue
+		}
+		if len(again.Comments) != len(file.Comments) {
+			t.Errorf("%q: %d comments printed, want %d", test.source, len(again.Comments), len(file.Comments))
+		}
+		if ast.Print(again) != got {
+			t.Errorf("%q printed again as\n%s", test.source, ast.Print(again))
+		}
+	}
+}
+
+// Printing a program and parsing it again gives code which prints the
+// same way and compiles to the same instructions.
+func TestPrintRoundTrip(t *testing.T) {
+	for i, source := range append(programs, vmPrograms(t)...) {
+		file, err := ast.Parse(source)
+		if err != nil {
+			continue
+		}
+		printed := ast.Print(file)
+		again, err := ast.Parse(printed)
+		if err != nil {
+			t.Errorf("program %d: %v\n%s", i, err, printed)
+			continue
+		}
+		if reprinted := ast.Print(again); reprinted != printed {
+			t.Errorf("program %d prints as\n%s\nthen as\n%s", i, printed, reprinted)
+			continue
+		}
+		if len(again.Comments) != len(file.Comments) {
+			t.Errorf("program %d has %d comments, and %d when printed\n%s", i, len(file.Comments), len(again.Comments), printed)
+		}
+		want, wantOK := generate(t, source)
+		got, gotOK := generate(t, printed)
+		if wantOK != gotOK || !reflect.DeepEqual(want.Chun.Code, got.Chun.Code) {
+			t.Errorf("program %d compiles differently when printed\n%s", i, printed)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		source, want string
+	}{
+		{"print 1 +;", "[line 1:10] Error at ';': Expect expression."},
+		{"var 1;", "[line 1:5] Error at '1': Expect variable name."},
+		{"fun f(...a, b) {}", "[line 1:11] Error at ',': Rest parameter must be last."},
+		{"var m = {1 2};", "[line 1:12] Error at '2': Expect ':' after map key."},
+		{"break;", "[line 1:1] Error at 'break': Can't use 'break' outside of a loop."},
+		{"{ const k = 1; k = 2; }", "[line 1:18] Error at '=': Can't assign to constant 'k'."},
+	}
+	for _, test := range tests {
+		file, err := ast.Parse(test.source)
+		if err == nil {
+			_, err = ast.Generate(file)
+		}
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%q: got error %v, want %s", test.source, err, test.want)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	file, err := ast.Parse("var a = 1;\nprint a + f(a, [a]);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uses []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		if v, ok := n.(*ast.Variable); ok && v.Name == "a" {
+			uses = append(uses, v.Pos().String())
+		}
+		return true
+	})
+	if want := []string{"2:7", "2:13", "2:17"}; !reflect.DeepEqual(uses, want) {
+		t.Errorf("uses of a at %v, want %v", uses, want)
+	}
+}
@@ -0,0 +1,1285 @@
+package ast
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/davidfung/glox/chunk"
+	"github.com/davidfung/glox/common"
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/optimizer"
+	"github.com/davidfung/glox/value"
+)
+
+// The code generator walks a syntax tree and emits the bytecode the
+// compiler would have emitted while parsing the same source.  It keeps
+// the same state as the compiler for each function being compiled,
+// and follows the compiler step by step, so the comments in the
+// compiler package explain how each construct is compiled.
+//
+// Each instruction the compiler emits is given the line of the token
+// it has just consumed, which is why the generator moves to a node's
+// position before emitting, say, the OP_ADD of a binary expression at
+// the last token of its right operand.
+
+type local struct {
+	name       string // empty for hidden locals
+	depth      int
+	isCaptured bool
+	isConst    bool
+	debug      int // index in the chunk's debug table, -1 if not entered yet
+}
+
+type upvalue struct {
+	index   uint8
+	isLocal bool
+	isConst bool
+}
+
+type loop struct {
+	enclosing  *loop
+	start      int
+	scopeDepth int
+	breakJumps []int
+}
+
+type finally struct {
+	enclosing *finally
+	depth     int
+	kindSlot  uint8
+	valueSlot uint8
+	loop      *loop
+	jumps     []int
+	hasReturn bool
+	exits     []exit
+	nextKind  int
+}
+
+type exit struct {
+	kind    int
+	loop    *loop
+	isBreak bool
+}
+
+const (
+	COMPLETION_NORMAL = iota
+	COMPLETION_THROW
+	COMPLETION_RETURN
+	COMPLETION_EXIT
+)
+
+type FunctionType int
+
+const (
+	_ FunctionType = iota
+	TYPE_ANONYMOUS
+	TYPE_FUNCTION
+	TYPE_SCRIPT
+)
+
+// The state of a function being compiled.
+type funcState struct {
+	enclosing *funcState
+	function  object.ObjFunction
+	type_     FunctionType
+
+	locals     [common.UINT8_COUNT]local
+	localCount int
+	upvalues   [common.UINT8_COUNT]upvalue
+	scopeDepth int
+
+	loop    *loop
+	finally *finally
+}
+
+type generator struct {
+	current *funcState
+	pos     Pos // of the token the compiler would have just consumed
+	errors  ErrorList
+}
+
+// Compile a syntax tree to the function for the script, as
+// compiler.Compile() compiles its source.  If the tree has errors
+// which the parser cannot find, such as a break outside a loop, they
+// are returned as an ErrorList, and the function has an Arity of -1.
+func Generate(file *File) (object.ObjFunction, error) {
+	g := &generator{}
+	g.initFunction(TYPE_SCRIPT, "")
+	for _, stmt := range file.Stmts {
+		g.stmt(stmt)
+	}
+	g.at(file.EOF)
+	function := g.endFunction()
+	if len(g.errors) > 0 {
+		return object.ObjFunction{Arity: -1}, g.errors
+	}
+	return function, nil
+}
+
+func (g *generator) at(pos Pos) {
+	g.pos = pos
+}
+
+func (g *generator) error(message string) {
+	g.errors = append(g.errors, &Error{Pos: g.pos, Message: message})
+}
+
+// Report an error at the token with the lexeme, which is the one the
+// compiler has just consumed when it reports the same error.
+func (g *generator) errorAt(lexeme string, message string) {
+	g.errors = append(g.errors, &Error{Pos: g.pos, Where: fmt.Sprintf(" at '%s'", lexeme), Message: message})
+}
+
+func (g *generator) chunk() *chunk.Chunk {
+	return &g.current.function.Chun
+}
+
+func (g *generator) ip() int {
+	return len(g.chunk().Code)
+}
+
+func (g *generator) emit(bytes ...any) {
+	for _, b := range bytes {
+		switch b := b.(type) {
+		case chunk.OpCode:
+			chunk.WriteChunk(g.chunk(), b, g.pos.Line)
+		case uint8:
+			chunk.WriteChunk(g.chunk(), b, g.pos.Line)
+		default:
+			panic(fmt.Sprintf("emit: %T is not a byte", b))
+		}
+	}
+}
+
+func (g *generator) emitLoop(loopStart int) {
+	g.emit(chunk.OP_LOOP)
+	offset := g.ip() - loopStart + 2
+	if offset > common.UINT16_MAX {
+		g.error("Loop body too large.")
+	}
+	g.emit(uint8((offset>>8)&0xff), uint8(offset&0xff))
+}
+
+func (g *generator) emitJump(op chunk.OpCode) int {
+	g.emit(op, uint8(0xff), uint8(0xff))
+	return g.ip() - 2
+}
+
+func (g *generator) patchJump(offset int) {
+	jump := g.ip() - offset - 2
+	if jump > common.UINT16_MAX {
+		g.error("Too much code to jump over.")
+	}
+	g.chunk().Code[offset] = uint8((jump >> 8) & 0xff)
+	g.chunk().Code[offset+1] = uint8(jump & 0xff)
+}
+
+func (g *generator) makeConstant(value value.Value) uint8 {
+	constant := chunk.AddConstant(g.chunk(), value)
+	if constant > math.MaxUint8 {
+		g.error("Too many constants in one chunk.")
+		return 0
+	}
+	return uint8(constant)
+}
+
+func (g *generator) emitConstant(value value.Value) {
+	g.emit(chunk.OP_CONSTANT, g.makeConstant(value))
+}
+
+func (g *generator) identifierConstant(name string) uint8 {
+	return g.makeConstant(objval.STRING_VAL(name))
+}
+
+// Functions and scopes.
+
+func (g *generator) initFunction(type_ FunctionType, name string) {
+	f := &funcState{enclosing: g.current, type_: type_, function: object.NewFunction()}
+	f.function.Name = object.ObjString(name)
+	// Slot zero belongs to the VM.
+	f.locals[0] = local{debug: -1}
+	f.localCount = 1
+	g.current = f
+}
+
+func (g *generator) endFunction() object.ObjFunction {
+	g.emit(chunk.OP_NIL, chunk.OP_RETURN)
+	for i := range g.current.localCount {
+		g.endLocal(&g.current.locals[i])
+	}
+	if len(g.errors) == 0 {
+		optimizer.Optimize(g.chunk())
+	}
+	function := g.current.function
+	g.current = g.current.enclosing
+	return function
+}
+
+// Compile a function, and emit the closure for it in the enclosing
+// function.
+func (g *generator) function(fn *Function, type_ FunctionType) object.ObjFunction {
+	name := fn.Name
+	if type_ == TYPE_ANONYMOUS {
+		line := fn.Pos().Line
+		if fn.IsGenerator {
+			line = fn.Star.Line
+		}
+		name = fmt.Sprintf("anonymous@%d", line)
+	}
+	g.initFunction(type_, name)
+	g.current.function.IsGenerator = fn.IsGenerator
+	g.beginScope()
+	g.parameters(fn.Params)
+	if fn.Body != nil {
+		g.stmts(fn.Body.Stmts)
+	} else {
+		g.expr(fn.Result)
+		g.at(fn.Result.End())
+		g.emit(chunk.OP_RETURN)
+	}
+	g.at(fn.End())
+
+	compiled := g.current
+	function := g.endFunction()
+	obj := object.Obj{Type_: object.OBJ_FUNCTION, Val: function}
+	g.emit(chunk.OP_CLOSURE, g.makeConstant(objval.OBJ_VAL(obj)))
+	for i := range function.UpvalueCount {
+		if compiled.upvalues[i].isLocal {
+			g.emit(uint8(1))
+		} else {
+			g.emit(uint8(0))
+		}
+		g.emit(compiled.upvalues[i].index)
+	}
+	return function
+}
+
+func (g *generator) parameters(params []*Param) {
+	function := &g.current.function
+	function.MaxArity = -1
+	for _, param := range params {
+		g.at(param.NamePos)
+		if param.Rest {
+			g.declareVariable(param.Name)
+			g.markInitialized()
+			return
+		}
+		function.Arity++
+		g.declareVariable(param.Name)
+		function.Params = append(function.Params, object.ObjString(param.Name))
+		if param.Default != nil {
+			// Store the default in the slot if no argument was passed.
+			slot := uint8(g.current.localCount - 1)
+			g.at(param.EqualPos)
+			g.emit(chunk.OP_JUMP_IF_PASSED, slot, uint8(0xff), uint8(0xff))
+			jump := g.ip() - 2
+			g.expr(param.Default)
+			g.at(param.Default.End())
+			g.emit(chunk.OP_SET_LOCAL, slot, chunk.OP_POP)
+			g.patchJump(jump)
+		} else {
+			function.MinArity++
+		}
+		g.markInitialized()
+	}
+	function.MaxArity = function.Arity
+}
+
+func (g *generator) beginScope() {
+	g.current.scopeDepth++
+}
+
+func (g *generator) endScope() {
+	c := g.current
+	c.scopeDepth--
+	for c.localCount > 0 && c.locals[c.localCount-1].depth > c.scopeDepth {
+		g.endLocal(&c.locals[c.localCount-1])
+		if c.locals[c.localCount-1].isCaptured {
+			g.emit(chunk.OP_CLOSE_UPVALUE)
+		} else {
+			g.emit(chunk.OP_POP)
+		}
+		c.localCount--
+	}
+}
+
+func (g *generator) endLocal(l *local) {
+	if l.debug != -1 {
+		g.chunk().Locals[l.debug].End = g.ip()
+	}
+}
+
+func (g *generator) addLocal(name string) {
+	c := g.current
+	if c.localCount == common.UINT8_COUNT {
+		g.error("Too may local variables in function.")
+		return
+	}
+	c.locals[c.localCount] = local{name: name, depth: c.scopeDepth, debug: -1}
+	c.localCount++
+}
+
+// Declare a local with the name.  Globals are late bound and are not
+// declared.
+func (g *generator) declareVariable(name string) {
+	c := g.current
+	if c.scopeDepth == 0 {
+		return
+	}
+	for i := c.localCount - 1; i >= 0; i-- {
+		l := c.locals[i]
+		if l.depth != -1 && l.depth < c.scopeDepth {
+			break
+		}
+		if l.name == name {
+			g.errorAt(name, "Already a variable with this name in this scope.")
+		}
+	}
+	g.addLocal(name)
+}
+
+// Declare the variable, and return the constant of its name if it is
+// a global.
+func (g *generator) parseVariable(name string) uint8 {
+	g.declareVariable(name)
+	if g.current.scopeDepth > 0 {
+		return 0
+	}
+	return g.identifierConstant(name)
+}
+
+func (g *generator) markInitialized() {
+	c := g.current
+	if c.scopeDepth == 0 {
+		return
+	}
+	l := &c.locals[c.localCount-1]
+	l.depth = c.scopeDepth
+	if l.debug == -1 && l.name != "" {
+		l.debug = chunk.AddLocal(g.chunk(), l.name, c.localCount-1)
+	}
+}
+
+func (g *generator) defineVariable(global uint8) {
+	if g.current.scopeDepth > 0 {
+		g.markInitialized()
+		return
+	}
+	g.emit(chunk.OP_DEFINE_GLOBAL, global)
+}
+
+func (g *generator) resolveLocal(c *funcState, name string) int {
+	for i := c.localCount - 1; i >= 0; i-- {
+		if c.locals[i].name == name {
+			if c.locals[i].depth == -1 {
+				g.error("Can't read local variable in its own initializer.")
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *generator) addUpvalue(c *funcState, index uint8, isLocal bool, name string) int {
+	upvalueCount := c.function.UpvalueCount
+	for i := range upvalueCount {
+		if c.upvalues[i].index == index && c.upvalues[i].isLocal == isLocal {
+			return i
+		}
+	}
+	if upvalueCount == common.UINT8_COUNT {
+		g.error("Too many closure variables in function.")
+	}
+	c.upvalues[upvalueCount].isLocal = isLocal
+	c.upvalues[upvalueCount].index = index
+	c.function.Chun.UpvalueNames = append(c.function.Chun.UpvalueNames, name)
+	c.function.UpvalueCount++
+	return upvalueCount
+}
+
+func (g *generator) resolveUpvalue(c *funcState, name string) int {
+	if c.enclosing == nil {
+		return -1
+	}
+	if l := g.resolveLocal(c.enclosing, name); l != -1 {
+		c.enclosing.locals[l].isCaptured = true
+		index := g.addUpvalue(c, uint8(l), true, name)
+		c.upvalues[index].isConst = c.enclosing.locals[l].isConst
+		return index
+	}
+	if up := g.resolveUpvalue(c.enclosing, name); up != -1 {
+		index := g.addUpvalue(c, uint8(up), false, name)
+		c.upvalues[index].isConst = c.enclosing.upvalues[up].isConst
+		return index
+	}
+	return -1
+}
+
+// Return the instructions and operand to read and write the variable.
+func (g *generator) resolveVariable(name string) (chunk.OpCode, chunk.OpCode, uint8) {
+	if arg := g.resolveLocal(g.current, name); arg != -1 {
+		return chunk.OP_GET_LOCAL, chunk.OP_SET_LOCAL, uint8(arg)
+	}
+	if arg := g.resolveUpvalue(g.current, name); arg != -1 {
+		return chunk.OP_GET_UPVALUE, chunk.OP_SET_UPVALUE, uint8(arg)
+	}
+	return chunk.OP_GET_GLOBAL, chunk.OP_SET_GLOBAL, g.identifierConstant(name)
+}
+
+// Report an error if the variable is a constant.  lexeme is the token
+// the compiler has just consumed, the operator or the variable.
+func (g *generator) checkAssignable(name, lexeme string, setOp chunk.OpCode, arg uint8) {
+	isConst := false
+	switch setOp {
+	case chunk.OP_SET_LOCAL:
+		isConst = g.current.locals[arg].isConst
+	case chunk.OP_SET_UPVALUE:
+		isConst = g.current.upvalues[arg].isConst
+	}
+	if isConst {
+		g.errorAt(lexeme, fmt.Sprintf("Can't assign to constant '%s'.", name))
+	}
+}
+
+// Loops and try statements.
+
+func (g *generator) beginLoop(l *loop, start int) {
+	l.enclosing = g.current.loop
+	l.start = start
+	l.scopeDepth = g.current.scopeDepth
+	g.current.loop = l
+}
+
+func (g *generator) endLoop() {
+	for _, jump := range g.current.loop.breakJumps {
+		g.patchJump(jump)
+	}
+	g.current.loop = g.current.loop.enclosing
+}
+
+func (g *generator) discardLocals(count int) {
+	for i := g.current.localCount - 1; i >= count; i-- {
+		if g.current.locals[i].isCaptured {
+			g.emit(chunk.OP_CLOSE_UPVALUE)
+		} else {
+			g.emit(chunk.OP_POP)
+		}
+	}
+}
+
+func (g *generator) discardLoopLocals(l *loop) {
+	count := g.current.localCount
+	for count > 0 && g.current.locals[count-1].depth > l.scopeDepth {
+		count--
+	}
+	g.discardLocals(count)
+}
+
+func (g *generator) finallyInside(l *loop) *finally {
+	if g.current.finally == nil {
+		return nil
+	}
+	for outer := g.current.finally.loop; outer != nil; outer = outer.enclosing {
+		if outer == l {
+			return g.current.finally
+		}
+	}
+	return nil
+}
+
+func (g *generator) jumpToFinally(f *finally, kind int) {
+	if kind == COMPLETION_RETURN {
+		g.emit(chunk.OP_SET_LOCAL, f.valueSlot, chunk.OP_POP)
+	}
+	g.emitConstant(objval.NUMBER_VAL(float64(kind)))
+	g.emit(chunk.OP_SET_LOCAL, f.kindSlot, chunk.OP_POP)
+	g.discardLocals(f.depth)
+	f.jumps = append(f.jumps, g.emitJump(chunk.OP_JUMP))
+}
+
+func (g *generator) emitBreak(l *loop) {
+	if f := g.finallyInside(l); f != nil {
+		f.exits = append(f.exits, exit{f.nextKind, l, true})
+		g.jumpToFinally(f, f.nextKind)
+		f.nextKind++
+		return
+	}
+	g.discardLoopLocals(l)
+	l.breakJumps = append(l.breakJumps, g.emitJump(chunk.OP_JUMP))
+}
+
+func (g *generator) emitContinue(l *loop) {
+	if f := g.finallyInside(l); f != nil {
+		f.exits = append(f.exits, exit{f.nextKind, l, false})
+		g.jumpToFinally(f, f.nextKind)
+		f.nextKind++
+		return
+	}
+	g.discardLoopLocals(l)
+	g.emitLoop(l.start)
+}
+
+func (g *generator) emitReturnValue() {
+	if g.current.finally != nil {
+		g.current.finally.hasReturn = true
+		g.jumpToFinally(g.current.finally, COMPLETION_RETURN)
+	} else {
+		g.emit(chunk.OP_RETURN)
+	}
+}
+
+// Statements.
+
+func (g *generator) stmts(stmts []Stmt) {
+	for _, stmt := range stmts {
+		g.stmt(stmt)
+	}
+}
+
+func (g *generator) stmt(stmt Stmt) {
+	switch s := stmt.(type) {
+	case *ExprStmt:
+		g.expr(s.Expr)
+		g.at(s.End())
+		g.emit(chunk.OP_POP)
+	case *PrintStmt:
+		g.expr(s.Expr)
+		g.at(s.End())
+		g.emit(chunk.OP_PRINT)
+	case *VarStmt:
+		g.at(s.NamePos)
+		global := g.parseVariable(s.Name)
+		if s.Init != nil {
+			g.expr(s.Init)
+		} else {
+			g.emit(chunk.OP_NIL)
+		}
+		g.at(s.End())
+		g.defineVariable(global)
+	case *ConstStmt:
+		g.at(s.NamePos)
+		global := g.parseVariable(s.Name)
+		if g.current.scopeDepth > 0 {
+			g.current.locals[g.current.localCount-1].isConst = true
+		}
+		g.expr(s.Value)
+		g.at(s.End())
+		if g.current.scopeDepth > 0 {
+			g.markInitialized()
+			return
+		}
+		g.emit(chunk.OP_DEFINE_CONST, global)
+	case *FunStmt:
+		g.at(s.Function.NamePos)
+		global := g.parseVariable(s.Function.Name)
+		g.markInitialized()
+		g.function(s.Function, TYPE_FUNCTION)
+		g.defineVariable(global)
+	case *ClassStmt:
+		g.classStatement(s)
+	case *BlockStmt:
+		g.beginScope()
+		g.stmts(s.Stmts)
+		g.at(s.End())
+		g.endScope()
+	case *IfStmt:
+		g.expr(s.Cond)
+		g.at(s.RParenPos)
+		thenJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		g.emit(chunk.OP_POP)
+		g.stmt(s.Then)
+		g.at(s.Then.End())
+		elseJump := g.emitJump(chunk.OP_JUMP)
+		g.patchJump(thenJump)
+		g.emit(chunk.OP_POP)
+		if s.Else != nil {
+			g.stmt(s.Else)
+		}
+		g.patchJump(elseJump)
+	case *WhileStmt:
+		loopStart := g.ip()
+		g.expr(s.Cond)
+		g.at(s.RParenPos)
+		exitJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		g.emit(chunk.OP_POP)
+		var l loop
+		g.beginLoop(&l, loopStart)
+		g.stmt(s.Body)
+		g.at(s.Body.End())
+		g.emitLoop(loopStart)
+		g.patchJump(exitJump)
+		g.emit(chunk.OP_POP)
+		g.endLoop()
+	case *ForStmt:
+		g.forStatement(s)
+	case *ForInStmt:
+		g.forInStatement(s)
+	case *ImportStmt:
+		g.at(s.Pos())
+		if g.current.scopeDepth > 0 {
+			g.errorAt("import", "Can only import at top level.")
+		}
+		path := g.makeConstant(objval.STRING_VAL(s.Path))
+		g.at(s.End())
+		g.emit(chunk.OP_IMPORT, path)
+		g.emit(chunk.OP_DEFINE_GLOBAL, g.identifierConstant(s.Name()))
+	case *ReturnStmt:
+		g.at(s.Pos())
+		if g.current.type_ == TYPE_SCRIPT {
+			g.errorAt("return", "Can't return from top-level code.")
+		}
+		if s.Value == nil {
+			g.at(s.End())
+			g.emit(chunk.OP_NIL)
+		} else {
+			if g.current.function.IsGenerator {
+				g.errorAt("return", "Can't return a value from a generator.")
+			}
+			g.expr(s.Value)
+			g.at(s.End())
+		}
+		g.emitReturnValue()
+	case *ThrowStmt:
+		g.expr(s.Value)
+		g.at(s.End())
+		g.emit(chunk.OP_THROW)
+	case *BreakStmt:
+		g.at(s.Pos())
+		if g.current.loop == nil {
+			g.errorAt("break", "Can't use 'break' outside of a loop.")
+			return
+		}
+		g.at(s.End())
+		g.emitBreak(g.current.loop)
+	case *ContinueStmt:
+		g.at(s.Pos())
+		l := g.current.loop
+		for l != nil && l.start == -1 {
+			l = l.enclosing
+		}
+		if l == nil {
+			g.errorAt("continue", "Can't use 'continue' outside of a loop.")
+			return
+		}
+		g.at(s.End())
+		g.emitContinue(l)
+	case *TryStmt:
+		g.tryStatement(s)
+	case *SwitchStmt:
+		g.switchStatement(s)
+	}
+}
+
+func (g *generator) classStatement(s *ClassStmt) {
+	g.at(s.NamePos)
+	nameConstant := g.identifierConstant(s.Name)
+	g.declareVariable(s.Name)
+	g.emit(chunk.OP_CLASS, nameConstant)
+	g.defineVariable(nameConstant)
+
+	// Load the class for OP_METHOD to add the methods to.
+	getOp, _, arg := g.resolveVariable(s.Name)
+	g.emit(getOp, arg)
+	for _, method := range s.Methods {
+		g.at(method.NamePos)
+		constant := g.identifierConstant(method.Name)
+		g.function(method, TYPE_FUNCTION)
+		g.emit(chunk.OP_METHOD, constant)
+	}
+	g.at(s.End())
+	g.emit(chunk.OP_POP)
+}
+
+func (g *generator) forStatement(s *ForStmt) {
+	g.beginScope()
+	if s.Init != nil {
+		g.stmt(s.Init)
+	}
+
+	loopStart := g.ip()
+	exitJump := -1
+	if s.Cond != nil {
+		g.expr(s.Cond)
+		g.at(s.CondSemiPos)
+		exitJump = g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		g.emit(chunk.OP_POP)
+	}
+	if s.Incr != nil {
+		g.at(s.CondSemiPos)
+		bodyJump := g.emitJump(chunk.OP_JUMP)
+		incrementStart := g.ip()
+		g.expr(s.Incr)
+		g.at(s.Incr.End())
+		g.emit(chunk.OP_POP)
+		g.at(s.RParenPos)
+		g.emitLoop(loopStart)
+		loopStart = incrementStart
+		g.patchJump(bodyJump)
+	}
+
+	var l loop
+	g.beginLoop(&l, loopStart)
+	g.stmt(s.Body)
+	g.at(s.Body.End())
+	g.emitLoop(loopStart)
+	if exitJump != -1 {
+		g.patchJump(exitJump)
+		g.emit(chunk.OP_POP)
+	}
+	g.endLoop()
+	g.endScope()
+}
+
+func (g *generator) forInStatement(s *ForInStmt) {
+	g.beginScope()
+	var setOp chunk.OpCode
+	var arg uint8
+	if !s.HasVar {
+		g.at(s.NamePos)
+		_, setOp, arg = g.resolveVariable(s.Name)
+		g.checkAssignable(s.Name, s.Name, setOp, arg)
+	}
+	g.expr(s.Iterable)
+	g.at(s.RParenPos)
+	g.emit(chunk.OP_ITERATOR)
+	g.addLocal("")
+	g.markInitialized()
+	iterator := uint8(g.current.localCount - 1)
+
+	loopStart := g.ip()
+	g.emit(chunk.OP_ITER_NEXT, iterator)
+	g.emit(chunk.OP_JUMP_IF_DONE, iterator, uint8(0xff), uint8(0xff))
+	exitJump := g.ip() - 2
+
+	var l loop
+	g.beginLoop(&l, loopStart)
+	g.beginScope()
+	if s.HasVar {
+		g.addLocal(s.Name)
+		g.markInitialized()
+	} else {
+		g.emit(setOp, arg, chunk.OP_POP)
+	}
+	g.stmt(s.Body)
+	g.at(s.Body.End())
+	g.endScope()
+	g.emitLoop(loopStart)
+
+	g.patchJump(exitJump)
+	g.endLoop()
+	g.endScope()
+}
+
+func (g *generator) tryStatement(s *TryStmt) {
+	g.at(s.Pos())
+	g.beginScope()
+	var f *finally
+	if s.Finally != nil {
+		f = new(finally)
+		g.emit(chunk.OP_NIL)
+		g.addLocal("")
+		g.markInitialized()
+		f.kindSlot = uint8(g.current.localCount - 1)
+		g.emit(chunk.OP_NIL)
+		g.addLocal("")
+		g.markInitialized()
+		f.valueSlot = uint8(g.current.localCount - 1)
+		f.depth = g.current.localCount
+		f.loop = g.current.loop
+		f.nextKind = COMPLETION_EXIT
+		f.enclosing = g.current.finally
+		g.current.finally = f
+	}
+	depth := g.current.localCount
+
+	tryStart := g.ip()
+	g.beginScope()
+	g.stmts(s.Body.Stmts)
+	g.at(s.Body.End())
+	g.endScope()
+	tryHandler := chunk.Handler{Start: tryStart, End: g.ip(), StackDepth: depth}
+	tryEnd := g.emitJump(chunk.OP_JUMP)
+
+	catchEnd := -1
+	var catchHandler chunk.Handler
+	if s.Catch != nil {
+		tryHandler.Target = g.ip()
+		chunk.AddHandler(g.chunk(), tryHandler)
+
+		g.beginScope()
+		g.at(s.CatchPos)
+		g.declareVariable(s.CatchName)
+		g.markInitialized()
+		catchStart := g.ip()
+		g.stmts(s.Catch.Stmts)
+		g.at(s.Catch.End())
+		catchHandler = chunk.Handler{Start: catchStart, End: g.ip(), StackDepth: depth}
+		g.endScope()
+		catchEnd = g.emitJump(chunk.OP_JUMP)
+	}
+
+	if f != nil {
+		g.current.finally = f.enclosing
+		g.at(s.FinallyPos)
+
+		throwTarget := g.ip()
+		if catchEnd == -1 {
+			tryHandler.Target = throwTarget
+			chunk.AddHandler(g.chunk(), tryHandler)
+		} else {
+			catchHandler.Target = throwTarget
+			chunk.AddHandler(g.chunk(), catchHandler)
+		}
+		g.emit(chunk.OP_SET_LOCAL, f.valueSlot, chunk.OP_POP)
+		g.emitConstant(objval.NUMBER_VAL(COMPLETION_THROW))
+		g.emit(chunk.OP_SET_LOCAL, f.kindSlot, chunk.OP_POP)
+		throwJump := g.emitJump(chunk.OP_JUMP)
+
+		g.patchJump(tryEnd)
+		if catchEnd != -1 {
+			g.patchJump(catchEnd)
+		}
+		g.emitConstant(objval.NUMBER_VAL(COMPLETION_NORMAL))
+		g.emit(chunk.OP_SET_LOCAL, f.kindSlot, chunk.OP_POP)
+
+		g.patchJump(throwJump)
+		for _, jump := range f.jumps {
+			g.patchJump(jump)
+		}
+		g.beginScope()
+		g.stmts(s.Finally.Stmts)
+		g.at(s.Finally.End())
+		g.endScope()
+
+		g.completion(f, COMPLETION_THROW, func() {
+			g.emit(chunk.OP_GET_LOCAL, f.valueSlot, chunk.OP_THROW)
+		})
+		if f.hasReturn {
+			g.completion(f, COMPLETION_RETURN, func() {
+				g.emit(chunk.OP_GET_LOCAL, f.valueSlot)
+				g.emitReturnValue()
+			})
+		}
+		for _, e := range f.exits {
+			g.completion(f, e.kind, func() {
+				if e.isBreak {
+					g.emitBreak(e.loop)
+				} else {
+					g.emitContinue(e.loop)
+				}
+			})
+		}
+	} else {
+		g.patchJump(tryEnd)
+		if catchEnd != -1 {
+			g.patchJump(catchEnd)
+		}
+	}
+	g.endScope()
+}
+
+func (g *generator) completion(f *finally, kind int, emitAction func()) {
+	g.emit(chunk.OP_GET_LOCAL, f.kindSlot)
+	g.emitConstant(objval.NUMBER_VAL(float64(kind)))
+	g.emit(chunk.OP_EQUAL)
+	skipJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+	g.emit(chunk.OP_POP)
+	emitAction()
+	g.patchJump(skipJump)
+	g.emit(chunk.OP_POP)
+}
+
+func (g *generator) switchStatement(s *SwitchStmt) {
+	g.beginScope()
+	g.expr(s.Subject)
+	g.addLocal("")
+	g.markInitialized()
+	subject := uint8(g.current.localCount - 1)
+	g.at(s.LBracePos)
+
+	var table *object.ObjList
+	var low int
+	tableStart := 0
+	if values, ok := caseValues(s); ok {
+		table, low = newJumpTable(values)
+		if table != nil {
+			g.emit(chunk.OP_JUMP_TABLE, g.makeConstant(objval.LIST_VAL(table)))
+			tableStart = g.ip()
+		}
+	}
+
+	var l loop
+	g.beginLoop(&l, -1)
+	var endJumps []int
+	for _, c := range s.Cases {
+		if c.IsDefault {
+			g.caseBody(c)
+			continue
+		}
+		var bodyJumps []int
+		for i, v := range c.Values {
+			g.at(c.ValuePos[i])
+			g.emit(chunk.OP_GET_LOCAL, subject)
+			g.expr(v)
+			g.at(v.End())
+			g.emit(chunk.OP_EQUAL)
+			nextJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+			g.emit(chunk.OP_POP)
+			bodyJumps = append(bodyJumps, g.emitJump(chunk.OP_JUMP))
+			g.patchJump(nextJump)
+			g.emit(chunk.OP_POP)
+		}
+		g.at(c.ColonPos)
+		nextCase := g.emitJump(chunk.OP_JUMP)
+		for _, jump := range bodyJumps {
+			g.patchJump(jump)
+		}
+		if table != nil {
+			for _, v := range c.Values {
+				// The first case with a given value wins.
+				slot := int(v.(*Literal).Number) - low + 1
+				if objval.IS_NIL(table.Items[slot]) {
+					table.Items[slot] = objval.NUMBER_VAL(float64(g.ip() - tableStart))
+				}
+			}
+		}
+		g.caseBody(c)
+		endJumps = append(endJumps, g.emitJump(chunk.OP_JUMP))
+		g.patchJump(nextCase)
+	}
+	for _, jump := range endJumps {
+		g.patchJump(jump)
+	}
+	g.at(s.End())
+	g.endLoop()
+	g.endScope()
+}
+
+func (g *generator) caseBody(c *Case) {
+	g.beginScope()
+	g.stmts(c.Body)
+	g.at(c.End())
+	g.endScope()
+}
+
+// Return the values of the cases of a switch statement if every one of
+// them is an integer literal.
+func caseValues(s *SwitchStmt) ([]int, bool) {
+	var values []int
+	for _, c := range s.Cases {
+		for _, v := range c.Values {
+			literal, ok := v.(*Literal)
+			if !ok || literal.Kind != LITERAL_NUMBER || literal.Number != float64(int(literal.Number)) {
+				return nil, false
+			}
+			values = append(values, int(literal.Number))
+		}
+	}
+	return values, true
+}
+
+// Return an empty jump table for the case values, and the lowest
+// value, if a table is worthwhile, as the compiler decides.
+func newJumpTable(values []int) (*object.ObjList, int) {
+	distinct := make(map[int]bool)
+	for _, v := range values {
+		distinct[v] = true
+	}
+	if len(distinct) < 3 {
+		return nil, 0
+	}
+	low, high := slices.Min(values), slices.Max(values)
+	size := high - low + 1
+	if size > 2*len(distinct) || size > common.UINT8_COUNT {
+		return nil, 0
+	}
+	items := make([]value.Value, size+1)
+	items[0] = objval.NUMBER_VAL(float64(low))
+	for i := 1; i <= size; i++ {
+		items[i] = objval.NIL_VAL()
+	}
+	return object.NewList(items), low
+}
+
+// Expressions.
+
+var binaryOps = map[string]chunk.OpCode{
+	"!=": chunk.OP_NOT_EQUAL,
+	"==": chunk.OP_EQUAL,
+	">":  chunk.OP_GREATER,
+	">=": chunk.OP_GREATER_EQUAL,
+	"<":  chunk.OP_LESS,
+	"<=": chunk.OP_LESS_EQUAL,
+	"+":  chunk.OP_ADD,
+	"-":  chunk.OP_SUBTRACT,
+	"*":  chunk.OP_MULTIPLY,
+	"/":  chunk.OP_DIVIDE,
+	"%":  chunk.OP_MODULO,
+	"~/": chunk.OP_INT_DIVIDE,
+	"&":  chunk.OP_BIT_AND,
+	"|":  chunk.OP_BIT_OR,
+	"^":  chunk.OP_BIT_XOR,
+	"<<": chunk.OP_SHIFT_LEFT,
+	">>": chunk.OP_SHIFT_RIGHT,
+
+	// The arithmetic of compound assignments and increments.
+	"+=": chunk.OP_ADD,
+	"-=": chunk.OP_SUBTRACT,
+	"*=": chunk.OP_MULTIPLY,
+	"/=": chunk.OP_DIVIDE,
+	"%=": chunk.OP_MODULO,
+	"++": chunk.OP_ADD,
+	"--": chunk.OP_SUBTRACT,
+}
+
+var unaryOps = map[string]chunk.OpCode{
+	"!": chunk.OP_NOT,
+	"-": chunk.OP_NEGATE,
+	"~": chunk.OP_BIT_NOT,
+}
+
+func (g *generator) expr(expr Expr) {
+	switch e := expr.(type) {
+	case *Literal:
+		g.at(e.Pos())
+		switch e.Kind {
+		case LITERAL_NIL:
+			g.emit(chunk.OP_NIL)
+		case LITERAL_TRUE:
+			g.emit(chunk.OP_TRUE)
+		case LITERAL_FALSE:
+			g.emit(chunk.OP_FALSE)
+		case LITERAL_NUMBER:
+			g.emitConstant(objval.NUMBER_VAL(e.Number))
+		case LITERAL_STRING:
+			g.emitConstant(objval.STRING_VAL(e.String))
+		}
+	case *Interpolation:
+		g.at(e.Segments[0].Pos)
+		g.emitConstant(objval.STRING_VAL(e.Segments[0].Text))
+		for i, x := range e.Exprs {
+			g.expr(x)
+			g.at(x.End())
+			g.emit(chunk.OP_TO_STRING, chunk.OP_ADD)
+			if i+1 < len(e.Segments) && e.Segments[i+1].Text != "" {
+				g.at(e.Segments[i+1].Pos)
+				g.emitConstant(objval.STRING_VAL(e.Segments[i+1].Text))
+				g.emit(chunk.OP_ADD)
+			}
+		}
+	case *Variable:
+		g.at(e.Pos())
+		getOp, _, arg := g.resolveVariable(e.Name)
+		g.emit(getOp, arg)
+	case *Assign:
+		g.assign(e)
+	case *Increment:
+		g.increment(e)
+	case *Unary:
+		g.expr(e.Operand)
+		g.at(e.Operand.End())
+		g.emit(unaryOps[e.Op])
+	case *Binary:
+		g.expr(e.Left)
+		g.expr(e.Right)
+		g.at(e.Right.End())
+		g.emit(binaryOps[e.Op])
+	case *Logical:
+		g.expr(e.Left)
+		g.at(e.OpPos)
+		if e.Op == "and" {
+			endJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+			g.emit(chunk.OP_POP)
+			g.expr(e.Right)
+			g.patchJump(endJump)
+			return
+		}
+		elseJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		endJump := g.emitJump(chunk.OP_JUMP)
+		g.patchJump(elseJump)
+		g.emit(chunk.OP_POP)
+		g.expr(e.Right)
+		g.patchJump(endJump)
+	case *Conditional:
+		g.expr(e.Cond)
+		g.at(e.QuestionPos)
+		thenJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		g.emit(chunk.OP_POP)
+		g.expr(e.Then)
+		g.at(e.Then.End())
+		elseJump := g.emitJump(chunk.OP_JUMP)
+		g.patchJump(thenJump)
+		g.emit(chunk.OP_POP)
+		g.expr(e.Else)
+		g.patchJump(elseJump)
+	case *Grouping:
+		g.expr(e.Expr)
+	case *Call:
+		g.expr(e.Callee)
+		var names []value.Value
+		for _, arg := range e.Args {
+			if arg.Name != "" {
+				names = append(names, objval.STRING_VAL(arg.Name))
+			}
+			g.expr(arg.Value)
+		}
+		g.at(e.End())
+		if len(names) == 0 {
+			g.emit(chunk.OP_CALL, uint8(len(e.Args)))
+			return
+		}
+		g.emit(chunk.OP_CALL_NAMED, uint8(len(e.Args)))
+		g.emit(g.makeConstant(objval.LIST_VAL(object.NewList(names))))
+	case *Get:
+		g.expr(e.Object)
+		g.at(e.NamePos)
+		g.emit(chunk.OP_GET_PROPERTY, g.identifierConstant(e.Name))
+	case *Index:
+		g.expr(e.Object)
+		g.expr(e.Index)
+		g.at(e.End())
+		g.emit(chunk.OP_GET_INDEX)
+	case *List:
+		for _, element := range e.Elements {
+			g.expr(element)
+		}
+		g.at(e.End())
+		g.emit(chunk.OP_BUILD_LIST, uint8(len(e.Elements)))
+	case *Map:
+		for _, entry := range e.Entries {
+			g.expr(entry.Key)
+			g.expr(entry.Value)
+		}
+		g.at(e.End())
+		g.emit(chunk.OP_BUILD_MAP, uint8(len(e.Entries)))
+	case *Yield:
+		g.at(e.Pos())
+		if !g.current.function.IsGenerator {
+			g.errorAt("yield", "Can't yield outside a generator.")
+		}
+		if e.Value == nil {
+			g.emit(chunk.OP_NIL)
+		} else {
+			g.expr(e.Value)
+			g.at(e.End())
+		}
+		g.emit(chunk.OP_YIELD)
+	case *FunctionExpr:
+		g.function(e.Function, TYPE_ANONYMOUS)
+	}
+}
+
+func (g *generator) assign(e *Assign) {
+	op, compound := binaryOps[e.Op]
+	switch t := e.Target.(type) {
+	case *Variable:
+		g.at(t.Pos())
+		getOp, setOp, arg := g.resolveVariable(t.Name)
+		g.at(e.OpPos)
+		g.checkAssignable(t.Name, e.Op, setOp, arg)
+		if compound {
+			g.emit(getOp, arg)
+		}
+		g.expr(e.Value)
+		g.at(e.Value.End())
+		if compound {
+			g.emit(op)
+		}
+		g.emit(setOp, arg)
+	case *Get:
+		g.expr(t.Object)
+		g.at(t.NamePos)
+		name := g.identifierConstant(t.Name)
+		if compound {
+			// Keep a copy of the receiver for OP_SET_PROPERTY.
+			g.at(e.OpPos)
+			g.emit(chunk.OP_DUP, chunk.OP_GET_PROPERTY, name)
+		}
+		g.expr(e.Value)
+		g.at(e.Value.End())
+		if compound {
+			g.emit(op)
+		}
+		g.emit(chunk.OP_SET_PROPERTY, name)
+	case *Index:
+		g.expr(t.Object)
+		g.expr(t.Index)
+		if compound {
+			g.at(e.OpPos)
+			g.emit(chunk.OP_DUP2, chunk.OP_GET_INDEX)
+		}
+		g.expr(e.Value)
+		g.at(e.Value.End())
+		if compound {
+			g.emit(op)
+		}
+		g.emit(chunk.OP_SET_INDEX)
+	}
+}
+
+// A postfix ++ or -- is emitted where the operator is, and a prefix
+// one where its target ends, after reading the parts of the target
+// before the last one.  A postfix increment keeps a copy of the old
+// value under the operands of the set instruction, like the
+// compiler's emitPostfix(), and pops the new value.
+func (g *generator) increment(e *Increment) {
+	op := binaryOps[e.Op]
+	finish := func() {
+		if e.Prefix {
+			g.at(e.Target.End())
+		} else {
+			g.at(e.OpPos)
+		}
+	}
+	switch t := e.Target.(type) {
+	case *Variable:
+		g.at(t.Pos())
+		getOp, setOp, arg := g.resolveVariable(t.Name)
+		finish()
+		lexeme := e.Op
+		if e.Prefix {
+			lexeme = t.Name
+		}
+		g.checkAssignable(t.Name, lexeme, setOp, arg)
+		g.emit(getOp, arg)
+		g.emitStep(e, op, 0)
+		g.emit(setOp, arg)
+	case *Get:
+		g.expr(t.Object)
+		g.at(t.NamePos)
+		name := g.identifierConstant(t.Name)
+		finish()
+		g.emit(chunk.OP_DUP, chunk.OP_GET_PROPERTY, name)
+		g.emitStep(e, op, 1)
+		g.emit(chunk.OP_SET_PROPERTY, name)
+	case *Index:
+		g.expr(t.Object)
+		g.expr(t.Index)
+		finish()
+		g.emit(chunk.OP_DUP2, chunk.OP_GET_INDEX)
+		g.emitStep(e, op, 2)
+		g.emit(chunk.OP_SET_INDEX)
+	}
+	if !e.Prefix {
+		g.emit(chunk.OP_POP)
+	}
+}
+
+// Emit the arithmetic of an increment on the value read from its
+// target, which has depth operands of the set instruction under it.
+func (g *generator) emitStep(e *Increment, op chunk.OpCode, depth byte) {
+	if !e.Prefix {
+		g.emit(chunk.OP_DUP)
+		if depth > 0 {
+			g.emit(chunk.OP_BURY, depth+1)
+		}
+	}
+	g.emitIncrement(op)
+}
+
+func (g *generator) emitIncrement(op chunk.OpCode) {
+	g.emitConstant(objval.NUMBER_VAL(1))
+	g.emit(op)
+}
@@ -0,0 +1,999 @@
+package ast
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/davidfung/glox/scanner"
+)
+
+// A syntax error, or an error Generate() finds in a syntax tree.
+// Where is " at 'token'" or " at end", as the compiler reports it,
+// or empty for an error such as too many constants which has no
+// token of its own.
+type Error struct {
+	Pos     Pos
+	Where   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("[line %d:%d] Error%s: %s", e.Pos.Line, e.Pos.Column, e.Where, e.Message)
+}
+
+// The errors found in a script, one per line when printed.
+type ErrorList []*Error
+
+func (list ErrorList) Error() string {
+	var lines []string
+	for _, e := range list {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type Precedence int
+
+const (
+	PREC_NONE        Precedence = iota
+	PREC_ASSIGNMENT             // =
+	PREC_CONDITIONAL            // ?:
+	PREC_OR                     // or
+	PREC_AND                    // and
+	PREC_EQUALITY               // == !=
+	PREC_COMPARISON             // < > <= >=
+	PREC_BIT_OR                 // |
+	PREC_BIT_XOR                // ^
+	PREC_BIT_AND                // &
+	PREC_SHIFT                  // << >>
+	PREC_TERM                   // + -
+	PREC_FACTOR                 // * / % ~/
+	PREC_UNARY                  // ! - ~
+	PREC_CALL                   // . ()
+	PREC_PRIMARY
+)
+
+// The precedence of the infix operators, as in the compiler's table of
+// parse rules.
+var infixPrecedence = map[scanner.TokenType]Precedence{
+	scanner.TOKEN_LEFT_PAREN:      PREC_CALL,
+	scanner.TOKEN_LEFT_BRACKET:    PREC_CALL,
+	scanner.TOKEN_DOT:             PREC_CALL,
+	scanner.TOKEN_MINUS:           PREC_TERM,
+	scanner.TOKEN_PLUS:            PREC_TERM,
+	scanner.TOKEN_QUESTION:        PREC_CONDITIONAL,
+	scanner.TOKEN_SLASH:           PREC_FACTOR,
+	scanner.TOKEN_PERCENT:         PREC_FACTOR,
+	scanner.TOKEN_STAR:            PREC_FACTOR,
+	scanner.TOKEN_TILDE_SLASH:     PREC_FACTOR,
+	scanner.TOKEN_AMPERSAND:       PREC_BIT_AND,
+	scanner.TOKEN_PIPE:            PREC_BIT_OR,
+	scanner.TOKEN_CARET:           PREC_BIT_XOR,
+	scanner.TOKEN_BANG_EQUAL:      PREC_EQUALITY,
+	scanner.TOKEN_EQUAL_EQUAL:     PREC_EQUALITY,
+	scanner.TOKEN_GREATER:         PREC_COMPARISON,
+	scanner.TOKEN_GREATER_EQUAL:   PREC_COMPARISON,
+	scanner.TOKEN_LESS:            PREC_COMPARISON,
+	scanner.TOKEN_LESS_EQUAL:      PREC_COMPARISON,
+	scanner.TOKEN_GREATER_GREATER: PREC_SHIFT,
+	scanner.TOKEN_LESS_LESS:       PREC_SHIFT,
+	scanner.TOKEN_AND:             PREC_AND,
+	scanner.TOKEN_OR:              PREC_OR,
+}
+
+// The parser follows the compiler's grammar and reports the same
+// syntax errors, but scans the whole source up front so that it can
+// look ahead as far as it likes instead of saving the scanner's state.
+type parser struct {
+	tokens    []scanner.Token
+	next      int // index of the token after current
+	current   scanner.Token
+	previous  scanner.Token
+	errors    ErrorList
+	panicMode bool
+}
+
+// Parse a script.  If it has syntax errors, they are returned as an
+// ErrorList along with as much of the tree as could be made out.
+func Parse(source string) (*File, error) {
+	p := &parser{}
+	file := &File{}
+	scanner.InitScanner(&source)
+	scanner.KeepComments()
+	for {
+		token := scanner.ScanToken()
+		if token.Type == scanner.TOKEN_COMMENT {
+			text := strings.TrimRight(lexeme(token), " \t\r")
+			file.Comments = append(file.Comments, &Comment{Pos: tokenPos(token), Text: text})
+			continue
+		}
+		p.tokens = append(p.tokens, token)
+		if token.Type == scanner.TOKEN_EOF {
+			break
+		}
+	}
+
+	p.advance()
+	for !p.match(scanner.TOKEN_EOF) {
+		if stmt := p.declaration(); stmt != nil {
+			file.Stmts = append(file.Stmts, stmt)
+		}
+	}
+	file.EOF = tokenPos(p.previous)
+	if len(p.errors) > 0 {
+		return file, p.errors
+	}
+	return file, nil
+}
+
+func tokenPos(token scanner.Token) Pos {
+	return Pos{Line: token.Line, Column: token.Column}
+}
+
+func lexeme(token scanner.Token) string {
+	return (*token.Source)[token.Start : token.Start+token.Length]
+}
+
+func (p *parser) errorAt(token scanner.Token, message string) {
+	if p.panicMode {
+		return
+	}
+	p.panicMode = true
+	where := ""
+	if token.Type == scanner.TOKEN_EOF {
+		where = " at end"
+	} else if token.Type != scanner.TOKEN_ERROR {
+		where = fmt.Sprintf(" at '%s'", lexeme(token))
+	}
+	p.errors = append(p.errors, &Error{Pos: tokenPos(token), Where: where, Message: message})
+}
+
+func (p *parser) error(message string) {
+	p.errorAt(p.previous, message)
+}
+
+func (p *parser) errorAtCurrent(message string) {
+	p.errorAt(p.current, message)
+}
+
+func (p *parser) advance() {
+	p.previous = p.current
+	for {
+		p.current = p.tokens[p.next]
+		if p.next < len(p.tokens)-1 {
+			p.next++
+		}
+		if p.current.Type != scanner.TOKEN_ERROR {
+			break
+		}
+		p.errorAtCurrent(lexeme(p.current))
+	}
+}
+
+// Return the token n tokens after the current one.
+func (p *parser) peek(n int) scanner.Token {
+	i := min(p.next+n-1, len(p.tokens)-1)
+	return p.tokens[i]
+}
+
+func (p *parser) consume(typ scanner.TokenType, message string) {
+	if p.current.Type == typ {
+		p.advance()
+		return
+	}
+	p.errorAtCurrent(message)
+}
+
+func (p *parser) check(typ scanner.TokenType) bool {
+	return p.current.Type == typ
+}
+
+func (p *parser) match(typ scanner.TokenType) bool {
+	if !p.check(typ) {
+		return false
+	}
+	p.advance()
+	return true
+}
+
+// Return the span from pos to the token just parsed.
+func (p *parser) spanFrom(pos Pos) Span {
+	return Span{First: pos, Last: tokenPos(p.previous)}
+}
+
+func (p *parser) synchronize() {
+	p.panicMode = false
+	for p.current.Type != scanner.TOKEN_EOF {
+		if p.previous.Type == scanner.TOKEN_SEMICOLON {
+			return
+		}
+		switch p.current.Type {
+		case scanner.TOKEN_CLASS, scanner.TOKEN_CONST, scanner.TOKEN_FUN,
+			scanner.TOKEN_VAR, scanner.TOKEN_FOR, scanner.TOKEN_IF,
+			scanner.TOKEN_WHILE, scanner.TOKEN_PRINT, scanner.TOKEN_RETURN,
+			scanner.TOKEN_IMPORT, scanner.TOKEN_SWITCH, scanner.TOKEN_TRY,
+			scanner.TOKEN_THROW, scanner.TOKEN_YIELD:
+			return
+		}
+		p.advance()
+	}
+}
+
+// Declarations and statements.
+
+func (p *parser) declaration() Stmt {
+	var stmt Stmt
+	if p.match(scanner.TOKEN_CLASS) {
+		stmt = p.classDeclaration()
+	} else if p.match(scanner.TOKEN_FUN) {
+		stmt = p.funDeclaration()
+	} else if p.match(scanner.TOKEN_VAR) {
+		stmt = p.varDeclaration()
+	} else if p.match(scanner.TOKEN_CONST) {
+		stmt = p.constDeclaration()
+	} else {
+		stmt = p.statement()
+	}
+	if p.panicMode {
+		p.synchronize()
+	}
+	return stmt
+}
+
+func (p *parser) statement() Stmt {
+	if p.match(scanner.TOKEN_PRINT) {
+		return p.printStatement()
+	} else if p.match(scanner.TOKEN_IMPORT) {
+		return p.importStatement()
+	} else if p.match(scanner.TOKEN_SWITCH) {
+		return p.switchStatement()
+	} else if p.match(scanner.TOKEN_TRY) {
+		return p.tryStatement()
+	} else if p.match(scanner.TOKEN_THROW) {
+		return p.throwStatement()
+	} else if p.match(scanner.TOKEN_BREAK) {
+		start := tokenPos(p.previous)
+		p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after 'break'.")
+		return &BreakStmt{p.spanFrom(start)}
+	} else if p.match(scanner.TOKEN_CONTINUE) {
+		start := tokenPos(p.previous)
+		p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after 'continue'.")
+		return &ContinueStmt{p.spanFrom(start)}
+	} else if p.match(scanner.TOKEN_FOR) {
+		return p.forStatement()
+	} else if p.match(scanner.TOKEN_IF) {
+		return p.ifStatement()
+	} else if p.match(scanner.TOKEN_RETURN) {
+		return p.returnStatement()
+	} else if p.match(scanner.TOKEN_WHILE) {
+		return p.whileStatement()
+	} else if p.match(scanner.TOKEN_LEFT_BRACE) {
+		return p.block()
+	}
+	return p.expressionStatement()
+}
+
+// Parse the rest of a block whose '{' has just been consumed.
+func (p *parser) block() *BlockStmt {
+	start := tokenPos(p.previous)
+	var stmts []Stmt
+	for !p.check(scanner.TOKEN_RIGHT_BRACE) && !p.check(scanner.TOKEN_EOF) {
+		if stmt := p.declaration(); stmt != nil {
+			stmts = append(stmts, stmt)
+		}
+	}
+	p.consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after block.")
+	return &BlockStmt{p.spanFrom(start), stmts}
+}
+
+func (p *parser) classDeclaration() Stmt {
+	stmt := &ClassStmt{}
+	start := tokenPos(p.previous)
+	p.consume(scanner.TOKEN_IDENTIFIER, "Expect class name.")
+	stmt.Name, stmt.NamePos = lexeme(p.previous), tokenPos(p.previous)
+	p.consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+	for !p.check(scanner.TOKEN_RIGHT_BRACE) && !p.check(scanner.TOKEN_EOF) {
+		p.consume(scanner.TOKEN_IDENTIFIER, "Expect method name.")
+		method := &Function{Name: lexeme(p.previous), NamePos: tokenPos(p.previous)}
+		p.function(method, tokenPos(p.previous))
+		stmt.Methods = append(stmt.Methods, method)
+	}
+	p.consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+// fun name(a, b) { ... } or fun* name(a, b) { ... } for a generator.
+func (p *parser) funDeclaration() Stmt {
+	start := tokenPos(p.previous)
+	fn := &Function{}
+	if p.match(scanner.TOKEN_STAR) {
+		fn.IsGenerator = true
+		fn.Star = tokenPos(p.previous)
+	}
+	p.consume(scanner.TOKEN_IDENTIFIER, "Expect function name.")
+	fn.Name, fn.NamePos = lexeme(p.previous), tokenPos(p.previous)
+	p.function(fn, start)
+	return &FunStmt{fn}
+}
+
+// Parse the parameters and body of a function, which starts at start.
+func (p *parser) function(fn *Function, start Pos) {
+	p.consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	p.parameters(fn)
+	p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	fn.RParenPos = tokenPos(p.previous)
+	p.consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' after function body.")
+	fn.Body = p.block()
+	fn.Span = p.spanFrom(start)
+}
+
+// (a, b = 1, ...rest)
+func (p *parser) parameters(fn *Function) {
+	if p.check(scanner.TOKEN_RIGHT_PAREN) {
+		return
+	}
+	hasDefault := false
+	for {
+		if len(fn.Params) == 255 {
+			p.errorAtCurrent("Can't have more than 255 parameters.")
+		}
+		if p.match(scanner.TOKEN_DOT_DOT_DOT) {
+			p.consume(scanner.TOKEN_IDENTIFIER, "Expect rest parameter name.")
+			fn.Params = append(fn.Params, &Param{Name: lexeme(p.previous), NamePos: tokenPos(p.previous), Rest: true})
+			if p.check(scanner.TOKEN_COMMA) {
+				p.errorAtCurrent("Rest parameter must be last.")
+				for !p.check(scanner.TOKEN_RIGHT_PAREN) && !p.check(scanner.TOKEN_EOF) {
+					p.advance()
+				}
+			}
+			return
+		}
+		p.consume(scanner.TOKEN_IDENTIFIER, "Expect parameter name.")
+		param := &Param{Name: lexeme(p.previous), NamePos: tokenPos(p.previous)}
+		if p.match(scanner.TOKEN_EQUAL) {
+			hasDefault = true
+			param.EqualPos = tokenPos(p.previous)
+			param.Default = p.expression()
+		} else if hasDefault {
+			p.error("Parameter without a default value can't follow one with a default.")
+		}
+		fn.Params = append(fn.Params, param)
+		if !p.match(scanner.TOKEN_COMMA) {
+			break
+		}
+	}
+}
+
+func (p *parser) varDeclaration() *VarStmt {
+	start := tokenPos(p.previous)
+	stmt := &VarStmt{}
+	p.consume(scanner.TOKEN_IDENTIFIER, "Expect variable name.")
+	stmt.Name, stmt.NamePos = lexeme(p.previous), tokenPos(p.previous)
+	if p.match(scanner.TOKEN_EQUAL) {
+		stmt.Init = p.expression()
+	}
+	p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after variable declaration.")
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+func (p *parser) constDeclaration() Stmt {
+	start := tokenPos(p.previous)
+	stmt := &ConstStmt{}
+	p.consume(scanner.TOKEN_IDENTIFIER, "Expect constant name.")
+	stmt.Name, stmt.NamePos = lexeme(p.previous), tokenPos(p.previous)
+	p.consume(scanner.TOKEN_EQUAL, "Expect '=' after constant name.")
+	stmt.Value = p.expression()
+	p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after constant declaration.")
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+func (p *parser) expressionStatement() *ExprStmt {
+	start := tokenPos(p.current)
+	expr := p.expression()
+	p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after expression.")
+	return &ExprStmt{p.spanFrom(start), expr}
+}
+
+func (p *parser) printStatement() Stmt {
+	start := tokenPos(p.previous)
+	expr := p.expression()
+	p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after value.")
+	return &PrintStmt{p.spanFrom(start), expr}
+}
+
+func (p *parser) ifStatement() Stmt {
+	stmt := &IfStmt{}
+	start := tokenPos(p.previous)
+	p.consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
+	stmt.Cond = p.expression()
+	p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+	stmt.RParenPos = tokenPos(p.previous)
+	stmt.Then = p.statement()
+	if p.match(scanner.TOKEN_ELSE) {
+		stmt.Else = p.statement()
+	}
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+func (p *parser) whileStatement() Stmt {
+	stmt := &WhileStmt{}
+	start := tokenPos(p.previous)
+	p.consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
+	stmt.Cond = p.expression()
+	p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after 'condition'.")
+	stmt.RParenPos = tokenPos(p.previous)
+	stmt.Body = p.statement()
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+func (p *parser) forStatement() Stmt {
+	start := tokenPos(p.previous)
+	p.consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	if p.isForIn() {
+		return p.forInStatement(start)
+	}
+
+	stmt := &ForStmt{}
+	if p.match(scanner.TOKEN_SEMICOLON) {
+		// No initializer.
+	} else if p.match(scanner.TOKEN_VAR) {
+		stmt.Init = p.varDeclaration()
+	} else {
+		stmt.Init = p.expressionStatement()
+	}
+	if !p.match(scanner.TOKEN_SEMICOLON) {
+		stmt.Cond = p.expression()
+		p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+	}
+	stmt.CondSemiPos = tokenPos(p.previous)
+	if !p.match(scanner.TOKEN_RIGHT_PAREN) {
+		stmt.Incr = p.expression()
+		p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+	}
+	stmt.RParenPos = tokenPos(p.previous)
+	stmt.Body = p.statement()
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+// Look ahead for the "var name in" or "name in" that starts a for-in
+// loop.
+func (p *parser) isForIn() bool {
+	token, n := p.current, 1
+	if token.Type == scanner.TOKEN_VAR {
+		token, n = p.peek(1), 2
+	}
+	if token.Type != scanner.TOKEN_IDENTIFIER {
+		return false
+	}
+	next := p.peek(n)
+	return next.Type == scanner.TOKEN_IDENTIFIER && lexeme(next) == "in"
+}
+
+func (p *parser) forInStatement(start Pos) Stmt {
+	stmt := &ForInStmt{}
+	stmt.HasVar = p.match(scanner.TOKEN_VAR)
+	p.consume(scanner.TOKEN_IDENTIFIER, "Expect loop variable name.")
+	stmt.Name, stmt.NamePos = lexeme(p.previous), tokenPos(p.previous)
+	p.advance() // isForIn() has checked that this is 'in'
+	stmt.Iterable = p.expression()
+	p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after for-in clauses.")
+	stmt.RParenPos = tokenPos(p.previous)
+	stmt.Body = p.statement()
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+// import "path"; or import "path" as name;
+func (p *parser) importStatement() Stmt {
+	stmt := &ImportStmt{}
+	start := tokenPos(p.previous)
+	p.consume(scanner.TOKEN_STRING, "Expect module path after 'import'.")
+	stmt.RawPath, stmt.Path = p.stringSegment(p.previous)
+	stmt.PathPos = tokenPos(p.previous)
+	if p.check(scanner.TOKEN_IDENTIFIER) && lexeme(p.current) == "as" {
+		p.advance()
+		p.consume(scanner.TOKEN_IDENTIFIER, "Expect module name after 'as'.")
+		stmt.Alias, stmt.AliasPos = lexeme(p.previous), tokenPos(p.previous)
+	} else if !isIdentifier(stmt.Name()) {
+		p.error("Module name is not an identifier; use 'import ... as name'.")
+	}
+	p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after import.")
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+// Return the name the module is imported as, which is the alias if
+// there is one, or else the name of the file without its extension.
+func (s *ImportStmt) Name() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return strings.TrimSuffix(filepath.Base(s.Path), filepath.Ext(s.Path))
+}
+
+// Report whether s could have been scanned as an identifier.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !unicode.IsLetter(c) && c != '_' && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *parser) returnStatement() Stmt {
+	stmt := &ReturnStmt{}
+	start := tokenPos(p.previous)
+	if !p.match(scanner.TOKEN_SEMICOLON) {
+		stmt.Value = p.expression()
+		p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after return value.")
+	}
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+func (p *parser) throwStatement() Stmt {
+	start := tokenPos(p.previous)
+	value := p.expression()
+	p.consume(scanner.TOKEN_SEMICOLON, "Expect ';' after thrown value.")
+	return &ThrowStmt{p.spanFrom(start), value}
+}
+
+// try { ... } catch (e) { ... } finally { ... }
+func (p *parser) tryStatement() Stmt {
+	stmt := &TryStmt{}
+	start := tokenPos(p.previous)
+	p.consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' after 'try'.")
+	stmt.Body = p.block()
+	hasCatch := p.match(scanner.TOKEN_CATCH)
+	if hasCatch {
+		p.consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'catch'.")
+		p.consume(scanner.TOKEN_IDENTIFIER, "Expect exception variable name.")
+		stmt.CatchName, stmt.CatchPos = lexeme(p.previous), tokenPos(p.previous)
+		p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after exception variable.")
+		p.consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' before catch body.")
+		stmt.Catch = p.block()
+	}
+	if p.match(scanner.TOKEN_FINALLY) {
+		stmt.FinallyPos = tokenPos(p.previous)
+		p.consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' after 'finally'.")
+		stmt.Finally = p.block()
+	} else if !hasCatch {
+		p.errorAtCurrent("Expect 'catch' or 'finally' after try block.")
+	}
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+// switch (subject) { case a: ... case b, c: ... default: ... }
+func (p *parser) switchStatement() Stmt {
+	stmt := &SwitchStmt{}
+	start := tokenPos(p.previous)
+	p.consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'switch'.")
+	stmt.Subject = p.expression()
+	p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after switch subject.")
+	p.consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' before switch cases.")
+	stmt.LBracePos = tokenPos(p.previous)
+
+	sawDefault := false
+	for !p.check(scanner.TOKEN_RIGHT_BRACE) && !p.check(scanner.TOKEN_EOF) {
+		c := &Case{}
+		if p.match(scanner.TOKEN_CASE) {
+			if sawDefault {
+				p.error("Can't have a case after the default case.")
+			}
+			caseStart := tokenPos(p.previous)
+			for {
+				c.ValuePos = append(c.ValuePos, tokenPos(p.previous))
+				c.Values = append(c.Values, p.expression())
+				if !p.match(scanner.TOKEN_COMMA) {
+					break
+				}
+			}
+			p.consume(scanner.TOKEN_COLON, "Expect ':' after case value.")
+			p.caseBody(c, caseStart)
+		} else if p.match(scanner.TOKEN_DEFAULT) {
+			if sawDefault {
+				p.error("Can't have more than one default case.")
+			}
+			sawDefault = true
+			c.IsDefault = true
+			caseStart := tokenPos(p.previous)
+			p.consume(scanner.TOKEN_COLON, "Expect ':' after 'default'.")
+			p.caseBody(c, caseStart)
+		} else {
+			p.errorAtCurrent("Expect 'case' or 'default'.")
+			break
+		}
+		stmt.Cases = append(stmt.Cases, c)
+	}
+	p.consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after switch cases.")
+	stmt.Span = p.spanFrom(start)
+	return stmt
+}
+
+func (p *parser) caseBody(c *Case, start Pos) {
+	c.ColonPos = tokenPos(p.previous)
+	for !p.check(scanner.TOKEN_CASE) && !p.check(scanner.TOKEN_DEFAULT) &&
+		!p.check(scanner.TOKEN_RIGHT_BRACE) && !p.check(scanner.TOKEN_EOF) {
+		if stmt := p.declaration(); stmt != nil {
+			c.Body = append(c.Body, stmt)
+		}
+	}
+	c.Span = p.spanFrom(start)
+}
+
+// Expressions.
+
+func (p *parser) expression() Expr {
+	return p.parsePrecedence(PREC_ASSIGNMENT)
+}
+
+func (p *parser) parsePrecedence(precedence Precedence) Expr {
+	p.advance()
+	canAssign := precedence <= PREC_ASSIGNMENT
+	expr := p.prefix(canAssign)
+	if expr == nil {
+		p.error("Expect expression.")
+		return nil
+	}
+
+	for precedence <= infixPrecedence[p.current.Type] {
+		p.advance()
+		expr = p.infix(expr, canAssign)
+	}
+
+	// An '=' left over means the left-hand side is not something
+	// which can be assigned to.
+	if canAssign && p.match(scanner.TOKEN_EQUAL) {
+		p.error("Invalid assignment target.")
+	}
+	if _, ok := p.matchCompoundAssignment(canAssign); ok {
+		p.error("Invalid assignment target.")
+	}
+	return expr
+}
+
+// Parse the expression starting with the token just consumed, or
+// return nil if no expression starts with it.
+func (p *parser) prefix(canAssign bool) Expr {
+	token := p.previous
+	pos := tokenPos(token)
+	switch token.Type {
+	case scanner.TOKEN_LEFT_PAREN:
+		if p.isLambda() {
+			return p.lambda()
+		}
+		expr := p.expression()
+		p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
+		return &Grouping{p.spanFrom(pos), expr}
+	case scanner.TOKEN_LEFT_BRACKET:
+		return p.list()
+	case scanner.TOKEN_YIELD:
+		yield := &Yield{Span: Span{pos, pos}}
+		if !endsExpression(p.current.Type) {
+			yield.Value = p.parsePrecedence(PREC_ASSIGNMENT)
+			yield.Span = p.spanFrom(pos)
+		}
+		return yield
+	case scanner.TOKEN_LEFT_BRACE:
+		return p.mapLiteral()
+	case scanner.TOKEN_MINUS, scanner.TOKEN_BANG, scanner.TOKEN_TILDE:
+		operand := p.parsePrecedence(PREC_UNARY)
+		return &Unary{p.spanFrom(pos), lexeme(token), operand}
+	case scanner.TOKEN_MINUS_MINUS, scanner.TOKEN_PLUS_PLUS:
+		return p.prefixIncrement()
+	case scanner.TOKEN_IDENTIFIER:
+		return p.assignment(&Variable{Span{pos, pos}, lexeme(token)}, canAssign)
+	case scanner.TOKEN_STRING:
+		_, text := p.stringSegment(token)
+		return &Literal{Span: Span{pos, pos}, Kind: LITERAL_STRING, Raw: lexeme(token), String: text}
+	case scanner.TOKEN_INTERPOLATION:
+		return p.interpolation()
+	case scanner.TOKEN_NUMBER:
+		n, err := strconv.ParseFloat(lexeme(token), 64)
+		if err != nil {
+			p.error(err.Error())
+		}
+		return &Literal{Span: Span{pos, pos}, Kind: LITERAL_NUMBER, Raw: lexeme(token), Number: n}
+	case scanner.TOKEN_TRUE:
+		return &Literal{Span: Span{pos, pos}, Kind: LITERAL_TRUE, Raw: "true"}
+	case scanner.TOKEN_FALSE:
+		return &Literal{Span: Span{pos, pos}, Kind: LITERAL_FALSE, Raw: "false"}
+	case scanner.TOKEN_NIL:
+		return &Literal{Span: Span{pos, pos}, Kind: LITERAL_NIL, Raw: "nil"}
+	case scanner.TOKEN_FUN:
+		fn := &Function{}
+		if p.match(scanner.TOKEN_STAR) {
+			fn.IsGenerator = true
+			fn.Star = tokenPos(p.previous)
+		}
+		p.function(fn, pos)
+		return &FunctionExpr{fn}
+	}
+	return nil
+}
+
+// Parse the rest of the expression whose infix operator has just been
+// consumed.
+func (p *parser) infix(left Expr, canAssign bool) Expr {
+	token := p.previous
+	pos := tokenPos(token)
+	start := left.Pos()
+	switch token.Type {
+	case scanner.TOKEN_LEFT_PAREN:
+		return p.call(left)
+	case scanner.TOKEN_LEFT_BRACKET:
+		index := p.expression()
+		p.consume(scanner.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+		return p.assignment(&Index{p.spanFrom(start), left, index}, canAssign)
+	case scanner.TOKEN_DOT:
+		// yield is a keyword, but also the name of Fiber.yield().
+		if !p.match(scanner.TOKEN_YIELD) {
+			p.consume(scanner.TOKEN_IDENTIFIER, "Expect property name after '.'.")
+		}
+		get := &Get{p.spanFrom(start), left, lexeme(p.previous), tokenPos(p.previous)}
+		return p.assignment(get, canAssign)
+	case scanner.TOKEN_QUESTION:
+		then := p.expression()
+		p.consume(scanner.TOKEN_COLON, "Expect ':' after then branch of conditional expression.")
+		colon := tokenPos(p.previous)
+		// The else branch is parsed at the conditional operator's own
+		// precedence, so that a ? b : c ? d : e groups to the right.
+		otherwise := p.parsePrecedence(PREC_CONDITIONAL)
+		return &Conditional{p.spanFrom(start), left, pos, then, colon, otherwise}
+	case scanner.TOKEN_AND:
+		right := p.parsePrecedence(PREC_AND)
+		return &Logical{p.spanFrom(start), left, "and", pos, right}
+	case scanner.TOKEN_OR:
+		right := p.parsePrecedence(PREC_OR)
+		return &Logical{p.spanFrom(start), left, "or", pos, right}
+	}
+	right := p.parsePrecedence(infixPrecedence[token.Type] + 1)
+	return &Binary{p.spanFrom(start), left, lexeme(token), pos, right}
+}
+
+// Parse an assignment to target, a compound assignment or a postfix
+// ++ or -- if one follows it.  Only the postfix operators are allowed
+// where an assignment is not.
+func (p *parser) assignment(target Expr, canAssign bool) Expr {
+	start := target.Pos()
+	if canAssign && p.match(scanner.TOKEN_EQUAL) {
+		opPos := tokenPos(p.previous)
+		value := p.expression()
+		return &Assign{p.spanFrom(start), target, "=", opPos, value}
+	}
+	if op, ok := p.matchCompoundAssignment(canAssign); ok {
+		opPos := tokenPos(p.previous)
+		value := p.expression()
+		return &Assign{p.spanFrom(start), target, op, opPos, value}
+	}
+	if p.match(scanner.TOKEN_PLUS_PLUS) || p.match(scanner.TOKEN_MINUS_MINUS) {
+		return &Increment{p.spanFrom(start), target, lexeme(p.previous), tokenPos(p.previous), false}
+	}
+	return target
+}
+
+// If assignment is allowed and the next token is a compound
+// assignment operator such as +=, consume it and return it.
+func (p *parser) matchCompoundAssignment(canAssign bool) (string, bool) {
+	if !canAssign {
+		return "", false
+	}
+	switch p.current.Type {
+	case scanner.TOKEN_PLUS_EQUAL, scanner.TOKEN_MINUS_EQUAL, scanner.TOKEN_STAR_EQUAL,
+		scanner.TOKEN_SLASH_EQUAL, scanner.TOKEN_PERCENT_EQUAL:
+		p.advance()
+		return lexeme(p.previous), true
+	}
+	return "", false
+}
+
+// ++target or --target, where the target is a variable followed by
+// any number of properties, subscripts and calls, the last of which
+// is not a call.
+func (p *parser) prefixIncrement() Expr {
+	op := p.previous
+	p.consume(scanner.TOKEN_IDENTIFIER, "Expect variable after increment operator.")
+	start := tokenPos(p.previous)
+	var target Expr = &Variable{p.spanFrom(start), lexeme(p.previous)}
+	for p.check(scanner.TOKEN_DOT) || p.check(scanner.TOKEN_LEFT_BRACKET) || p.check(scanner.TOKEN_LEFT_PAREN) {
+		if p.match(scanner.TOKEN_DOT) {
+			p.consume(scanner.TOKEN_IDENTIFIER, "Expect property name after '.'.")
+			target = &Get{p.spanFrom(start), target, lexeme(p.previous), tokenPos(p.previous)}
+		} else if p.match(scanner.TOKEN_LEFT_BRACKET) {
+			index := p.expression()
+			p.consume(scanner.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+			target = &Index{p.spanFrom(start), target, index}
+		} else {
+			p.advance()
+			target = p.call(target)
+		}
+	}
+	if _, ok := target.(*Call); ok {
+		p.error("Invalid increment target.")
+	}
+	return &Increment{p.spanFrom(tokenPos(op)), target, lexeme(op), tokenPos(op), true}
+}
+
+// Parse the arguments of a call whose '(' has just been consumed.
+// Named arguments must come after all the positional ones.
+func (p *parser) call(callee Expr) Expr {
+	var args []Argument
+	named := false
+	if !p.check(scanner.TOKEN_RIGHT_PAREN) {
+		for {
+			var arg Argument
+			if p.check(scanner.TOKEN_IDENTIFIER) && p.peek(1).Type == scanner.TOKEN_COLON {
+				p.advance()
+				arg.Name, arg.NamePos = lexeme(p.previous), tokenPos(p.previous)
+				p.advance()
+				named = true
+			} else if named {
+				p.errorAtCurrent("Positional argument can't follow a named argument.")
+			}
+			arg.Value = p.expression()
+			if len(args) == 255 {
+				p.error("Can't have more than 255 arguments.")
+			}
+			args = append(args, arg)
+			if !p.match(scanner.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after arguments")
+	return &Call{p.spanFrom(callee.Pos()), callee, args}
+}
+
+func (p *parser) list() Expr {
+	start := tokenPos(p.previous)
+	var elements []Expr
+	if !p.check(scanner.TOKEN_RIGHT_BRACKET) {
+		for {
+			element := p.expression()
+			if len(elements) == 255 {
+				p.error("Can't have more than 255 elements in a list literal.")
+			}
+			elements = append(elements, element)
+			if !p.match(scanner.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	p.consume(scanner.TOKEN_RIGHT_BRACKET, "Expect ']' after list elements.")
+	return &List{p.spanFrom(start), elements}
+}
+
+func (p *parser) mapLiteral() Expr {
+	start := tokenPos(p.previous)
+	var entries []*Entry
+	if !p.check(scanner.TOKEN_RIGHT_BRACE) {
+		for {
+			key := p.expression()
+			p.consume(scanner.TOKEN_COLON, "Expect ':' after map key.")
+			value := p.expression()
+			if len(entries) == 255 {
+				p.error("Can't have more than 255 entries in a map literal.")
+			}
+			entries = append(entries, &Entry{key, value})
+			if !p.match(scanner.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	p.consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after map entries.")
+	return &Map{p.spanFrom(start), entries}
+}
+
+// Return whether a token can only follow an expression, so a yield
+// before it has no value.
+func endsExpression(type_ scanner.TokenType) bool {
+	switch type_ {
+	case scanner.TOKEN_SEMICOLON, scanner.TOKEN_RIGHT_PAREN, scanner.TOKEN_RIGHT_BRACKET,
+		scanner.TOKEN_RIGHT_BRACE, scanner.TOKEN_COMMA, scanner.TOKEN_COLON, scanner.TOKEN_EOF:
+		return true
+	}
+	return false
+}
+
+// Look ahead from just after a '(' for the '=>' after the matching
+// ')' which shows that it starts a lambda.
+func (p *parser) isLambda() bool {
+	depth := 1
+	for n := 0; ; n++ {
+		token := p.current
+		if n > 0 {
+			token = p.peek(n)
+		}
+		switch token.Type {
+		case scanner.TOKEN_LEFT_PAREN:
+			depth++
+		case scanner.TOKEN_RIGHT_PAREN:
+			depth--
+		case scanner.TOKEN_EOF:
+			return false
+		}
+		if depth == 0 {
+			return p.peek(n+1).Type == scanner.TOKEN_ARROW
+		}
+	}
+}
+
+// (a, b) => a + b, or (a, b) => { ... }
+func (p *parser) lambda() Expr {
+	fn := &Function{IsLambda: true}
+	start := tokenPos(p.previous)
+	p.parameters(fn)
+	p.consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	fn.RParenPos = tokenPos(p.previous)
+	p.consume(scanner.TOKEN_ARROW, "Expect '=>' after parameters.")
+	fn.ArrowPos = tokenPos(p.previous)
+	if p.match(scanner.TOKEN_LEFT_BRACE) {
+		fn.Body = p.block()
+	} else {
+		fn.Result = p.expression()
+	}
+	fn.Span = p.spanFrom(start)
+	return &FunctionExpr{fn}
+}
+
+// "a${x}b${y}c", whose first segment has just been consumed.
+func (p *parser) interpolation() Expr {
+	start := tokenPos(p.previous)
+	expr := &Interpolation{}
+	expr.Segments = append(expr.Segments, p.segment(p.previous))
+	for {
+		expr.Exprs = append(expr.Exprs, p.expression())
+		if !p.match(scanner.TOKEN_INTERPOLATION) {
+			p.consume(scanner.TOKEN_STRING, "Expect end of string interpolation.")
+			if p.previous.Type != scanner.TOKEN_STRING {
+				break
+			}
+		}
+		expr.Segments = append(expr.Segments, p.segment(p.previous))
+		if p.previous.Type != scanner.TOKEN_INTERPOLATION {
+			break
+		}
+	}
+	expr.Span = p.spanFrom(start)
+	return expr
+}
+
+func (p *parser) segment(token scanner.Token) Segment {
+	raw, text := p.stringSegment(token)
+	return Segment{Pos: tokenPos(token), Raw: raw, Text: text}
+}
+
+// Return the text of a string token as written, with its delimiters
+// removed, and with its escape sequences translated.  A string token
+// starts with either the opening quote or the '}' closing an
+// interpolation, and ends with either the closing quote or the "${"
+// opening an interpolation.
+func (p *parser) stringSegment(token scanner.Token) (string, string) {
+	if token.Type != scanner.TOKEN_STRING && token.Type != scanner.TOKEN_INTERPOLATION {
+		return "", ""
+	}
+	end := token.Start + token.Length - 1
+	if token.Type == scanner.TOKEN_INTERPOLATION {
+		end--
+	}
+	raw := (*token.Source)[token.Start+1 : end]
+	text, ok := scanner.Unescape(raw)
+	if !ok {
+		p.error("Invalid escape sequence in string.")
+	}
+	return raw, text
+}
@@ -0,0 +1,674 @@
+package ast
+
+import (
+	"bytes"
+	"strings"
+)
+
+// The printer lays code out in one canonical style: two spaces of
+// indentation, one statement per line, the '{' of a block at the end
+// of the line which starts it and the '}' on a line of its own, and
+// single spaces around binary operators and after commas.  A single
+// blank line between statements is kept, and a list or call whose
+// first element starts a new line keeps one element per line.
+// Otherwise the layout of the source is ignored, so an expression is
+// printed on one line however it was written.
+//
+// Parentheses are printed where the tree has a Grouping, and nowhere
+// else, so a tree made by Parse() prints as code which parses to the
+// same tree.
+//
+// The comments of a File are printed among the statements they were
+// found between.  A comment at the end of a line stays at the end of
+// the line of the statement, or the '{', it followed.  A comment
+// inside a statement, such as one between two operands or two
+// parameters, stays after the token it followed, and since it runs to
+// the end of the line, what comes after it goes on a new line,
+// indented one level more.
+
+const indentation = "  "
+
+type printer struct {
+	buf      []byte
+	indent   int
+	comments []*Comment // still to be printed
+	last     int        // line in the source of what was printed last
+	line     int        // line in the source of the token printed last
+	close    Pos        // of the '}' of the braces being printed, if any
+}
+
+// Return the source for a node.  A File ends with a newline; other
+// nodes do not.
+func Print(node Node) string {
+	p := &printer{}
+	switch n := node.(type) {
+	case *File:
+		p.comments = n.Comments
+		p.stmtList(n.Stmts)
+		p.leading(n.EOF)
+		if len(p.buf) > 0 {
+			p.write("\n")
+		}
+	case Stmt:
+		p.stmt(n)
+	case Expr:
+		p.expr(n)
+	}
+	return string(p.buf)
+}
+
+func (p *printer) write(s string) {
+	p.buf = append(p.buf, s...)
+}
+
+// Start a new line at the current indentation.
+func (p *printer) newline() {
+	p.write("\n")
+	p.write(strings.Repeat(indentation, p.indent))
+}
+
+// Start a new line for something on the line of the source, after a
+// blank line if the source has one or more since what was printed
+// last.  Nothing is needed at the start of the output.
+func (p *printer) startLine(line int) {
+	if len(p.buf) == 0 {
+		return
+	}
+	if p.last > 0 && line > p.last+1 {
+		p.write("\n")
+	}
+	p.newline()
+}
+
+func before(a, b Pos) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// Print the comments before pos on lines of their own.
+func (p *printer) leading(pos Pos) {
+	for len(p.comments) > 0 && before(p.comments[0].Pos, pos) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.startLine(c.Pos.Line)
+		p.write(c.Text)
+		p.last = c.Pos.Line
+		p.line = c.Pos.Line
+	}
+}
+
+// Print the comments before pos, the position of the token about to
+// be printed inside a statement.  A comment on the line of the token
+// printed last stays at the end of the output line, and any other
+// goes on a line of its own.  Either way the token goes on a new line
+// after it, indented one level more unless the comment was all there
+// was on its line.
+func (p *printer) comment(pos Pos) {
+	for len(p.comments) > 0 && before(p.comments[0].Pos, pos) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		continuation := "\n" + strings.Repeat(indentation, p.indent+1)
+		if indent, ok := p.lineStart(); ok {
+			p.write(c.Text + "\n" + indent)
+		} else if c.Pos.Line == p.line {
+			p.trimSpace()
+			p.write(" " + c.Text + continuation)
+		} else {
+			p.trimSpace()
+			p.write(continuation + c.Text + continuation)
+		}
+	}
+	p.line = pos.Line
+}
+
+// Return the indentation of the output line, if nothing else has been
+// printed on it.
+func (p *printer) lineStart() (string, bool) {
+	line := p.buf[bytes.LastIndexByte(p.buf, '\n')+1:]
+	if len(bytes.TrimLeft(line, " ")) > 0 {
+		return "", false
+	}
+	return string(line), true
+}
+
+// Drop the spaces at the end of the output, before a comment.
+func (p *printer) trimSpace() {
+	p.buf = bytes.TrimRight(p.buf, " ")
+}
+
+// Print the comments up to the end of the line at the end of the
+// output line, and report whether there were any.  Any but the last
+// were inside what has just been printed, and go on lines of their
+// own.  Comments after the '}' of the braces being printed are left
+// for after the '}'.
+func (p *printer) trailing(line int) bool {
+	return p.trailingBefore(line, p.close)
+}
+
+// Print the comments up to the end of the line as trailing() does,
+// but only those before end, where what follows starts.
+func (p *printer) trailingBefore(line int, end Pos) bool {
+	found := false
+	for len(p.comments) > 0 && p.comments[0].Pos.Line <= line &&
+		(end.Line == 0 || before(p.comments[0].Pos, end)) {
+		if found {
+			p.newline()
+		} else {
+			p.write(" ")
+		}
+		p.write(p.comments[0].Text)
+		p.line = p.comments[0].Pos.Line
+		p.comments = p.comments[1:]
+		found = true
+	}
+	return found
+}
+
+// Print a comment at the end of the line of a '{' at open, which must
+// come before first, the position of what is inside the braces.  For
+// a block on one line, a comment after the '}' is not this one.  A
+// comment between the header and a '{' on a later line goes here too.
+func (p *printer) opening(open Pos, first Pos) {
+	if len(p.comments) > 0 && before(p.comments[0].Pos, first) &&
+		(p.comments[0].Pos.Line == open.Line || before(p.comments[0].Pos, open)) {
+		p.write(" " + p.comments[0].Text)
+		p.comments = p.comments[1:]
+	}
+}
+
+// Print the statements on lines of their own, keeping a blank line
+// where the source has one or more.
+func (p *printer) stmtList(stmts []Stmt) {
+	for _, stmt := range stmts {
+		p.leading(stmt.Pos())
+		p.startLine(stmt.Pos().Line)
+		p.line = stmt.Pos().Line
+		p.stmt(stmt)
+		p.trailing(stmt.End().Line)
+		p.last = stmt.End().Line
+	}
+}
+
+// Print a block from the '{' at open to the '}' at close, or {} if it
+// is empty.
+func (p *printer) block(open Pos, stmts []Stmt, close Pos) {
+	if len(stmts) == 0 && (len(p.comments) == 0 || !before(p.comments[0].Pos, close)) {
+		p.write("{}")
+		return
+	}
+	p.write("{")
+	first := close
+	if len(stmts) > 0 {
+		first = stmts[0].Pos()
+	}
+	p.opening(open, first)
+	p.indent++
+	p.last = 0
+	enclosing := p.close
+	p.close = close
+	p.stmtList(stmts)
+	p.leading(close)
+	p.close = enclosing
+	p.indent--
+	p.newline()
+	p.write("}")
+}
+
+func (p *printer) blockStmt(b *BlockStmt) {
+	p.block(b.Pos(), b.Stmts, b.End())
+}
+
+// Print the body of an if, while or for statement after its header.
+// A block goes on the same line, and so does any other statement
+// unless a comment comes before it.
+func (p *printer) body(stmt Stmt) {
+	p.write(" ")
+	if _, isBlock := stmt.(*BlockStmt); !isBlock {
+		p.comment(stmt.Pos())
+	}
+	p.stmt(stmt)
+}
+
+func (p *printer) stmt(stmt Stmt) {
+	switch s := stmt.(type) {
+	case *ExprStmt:
+		p.expr(s.Expr)
+		p.write(";")
+	case *PrintStmt:
+		p.write("print ")
+		p.expr(s.Expr)
+		p.write(";")
+	case *VarStmt:
+		p.write("var ")
+		p.comment(s.NamePos)
+		p.write(s.Name)
+		if s.Init != nil {
+			p.write(" = ")
+			p.expr(s.Init)
+		}
+		p.write(";")
+	case *ConstStmt:
+		p.write("const ")
+		p.comment(s.NamePos)
+		p.write(s.Name + " = ")
+		p.expr(s.Value)
+		p.write(";")
+	case *FunStmt:
+		p.write("fun")
+		if s.Function.IsGenerator {
+			p.write("*")
+		}
+		p.write(" ")
+		p.comment(s.Function.NamePos)
+		p.write(s.Function.Name)
+		p.function(s.Function)
+	case *ClassStmt:
+		p.write("class ")
+		p.comment(s.NamePos)
+		p.write(s.Name + " ")
+		if len(s.Methods) == 0 && (len(p.comments) == 0 || !before(p.comments[0].Pos, s.End())) {
+			p.write("{}")
+			return
+		}
+		p.write("{")
+		first := s.End()
+		if len(s.Methods) > 0 {
+			first = s.Methods[0].Pos()
+		}
+		p.opening(s.NamePos, first)
+		p.indent++
+		p.last = 0
+		enclosing := p.close
+		p.close = s.End()
+		for _, method := range s.Methods {
+			p.leading(method.Pos())
+			p.startLine(method.Pos().Line)
+			p.line = method.Pos().Line
+			p.write(method.Name)
+			p.function(method)
+			p.trailing(method.End().Line)
+			p.last = method.End().Line
+		}
+		p.leading(s.End())
+		p.close = enclosing
+		p.indent--
+		p.newline()
+		p.write("}")
+	case *BlockStmt:
+		p.blockStmt(s)
+	case *IfStmt:
+		p.write("if (")
+		p.expr(s.Cond)
+		p.comment(s.RParenPos)
+		p.write(")")
+		p.body(s.Then)
+		if s.Else == nil {
+			return
+		}
+		_, isBlock := s.Then.(*BlockStmt)
+		if p.trailingBefore(s.Then.End().Line, s.Else.Pos()) || !isBlock {
+			p.newline()
+		} else {
+			p.write(" ")
+		}
+		p.write("else")
+		p.body(s.Else)
+	case *WhileStmt:
+		p.write("while (")
+		p.expr(s.Cond)
+		p.comment(s.RParenPos)
+		p.write(")")
+		p.body(s.Body)
+	case *ForStmt:
+		p.write("for (")
+		if s.Init != nil {
+			p.stmt(s.Init)
+		} else {
+			p.write(";")
+		}
+		if s.Cond != nil {
+			p.write(" ")
+			p.expr(s.Cond)
+		}
+		p.comment(s.CondSemiPos)
+		p.write(";")
+		if s.Incr != nil {
+			p.write(" ")
+			p.expr(s.Incr)
+		}
+		p.comment(s.RParenPos)
+		p.write(")")
+		p.body(s.Body)
+	case *ForInStmt:
+		p.write("for (")
+		if s.HasVar {
+			p.write("var ")
+		}
+		p.comment(s.NamePos)
+		p.write(s.Name + " in ")
+		p.expr(s.Iterable)
+		p.comment(s.RParenPos)
+		p.write(")")
+		p.body(s.Body)
+	case *ImportStmt:
+		p.write("import ")
+		p.comment(s.PathPos)
+		p.write(`"` + s.RawPath + `"`)
+		if s.Alias != "" {
+			p.write(" as ")
+			p.comment(s.AliasPos)
+			p.write(s.Alias)
+		}
+		p.write(";")
+	case *ReturnStmt:
+		p.write("return")
+		if s.Value != nil {
+			p.write(" ")
+			p.expr(s.Value)
+		}
+		p.write(";")
+	case *ThrowStmt:
+		p.write("throw ")
+		p.expr(s.Value)
+		p.write(";")
+	case *BreakStmt:
+		p.write("break;")
+	case *ContinueStmt:
+		p.write("continue;")
+	case *TryStmt:
+		p.write("try ")
+		p.blockStmt(s.Body)
+		last := s.Body
+		if s.Catch != nil {
+			p.clause(last, s.CatchPos)
+			p.write("catch (")
+			p.comment(s.CatchPos)
+			p.write(s.CatchName + ") ")
+			p.blockStmt(s.Catch)
+			last = s.Catch
+		}
+		if s.Finally != nil {
+			p.clause(last, s.FinallyPos)
+			p.write("finally ")
+			p.blockStmt(s.Finally)
+		}
+	case *SwitchStmt:
+		p.write("switch (")
+		p.expr(s.Subject)
+		p.write(") ")
+		if len(s.Cases) == 0 && (len(p.comments) == 0 || !before(p.comments[0].Pos, s.End())) {
+			p.write("{}")
+			return
+		}
+		p.write("{")
+		first := s.End()
+		if len(s.Cases) > 0 {
+			first = s.Cases[0].Pos()
+		}
+		p.opening(s.LBracePos, first)
+		p.indent++
+		p.last = 0
+		enclosing := p.close
+		p.close = s.End()
+		for _, c := range s.Cases {
+			p.leading(c.Pos())
+			p.startLine(c.Pos().Line)
+			p.line = c.Pos().Line
+			if c.IsDefault {
+				p.write("default:")
+			} else {
+				p.write("case ")
+				p.exprList(c.Values)
+				p.comment(c.ColonPos)
+				p.write(":")
+			}
+			p.trailing(c.ColonPos.Line)
+			p.last = 0
+			p.indent++
+			p.stmtList(c.Body)
+			p.indent--
+			p.last = c.End().Line
+		}
+		p.leading(s.End())
+		p.close = enclosing
+		p.indent--
+		p.newline()
+		p.write("}")
+	}
+}
+
+// Start the catch or finally clause at next after the block, on the
+// same line unless a comment follows the block.
+func (p *printer) clause(block *BlockStmt, next Pos) {
+	if p.trailingBefore(block.End().Line, next) {
+		p.newline()
+	} else {
+		p.write(" ")
+	}
+}
+
+// Print the parameters and body of a function after its name.
+func (p *printer) function(fn *Function) {
+	p.write("(")
+	for i, param := range fn.Params {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.comment(param.NamePos)
+		if param.Rest {
+			p.write("...")
+		}
+		p.write(param.Name)
+		if param.Default != nil {
+			p.write(" ")
+			p.comment(param.EqualPos)
+			p.write("= ")
+			p.expr(param.Default)
+		}
+	}
+	p.comment(fn.RParenPos)
+	p.write(")")
+	if fn.IsLambda {
+		p.write(" ")
+		p.comment(fn.ArrowPos)
+		p.write("=>")
+	}
+	p.write(" ")
+	if fn.Body != nil {
+		p.blockStmt(fn.Body)
+	} else {
+		p.expr(fn.Result)
+	}
+}
+
+func (p *printer) exprList(exprs []Expr) {
+	for i, e := range exprs {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(e)
+	}
+}
+
+// Print the elements of a list or the arguments of a call between
+// open, on line openLine, and close, at closePos.  If the first, at
+// first, starts a new line, each goes on a line of its own.  element
+// prints one and returns it, for the comment after it.
+func (p *printer) elements(open, close string, openLine int, first, closePos Pos, n int, element func(int) Node) {
+	p.write(open)
+	if n == 0 || first.Line == openLine {
+		for i := range n {
+			if i > 0 {
+				p.write(", ")
+			}
+			element(i)
+		}
+		p.comment(closePos)
+		p.write(close)
+		return
+	}
+	p.opening(Pos{Line: openLine}, first)
+	p.indent++
+	for i := range n {
+		p.newline()
+		node := element(i)
+		if i < n-1 {
+			p.write(",")
+		}
+		p.trailing(node.End().Line)
+	}
+	for len(p.comments) > 0 && before(p.comments[0].Pos, closePos) {
+		p.newline()
+		p.write(p.comments[0].Text)
+		p.comments = p.comments[1:]
+	}
+	p.indent--
+	p.newline()
+	p.line = closePos.Line
+	p.write(close)
+}
+
+// Report whether an operand is printed starting with a '-', which a
+// '-' before it must be kept apart from, since -- is a decrement.
+func startsWithMinus(e Expr) bool {
+	switch e := e.(type) {
+	case *Unary:
+		return e.Op == "-"
+	case *Increment:
+		return e.Prefix && e.Op == "--"
+	}
+	return false
+}
+
+func (p *printer) expr(expr Expr) {
+	p.comment(expr.Pos())
+	switch e := expr.(type) {
+	case *Literal:
+		p.write(e.Raw)
+	case *Interpolation:
+		p.write(`"`)
+		for i, segment := range e.Segments {
+			if i > 0 {
+				p.write("}")
+			}
+			p.write(segment.Raw)
+			if i < len(e.Exprs) {
+				p.write("${")
+				p.expr(e.Exprs[i])
+			}
+		}
+		p.write(`"`)
+	case *Variable:
+		p.write(e.Name)
+	case *Assign:
+		p.expr(e.Target)
+		p.write(" ")
+		p.comment(e.OpPos)
+		p.write(e.Op + " ")
+		p.expr(e.Value)
+	case *Increment:
+		if e.Prefix {
+			p.write(e.Op)
+			p.expr(e.Target)
+		} else {
+			p.expr(e.Target)
+			p.comment(e.OpPos)
+			p.write(e.Op)
+		}
+	case *Unary:
+		p.write(e.Op)
+		if e.Op == "-" && startsWithMinus(e.Operand) {
+			p.write(" ")
+		}
+		p.expr(e.Operand)
+	case *Binary:
+		p.expr(e.Left)
+		p.write(" ")
+		p.comment(e.OpPos)
+		p.write(e.Op + " ")
+		p.expr(e.Right)
+	case *Logical:
+		p.expr(e.Left)
+		p.write(" ")
+		p.comment(e.OpPos)
+		p.write(e.Op + " ")
+		p.expr(e.Right)
+	case *Conditional:
+		p.expr(e.Cond)
+		p.write(" ")
+		p.comment(e.QuestionPos)
+		p.write("? ")
+		p.expr(e.Then)
+		p.write(" ")
+		p.comment(e.ColonPos)
+		p.write(": ")
+		p.expr(e.Else)
+	case *Grouping:
+		p.write("(")
+		p.expr(e.Expr)
+		p.comment(e.End())
+		p.write(")")
+	case *Call:
+		p.expr(e.Callee)
+		var first Pos
+		if len(e.Args) > 0 {
+			first = e.Args[0].Value.Pos()
+			if e.Args[0].Name != "" {
+				first = e.Args[0].NamePos
+			}
+		}
+		p.elements("(", ")", e.Callee.End().Line, first, e.End(), len(e.Args), func(i int) Node {
+			if e.Args[i].Name != "" {
+				p.comment(e.Args[i].NamePos)
+				p.write(e.Args[i].Name + ": ")
+			}
+			p.expr(e.Args[i].Value)
+			return e.Args[i].Value
+		})
+	case *Get:
+		p.expr(e.Object)
+		p.comment(e.NamePos)
+		p.write("." + e.Name)
+	case *Index:
+		p.expr(e.Object)
+		p.write("[")
+		p.expr(e.Index)
+		p.comment(e.End())
+		p.write("]")
+	case *List:
+		var first Pos
+		if len(e.Elements) > 0 {
+			first = e.Elements[0].Pos()
+		}
+		p.elements("[", "]", e.Pos().Line, first, e.End(), len(e.Elements), func(i int) Node {
+			p.expr(e.Elements[i])
+			return e.Elements[i]
+		})
+	case *Yield:
+		p.write("yield")
+		if e.Value != nil {
+			p.write(" ")
+			p.expr(e.Value)
+		}
+	case *Map:
+		var first Pos
+		if len(e.Entries) > 0 {
+			first = e.Entries[0].Key.Pos()
+		}
+		p.elements("{", "}", e.Pos().Line, first, e.End(), len(e.Entries), func(i int) Node {
+			p.expr(e.Entries[i].Key)
+			p.write(": ")
+			p.expr(e.Entries[i].Value)
+			return e.Entries[i].Value
+		})
+	case *FunctionExpr:
+		fn := e.Function
+		if !fn.IsLambda {
+			p.write("fun")
+			if fn.IsGenerator {
+				p.write("*")
+			}
+			p.write(" ")
+		}
+		p.function(fn)
+	}
+}
@@ -14,45 +14,105 @@ const (
 	OP_TRUE
 	OP_FALSE
 	OP_POP
+	OP_DUP
+	OP_DUP2
+	OP_BURY
 	OP_GET_LOCAL
 	OP_SET_LOCAL
 	OP_GET_GLOBAL
 	OP_DEFINE_GLOBAL
+	OP_DEFINE_CONST
 	OP_SET_GLOBAL
 	OP_GET_UPVALUE
 	OP_SET_UPVALUE
 	OP_GET_PROPERTY
 	OP_SET_PROPERTY
+	OP_BUILD_LIST
+	OP_BUILD_MAP
+	OP_GET_INDEX
+	OP_SET_INDEX
 	OP_EQUAL
+	OP_NOT_EQUAL
 	OP_GREATER
+	OP_GREATER_EQUAL
 	OP_LESS
+	OP_LESS_EQUAL
 	OP_ADD
 	OP_SUBTRACT
 	OP_MULTIPLY
 	OP_DIVIDE
+	OP_MODULO
+	OP_INT_DIVIDE
+	OP_BIT_AND
+	OP_BIT_OR
+	OP_BIT_XOR
+	OP_BIT_NOT
+	OP_SHIFT_LEFT
+	OP_SHIFT_RIGHT
 	OP_NOT
 	OP_NEGATE
+	OP_TO_STRING
 	OP_PRINT
 	OP_JUMP
 	OP_JUMP_IF_FALSE
 	OP_LOOP
+	OP_JUMP_TABLE
+	OP_JUMP_IF_PASSED
+	OP_ITERATOR
+	OP_ITER_NEXT
+	OP_JUMP_IF_DONE
 	OP_CALL
+	OP_CALL_NAMED
 	OP_CLOSURE
 	OP_CLOSE_UPVALUE
 	OP_RETURN
+	OP_YIELD
+	OP_THROW
 	OP_CLASS
 	OP_METHOD
+	OP_IMPORT
 )
 
+// An exception handler covers the instructions in [Start, End) of
+// a try block.  When one of them throws, the VM cuts the frame's
+// stack back to StackDepth slots, pushes the thrown value and jumps
+// to Target.  Handlers of nested try blocks come before the handlers
+// of the blocks enclosing them.
+type Handler struct {
+	Start      int
+	End        int
+	Target     int
+	StackDepth int
+}
+
+// A named local variable, the stack slot it lives in, and the range
+// of code in which it is in scope.  The debugger uses these to show
+// the values in a frame's slots by name.
+type LocalVar struct {
+	Name  string
+	Slot  int
+	Start int // offset of the first instruction in its scope
+	End   int // offset just past the last
+}
+
 type Chunk struct {
 	Code      []uint8
 	Lines     []int
 	Constants value.ValueArray
+	Handlers  []Handler
+
+	// Debug information: the function's named locals, and the names
+	// of the variables captured by its upvalues, by upvalue index.
+	Locals       []LocalVar
+	UpvalueNames []string
 }
 
 func InitChunk(chun *Chunk) {
 	chun.Code = nil
 	chun.Lines = nil
+	chun.Handlers = nil
+	chun.Locals = nil
+	chun.UpvalueNames = nil
 	value.InitValueArray(&chun.Constants)
 }
 
@@ -66,6 +126,16 @@ func AddConstant(chun *Chunk, val value.Value) int {
 	return len(chun.Constants.Values) - 1
 }
 
+func AddHandler(chun *Chunk, handler Handler) {
+	chun.Handlers = append(chun.Handlers, handler)
+}
+
+// Add a local whose scope has not ended yet, and return its index.
+func AddLocal(chun *Chunk, name string, slot int) int {
+	chun.Locals = append(chun.Locals, LocalVar{Name: name, Slot: slot, Start: len(chun.Code), End: -1})
+	return len(chun.Locals) - 1
+}
+
 func FreeChunk(chun *Chunk) {
 	value.FreeValueArrary(&chun.Constants)
 	InitChunk(chun)
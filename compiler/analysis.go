@@ -0,0 +1,258 @@
+package compiler
+
+import (
+	"unicode/utf8"
+
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/scanner"
+)
+
+// Analysis of a script for editors, which want to know where its
+// variables, functions and classes are declared and used, and what
+// errors it has, without running it.  Analyze() compiles the script
+// with hooks in the compiler switched on, which record each
+// declaration as a Symbol and each use of a name as a Reference, and
+// collect compile errors as Diagnostics instead of printing them.
+//
+// A use of a local is resolved as the compiler resolves it, while the
+// locals in scope are known.  Globals are late bound, so a use of a
+// global is resolved by name once the whole script has been seen.  A
+// property is not resolved at all, since it may name a method of any
+// class.
+
+type SymbolKind int
+
+const (
+	SYMBOL_VARIABLE SymbolKind = iota
+	SYMBOL_CONSTANT
+	SYMBOL_PARAMETER
+	SYMBOL_FUNCTION
+	SYMBOL_CLASS
+	SYMBOL_METHOD
+	SYMBOL_MODULE
+)
+
+// A place in the source.  Lines and columns start from 1, and columns
+// count runes, as they do in tokens.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// Report whether p comes before q.
+func (p Position) Before(q Position) bool {
+	return p.Line < q.Line || p.Line == q.Line && p.Column < q.Column
+}
+
+// A declaration.  Pos is where its name is.  A local is in scope from
+// there to End, which is just after the token ending its block.  End
+// is zero for globals and methods.
+type Symbol struct {
+	Name      string
+	Kind      SymbolKind
+	Pos       Position
+	End       Position
+	Global    bool
+	Container int // the function, method or class declared in, or -1
+
+	// For functions and methods, as in object.ObjFunction.
+	Arity, MinArity, MaxArity int
+	IsGenerator               bool
+}
+
+// Return the position just after the name of the symbol.
+func (s Symbol) NameEnd() Position {
+	return Position{Line: s.Pos.Line, Column: s.Pos.Column + utf8.RuneCountInString(s.Name)}
+}
+
+// A use of a name.  Symbol is the index of the symbol the name refers
+// to, or -1 if it is a property, or names no declaration in the
+// script, such as a native function.
+type Reference struct {
+	Name       string
+	Pos        Position
+	Symbol     int
+	IsProperty bool
+	isLocal    bool // resolved while compiling
+}
+
+// A compile error, from Pos up to End.
+type Diagnostic struct {
+	Pos     Position
+	End     Position
+	Message string
+}
+
+type Analysis struct {
+	Symbols     []Symbol
+	References  []Reference
+	Diagnostics []Diagnostic
+
+	container int // the symbol of the function or class being compiled
+	declared  int // the symbol declareVariable() has just recorded
+}
+
+// Set while Analyze() runs.
+var analysis *Analysis
+
+// Compile the source to find its symbols, references and errors.
+// Nothing is printed, even when the compiler would print the code it
+// generates.
+func Analyze(source *string) *Analysis {
+	analysis = &Analysis{container: -1, declared: -1}
+	defer func() { analysis = nil }()
+	Compile(source)
+	result := analysis
+	result.resolveGlobals()
+	return result
+}
+
+// A use of a global refers to the last declaration of it before the
+// use, or failing that, to its first declaration.
+func (a *Analysis) resolveGlobals() {
+	for i := range a.References {
+		ref := &a.References[i]
+		if ref.isLocal || ref.IsProperty {
+			continue
+		}
+		for j, symbol := range a.Symbols {
+			if !symbol.Global || symbol.Name != ref.Name {
+				continue
+			}
+			if ref.Symbol == -1 || !ref.Pos.Before(symbol.Pos) {
+				ref.Symbol = j
+			}
+			if ref.Pos.Before(symbol.Pos) {
+				break
+			}
+		}
+	}
+}
+
+func tokenPosition(token scanner.Token) Position {
+	return Position{Line: token.Line, Column: token.Column}
+}
+
+// Return the position just after the token.
+func tokenEnd(token scanner.Token) Position {
+	pos := tokenPosition(token)
+	if token.Type == scanner.TOKEN_ERROR {
+		// The token holds a message, not a piece of the source.
+		pos.Column++
+		return pos
+	}
+	for _, r := range lexeme(token) {
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return pos
+}
+
+// Record a declaration of the name in token, and return the index of
+// its symbol, or -1 when not analyzing.
+func addSymbol(token scanner.Token, kind SymbolKind) int {
+	if analysis == nil || token.Type != scanner.TOKEN_IDENTIFIER {
+		return -1
+	}
+	analysis.Symbols = append(analysis.Symbols, Symbol{
+		Name:      lexeme(token),
+		Kind:      kind,
+		Pos:       tokenPosition(token),
+		Global:    current.scopeDepth == 0 && kind != SYMBOL_METHOD,
+		Container: analysis.container,
+	})
+	return len(analysis.Symbols) - 1
+}
+
+// Give the symbol declareVariable() has just recorded its kind, and
+// return its index.
+func declaredSymbol(kind SymbolKind) int {
+	if analysis == nil || analysis.declared == -1 {
+		return -1
+	}
+	symbol := analysis.declared
+	analysis.declared = -1
+	analysis.Symbols[symbol].Kind = kind
+	return symbol
+}
+
+// Record a function's parameters with its symbol.
+func setSignature(symbol int, function object.ObjFunction) {
+	if analysis == nil || symbol == -1 {
+		return
+	}
+	s := &analysis.Symbols[symbol]
+	s.Arity = function.Arity
+	s.MinArity = function.MinArity
+	s.MaxArity = function.MaxArity
+	s.IsGenerator = function.IsGenerator
+}
+
+// Make the symbol the container of those declared until
+// leaveContainer() is called with the result.
+func enterContainer(symbol int) int {
+	if analysis == nil {
+		return -1
+	}
+	outer := analysis.container
+	analysis.container = symbol
+	return outer
+}
+
+func leaveContainer(outer int) {
+	if analysis != nil {
+		analysis.container = outer
+	}
+}
+
+// End the scope of a local's symbol at the token just compiled.
+func endSymbol(symbol int) {
+	if analysis != nil && symbol != -1 {
+		analysis.Symbols[symbol].End = tokenEnd(parser.previous)
+	}
+}
+
+// Record a use of the variable named by token.
+func addReference(token scanner.Token) {
+	if analysis == nil {
+		return
+	}
+	ref := Reference{Name: lexeme(token), Pos: tokenPosition(token), Symbol: -1}
+	if n := len(analysis.Symbols); n > 0 && analysis.Symbols[n-1].Pos == ref.Pos {
+		// A class declaration loads the class it has just declared,
+		// but that is not a use of the name.
+		return
+	}
+	ref.Symbol, ref.isLocal = localSymbol(current, &token)
+	analysis.References = append(analysis.References, ref)
+}
+
+// Record a use of the property named by token.
+func addPropertyReference(token scanner.Token) {
+	if analysis != nil {
+		analysis.References = append(analysis.References,
+			Reference{Name: lexeme(token), Pos: tokenPosition(token), Symbol: -1, IsProperty: true})
+	}
+}
+
+// Return the symbol of the local named by token in the compiler or
+// the functions enclosing it, and whether there is such a local.
+func localSymbol(compiler *Compiler, name *scanner.Token) (int, bool) {
+	for ; compiler != nil; compiler = compiler.enclosing {
+		for i := compiler.localCount - 1; i >= 0; i-- {
+			if identifierEqual(name, &compiler.locals[i].name) {
+				return compiler.locals[i].symbol, true
+			}
+		}
+	}
+	return -1, false
+}
+
+func addDiagnostic(token scanner.Token, message string) {
+	analysis.Diagnostics = append(analysis.Diagnostics,
+		Diagnostic{Pos: tokenPosition(token), End: tokenEnd(token), Message: message})
+}
@@ -4,13 +4,18 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/davidfung/glox/chunk"
 	"github.com/davidfung/glox/common"
 	"github.com/davidfung/glox/debugger"
 	"github.com/davidfung/glox/object"
 	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/optimizer"
 	"github.com/davidfung/glox/scanner"
 	"github.com/davidfung/glox/value"
 )
@@ -25,16 +30,21 @@ type Parser struct {
 type Precedence int
 
 const (
-	PREC_NONE       Precedence = iota
-	PREC_ASSIGNMENT            // =
-	PREC_OR                    // or
-	PREC_AND                   // and
-	PREC_EQUALITY              // == !=
-	PREC_COMPARISON            // < > <= >=
-	PREC_TERM                  // + -
-	PREC_FACTOR                // * /
-	PREC_UNARY                 // ! -
-	PREC_CALL                  // . ()
+	PREC_NONE        Precedence = iota
+	PREC_ASSIGNMENT             // =
+	PREC_CONDITIONAL            // ?:
+	PREC_OR                     // or
+	PREC_AND                    // and
+	PREC_EQUALITY               // == !=
+	PREC_COMPARISON             // < > <= >=
+	PREC_BIT_OR                 // |
+	PREC_BIT_XOR                // ^
+	PREC_BIT_AND                // &
+	PREC_SHIFT                  // << >>
+	PREC_TERM                   // + -
+	PREC_FACTOR                 // * / % ~/
+	PREC_UNARY                  // ! - ~
+	PREC_CALL                   // . ()
 	PREC_PRIMARY
 )
 
@@ -50,17 +60,74 @@ type Local struct {
 	name       scanner.Token
 	depth      int
 	isCaptured bool
+	isConst    bool
+	debug      int // index in the chunk's debug table, -1 if not entered yet
+	symbol     int // index in the analysis's symbols, -1 if none
 }
 
 type Upvalue struct {
 	index   uint8
 	isLocal bool
-}
+	isConst bool // the variable captured is a constant
+}
+
+// Each loop being compiled records where a continue statement jumps
+// back to, and the scope depth of the loop so that break and continue
+// know which locals to discard.  The jumps emitted by break statements
+// are collected so that they can be patched once the end of the loop
+// is known.  A switch statement is also a Loop as far as break is
+// concerned, but has no start, so continue passes through it to the
+// enclosing loop.
+type Loop struct {
+	enclosing  *Loop
+	start      int
+	scopeDepth int
+	breakJumps []int
+}
+
+// A try statement with a finally clause whose try or catch block is
+// being compiled.  Control can leave those blocks by falling off the
+// end, by an exception, or by a return, break or continue statement,
+// and the finally block must run in every case.  So each of them
+// stores a completion kind in a hidden local, and the value being
+// returned or thrown in another, before going to the finally block.
+// After the finally block, code generated for each kind that was used
+// carries on where the completion was heading.
+type Finally struct {
+	enclosing *Finally
+	depth     int // local count once the two hidden locals are declared
+	kindSlot  uint8
+	valueSlot uint8
+	loop      *Loop // innermost loop enclosing the try statement
+	jumps     []int // jumps to the finally block to be patched
+	hasReturn bool
+	exits     []Exit
+	nextKind  int
+}
+
+// A break or continue that leaves a try statement with a finally
+// clause, to be carried out after the finally block has run.
+type Exit struct {
+	kind    int
+	loop    *Loop
+	isBreak bool
+}
+
+// Completion kinds of a try statement with a finally clause.  The
+// break and continue statements leaving the try statement are each
+// given their own kind, starting from COMPLETION_EXIT.
+const (
+	COMPLETION_NORMAL = iota
+	COMPLETION_THROW
+	COMPLETION_RETURN
+	COMPLETION_EXIT
+)
 
 type FunctionType int
 
 const (
 	_ FunctionType = iota
+	TYPE_ANONYMOUS
 	TYPE_FUNCTION
 	TYPE_SCRIPT
 )
@@ -81,6 +148,9 @@ type Compiler struct {
 	localCount int
 	upvalues   [common.UINT8_COUNT]Upvalue
 	scopeDepth int
+
+	loop    *Loop    // innermost loop enclosing the code being compiled
+	finally *Finally // innermost try statement with a finally clause
 }
 
 var parser Parser
@@ -103,18 +173,52 @@ func errorAt(token scanner.Token, message string) {
 		return
 	}
 	parser.panicMode = true
-	fmt.Fprintf(os.Stderr, "[line %d] Error", token.Line)
+	parser.hadError = true
+	if analysis != nil {
+		addDiagnostic(token, message)
+		return
+	}
 
+	where := ""
 	if token.Type == scanner.TOKEN_EOF {
-		fmt.Fprintf(os.Stderr, " at end")
+		where = " at end"
 	} else if token.Type == scanner.TOKEN_ERROR {
 		// Nothing.
 	} else {
-		fmt.Fprintf(os.Stderr, " at '%s'", (*token.Source)[token.Start:token.Start+token.Length])
+		where = fmt.Sprintf(" at '%s'", (*token.Source)[token.Start:token.Start+token.Length])
 	}
 
-	fmt.Fprintf(os.Stderr, ": %s\n", message)
-	parser.hadError = true
+	if replMode {
+		replError(token, fmt.Sprintf("Error%s: %s", where, message))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[line %d:%d] Error%s: %s\n", token.Line, token.Column, where, message)
+}
+
+// In the REPL, the line of the input with the error is shown, with a
+// caret under the column where it is.
+func replError(token scanner.Token, message string) {
+	lines := strings.Split(*replSource, "\n")
+	if token.Line > len(lines) {
+		fmt.Fprintln(os.Stderr, message)
+		return
+	}
+	line := lines[token.Line-1]
+	// Keep the tabs before the column, so that the caret lines up.
+	var indent strings.Builder
+	for i, r := range []rune(line) {
+		if i >= token.Column-1 {
+			break
+		}
+		if r == '\t' {
+			indent.WriteRune('\t')
+		} else {
+			indent.WriteRune(' ')
+		}
+	}
+	number := fmt.Sprint(token.Line)
+	fmt.Fprintf(os.Stderr, "  %s | %s\n", number, line)
+	fmt.Fprintf(os.Stderr, "  %s | %s^ %s\n", strings.Repeat(" ", len(number)), indent.String(), message)
 }
 
 func error(message string) {
@@ -229,9 +333,16 @@ func initCompiler(compiler *Compiler, type_ FunctionType) {
 	compiler.type_ = type_
 	compiler.localCount = 0
 	compiler.scopeDepth = 0
+	compiler.loop = nil
+	compiler.finally = nil
 	compiler.function = object.NewFunction()
 	current = compiler
-	if type_ != TYPE_SCRIPT {
+	if type_ == TYPE_ANONYMOUS {
+		// Name an anonymous function after the line where it is
+		// defined, so that it can be told apart when printed.
+		name := fmt.Sprintf("anonymous@%d", parser.previous.Line)
+		current.function.Name = object.ObjString(name)
+	} else if type_ != TYPE_SCRIPT {
 		source := parser.previous.Source
 		start := parser.previous.Start
 		length := parser.previous.Length
@@ -244,19 +355,28 @@ func initCompiler(compiler *Compiler, type_ FunctionType) {
 	// The compiler implicitly claims stack slot zero for the
 	// VM’s own internal use. We give it an empty name so that
 	// the user can’t write an identifier that refers to it.
-	var local Local
-	local = current.locals[current.localCount]
+	local := &current.locals[current.localCount]
 	current.localCount++
 	local.depth = 0
 	local.isCaptured = false
 	local.name.Start = 0
 	local.name.Length = 0
+	local.debug = -1
+	local.symbol = -1
 }
 
 func endCompiler() object.ObjFunction {
 	emitReturn()
+	// The scopes of the parameters and of locals in the function's
+	// outermost block last until the end of the function.
+	for i := range current.localCount {
+		endLocal(&current.locals[i])
+	}
+	if !parser.hadError {
+		optimizer.Optimize(currentChunk())
+	}
 	var function object.ObjFunction = current.function
-	if debugger.DEBUG_PRINT_CODE {
+	if debugger.DEBUG_PRINT_CODE && analysis == nil && !expressionMode {
 		if !parser.hadError {
 			name := function.Name
 			if name == "" {
@@ -282,6 +402,7 @@ func endScope() {
 	// to pop them from the stack.
 	for current.localCount > 0 &&
 		current.locals[current.localCount-1].depth > current.scopeDepth {
+		endLocal(&current.locals[current.localCount-1])
 		if current.locals[current.localCount-1].isCaptured {
 			emitByte(chunk.OP_CLOSE_UPVALUE)
 		} else {
@@ -291,6 +412,136 @@ func endScope() {
 	}
 }
 
+// Mark the end of a local's scope in the debug table.
+func endLocal(local *Local) {
+	if local.debug != -1 {
+		currentChunk().Locals[local.debug].End = currentIP()
+	}
+	endSymbol(local.symbol)
+}
+
+func beginLoop(loop *Loop, start int) {
+	loop.enclosing = current.loop
+	loop.start = start
+	loop.scopeDepth = current.scopeDepth
+	loop.breakJumps = nil
+	current.loop = loop
+}
+
+// Patch the break jumps to land on the next instruction emitted.
+func endLoop() {
+	for _, jump := range current.loop.breakJumps {
+		patchJump(jump)
+	}
+	current.loop = current.loop.enclosing
+}
+
+// Emit the instructions to discard the locals above the first count
+// locals, as endScope() would, but without forgetting them since the
+// code following a jump out of their scope is still in their scope.
+func discardLocals(count int) {
+	for i := current.localCount - 1; i >= count; i-- {
+		if current.locals[i].isCaptured {
+			emitByte(chunk.OP_CLOSE_UPVALUE)
+		} else {
+			emitByte(chunk.OP_POP)
+		}
+	}
+}
+
+// Discard the locals declared inside the loop.
+func discardLoopLocals(loop *Loop) {
+	count := current.localCount
+	for count > 0 && current.locals[count-1].depth > loop.scopeDepth {
+		count--
+	}
+	discardLocals(count)
+}
+
+// Return the innermost try statement with a finally clause that is
+// inside the given loop, and so must run its finally block before a
+// break or continue can leave the loop.
+func finallyInside(loop *Loop) *Finally {
+	if current.finally == nil {
+		return nil
+	}
+	for l := current.finally.loop; l != nil; l = l.enclosing {
+		if l == loop {
+			return current.finally
+		}
+	}
+	return nil
+}
+
+// Leave the try statement through its finally block.  The completion
+// value, if any, is on top of the stack.
+func jumpToFinally(finally *Finally, kind int) {
+	if kind == COMPLETION_RETURN {
+		emitBytes(chunk.OP_SET_LOCAL, finally.valueSlot)
+		emitByte(chunk.OP_POP)
+	}
+	emitConstant(objval.NUMBER_VAL(float64(kind)))
+	emitBytes(chunk.OP_SET_LOCAL, finally.kindSlot)
+	emitByte(chunk.OP_POP)
+	discardLocals(finally.depth)
+	finally.jumps = append(finally.jumps, emitJump(chunk.OP_JUMP))
+}
+
+func emitBreak(loop *Loop) {
+	if finally := finallyInside(loop); finally != nil {
+		finally.exits = append(finally.exits, Exit{finally.nextKind, loop, true})
+		jumpToFinally(finally, finally.nextKind)
+		finally.nextKind++
+		return
+	}
+	discardLoopLocals(loop)
+	loop.breakJumps = append(loop.breakJumps, emitJump(chunk.OP_JUMP))
+}
+
+func emitContinue(loop *Loop) {
+	if finally := finallyInside(loop); finally != nil {
+		finally.exits = append(finally.exits, Exit{finally.nextKind, loop, false})
+		jumpToFinally(finally, finally.nextKind)
+		finally.nextKind++
+		return
+	}
+	discardLoopLocals(loop)
+	emitLoop(loop.start)
+}
+
+// Return the value on top of the stack from the function, going
+// through the finally blocks of any try statements first.
+func emitReturnValue() {
+	if current.finally != nil {
+		current.finally.hasReturn = true
+		jumpToFinally(current.finally, COMPLETION_RETURN)
+	} else {
+		emitByte(chunk.OP_RETURN)
+	}
+}
+
+func breakStatement() {
+	if current.loop == nil {
+		error("Can't use 'break' outside of a loop.")
+		return
+	}
+	consume(scanner.TOKEN_SEMICOLON, "Expect ';' after 'break'.")
+	emitBreak(current.loop)
+}
+
+func continueStatement() {
+	loop := current.loop
+	for loop != nil && loop.start == (-1) {
+		loop = loop.enclosing
+	}
+	if loop == nil {
+		error("Can't use 'continue' outside of a loop.")
+		return
+	}
+	consume(scanner.TOKEN_SEMICOLON, "Expect ';' after 'continue'.")
+	emitContinue(loop)
+}
+
 func binary(canAssign bool) {
 	operatorType := parser.previous.Type
 	rule := getRule(operatorType)
@@ -298,17 +549,17 @@ func binary(canAssign bool) {
 
 	switch operatorType {
 	case scanner.TOKEN_BANG_EQUAL:
-		emitBytes(chunk.OP_EQUAL, chunk.OP_NOT)
+		emitByte(chunk.OP_NOT_EQUAL)
 	case scanner.TOKEN_EQUAL_EQUAL:
 		emitByte(chunk.OP_EQUAL)
 	case scanner.TOKEN_GREATER:
 		emitByte(chunk.OP_GREATER)
 	case scanner.TOKEN_GREATER_EQUAL:
-		emitBytes(chunk.OP_LESS, chunk.OP_NOT)
+		emitByte(chunk.OP_GREATER_EQUAL)
 	case scanner.TOKEN_LESS:
 		emitByte(chunk.OP_LESS)
 	case scanner.TOKEN_LESS_EQUAL:
-		emitBytes(chunk.OP_GREATER, chunk.OP_NOT)
+		emitByte(chunk.OP_LESS_EQUAL)
 	case scanner.TOKEN_PLUS:
 		emitByte(chunk.OP_ADD)
 	case scanner.TOKEN_MINUS:
@@ -317,28 +568,269 @@ func binary(canAssign bool) {
 		emitByte(chunk.OP_MULTIPLY)
 	case scanner.TOKEN_SLASH:
 		emitByte(chunk.OP_DIVIDE)
+	case scanner.TOKEN_PERCENT:
+		emitByte(chunk.OP_MODULO)
+	case scanner.TOKEN_TILDE_SLASH:
+		emitByte(chunk.OP_INT_DIVIDE)
+	case scanner.TOKEN_AMPERSAND:
+		emitByte(chunk.OP_BIT_AND)
+	case scanner.TOKEN_PIPE:
+		emitByte(chunk.OP_BIT_OR)
+	case scanner.TOKEN_CARET:
+		emitByte(chunk.OP_BIT_XOR)
+	case scanner.TOKEN_LESS_LESS:
+		emitByte(chunk.OP_SHIFT_LEFT)
+	case scanner.TOKEN_GREATER_GREATER:
+		emitByte(chunk.OP_SHIFT_RIGHT)
 	default:
 		return // Unreachable.
 	}
 }
 
+// If assignment is allowed and the next token is a compound
+// assignment operator such as +=, consume it and return the
+// instruction for its arithmetic.
+func matchCompoundAssignment(canAssign bool) (chunk.OpCode, bool) {
+	if !canAssign {
+		return 0, false
+	}
+	switch parser.current.Type {
+	case scanner.TOKEN_PLUS_EQUAL:
+		advance()
+		return chunk.OP_ADD, true
+	case scanner.TOKEN_MINUS_EQUAL:
+		advance()
+		return chunk.OP_SUBTRACT, true
+	case scanner.TOKEN_STAR_EQUAL:
+		advance()
+		return chunk.OP_MULTIPLY, true
+	case scanner.TOKEN_SLASH_EQUAL:
+		advance()
+		return chunk.OP_DIVIDE, true
+	case scanner.TOKEN_PERCENT_EQUAL:
+		advance()
+		return chunk.OP_MODULO, true
+	}
+	return 0, false
+}
+
+// If the next token is a postfix ++ or --, consume it and return
+// the instruction which adds or subtracts one.
+func matchIncrement() (chunk.OpCode, bool) {
+	if match(scanner.TOKEN_PLUS_PLUS) {
+		return chunk.OP_ADD, true
+	}
+	if match(scanner.TOKEN_MINUS_MINUS) {
+		return chunk.OP_SUBTRACT, true
+	}
+	return 0, false
+}
+
+// Emit the arithmetic for ++ or -- on the value on top of the stack.
+func emitIncrement(op chunk.OpCode) {
+	emitConstant(objval.NUMBER_VAL(1))
+	emitByte(op)
+}
+
+// Emit a postfix ++ or -- on the value on top of the stack, which
+// the set instruction after it stores, with the depth values under
+// it that the set instruction takes too.  A copy of the old value is
+// put under those for the result of the expression, and the new
+// value the set instruction leaves is popped.  Working the old value
+// out again from the new one would be wrong when the arithmetic
+// rounds.
+func emitPostfix(op chunk.OpCode, depth uint8, set func()) {
+	emitByte(chunk.OP_DUP)
+	if depth > 0 {
+		emitBytes(chunk.OP_BURY, depth+1)
+	}
+	emitIncrement(op)
+	set()
+	emitByte(chunk.OP_POP)
+}
+
+// The target of a prefix ++ or --, which is a variable, a property
+// or an element, as in ++a, ++a.b or ++a[i].  The result of a call
+// is on the way to a target but cannot be one.
+type IncrementTarget int
+
+const (
+	TARGET_VARIABLE IncrementTarget = iota
+	TARGET_PROPERTY
+	TARGET_INDEX
+	TARGET_CALL
+)
+
+// Compile ++target or --target.  The operand cannot be compiled with
+// parsePrecedence() like other unary operators, because that would
+// emit the instruction to read the target rather than to update it.
+// Instead we walk the chain of property accesses, subscripts and
+// calls ourselves, reading each part until we reach the last one.
+func prefixIncrement(canAssign bool) {
+	op := chunk.OP_ADD
+	if parser.previous.Type == scanner.TOKEN_MINUS_MINUS {
+		op = chunk.OP_SUBTRACT
+	}
+
+	consume(scanner.TOKEN_IDENTIFIER, "Expect variable after increment operator.")
+	target := TARGET_VARIABLE
+	variable := parser.previous
+	var name uint8
+	for {
+		if !check(scanner.TOKEN_DOT) && !check(scanner.TOKEN_LEFT_BRACKET) && !check(scanner.TOKEN_LEFT_PAREN) {
+			break
+		}
+		// The current target is only a step on the way; read it.
+		switch target {
+		case TARGET_VARIABLE:
+			namedVariable(variable, false)
+		case TARGET_PROPERTY:
+			emitBytes(chunk.OP_GET_PROPERTY, name)
+		case TARGET_INDEX:
+			emitByte(chunk.OP_GET_INDEX)
+		}
+		if match(scanner.TOKEN_DOT) {
+			consume(scanner.TOKEN_IDENTIFIER, "Expect property name after '.'.")
+			name = identifierConstant(parser.previous)
+			target = TARGET_PROPERTY
+		} else if match(scanner.TOKEN_LEFT_BRACKET) {
+			expression()
+			consume(scanner.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+			target = TARGET_INDEX
+		} else {
+			advance()
+			call(false)
+			target = TARGET_CALL
+		}
+	}
+
+	switch target {
+	case TARGET_VARIABLE:
+		getOp, setOp, arg := resolveVariable(variable)
+		checkAssignable(variable, setOp, arg)
+		emitBytes(getOp, arg)
+		emitIncrement(op)
+		emitBytes(setOp, arg)
+	case TARGET_PROPERTY:
+		emitByte(chunk.OP_DUP)
+		emitBytes(chunk.OP_GET_PROPERTY, name)
+		emitIncrement(op)
+		emitBytes(chunk.OP_SET_PROPERTY, name)
+	case TARGET_INDEX:
+		emitByte(chunk.OP_DUP2)
+		emitByte(chunk.OP_GET_INDEX)
+		emitIncrement(op)
+		emitByte(chunk.OP_SET_INDEX)
+	case TARGET_CALL:
+		error("Invalid increment target.")
+	}
+}
+
 func call(canAssign bool) {
-	argCount := argumentList()
-	emitBytes(chunk.OP_CALL, argCount)
+	argCount, names := argumentList()
+	if len(names) == 0 {
+		emitBytes(chunk.OP_CALL, argCount)
+		return
+	}
+	emitBytes(chunk.OP_CALL_NAMED, argCount)
+	emitByte(makeConstant(objval.LIST_VAL(object.NewList(names))))
 }
 
 func dot(canAssign bool) {
-	consume(scanner.TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	// yield is a keyword, but also the name of Fiber.yield().
+	if !match(scanner.TOKEN_YIELD) {
+		consume(scanner.TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	}
+	addPropertyReference(parser.previous)
 	name := identifierConstant(parser.previous)
 
 	if canAssign && match(scanner.TOKEN_EQUAL) {
 		expression()
 		emitBytes(chunk.OP_SET_PROPERTY, name)
+	} else if op, ok := matchCompoundAssignment(canAssign); ok {
+		// Keep a copy of the receiver for OP_SET_PROPERTY, so that
+		// the expression for it is evaluated only once.
+		emitByte(chunk.OP_DUP)
+		emitBytes(chunk.OP_GET_PROPERTY, name)
+		expression()
+		emitByte(op)
+		emitBytes(chunk.OP_SET_PROPERTY, name)
+	} else if op, ok := matchIncrement(); ok {
+		emitByte(chunk.OP_DUP)
+		emitBytes(chunk.OP_GET_PROPERTY, name)
+		emitPostfix(op, 1, func() { emitBytes(chunk.OP_SET_PROPERTY, name) })
 	} else {
 		emitBytes(chunk.OP_GET_PROPERTY, name)
 	}
 }
 
+// A list literal pushes each element in order, and OP_BUILD_LIST
+// gathers them off the stack into a single list object.
+func list(canAssign bool) {
+	var itemCount uint8 = 0
+	if !check(scanner.TOKEN_RIGHT_BRACKET) {
+		for {
+			expression()
+			if itemCount == 255 {
+				error("Can't have more than 255 elements in a list literal.")
+			}
+			itemCount++
+			if !match(scanner.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	consume(scanner.TOKEN_RIGHT_BRACKET, "Expect ']' after list elements.")
+	emitBytes(chunk.OP_BUILD_LIST, itemCount)
+}
+
+// A map literal {key: value, ...} pushes each key followed by its
+// value, and OP_BUILD_MAP makes a map of the pairs.  A '{' only starts
+// a map in an expression; at the start of a statement it is a block.
+func mapLiteral(canAssign bool) {
+	var entryCount uint8 = 0
+	if !check(scanner.TOKEN_RIGHT_BRACE) {
+		for {
+			expression()
+			consume(scanner.TOKEN_COLON, "Expect ':' after map key.")
+			expression()
+			if entryCount == 255 {
+				error("Can't have more than 255 entries in a map literal.")
+			}
+			entryCount++
+			if !match(scanner.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after map entries.")
+	emitBytes(chunk.OP_BUILD_MAP, entryCount)
+}
+
+// The subscript operator works like dot(): the receiver is already
+// on the stack, and we compile the index expression after it.
+func subscript(canAssign bool) {
+	expression()
+	consume(scanner.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+
+	if canAssign && match(scanner.TOKEN_EQUAL) {
+		expression()
+		emitByte(chunk.OP_SET_INDEX)
+	} else if op, ok := matchCompoundAssignment(canAssign); ok {
+		emitByte(chunk.OP_DUP2)
+		emitByte(chunk.OP_GET_INDEX)
+		expression()
+		emitByte(op)
+		emitByte(chunk.OP_SET_INDEX)
+	} else if op, ok := matchIncrement(); ok {
+		emitByte(chunk.OP_DUP2)
+		emitByte(chunk.OP_GET_INDEX)
+		emitPostfix(op, 2, func() { emitByte(chunk.OP_SET_INDEX) })
+	} else {
+		emitByte(chunk.OP_GET_INDEX)
+	}
+}
+
 func literal(canAssign bool) {
 	switch parser.previous.Type {
 	case scanner.TOKEN_FALSE:
@@ -351,10 +843,73 @@ func literal(canAssign bool) {
 }
 
 func grouping(canAssign bool) {
+	if isLambda() {
+		lambda()
+		return
+	}
 	expression()
 	consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
 }
 
+// (a, b) => a + b
+//
+// The body of a lambda is either a single expression, whose value is
+// returned, or a block like the body of any other function.
+func lambda() {
+	outer := enterContainer(-1)
+	defer leaveContainer(outer)
+	var compiler Compiler
+	initCompiler(&compiler, TYPE_ANONYMOUS)
+	beginScope() // no need for a matching endScope()
+
+	parameters()
+	consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	consume(scanner.TOKEN_ARROW, "Expect '=>' after parameters.")
+	if match(scanner.TOKEN_LEFT_BRACE) {
+		block()
+	} else {
+		expression()
+		emitByte(chunk.OP_RETURN)
+	}
+
+	endFunction(&compiler)
+}
+
+// Look ahead from just after a '(' to see whether it starts the
+// parameter list of a lambda rather than a parenthesized expression.
+// Parameters may have default values, so skip to the matching ')'
+// and check for the '=>' that only a lambda has after it.
+func isLambda() bool {
+	state := scanner.SaveState()
+	defer scanner.RestoreState(state)
+
+	depth := 1
+	token := parser.current
+	for {
+		switch token.Type {
+		case scanner.TOKEN_LEFT_PAREN:
+			depth++
+		case scanner.TOKEN_RIGHT_PAREN:
+			depth--
+		case scanner.TOKEN_EOF:
+			return false
+		}
+		if depth == 0 {
+			break
+		}
+		token = scanner.ScanToken()
+	}
+	return scanner.ScanToken().Type == scanner.TOKEN_ARROW
+}
+
+// fun (a, b) { ... } used as an expression.
+func funExpression(canAssign bool) {
+	isGenerator := match(scanner.TOKEN_STAR)
+	outer := enterContainer(-1)
+	function(TYPE_ANONYMOUS, isGenerator)
+	leaveContainer(outer)
+}
+
 func expression() {
 	parsePrecedence(PREC_ASSIGNMENT)
 }
@@ -386,30 +941,88 @@ func block() {
 	consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after block.")
 }
 
-func function(type_ FunctionType) {
+func function(type_ FunctionType, isGenerator bool) object.ObjFunction {
 	var compiler Compiler
 	initCompiler(&compiler, type_)
+	current.function.IsGenerator = isGenerator
 	beginScope() // no need for a matching endScope()
 
 	//fun() {}
 	consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	parameters()
+	consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' after function body.")
+	block()
+
+	return endFunction(&compiler)
+}
+
+// (a, b = 1, ...rest)
+//
+// Parameters with default values must come after those without, and
+// a rest parameter, which collects any extra arguments into a list,
+// must come last.
+func parameters() {
+	function := &current.function
+	function.MaxArity = -1
+	hasDefault := false
 	if !check(scanner.TOKEN_RIGHT_PAREN) {
 		for {
-			current.function.Arity++
-			if current.function.Arity > 255 {
+			if function.Arity == 255 {
 				errorAtCurrent("Can't have more than 255 parameters.")
 			}
+			if match(scanner.TOKEN_DOT_DOT_DOT) {
+				constant := parseVariable("Expect rest parameter name.")
+				declaredSymbol(SYMBOL_PARAMETER)
+				defineVariable(constant)
+				if check(scanner.TOKEN_COMMA) {
+					errorAtCurrent("Rest parameter must be last.")
+					// Skip the parameters after it, so that the
+					// rest of the function parses without more
+					// errors.
+					for !check(scanner.TOKEN_RIGHT_PAREN) && !check(scanner.TOKEN_EOF) {
+						advance()
+					}
+				}
+				return
+			}
+			function.Arity++
 			constant := parseVariable("Expect parameter name.")
+			declaredSymbol(SYMBOL_PARAMETER)
+			function.Params = append(function.Params, object.ObjString(lexeme(parser.previous)))
+			if match(scanner.TOKEN_EQUAL) {
+				hasDefault = true
+				defaultValue(uint8(current.localCount - 1))
+			} else if hasDefault {
+				error("Parameter without a default value can't follow one with a default.")
+			} else {
+				function.MinArity++
+			}
 			defineVariable(constant)
 			if !match(scanner.TOKEN_COMMA) {
 				break
 			}
 		}
 	}
-	consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
-	consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' after function body.")
-	block()
+	function.MaxArity = function.Arity
+}
 
+// Compile a default value into the function's prologue.  The VM fills
+// the slots of parameters that were not passed with undefined, which
+// the jump checks for before storing the default in the slot.
+func defaultValue(slot uint8) {
+	emitBytes(chunk.OP_JUMP_IF_PASSED, slot)
+	emitBytes(uint8(0xff), uint8(0xff))
+	jump := len(currentChunk().Code) - 2
+	expression()
+	emitBytes(chunk.OP_SET_LOCAL, slot)
+	emitByte(chunk.OP_POP)
+	patchJump(jump)
+}
+
+// Finish compiling the function of the current compiler, and emit the
+// instruction to create a closure for it in the enclosing function.
+func endFunction(compiler *Compiler) object.ObjFunction {
 	function := endCompiler()
 	obj := object.Obj{Type_: object.OBJ_FUNCTION, Val: function}
 	emitBytes(chunk.OP_CLOSURE, makeConstant(objval.OBJ_VAL(obj)))
@@ -422,14 +1035,18 @@ func function(type_ FunctionType) {
 		}
 		emitByte(compiler.upvalues[i].index)
 	}
+	return function
 }
 
 func method() {
 	consume(scanner.TOKEN_IDENTIFIER, "Expect method name.")
+	symbol := addSymbol(parser.previous, SYMBOL_METHOD)
 	constant := identifierConstant(parser.previous)
 
 	type_ := TYPE_FUNCTION
-	function(type_)
+	outer := enterContainer(symbol)
+	setSignature(symbol, function(type_, false))
+	leaveContainer(outer)
 	emitBytes(chunk.OP_METHOD, constant)
 }
 
@@ -438,26 +1055,34 @@ func classDeclaration() {
 	className := parser.previous
 	nameConstant := identifierConstant(parser.previous)
 	declareVariable()
+	symbol := declaredSymbol(SYMBOL_CLASS)
 
 	emitBytes(chunk.OP_CLASS, nameConstant)
 	defineVariable(nameConstant)
 
 	namedVariable(className, false)
 	consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+	outer := enterContainer(symbol)
 	for {
 		if check(scanner.TOKEN_RIGHT_BRACE) || check(scanner.TOKEN_EOF) {
 			break
 		}
 		method()
 	}
+	leaveContainer(outer)
 	consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
 	emitByte(chunk.OP_POP)
 }
 
+// fun name(a, b) { ... } or fun* name(a, b) { ... } for a generator.
 func funDeclaration() {
+	isGenerator := match(scanner.TOKEN_STAR)
 	global := parseVariable("Expect function name.")
+	symbol := declaredSymbol(SYMBOL_FUNCTION)
 	markInitialized()
-	function(TYPE_FUNCTION)
+	outer := enterContainer(symbol)
+	setSignature(symbol, function(TYPE_FUNCTION, isGenerator))
+	leaveContainer(outer)
 	defineVariable(global)
 }
 
@@ -475,18 +1100,70 @@ func varDeclaration() {
 	defineVariable(global)
 }
 
+// const NAME = expr;
+//
+// A local constant is checked by the compiler, which refuses to
+// compile an assignment to it.  A global constant is checked by the
+// VM, since globals are late bound: OP_DEFINE_CONST records the name
+// in the module's Consts, and OP_SET_GLOBAL refuses to assign to it.
+func constDeclaration() {
+	global := parseVariable("Expect constant name.")
+	declaredSymbol(SYMBOL_CONSTANT)
+	if current.scopeDepth > 0 {
+		current.locals[current.localCount-1].isConst = true
+	}
+
+	consume(scanner.TOKEN_EQUAL, "Expect '=' after constant name.")
+	expression()
+	consume(scanner.TOKEN_SEMICOLON, "Expect ';' after constant declaration.")
+
+	if current.scopeDepth > 0 {
+		markInitialized()
+		return
+	}
+	emitBytes(chunk.OP_DEFINE_CONST, global)
+}
+
 func expressionStatement() {
 	expression()
+	if isEcho() {
+		match(scanner.TOKEN_SEMICOLON)
+		emitByte(chunk.OP_PRINT)
+		return
+	}
 	consume(scanner.TOKEN_SEMICOLON, "Expect ';' after expression.")
 	emitByte(chunk.OP_POP)
 }
 
+// In the REPL, an expression statement at the top level which ends
+// the input prints its value, and can leave out its semicolon.
+func isEcho() bool {
+	if !replMode || current.type_ != TYPE_SCRIPT || current.scopeDepth > 0 {
+		return false
+	}
+	if check(scanner.TOKEN_EOF) {
+		missingSemicolon = true
+		return true
+	}
+	if !check(scanner.TOKEN_SEMICOLON) {
+		return false
+	}
+	state := scanner.SaveState()
+	defer scanner.RestoreState(state)
+	return scanner.ScanToken().Type == scanner.TOKEN_EOF
+}
+
 // As with implementing for loops in jlox/clox, we didn’t need to touch
 // the runtime. It all gets compiled down to primitive control flow
 // operations the VM already supports.
 func forStatement() {
 	beginScope()
 	consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	if isForIn() {
+		forInStatement()
+		endScope()
+		return
+	}
 
 	// Initializer clause
 	if match(scanner.TOKEN_SEMICOLON) {
@@ -540,6 +1217,8 @@ func forStatement() {
 		patchJump(bodyJump)
 	}
 
+	var loop Loop
+	beginLoop(&loop, loopStart)
 	statement()
 	emitLoop(loopStart)
 
@@ -547,10 +1226,140 @@ func forStatement() {
 		patchJump(exitJump)
 		emitByte(chunk.OP_POP) // pop the condition
 	}
+	endLoop()
 
 	endScope()
 }
 
+// Look ahead from just after the '(' of a for loop for the
+// "var name in" or "name in" that starts a for-in loop.  "in" is not
+// a reserved word, so that existing code using it as a name still
+// compiles, and it is recognized only here.
+func isForIn() bool {
+	state := scanner.SaveState()
+	defer scanner.RestoreState(state)
+
+	token := parser.current
+	if token.Type == scanner.TOKEN_VAR {
+		token = scanner.ScanToken()
+	}
+	if token.Type != scanner.TOKEN_IDENTIFIER {
+		return false
+	}
+	return isIn(scanner.ScanToken())
+}
+
+func isIn(token scanner.Token) bool {
+	return token.Type == scanner.TOKEN_IDENTIFIER && lexeme(token) == "in"
+}
+
+// for (var item in items) body
+// for (item in items) body
+//
+// OP_ITERATOR turns the value of the expression into an iterator,
+// which is kept in a hidden local.  Each time round the loop,
+// OP_ITER_NEXT pushes the next item, and OP_JUMP_IF_DONE leaves the
+// loop if there are no more.  Otherwise the item becomes the loop
+// variable, in a scope of its own that ends with the body, so that a
+// closure in the body captures a fresh variable on every iteration.
+// Without var, the item is assigned to the existing variable instead,
+// as for (item = ...; ...) would assign to it.
+func forInStatement() {
+	hasVar := match(scanner.TOKEN_VAR)
+	consume(scanner.TOKEN_IDENTIFIER, "Expect loop variable name.")
+	name := parser.previous
+	var setOp chunk.OpCode
+	var arg uint8
+	if !hasVar {
+		_, setOp, arg = resolveVariable(name)
+		checkAssignable(name, setOp, arg)
+	}
+	advance() // isForIn() has checked that this is 'in'
+	expression()
+	consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after for-in clauses.")
+
+	emitByte(chunk.OP_ITERATOR)
+	addLocal(scanner.Token{Source: parser.previous.Source})
+	markInitialized()
+	iterator := uint8(current.localCount - 1)
+
+	loopStart := currentIP()
+	emitBytes(chunk.OP_ITER_NEXT, iterator)
+	emitBytes(chunk.OP_JUMP_IF_DONE, iterator)
+	emitBytes(uint8(0xff), uint8(0xff))
+	exitJump := len(currentChunk().Code) - 2
+
+	var loop Loop
+	beginLoop(&loop, loopStart)
+	beginScope()
+	if hasVar {
+		addLocal(name)
+		current.locals[current.localCount-1].symbol = addSymbol(name, SYMBOL_VARIABLE)
+		markInitialized()
+	} else {
+		emitBytes(setOp, arg)
+		emitByte(chunk.OP_POP)
+	}
+	statement()
+	endScope()
+	emitLoop(loopStart)
+
+	patchJump(exitJump)
+	endLoop()
+}
+
+// import "path/to/lib.lox";
+// import "lib" as name;
+//
+// OP_IMPORT loads the module at runtime and leaves the module object
+// on the stack, which we then bind to a global variable just like a
+// var declaration does.  Without "as", the variable is named after
+// the file, so both of the above could be used as lib.foo.
+func importStatement() {
+	if current.scopeDepth > 0 {
+		error("Can only import at top level.")
+	}
+	consume(scanner.TOKEN_STRING, "Expect module path after 'import'.")
+	path := stringSegment(parser.previous)
+	pathConstant := makeConstant(objval.STRING_VAL(path))
+
+	var name scanner.Token
+	if check(scanner.TOKEN_IDENTIFIER) && lexeme(parser.current) == "as" {
+		advance()
+		consume(scanner.TOKEN_IDENTIFIER, "Expect module name after 'as'.")
+		name = parser.previous
+	} else {
+		moduleName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if !isIdentifier(moduleName) {
+			error("Module name is not an identifier; use 'import ... as name'.")
+		}
+		name = scanner.Token{Source: &moduleName, Type: scanner.TOKEN_IDENTIFIER,
+			Start: 0, Length: len(moduleName), Line: parser.previous.Line, Column: parser.previous.Column}
+	}
+	consume(scanner.TOKEN_SEMICOLON, "Expect ';' after import.")
+
+	addSymbol(name, SYMBOL_MODULE)
+	emitBytes(chunk.OP_IMPORT, pathConstant)
+	emitBytes(chunk.OP_DEFINE_GLOBAL, identifierConstant(name))
+}
+
+// Report whether s could have been scanned as an identifier.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !unicode.IsLetter(c) && c != '_' && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func lexeme(token scanner.Token) string {
+	return (*token.Source)[token.Start : token.Start+token.Length]
+}
+
 func printStatement() {
 	expression()
 	consume(scanner.TOKEN_SEMICOLON, "Expect ';' after value.")
@@ -563,12 +1372,427 @@ func returnStatement() {
 	}
 
 	if match(scanner.TOKEN_SEMICOLON) {
-		emitReturn()
+		emitByte(chunk.OP_NIL)
 	} else {
+		if current.function.IsGenerator {
+			error("Can't return a value from a generator.")
+		}
 		expression()
 		consume(scanner.TOKEN_SEMICOLON, "Expect ';' after return value.")
-		emitByte(chunk.OP_RETURN)
 	}
+	emitReturnValue()
+}
+
+// yield value
+//
+// OP_YIELD suspends the generator, and the value becomes the result
+// of the call to next() which resumed it.  yield is an expression: when
+// the generator is resumed, the argument of that next() call, or nil,
+// is pushed as its value.  The value may be left out, as in yield; or
+// f(yield), and nil is yielded.
+func yieldExpression(canAssign bool) {
+	if !current.function.IsGenerator {
+		error("Can't yield outside a generator.")
+	}
+
+	if endsExpression(parser.current.Type) {
+		emitByte(chunk.OP_NIL)
+	} else {
+		parsePrecedence(PREC_ASSIGNMENT)
+	}
+	emitByte(chunk.OP_YIELD)
+}
+
+// Return whether a token can only follow an expression, so a yield
+// before it has no value.
+func endsExpression(type_ scanner.TokenType) bool {
+	switch type_ {
+	case scanner.TOKEN_SEMICOLON, scanner.TOKEN_RIGHT_PAREN, scanner.TOKEN_RIGHT_BRACKET,
+		scanner.TOKEN_RIGHT_BRACE, scanner.TOKEN_COMMA, scanner.TOKEN_COLON, scanner.TOKEN_EOF:
+		return true
+	}
+	return false
+}
+
+func throwStatement() {
+	expression()
+	consume(scanner.TOKEN_SEMICOLON, "Expect ';' after thrown value.")
+	emitByte(chunk.OP_THROW)
+}
+
+// try { ... } catch (e) { ... } finally { ... }
+//
+// The try block is covered by an exception handler in the chunk's
+// handler table.  If an instruction in the block throws, the VM cuts
+// the stack back to the locals in scope at the try statement, pushes
+// the thrown value and jumps to the catch block, where the value
+// becomes the local variable e.
+//
+// With a finally clause, a second handler covers the catch block, and
+// the try block's handler goes to the finally block if there is no
+// catch clause.  See Finally for how every way out of the try and
+// catch blocks runs the finally block.
+func tryStatement() {
+	beginScope()
+	var finally *Finally
+	hasFinally := tryHasFinally()
+	if hasFinally {
+		finally = new(Finally)
+		emitByte(chunk.OP_NIL)
+		addLocal(scanner.Token{Source: parser.previous.Source})
+		markInitialized()
+		finally.kindSlot = uint8(current.localCount - 1)
+		emitByte(chunk.OP_NIL)
+		addLocal(scanner.Token{Source: parser.previous.Source})
+		markInitialized()
+		finally.valueSlot = uint8(current.localCount - 1)
+		finally.depth = current.localCount
+		finally.loop = current.loop
+		finally.nextKind = COMPLETION_EXIT
+		finally.enclosing = current.finally
+		current.finally = finally
+	}
+	depth := current.localCount
+
+	consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' after 'try'.")
+	tryStart := currentIP()
+	beginScope()
+	block()
+	endScope()
+	tryHandler := chunk.Handler{Start: tryStart, End: currentIP(), StackDepth: depth}
+	tryEnd := emitJump(chunk.OP_JUMP)
+
+	var catchEnd int = -1
+	var catchHandler chunk.Handler
+	if match(scanner.TOKEN_CATCH) {
+		tryHandler.Target = currentIP()
+		chunk.AddHandler(currentChunk(), tryHandler)
+
+		beginScope()
+		consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'catch'.")
+		consume(scanner.TOKEN_IDENTIFIER, "Expect exception variable name.")
+		declareVariable()
+		markInitialized()
+		consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after exception variable.")
+		consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' before catch body.")
+		catchStart := currentIP()
+		block()
+		catchHandler = chunk.Handler{Start: catchStart, End: currentIP(), StackDepth: depth}
+		endScope()
+		catchEnd = emitJump(chunk.OP_JUMP)
+	} else if !hasFinally {
+		errorAtCurrent("Expect 'catch' or 'finally' after try block.")
+	}
+
+	if hasFinally {
+		current.finally = finally.enclosing
+		consume(scanner.TOKEN_FINALLY, "Expect 'finally'.")
+
+		// An exception thrown in the try block without a catch clause,
+		// or thrown in the catch block, arrives here.
+		throwTarget := currentIP()
+		if catchEnd == (-1) {
+			tryHandler.Target = throwTarget
+			chunk.AddHandler(currentChunk(), tryHandler)
+		} else {
+			catchHandler.Target = throwTarget
+			chunk.AddHandler(currentChunk(), catchHandler)
+		}
+		emitBytes(chunk.OP_SET_LOCAL, finally.valueSlot)
+		emitByte(chunk.OP_POP)
+		emitConstant(objval.NUMBER_VAL(COMPLETION_THROW))
+		emitBytes(chunk.OP_SET_LOCAL, finally.kindSlot)
+		emitByte(chunk.OP_POP)
+		throwJump := emitJump(chunk.OP_JUMP)
+
+		// The try or catch block completed normally.
+		patchJump(tryEnd)
+		if catchEnd != (-1) {
+			patchJump(catchEnd)
+		}
+		emitConstant(objval.NUMBER_VAL(COMPLETION_NORMAL))
+		emitBytes(chunk.OP_SET_LOCAL, finally.kindSlot)
+		emitByte(chunk.OP_POP)
+
+		patchJump(throwJump)
+		for _, jump := range finally.jumps {
+			patchJump(jump)
+		}
+		consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' after 'finally'.")
+		beginScope()
+		block()
+		endScope()
+
+		// Carry on with the completion that led to the finally block.
+		completion(finally, COMPLETION_THROW, func() {
+			emitBytes(chunk.OP_GET_LOCAL, finally.valueSlot)
+			emitByte(chunk.OP_THROW)
+		})
+		if finally.hasReturn {
+			completion(finally, COMPLETION_RETURN, func() {
+				emitBytes(chunk.OP_GET_LOCAL, finally.valueSlot)
+				emitReturnValue()
+			})
+		}
+		for _, exit := range finally.exits {
+			completion(finally, exit.kind, func() {
+				if exit.isBreak {
+					emitBreak(exit.loop)
+				} else {
+					emitContinue(exit.loop)
+				}
+			})
+		}
+	} else {
+		patchJump(tryEnd)
+		if catchEnd != (-1) {
+			patchJump(catchEnd)
+		}
+	}
+	endScope()
+}
+
+// Emit the code to run after a finally block when the completion was
+// of the given kind.
+func completion(finally *Finally, kind int, emitAction func()) {
+	emitBytes(chunk.OP_GET_LOCAL, finally.kindSlot)
+	emitConstant(objval.NUMBER_VAL(float64(kind)))
+	emitByte(chunk.OP_EQUAL)
+	skipJump := emitJump(chunk.OP_JUMP_IF_FALSE)
+	emitByte(chunk.OP_POP)
+	emitAction()
+	patchJump(skipJump)
+	emitByte(chunk.OP_POP)
+}
+
+// Look ahead past the try block, and the catch block if there is one,
+// to see whether the try statement has a finally clause.  We need to
+// know before compiling the try block, because the block's return,
+// break and continue statements are compiled differently.
+func tryHasFinally() bool {
+	state := scanner.SaveState()
+	defer scanner.RestoreState(state)
+
+	token := parser.current
+	for blocks := 0; blocks < 2; blocks++ {
+		if blocks > 0 {
+			// Skip "catch (e)".
+			for token.Type != scanner.TOKEN_LEFT_BRACE {
+				if token.Type == scanner.TOKEN_EOF || token.Type == scanner.TOKEN_ERROR {
+					return false
+				}
+				token = scanner.ScanToken()
+			}
+		}
+		if token.Type != scanner.TOKEN_LEFT_BRACE {
+			return false
+		}
+		depth := 0
+		for {
+			switch token.Type {
+			case scanner.TOKEN_LEFT_BRACE:
+				depth++
+			case scanner.TOKEN_RIGHT_BRACE:
+				depth--
+			case scanner.TOKEN_EOF, scanner.TOKEN_ERROR:
+				return false
+			}
+			if depth == 0 {
+				break
+			}
+			token = scanner.ScanToken()
+		}
+		token = scanner.ScanToken()
+		if token.Type == scanner.TOKEN_FINALLY {
+			return true
+		}
+		if token.Type != scanner.TOKEN_CATCH {
+			return false
+		}
+	}
+	return false
+}
+
+// switch (subject) { case a: ... case b, c: ... default: ... }
+//
+// The subject is evaluated once into a hidden local.  Each case then
+// compares it with its values in turn using OP_EQUAL, jumping to the
+// case body on a match or on to the next case otherwise.  There is no
+// fallthrough: each body ends by jumping past the whole statement.
+// The default case, if any, must come last, so that falling off the
+// end of the chain of tests runs it.
+//
+// If every case value is an integer literal and the values are dense
+// enough, we also emit an OP_JUMP_TABLE before the chain, which jumps
+// straight to the matching body.  The chain is still there to handle
+// a subject which is not in the table.
+func switchStatement() {
+	beginScope()
+	consume(scanner.TOKEN_LEFT_PAREN, "Expect '(' after 'switch'.")
+	expression()
+	consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after switch subject.")
+	addLocal(scanner.Token{Source: parser.previous.Source})
+	markInitialized()
+	subject := uint8(current.localCount - 1)
+	consume(scanner.TOKEN_LEFT_BRACE, "Expect '{' before switch cases.")
+
+	var table *object.ObjList
+	var low int
+	tableStart := 0
+	if values, ok := caseValues(); ok {
+		table, low = newJumpTable(values)
+		if table != nil {
+			emitBytes(chunk.OP_JUMP_TABLE, makeConstant(objval.LIST_VAL(table)))
+			tableStart = currentIP()
+		}
+	}
+
+	var loop Loop
+	beginLoop(&loop, -1)
+	var endJumps []int
+	sawDefault := false
+	for !check(scanner.TOKEN_RIGHT_BRACE) && !check(scanner.TOKEN_EOF) {
+		if match(scanner.TOKEN_CASE) {
+			if sawDefault {
+				error("Can't have a case after the default case.")
+			}
+			var bodyJumps []int
+			var tableSlots []int
+			for {
+				emitBytes(chunk.OP_GET_LOCAL, subject)
+				valueStart := currentIP()
+				expression()
+				if table != nil {
+					// caseValues() has already checked this is a constant.
+					n := objval.AS_NUMBER(currentChunk().Constants.Values[currentChunk().Code[valueStart+1]])
+					tableSlots = append(tableSlots, int(n)-low+1)
+				}
+				emitByte(chunk.OP_EQUAL)
+				nextJump := emitJump(chunk.OP_JUMP_IF_FALSE)
+				emitByte(chunk.OP_POP)
+				bodyJumps = append(bodyJumps, emitJump(chunk.OP_JUMP))
+				patchJump(nextJump)
+				emitByte(chunk.OP_POP)
+				if !match(scanner.TOKEN_COMMA) {
+					break
+				}
+			}
+			consume(scanner.TOKEN_COLON, "Expect ':' after case value.")
+			nextCase := emitJump(chunk.OP_JUMP)
+
+			for _, jump := range bodyJumps {
+				patchJump(jump)
+			}
+			for _, slot := range tableSlots {
+				// The first case with a given value wins.
+				if objval.IS_NIL(table.Items[slot]) {
+					table.Items[slot] = objval.NUMBER_VAL(float64(currentIP() - tableStart))
+				}
+			}
+			caseBody()
+			endJumps = append(endJumps, emitJump(chunk.OP_JUMP))
+			patchJump(nextCase)
+		} else if match(scanner.TOKEN_DEFAULT) {
+			if sawDefault {
+				error("Can't have more than one default case.")
+			}
+			sawDefault = true
+			consume(scanner.TOKEN_COLON, "Expect ':' after 'default'.")
+			caseBody()
+		} else {
+			errorAtCurrent("Expect 'case' or 'default'.")
+			break
+		}
+	}
+	for _, jump := range endJumps {
+		patchJump(jump)
+	}
+	consume(scanner.TOKEN_RIGHT_BRACE, "Expect '}' after switch cases.")
+	endLoop()
+	endScope()
+}
+
+// The statements of a case run in their own scope.
+func caseBody() {
+	beginScope()
+	for !check(scanner.TOKEN_CASE) && !check(scanner.TOKEN_DEFAULT) &&
+		!check(scanner.TOKEN_RIGHT_BRACE) && !check(scanner.TOKEN_EOF) {
+		declaration()
+	}
+	endScope()
+}
+
+// Look ahead through the cases of a switch statement, starting from
+// the current token, and return their values if every one of them is
+// an integer literal.  The scanner is put back where it was afterwards,
+// so the cases are then compiled as usual.
+func caseValues() ([]int, bool) {
+	state := scanner.SaveState()
+	defer scanner.RestoreState(state)
+
+	var values []int
+	depth := 0
+	token := parser.current
+	for token.Type != scanner.TOKEN_EOF && token.Type != scanner.TOKEN_ERROR {
+		switch token.Type {
+		case scanner.TOKEN_LEFT_BRACE:
+			depth++
+		case scanner.TOKEN_RIGHT_BRACE:
+			if depth == 0 {
+				return values, true
+			}
+			depth--
+		case scanner.TOKEN_CASE:
+			if depth > 0 {
+				break // a nested switch
+			}
+			for {
+				token = scanner.ScanToken()
+				if token.Type != scanner.TOKEN_NUMBER {
+					return nil, false
+				}
+				n, err := strconv.ParseFloat(lexeme(token), 64)
+				if err != nil || n != float64(int(n)) {
+					return nil, false
+				}
+				values = append(values, int(n))
+				token = scanner.ScanToken()
+				if token.Type != scanner.TOKEN_COMMA {
+					break
+				}
+			}
+			if token.Type != scanner.TOKEN_COLON {
+				return nil, false
+			}
+		}
+		token = scanner.ScanToken()
+	}
+	return nil, false
+}
+
+// Return an empty jump table for the case values, and the lowest
+// value, if a table is worthwhile.  It is when there are a few values
+// and they fill at least half of the range between the lowest and
+// highest values.
+func newJumpTable(values []int) (*object.ObjList, int) {
+	distinct := make(map[int]bool)
+	for _, v := range values {
+		distinct[v] = true
+	}
+	if len(distinct) < 3 {
+		return nil, 0
+	}
+	low, high := slices.Min(values), slices.Max(values)
+	size := high - low + 1
+	if size > 2*len(distinct) || size > common.UINT8_COUNT {
+		return nil, 0
+	}
+	items := make([]value.Value, size+1)
+	items[0] = objval.NUMBER_VAL(float64(low))
+	for i := 1; i <= size; i++ {
+		items[i] = objval.NIL_VAL()
+	}
+	return object.NewList(items), low
 }
 
 func whileStatement() {
@@ -579,11 +1803,14 @@ func whileStatement() {
 
 	exitJump := emitJump(chunk.OP_JUMP_IF_FALSE)
 	emitByte(chunk.OP_POP)
+	var loop Loop
+	beginLoop(&loop, loopStart)
 	statement()
 	emitLoop(loopStart)
 
 	patchJump(exitJump)
 	emitByte(chunk.OP_POP)
+	endLoop()
 }
 
 func synchronize() {
@@ -596,6 +1823,8 @@ func synchronize() {
 		switch parser.current.Type {
 		case scanner.TOKEN_CLASS:
 			return
+		case scanner.TOKEN_CONST:
+			return
 		case scanner.TOKEN_FUN:
 			return
 		case scanner.TOKEN_VAR:
@@ -610,6 +1839,16 @@ func synchronize() {
 			return
 		case scanner.TOKEN_RETURN:
 			return
+		case scanner.TOKEN_IMPORT:
+			return
+		case scanner.TOKEN_SWITCH:
+			return
+		case scanner.TOKEN_TRY:
+			return
+		case scanner.TOKEN_THROW:
+			return
+		case scanner.TOKEN_YIELD:
+			return
 		default:
 		}
 		advance()
@@ -623,6 +1862,8 @@ func declaration() {
 		funDeclaration()
 	} else if match(scanner.TOKEN_VAR) {
 		varDeclaration()
+	} else if match(scanner.TOKEN_CONST) {
+		constDeclaration()
 	} else {
 		statement()
 	}
@@ -634,6 +1875,18 @@ func declaration() {
 func statement() {
 	if match(scanner.TOKEN_PRINT) {
 		printStatement()
+	} else if match(scanner.TOKEN_IMPORT) {
+		importStatement()
+	} else if match(scanner.TOKEN_SWITCH) {
+		switchStatement()
+	} else if match(scanner.TOKEN_TRY) {
+		tryStatement()
+	} else if match(scanner.TOKEN_THROW) {
+		throwStatement()
+	} else if match(scanner.TOKEN_BREAK) {
+		breakStatement()
+	} else if match(scanner.TOKEN_CONTINUE) {
+		continueStatement()
 	} else if match(scanner.TOKEN_FOR) {
 		forStatement()
 	} else if match(scanner.TOKEN_IF) {
@@ -673,13 +1926,75 @@ func or_(canAssign bool) {
 	patchJump(endJump) // this jump is to go to the right operand expression
 }
 
+// cond ? a : b
+//
+// The else branch is parsed at the conditional operator's own
+// precedence, so that a ? b : c ? d : e groups as a ? b : (c ? d : e).
+func conditional(canAssign bool) {
+	thenJump := emitJump(chunk.OP_JUMP_IF_FALSE)
+	emitByte(chunk.OP_POP)
+	expression()
+	elseJump := emitJump(chunk.OP_JUMP)
+
+	patchJump(thenJump)
+	emitByte(chunk.OP_POP)
+	consume(scanner.TOKEN_COLON, "Expect ':' after then branch of conditional expression.")
+	parsePrecedence(PREC_CONDITIONAL)
+	patchJump(elseJump)
+}
+
 func str(canAssign bool) {
 	// Create a string object, wrap it in a Value, and stuff
 	// the value into the constant table.
-	emitConstant(objval.OBJ_VAL(object.CopyString(parser.previous.Source, parser.previous.Start+1, parser.previous.Length-2)))
+	emitConstant(objval.STRING_VAL(stringSegment(parser.previous)))
 }
 
-func namedVariable(token scanner.Token, canAssign bool) {
+// Return the text of a string token with its delimiters removed and
+// its escape sequences translated.  A string token starts with either
+// the opening quote or the '}' closing an interpolation, and ends with
+// either the closing quote or the "${" opening an interpolation.
+func stringSegment(token scanner.Token) string {
+	end := token.Start + token.Length - 1
+	if token.Type == scanner.TOKEN_INTERPOLATION {
+		end--
+	}
+	s, ok := scanner.Unescape((*token.Source)[token.Start+1 : end])
+	if !ok {
+		error("Invalid escape sequence in string.")
+	}
+	return s
+}
+
+// A string with interpolations is compiled as a chain of
+// concatenations.  "a${x}b${y}c" becomes the equivalent of
+// "a" + toString(x) + "b" + toString(y) + "c", where OP_TO_STRING
+// converts the value of each interpolated expression.
+func interpolation(canAssign bool) {
+	emitConstant(objval.STRING_VAL(stringSegment(parser.previous)))
+	for {
+		expression()
+		emitByte(chunk.OP_TO_STRING)
+		emitByte(chunk.OP_ADD)
+
+		if !match(scanner.TOKEN_INTERPOLATION) {
+			consume(scanner.TOKEN_STRING, "Expect end of string interpolation.")
+			if parser.previous.Type != scanner.TOKEN_STRING {
+				return
+			}
+		}
+		if segment := stringSegment(parser.previous); segment != "" {
+			emitConstant(objval.STRING_VAL(segment))
+			emitByte(chunk.OP_ADD)
+		}
+		if parser.previous.Type != scanner.TOKEN_INTERPOLATION {
+			break
+		}
+	}
+}
+
+// Return the instructions and operand to read and write the variable.
+func resolveVariable(token scanner.Token) (chunk.OpCode, chunk.OpCode, uint8) {
+	addReference(token)
 	var getOp, setOp chunk.OpCode
 	var arg int = resolveLocal(current, &token)
 	if arg != (-1) {
@@ -693,12 +2008,43 @@ func namedVariable(token scanner.Token, canAssign bool) {
 		getOp = chunk.OP_GET_GLOBAL
 		setOp = chunk.OP_SET_GLOBAL
 	}
+	return getOp, setOp, uint8(arg)
+}
+
+// Report an error if the variable resolved to setOp and arg is a
+// local or captured constant.
+func checkAssignable(token scanner.Token, setOp chunk.OpCode, arg uint8) {
+	isConst := false
+	switch setOp {
+	case chunk.OP_SET_LOCAL:
+		isConst = current.locals[arg].isConst
+	case chunk.OP_SET_UPVALUE:
+		isConst = current.upvalues[arg].isConst
+	}
+	if isConst {
+		error(fmt.Sprintf("Can't assign to constant '%s'.", lexeme(token)))
+	}
+}
+
+func namedVariable(token scanner.Token, canAssign bool) {
+	getOp, setOp, arg := resolveVariable(token)
 
 	if canAssign && match(scanner.TOKEN_EQUAL) {
+		checkAssignable(token, setOp, arg)
 		expression()
-		emitBytes(setOp, uint8(arg))
+		emitBytes(setOp, arg)
+	} else if op, ok := matchCompoundAssignment(canAssign); ok {
+		checkAssignable(token, setOp, arg)
+		emitBytes(getOp, arg)
+		expression()
+		emitByte(op)
+		emitBytes(setOp, arg)
+	} else if op, ok := matchIncrement(); ok {
+		checkAssignable(token, setOp, arg)
+		emitBytes(getOp, arg)
+		emitPostfix(op, 0, func() { emitBytes(setOp, arg) })
 	} else {
-		emitBytes(getOp, uint8(arg))
+		emitBytes(getOp, arg)
 	}
 }
 
@@ -718,6 +2064,8 @@ func unary(canAssign bool) {
 		emitByte(chunk.OP_NOT)
 	case scanner.TOKEN_MINUS:
 		emitByte(chunk.OP_NEGATE)
+	case scanner.TOKEN_TILDE:
+		emitByte(chunk.OP_BIT_NOT)
 	default: // Unreachable
 		return
 	}
@@ -745,6 +2093,9 @@ func parsePrecedence(precedence Precedence) {
 	if canAssign && match(scanner.TOKEN_EQUAL) {
 		error("Invalid assignment target.")
 	}
+	if _, ok := matchCompoundAssignment(canAssign); ok {
+		error("Invalid assignment target.")
+	}
 }
 
 // The token is the name of the identifier.
@@ -804,7 +2155,7 @@ func resolveLocal(compiler *Compiler, name *scanner.Token) int {
 // This function adds a new upvalue to that array. The index field tracks the
 // closed-over local variable’s slot index. That way the compiler knows which
 // variable in the enclosing function needs to be captured.
-func addUpValue(compiler *Compiler, index uint8, isLocal bool) int {
+func addUpValue(compiler *Compiler, index uint8, isLocal bool, name string) int {
 	upvalueCount := compiler.function.UpvalueCount
 
 	for i := range upvalueCount {
@@ -820,6 +2171,7 @@ func addUpValue(compiler *Compiler, index uint8, isLocal bool) int {
 
 	compiler.upvalues[upvalueCount].isLocal = isLocal
 	compiler.upvalues[upvalueCount].index = index
+	compiler.function.Chun.UpvalueNames = append(compiler.function.Chun.UpvalueNames, name)
 	compiler.function.UpvalueCount++
 	return upvalueCount
 }
@@ -836,12 +2188,16 @@ func resolveUpvalue(compiler *Compiler, name *scanner.Token) int {
 	local := resolveLocal(compiler.enclosing, name)
 	if local != -1 {
 		compiler.enclosing.locals[local].isCaptured = true
-		return addUpValue(compiler, uint8(local), true)
+		index := addUpValue(compiler, uint8(local), true, lexeme(*name))
+		compiler.upvalues[index].isConst = compiler.enclosing.locals[local].isConst
+		return index
 	}
 
 	upvalue := resolveUpvalue(compiler.enclosing, name)
 	if upvalue != -1 {
-		return addUpValue(compiler, uint8(upvalue), false)
+		index := addUpValue(compiler, uint8(upvalue), false, lexeme(*name))
+		compiler.upvalues[index].isConst = compiler.enclosing.upvalues[upvalue].isConst
+		return index
 	}
 
 	return -1
@@ -861,11 +2217,20 @@ func addLocal(name scanner.Token) {
 	local.name = name
 	local.depth = current.scopeDepth
 	local.isCaptured = false
+	local.isConst = false
+	local.debug = -1
+	local.symbol = -1
 }
 
 // The function declareVariable() is where the compiler records
 // the existence of the variable.
 func declareVariable() {
+	// Analyze() records globals as well as locals.
+	symbol := addSymbol(parser.previous, SYMBOL_VARIABLE)
+	if analysis != nil {
+		analysis.declared = symbol
+	}
+
 	// We only do this for locals, so if we’re in the top-level global scope,
 	// we just bail out. Because global variables are late bound, the compiler
 	// doesn’t keep track of which declarations for them it has seen.
@@ -900,6 +2265,7 @@ func declareVariable() {
 	}
 
 	addLocal(*name)
+	current.locals[current.localCount-1].symbol = symbol
 }
 
 func parseVariable(errorMessage string) uint8 {
@@ -925,7 +2291,14 @@ func markInitialized() {
 		// because the function is bound to a global variable.
 		return
 	}
-	current.locals[current.localCount-1].depth = current.scopeDepth
+	local := &current.locals[current.localCount-1]
+	local.depth = current.scopeDepth
+
+	// Its scope for the debugger starts here, once it has a value.
+	// Hidden locals have no name and are left out.
+	if local.debug == -1 && local.name.Length > 0 {
+		local.debug = chunk.AddLocal(currentChunk(), lexeme(local.name), current.localCount-1)
+	}
 }
 
 func defineVariable(global uint8) {
@@ -946,10 +2319,21 @@ func defineVariable(global uint8) {
 	emitBytes(chunk.OP_DEFINE_GLOBAL, global)
 }
 
-func argumentList() uint8 {
+// Compile the arguments of a call and return their count, along with
+// the names of the named arguments, which must come after all the
+// positional ones.
+func argumentList() (uint8, []value.Value) {
 	var argCount uint8 = 0
+	var names []value.Value
 	if !check(scanner.TOKEN_RIGHT_PAREN) {
 		for {
+			if isNamedArgument() {
+				advance()
+				names = append(names, objval.OBJ_VAL(object.CopyString(parser.previous.Source, parser.previous.Start, parser.previous.Length)))
+				advance()
+			} else if len(names) > 0 {
+				errorAtCurrent("Positional argument can't follow a named argument.")
+			}
 			expression()
 			if argCount == 255 {
 				error("Can't have more than 255 arguments.")
@@ -961,7 +2345,17 @@ func argumentList() uint8 {
 		}
 	}
 	consume(scanner.TOKEN_RIGHT_PAREN, "Expect ')' after arguments")
-	return argCount
+	return argCount, names
+}
+
+// Look ahead for 'name:' at the start of an argument.
+func isNamedArgument() bool {
+	if !check(scanner.TOKEN_IDENTIFIER) {
+		return false
+	}
+	state := scanner.SaveState()
+	defer scanner.RestoreState(state)
+	return scanner.ScanToken().Type == scanner.TOKEN_COLON
 }
 
 // At the point this is called, the left-hand side expression
@@ -988,49 +2382,108 @@ func getRule(tokenType scanner.TokenType) ParseRule {
 // ParseRule { prefix, infix, precedence }
 func initParseRules() {
 	rules = []ParseRule{
-		scanner.TOKEN_LEFT_PAREN:    {grouping, call, PREC_CALL},
-		scanner.TOKEN_RIGHT_PAREN:   {nil, nil, PREC_NONE},
-		scanner.TOKEN_LEFT_BRACE:    {nil, nil, PREC_NONE},
-		scanner.TOKEN_RIGHT_BRACE:   {nil, nil, PREC_NONE},
-		scanner.TOKEN_COMMA:         {nil, nil, PREC_NONE},
-		scanner.TOKEN_DOT:           {nil, dot, PREC_CALL},
-		scanner.TOKEN_MINUS:         {unary, binary, PREC_TERM},
-		scanner.TOKEN_PLUS:          {nil, binary, PREC_TERM},
-		scanner.TOKEN_SEMICOLON:     {nil, nil, PREC_NONE},
-		scanner.TOKEN_SLASH:         {nil, binary, PREC_FACTOR},
-		scanner.TOKEN_STAR:          {nil, binary, PREC_FACTOR},
-		scanner.TOKEN_BANG:          {unary, nil, PREC_NONE},
-		scanner.TOKEN_BANG_EQUAL:    {nil, binary, PREC_EQUALITY},
-		scanner.TOKEN_EQUAL:         {nil, nil, PREC_NONE},
-		scanner.TOKEN_EQUAL_EQUAL:   {nil, binary, PREC_EQUALITY},
-		scanner.TOKEN_GREATER:       {nil, binary, PREC_COMPARISON},
-		scanner.TOKEN_GREATER_EQUAL: {nil, binary, PREC_COMPARISON},
-		scanner.TOKEN_LESS:          {nil, binary, PREC_COMPARISON},
-		scanner.TOKEN_LESS_EQUAL:    {nil, binary, PREC_COMPARISON},
-		scanner.TOKEN_IDENTIFIER:    {variable, nil, PREC_NONE},
-		scanner.TOKEN_STRING:        {str, nil, PREC_NONE},
-		scanner.TOKEN_NUMBER:        {number, nil, PREC_NONE},
-		scanner.TOKEN_AND:           {nil, and_, PREC_AND},
-		scanner.TOKEN_CLASS:         {nil, nil, PREC_NONE},
-		scanner.TOKEN_ELSE:          {nil, nil, PREC_NONE},
-		scanner.TOKEN_FALSE:         {literal, nil, PREC_NONE},
-		scanner.TOKEN_FOR:           {nil, nil, PREC_NONE},
-		scanner.TOKEN_FUN:           {nil, nil, PREC_NONE},
-		scanner.TOKEN_IF:            {nil, nil, PREC_NONE},
-		scanner.TOKEN_NIL:           {literal, nil, PREC_NONE},
-		scanner.TOKEN_OR:            {nil, or_, PREC_OR},
-		scanner.TOKEN_PRINT:         {nil, nil, PREC_NONE},
-		scanner.TOKEN_RETURN:        {nil, nil, PREC_NONE},
-		scanner.TOKEN_SUPER:         {nil, nil, PREC_NONE},
-		scanner.TOKEN_THIS:          {nil, nil, PREC_NONE},
-		scanner.TOKEN_TRUE:          {literal, nil, PREC_NONE},
-		scanner.TOKEN_VAR:           {nil, nil, PREC_NONE},
-		scanner.TOKEN_WHILE:         {nil, nil, PREC_NONE},
-		scanner.TOKEN_ERROR:         {nil, nil, PREC_NONE},
-		scanner.TOKEN_EOF:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_LEFT_PAREN:      {grouping, call, PREC_CALL},
+		scanner.TOKEN_RIGHT_PAREN:     {nil, nil, PREC_NONE},
+		scanner.TOKEN_LEFT_BRACE:      {mapLiteral, nil, PREC_NONE},
+		scanner.TOKEN_RIGHT_BRACE:     {nil, nil, PREC_NONE},
+		scanner.TOKEN_LEFT_BRACKET:    {list, subscript, PREC_CALL},
+		scanner.TOKEN_RIGHT_BRACKET:   {nil, nil, PREC_NONE},
+		scanner.TOKEN_COMMA:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_DOT:             {nil, dot, PREC_CALL},
+		scanner.TOKEN_MINUS:           {unary, binary, PREC_TERM},
+		scanner.TOKEN_PLUS:            {nil, binary, PREC_TERM},
+		scanner.TOKEN_SEMICOLON:       {nil, nil, PREC_NONE},
+		scanner.TOKEN_COLON:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_QUESTION:        {nil, conditional, PREC_CONDITIONAL},
+		scanner.TOKEN_SLASH:           {nil, binary, PREC_FACTOR},
+		scanner.TOKEN_PERCENT:         {nil, binary, PREC_FACTOR},
+		scanner.TOKEN_AMPERSAND:       {nil, binary, PREC_BIT_AND},
+		scanner.TOKEN_PIPE:            {nil, binary, PREC_BIT_OR},
+		scanner.TOKEN_CARET:           {nil, binary, PREC_BIT_XOR},
+		scanner.TOKEN_STAR:            {nil, binary, PREC_FACTOR},
+		scanner.TOKEN_BANG:            {unary, nil, PREC_NONE},
+		scanner.TOKEN_BANG_EQUAL:      {nil, binary, PREC_EQUALITY},
+		scanner.TOKEN_EQUAL:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_EQUAL_EQUAL:     {nil, binary, PREC_EQUALITY},
+		scanner.TOKEN_ARROW:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_GREATER:         {nil, binary, PREC_COMPARISON},
+		scanner.TOKEN_GREATER_EQUAL:   {nil, binary, PREC_COMPARISON},
+		scanner.TOKEN_GREATER_GREATER: {nil, binary, PREC_SHIFT},
+		scanner.TOKEN_LESS:            {nil, binary, PREC_COMPARISON},
+		scanner.TOKEN_LESS_EQUAL:      {nil, binary, PREC_COMPARISON},
+		scanner.TOKEN_LESS_LESS:       {nil, binary, PREC_SHIFT},
+		scanner.TOKEN_MINUS_EQUAL:     {nil, nil, PREC_NONE},
+		scanner.TOKEN_MINUS_MINUS:     {prefixIncrement, nil, PREC_NONE},
+		scanner.TOKEN_PERCENT_EQUAL:   {nil, nil, PREC_NONE},
+		scanner.TOKEN_PLUS_EQUAL:      {nil, nil, PREC_NONE},
+		scanner.TOKEN_PLUS_PLUS:       {prefixIncrement, nil, PREC_NONE},
+		scanner.TOKEN_SLASH_EQUAL:     {nil, nil, PREC_NONE},
+		scanner.TOKEN_STAR_EQUAL:      {nil, nil, PREC_NONE},
+		scanner.TOKEN_TILDE:           {unary, nil, PREC_NONE},
+		scanner.TOKEN_TILDE_SLASH:     {nil, binary, PREC_FACTOR},
+		scanner.TOKEN_IDENTIFIER:      {variable, nil, PREC_NONE},
+		scanner.TOKEN_STRING:          {str, nil, PREC_NONE},
+		scanner.TOKEN_INTERPOLATION:   {interpolation, nil, PREC_NONE},
+		scanner.TOKEN_NUMBER:          {number, nil, PREC_NONE},
+		scanner.TOKEN_AND:             {nil, and_, PREC_AND},
+		scanner.TOKEN_BREAK:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_CASE:            {nil, nil, PREC_NONE},
+		scanner.TOKEN_CATCH:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_CLASS:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_CONST:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_CONTINUE:        {nil, nil, PREC_NONE},
+		scanner.TOKEN_DEFAULT:         {nil, nil, PREC_NONE},
+		scanner.TOKEN_ELSE:            {nil, nil, PREC_NONE},
+		scanner.TOKEN_FALSE:           {literal, nil, PREC_NONE},
+		scanner.TOKEN_FINALLY:         {nil, nil, PREC_NONE},
+		scanner.TOKEN_FOR:             {nil, nil, PREC_NONE},
+		scanner.TOKEN_FUN:             {funExpression, nil, PREC_NONE},
+		scanner.TOKEN_IF:              {nil, nil, PREC_NONE},
+		scanner.TOKEN_IMPORT:          {nil, nil, PREC_NONE},
+		scanner.TOKEN_NIL:             {literal, nil, PREC_NONE},
+		scanner.TOKEN_OR:              {nil, or_, PREC_OR},
+		scanner.TOKEN_PRINT:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_RETURN:          {nil, nil, PREC_NONE},
+		scanner.TOKEN_SUPER:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_SWITCH:          {nil, nil, PREC_NONE},
+		scanner.TOKEN_THIS:            {nil, nil, PREC_NONE},
+		scanner.TOKEN_THROW:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_TRUE:            {literal, nil, PREC_NONE},
+		scanner.TOKEN_TRY:             {nil, nil, PREC_NONE},
+		scanner.TOKEN_VAR:             {nil, nil, PREC_NONE},
+		scanner.TOKEN_WHILE:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_YIELD:           {yieldExpression, nil, PREC_NONE},
+		scanner.TOKEN_COMMENT:         {nil, nil, PREC_NONE},
+		scanner.TOKEN_ERROR:           {nil, nil, PREC_NONE},
+		scanner.TOKEN_EOF:             {nil, nil, PREC_NONE},
 	}
 }
 
+// Set while compiling an expression for the debugger, which is not
+// part of the program, so that DEBUG_PRINT_CODE leaves it out as it
+// does the code compiled by Analyze().
+var expressionMode bool
+
+// Set while compiling input to the REPL.
+var replMode bool
+var replSource *string
+var missingSemicolon bool // the input ends with an expression and no ';'
+
+// Compile a line of input to the REPL.  The source is returned too,
+// for the REPL to save as part of a script, with the semicolon added
+// back if the input compiles and ends with an expression without one.
+func CompileRepl(source *string) (object.ObjFunction, string) {
+	replMode = true
+	replSource = source
+	missingSemicolon = false
+	defer func() { replMode = false }()
+	function := Compile(source)
+	if function.Arity != -1 && missingSemicolon {
+		return function, *source + ";"
+	}
+	return function, *source
+}
+
 func Compile(source *string) object.ObjFunction {
 	scanner.InitScanner(source)
 	var compiler Compiler
@@ -1052,3 +2505,38 @@ func Compile(source *string) object.ObjFunction {
 		return function
 	}
 }
+
+// Compile an expression for the debugger to evaluate where a program
+// is stopped.  The expression becomes the body of a function whose
+// parameters are the names of the variables visible there, so that
+// the debugger can call it with their values.
+func CompileExpression(source *string, names []string) object.ObjFunction {
+	expressionMode = true
+	defer func() { expressionMode = false }()
+	scanner.InitScanner(source)
+	var compiler Compiler
+	initCompiler(&compiler, TYPE_SCRIPT)
+
+	parser.hadError = false
+	parser.panicMode = false
+
+	initParseRules()
+	beginScope()
+	for _, name := range names {
+		addLocal(scanner.Token{Source: &name, Length: len(name)})
+		markInitialized()
+	}
+	current.function.Arity = len(names)
+	current.function.MinArity = len(names)
+	current.function.MaxArity = len(names)
+
+	advance()
+	expression()
+	consume(scanner.TOKEN_EOF, "Expect end of expression.")
+	emitByte(chunk.OP_RETURN)
+	function := endCompiler()
+	if parser.hadError {
+		return object.ObjFunction{Arity: -1}
+	}
+	return function
+}
@@ -0,0 +1,475 @@
+// Package dap is a Debug Adapter Protocol server for glox, so that
+// editors such as VS Code can debug Lox scripts.  It drives the VM's
+// debug hook, and speaks the protocol over a pair of streams, which
+// glox dap connects to stdin and stdout.
+//
+// The program runs in a goroutine of its own.  Whenever it stops, the
+// debug hook sends a stopped event and then carries out the requests
+// which look at the program, such as stackTrace and evaluate, handed
+// to it by the goroutine reading requests, until one of them resumes
+// the program.  All access to the VM is therefore on the program's
+// goroutine, apart from setting breakpoints, which the VM allows from
+// any goroutine.
+//
+// While the program runs, what it writes to stdout and stderr is
+// captured and sent to the client as output events.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/davidfung/glox/framing"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/vm"
+)
+
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type response struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+// The program's only thread, for the requests which ask for one.
+const threadID = 1
+
+// Variables references for the scopes of a frame.  Each frame has
+// three, starting from 1 + 3 * its number.
+const (
+	scopeLocals = iota
+	scopeUpvalues
+	scopeGlobals
+	scopeCount
+)
+
+// Work for the program's goroutine while it is stopped.  fn returns
+// whether the program should resume.
+type task struct {
+	fn   func() bool
+	done chan struct{}
+}
+
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	mu      sync.Mutex // guards out, seq and stopped
+	seq     int
+	stopped bool
+
+	program     string
+	stopOnEntry bool
+	work        chan task
+	killed      bool // set by disconnect to end the stopped program
+}
+
+// Used to unwind the program's goroutine when the client disconnects.
+type disconnect struct{}
+
+// Serve DAP requests from in, writing responses and events to out,
+// until the client disconnects or in ends.
+func Serve(in io.Reader, out io.Writer) error {
+	s := &Server{in: bufio.NewReader(in), out: out, work: make(chan task)}
+	for {
+		req, err := s.readRequest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.handle(req) {
+			return nil
+		}
+	}
+}
+
+// Read a request, whose JSON content comes framed as framing.Read()
+// expects.
+func (s *Server) readRequest() (*request, error) {
+	data, err := framing.Read(s.in)
+	if err != nil {
+		return nil, err
+	}
+	req := new(request)
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *Server) send(message any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	switch m := message.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+	framing.Write(s.out, data)
+}
+
+func (s *Server) respond(req *request, body any) {
+	s.send(&response{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (s *Server) fail(req *request, message string) {
+	s.send(&response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: message})
+}
+
+func (s *Server) event(name string, body any) {
+	s.send(&event{Type: "event", Event: name, Body: body})
+}
+
+func (s *Server) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// Run fn on the program's goroutine, which must be stopped, and wait
+// for it.
+func (s *Server) onProgram(fn func() bool) {
+	t := task{fn: fn, done: make(chan struct{})}
+	s.work <- t
+	<-t.done
+}
+
+// Handle a request, and return false once the client has gone.
+func (s *Server) handle(req *request) bool {
+	switch req.Command {
+	case "initialize":
+		s.respond(req, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+			"supportTerminateDebuggee":         true,
+		})
+		s.event("initialized", nil)
+	case "launch":
+		var args struct {
+			Program     string `json:"program"`
+			StopOnEntry bool   `json:"stopOnEntry"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil || args.Program == "" {
+			s.fail(req, "launch needs the program to debug.")
+			break
+		}
+		s.program = args.Program
+		s.stopOnEntry = args.StopOnEntry
+		vm.SetDebugHook(s.stop)
+		s.respond(req, nil)
+	case "setBreakpoints":
+		s.setBreakpoints(req)
+	case "setFunctionBreakpoints":
+		s.setFunctionBreakpoints(req)
+	case "setExceptionBreakpoints":
+		s.respond(req, map[string]any{"breakpoints": []any{}})
+	case "configurationDone":
+		if s.program == "" {
+			s.fail(req, "No program has been launched.")
+			break
+		}
+		s.respond(req, nil)
+		go s.run()
+	case "threads":
+		s.respond(req, map[string]any{"threads": []any{map[string]any{"id": threadID, "name": "main"}}})
+	case "continue", "next", "stepIn", "stepOut":
+		if !s.isStopped() {
+			s.fail(req, "The program is not stopped.")
+			break
+		}
+		s.onProgram(func() bool {
+			switch req.Command {
+			case "continue":
+				vm.Continue()
+				s.respond(req, map[string]any{"allThreadsContinued": true})
+				return true
+			case "next":
+				vm.StepOver()
+			case "stepIn":
+				vm.StepInto()
+			case "stepOut":
+				vm.StepOut()
+			}
+			s.respond(req, nil)
+			return true
+		})
+	case "stackTrace", "scopes", "variables", "evaluate":
+		if !s.isStopped() {
+			s.fail(req, "The program is not stopped.")
+			break
+		}
+		s.onProgram(func() bool {
+			s.inspect(req)
+			return false
+		})
+	case "disconnect", "terminate":
+		// A program which is running rather than stopped can't be
+		// ended, and is left to finish.
+		if s.isStopped() {
+			s.onProgram(func() bool {
+				s.killed = true
+				return true
+			})
+		}
+		s.respond(req, nil)
+		return req.Command != "disconnect"
+	default:
+		s.fail(req, fmt.Sprintf("Unsupported request '%s'.", req.Command))
+	}
+	return true
+}
+
+func (s *Server) setBreakpoints(req *request) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		s.fail(req, err.Error())
+		return
+	}
+	var lines []int
+	var breakpoints []any
+	for _, bp := range args.Breakpoints {
+		lines = append(lines, bp.Line)
+		breakpoints = append(breakpoints, map[string]any{"verified": true, "line": bp.Line})
+	}
+	vm.SetBreakpoints(args.Source.Path, lines)
+	s.respond(req, map[string]any{"breakpoints": breakpoints})
+}
+
+func (s *Server) setFunctionBreakpoints(req *request) {
+	var args struct {
+		Breakpoints []struct {
+			Name string `json:"name"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		s.fail(req, err.Error())
+		return
+	}
+	var names []string
+	var breakpoints []any
+	for _, bp := range args.Breakpoints {
+		names = append(names, bp.Name)
+		breakpoints = append(breakpoints, map[string]any{"verified": true})
+	}
+	vm.SetFunctionBreakpoints(names)
+	s.respond(req, map[string]any{"breakpoints": breakpoints})
+}
+
+// Run the program, with its output sent to the client, and tell the
+// client when it has finished.
+func (s *Server) run() {
+	stdout, stderr := os.Stdout, os.Stderr
+	var outputs sync.WaitGroup
+	os.Stdout = s.capture("stdout", &outputs)
+	os.Stderr = s.capture("stderr", &outputs)
+
+	exitCode := 0
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(disconnect); !ok {
+					panic(r)
+				}
+				exitCode = 1
+			}
+		}()
+		data, err := os.ReadFile(s.program)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+			return
+		}
+		source := string(data)
+		result := vm.InterpretFile(&source, s.program)
+		for result == vm.INTERPRET_OK && vm.Scheduled() > 0 {
+			result = vm.Tick()
+		}
+		switch result {
+		case vm.INTERPRET_COMPILE_ERROR:
+			exitCode = 65
+		case vm.INTERPRET_RUNTIME_ERROR:
+			exitCode = 70
+		}
+	}()
+
+	os.Stdout.Close()
+	os.Stderr.Close()
+	os.Stdout, os.Stderr = stdout, stderr
+	outputs.Wait()
+	s.event("exited", map[string]any{"exitCode": exitCode})
+	s.event("terminated", nil)
+}
+
+// Return a file whose writes are sent to the client as output events
+// in the category.
+func (s *Server) capture(category string, outputs *sync.WaitGroup) *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	outputs.Add(1)
+	go func() {
+		defer outputs.Done()
+		defer r.Close()
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				s.event("output", map[string]any{"category": category, "output": string(buf[:n])})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// The debug hook.  Tell the client the program has stopped, and carry
+// out requests until one of them resumes it.
+func (s *Server) stop(reason vm.StopReason) {
+	if reason == vm.STOP_ENTRY && !s.stopOnEntry {
+		vm.Continue()
+		return
+	}
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	names := map[vm.StopReason]string{
+		vm.STOP_ENTRY:      "entry",
+		vm.STOP_BREAKPOINT: "breakpoint",
+		vm.STOP_STEP:       "step",
+	}
+	s.event("stopped", map[string]any{"reason": names[reason], "threadId": threadID, "allThreadsStopped": true})
+	for {
+		t := <-s.work
+		resume := t.fn()
+		if resume {
+			s.mu.Lock()
+			s.stopped = false
+			s.mu.Unlock()
+		}
+		close(t.done)
+		if resume {
+			break
+		}
+	}
+	if s.killed {
+		panic(disconnect{})
+	}
+}
+
+// Answer a request which looks at the stopped program.
+func (s *Server) inspect(req *request) {
+	var args struct {
+		FrameID            int    `json:"frameId"`
+		VariablesReference int    `json:"variablesReference"`
+		Expression         string `json:"expression"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		s.fail(req, err.Error())
+		return
+	}
+	frames := vm.StackFrames()
+
+	switch req.Command {
+	case "stackTrace":
+		var stackFrames []any
+		for i, frame := range frames {
+			stackFrames = append(stackFrames, map[string]any{
+				"id":     i,
+				"name":   frame.Function,
+				"line":   frame.Line,
+				"column": 1,
+				"source": map[string]any{"name": filepath.Base(frame.Path), "path": frame.Path},
+			})
+		}
+		s.respond(req, map[string]any{"stackFrames": stackFrames, "totalFrames": len(frames)})
+	case "scopes":
+		if args.FrameID < 0 || args.FrameID >= len(frames) {
+			s.fail(req, "No such frame.")
+			return
+		}
+		ref := 1 + scopeCount*args.FrameID
+		s.respond(req, map[string]any{"scopes": []any{
+			map[string]any{"name": "Locals", "variablesReference": ref + scopeLocals, "expensive": false},
+			map[string]any{"name": "Upvalues", "variablesReference": ref + scopeUpvalues, "expensive": false},
+			map[string]any{"name": "Globals", "variablesReference": ref + scopeGlobals, "expensive": false},
+		}})
+	case "variables":
+		frame, scope := (args.VariablesReference-1)/scopeCount, (args.VariablesReference-1)%scopeCount
+		if args.VariablesReference < 1 || frame >= len(frames) {
+			s.fail(req, "No such variables.")
+			return
+		}
+		var variables []vm.Variable
+		switch scope {
+		case scopeLocals:
+			variables = vm.Locals(frame)
+		case scopeUpvalues:
+			variables = vm.Upvalues(frame)
+		case scopeGlobals:
+			variables = vm.FrameGlobals(frame)
+		}
+		list := []any{}
+		for _, variable := range variables {
+			list = append(list, map[string]any{
+				"name":               variable.Name,
+				"value":              objval.ValueToString(variable.Value),
+				"variablesReference": 0,
+			})
+		}
+		s.respond(req, map[string]any{"variables": list})
+	case "evaluate":
+		if args.FrameID < 0 || args.FrameID >= len(frames) {
+			s.fail(req, "No such frame.")
+			return
+		}
+		val, err := vm.Evaluate(args.FrameID, args.Expression)
+		if err != nil {
+			s.fail(req, err.Error())
+			return
+		}
+		s.respond(req, map[string]any{"result": objval.ValueToString(val), "variablesReference": 0})
+	}
+}
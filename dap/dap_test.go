@@ -0,0 +1,215 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidfung/glox/framing"
+	"github.com/davidfung/glox/vm"
+)
+
+// A scripted DAP client talking to a server over pipes.
+type client struct {
+	t      *testing.T
+	w      io.Writer
+	r      *bufio.Reader
+	seq    int
+	output strings.Builder
+}
+
+type message struct {
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (c *client) send(command string, arguments any) int {
+	c.seq++
+	data, _ := json.Marshal(map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": arguments})
+	framing.Write(c.w, data)
+	return c.seq
+}
+
+func (c *client) read() message {
+	c.t.Helper()
+	data, err := framing.Read(c.r)
+	if err != nil {
+		c.t.Fatalf("reading message: %v", err)
+	}
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		c.t.Fatalf("bad message %s: %v", data, err)
+	}
+	return m
+}
+
+// Read messages up to the response to request seq, and decode its
+// body into body.
+func (c *client) response(seq int, body any) message {
+	c.t.Helper()
+	for {
+		m := c.read()
+		c.record(m)
+		if m.Type == "response" && m.RequestSeq == seq {
+			if body != nil {
+				json.Unmarshal(m.Body, body)
+			}
+			return m
+		}
+	}
+}
+
+// Make a request which must succeed.
+func (c *client) request(command string, arguments any, body any) {
+	c.t.Helper()
+	if m := c.response(c.send(command, arguments), body); !m.Success {
+		c.t.Fatalf("%s failed: %s", command, m.Message)
+	}
+}
+
+// Read messages up to the named event, and return its body.
+func (c *client) waitFor(event string) json.RawMessage {
+	c.t.Helper()
+	for {
+		m := c.read()
+		c.record(m)
+		if m.Type == "event" && m.Event == event {
+			return m.Body
+		}
+	}
+}
+
+func (c *client) record(m message) {
+	if m.Type == "event" && m.Event == "output" {
+		var body struct{ Output string }
+		json.Unmarshal(m.Body, &body)
+		c.output.WriteString(body.Output)
+	}
+}
+
+// Wait for the program to stop, and return the reason and the line of
+// the top frame.
+func (c *client) stopped() (string, int) {
+	c.t.Helper()
+	var event struct{ Reason string }
+	json.Unmarshal(c.waitFor("stopped"), &event)
+	var trace struct {
+		StackFrames []struct {
+			Name string
+			Line int
+		}
+	}
+	c.request("stackTrace", map[string]any{"threadId": 1}, &trace)
+	return event.Reason, trace.StackFrames[0].Line
+}
+
+func TestServer(t *testing.T) {
+	vm.InitVM()
+	defer vm.FreeVM()
+	program := filepath.Join(t.TempDir(), "program.lox")
+	os.WriteFile(program, []byte(`var x = 1;
+fun add(a, b) {
+  var sum = a + b;
+  return sum;
+}
+var y = add(x, 2);
+print y;
+print "done";
+`), 0644)
+
+	requests, toServer := io.Pipe()
+	fromServer, responses := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- Serve(requests, responses)
+		responses.Close()
+	}()
+	c := &client{t: t, w: toServer, r: bufio.NewReader(fromServer)}
+
+	c.request("initialize", map[string]any{"adapterID": "glox"}, nil)
+	c.waitFor("initialized")
+	c.request("launch", map[string]any{"program": program}, nil)
+	var bps struct{ Breakpoints []struct{ Verified bool } }
+	c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": program},
+		"breakpoints": []any{map[string]any{"line": 6}},
+	}, &bps)
+	if len(bps.Breakpoints) != 1 || !bps.Breakpoints[0].Verified {
+		t.Errorf("setBreakpoints: %v", bps)
+	}
+	c.request("configurationDone", nil, nil)
+
+	if reason, line := c.stopped(); reason != "breakpoint" || line != 6 {
+		t.Errorf("stopped for %s at line %d, want breakpoint at line 6", reason, line)
+	}
+	c.request("stepIn", map[string]any{"threadId": 1}, nil)
+	if reason, line := c.stopped(); reason != "step" || line != 3 {
+		t.Errorf("stopped for %s at line %d, want step at line 3", reason, line)
+	}
+
+	var scopes struct {
+		Scopes []struct {
+			Name               string
+			VariablesReference int
+		}
+	}
+	c.request("scopes", map[string]any{"frameId": 0}, &scopes)
+	if len(scopes.Scopes) != 3 || scopes.Scopes[0].Name != "Locals" {
+		t.Fatalf("scopes: %v", scopes)
+	}
+	var variables struct {
+		Variables []struct{ Name, Value string }
+	}
+	c.request("variables", map[string]any{"variablesReference": scopes.Scopes[0].VariablesReference}, &variables)
+	if got := fmt.Sprint(variables.Variables); got != "[{a 1} {b 2}]" {
+		t.Errorf("locals: %s", got)
+	}
+	var result struct{ Result string }
+	c.request("evaluate", map[string]any{"expression": "a * 10 + b", "frameId": 0}, &result)
+	if result.Result != "12" {
+		t.Errorf("evaluate: %q", result.Result)
+	}
+	if m := c.response(c.send("evaluate", map[string]any{"expression": "nope", "frameId": 0}), nil); m.Success || m.Message != "Undefined variable 'nope'." {
+		t.Errorf("evaluate of an undefined variable: %v, %q", m.Success, m.Message)
+	}
+
+	c.request("next", map[string]any{"threadId": 1}, nil)
+	if reason, line := c.stopped(); reason != "step" || line != 4 {
+		t.Errorf("stopped for %s at line %d, want step at line 4", reason, line)
+	}
+	c.request("stepOut", map[string]any{"threadId": 1}, nil)
+	if _, line := c.stopped(); line != 7 {
+		t.Errorf("stepOut stopped at line %d, want line 7", line)
+	}
+	c.request("continue", map[string]any{"threadId": 1}, nil)
+	var exited struct{ ExitCode int }
+	json.Unmarshal(c.waitFor("exited"), &exited)
+	c.waitFor("terminated")
+	if exited.ExitCode != 0 {
+		t.Errorf("exit code %d", exited.ExitCode)
+	}
+	if !strings.Contains(c.output.String(), "3\ndone\n") {
+		t.Errorf("output: %q", c.output.String())
+	}
+
+	c.request("disconnect", nil, nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() did not return after disconnect")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/davidfung/glox/lineedit"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/vm"
+)
+
+const debugHelp = `break <line>       stop at a line of the script (b)
+break <file:line>  stop at a line of a module
+break <fn>         stop on entering any function named fn
+delete <bp>        remove a breakpoint given as for break
+info breakpoints   list the breakpoints
+continue           run until a breakpoint (c)
+next               run to the next line, stepping over calls (n)
+step               run to the next line, stepping into calls (s)
+finish             run until the current function returns (o)
+backtrace          show the call stack (bt)
+up, down           select the caller or callee of the selected frame
+frame <n>          select frame n of the backtrace
+list               show the source around the selected frame (l)
+locals             show the locals of the selected frame
+upvalues           show the variables the selected frame's closure captured
+globals            show the globals
+print <expr>       evaluate an expression in the selected frame (p)
+watch <expr>       evaluate an expression at every stop
+unwatch <n>        remove watch expression n
+quit               end the program (q)
+
+An empty line repeats the last command.`
+
+// The state of `glox debug`, which drives the VM's debug hook from the
+// terminal.
+type debugSession struct {
+	editor    *lineedit.Editor
+	path      string              // the script being debugged
+	sources   map[string][]string // lines of the files shown so far
+	functions []string            // function breakpoints
+	watches   []string
+	frame     int // the frame selected for inspection
+	last      string
+}
+
+func debugFile(path string) {
+	source := readFile(path)
+	d := &debugSession{
+		editor:  lineedit.New(""),
+		path:    path,
+		sources: make(map[string][]string),
+	}
+	vm.SetDebugHook(d.stopped)
+	fmt.Println("Type help for the debugger's commands.")
+	result := vm.InterpretFile(&source, path)
+	if result == vm.INTERPRET_OK {
+		result = runScheduled()
+	}
+	fmt.Println("The program has finished.")
+	if result == vm.INTERPRET_COMPILE_ERROR {
+		os.Exit(65)
+	}
+	if result == vm.INTERPRET_RUNTIME_ERROR {
+		os.Exit(70)
+	}
+}
+
+// The debug hook.  Read commands until one of them resumes the
+// program.
+func (d *debugSession) stopped(reason vm.StopReason) {
+	d.frame = 0
+	if reason == vm.STOP_BREAKPOINT {
+		fmt.Print("Breakpoint, ")
+	}
+	d.showFrame()
+	for i, watch := range d.watches {
+		fmt.Printf("%d: %s = %s\n", i+1, watch, d.evaluate(watch))
+	}
+
+	for {
+		line, err := d.editor.ReadLine("(debug) ")
+		if err == lineedit.ErrInterrupt {
+			continue
+		}
+		if err == io.EOF {
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if strings.TrimSpace(line) == "" {
+			line = d.last
+		} else {
+			d.editor.AddHistory(line)
+			d.last = line
+		}
+		if d.command(line) {
+			return
+		}
+	}
+}
+
+// Carry out a command, and return whether it resumed the program.
+func (d *debugSession) command(line string) bool {
+	name, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "":
+	case "c", "continue":
+		vm.Continue()
+		return true
+	case "n", "next":
+		vm.StepOver()
+		return true
+	case "s", "step":
+		vm.StepInto()
+		return true
+	case "o", "finish":
+		vm.StepOut()
+		return true
+	case "b", "break":
+		d.breakpoint(arg, true)
+	case "d", "delete":
+		d.breakpoint(arg, false)
+	case "info":
+		d.listBreakpoints()
+	case "bt", "backtrace":
+		for i, frame := range vm.StackFrames() {
+			marker := " "
+			if i == d.frame {
+				marker = "*"
+			}
+			fmt.Printf("%s#%d %s at %s:%d\n", marker, i, frame.Function, d.displayPath(frame.Path), frame.Line)
+		}
+	case "up":
+		d.selectFrame(d.frame + 1)
+	case "down":
+		d.selectFrame(d.frame - 1)
+	case "frame":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Usage: frame <n>")
+			break
+		}
+		d.selectFrame(n)
+	case "l", "list":
+		d.list()
+	case "locals":
+		printVariables(vm.Locals(d.frame))
+	case "upvalues":
+		printVariables(vm.Upvalues(d.frame))
+	case "globals":
+		printVariables(vm.FrameGlobals(d.frame))
+	case "p", "print":
+		fmt.Println(d.evaluate(arg))
+	case "watch":
+		if arg == "" {
+			fmt.Fprintln(os.Stderr, "Usage: watch <expr>")
+			break
+		}
+		d.watches = append(d.watches, arg)
+		fmt.Printf("%d: %s = %s\n", len(d.watches), arg, d.evaluate(arg))
+	case "unwatch":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(d.watches) {
+			fmt.Fprintln(os.Stderr, "No such watch expression.")
+			break
+		}
+		d.watches = slices.Delete(d.watches, n-1, n)
+	case "help":
+		fmt.Println(debugHelp)
+	case "q", "quit":
+		os.Exit(0)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'.  Type help for help.\n", name)
+	}
+	return false
+}
+
+// Add or delete a breakpoint on a line of the script, on a line of
+// another file given as file:line, or on a function.
+func (d *debugSession) breakpoint(arg string, add bool) {
+	if arg == "" {
+		fmt.Fprintln(os.Stderr, "Usage: break <line> | <file:line> | <fn>")
+		return
+	}
+	path, lineText := d.path, arg
+	if i := strings.LastIndex(arg, ":"); i != -1 {
+		path, lineText = arg[:i], arg[i+1:]
+	}
+	line, err := strconv.Atoi(lineText)
+	if err != nil {
+		// A function name.
+		if add && !slices.Contains(d.functions, arg) {
+			d.functions = append(d.functions, arg)
+		} else if !add {
+			d.functions = slices.DeleteFunc(d.functions, func(name string) bool { return name == arg })
+		}
+		vm.SetFunctionBreakpoints(d.functions)
+		return
+	}
+	lines := vm.Breakpoints(path)
+	if add && !slices.Contains(lines, line) {
+		lines = append(lines, line)
+	} else if !add {
+		lines = slices.DeleteFunc(lines, func(l int) bool { return l == line })
+	}
+	vm.SetBreakpoints(path, lines)
+}
+
+func (d *debugSession) listBreakpoints() {
+	for _, line := range vm.Breakpoints(d.path) {
+		fmt.Printf("%s:%d\n", d.displayPath(d.path), line)
+	}
+	for _, name := range d.functions {
+		fmt.Printf("%s()\n", name)
+	}
+}
+
+func (d *debugSession) selectFrame(n int) {
+	if n < 0 || n >= len(vm.StackFrames()) {
+		fmt.Fprintln(os.Stderr, "No such frame.")
+		return
+	}
+	d.frame = n
+	d.showFrame()
+}
+
+// Show where the selected frame is, and the line of source there.
+func (d *debugSession) showFrame() {
+	frame := vm.StackFrames()[d.frame]
+	fmt.Printf("%s at %s:%d\n", frame.Function, d.displayPath(frame.Path), frame.Line)
+	if lines := d.source(frame.Path); frame.Line <= len(lines) {
+		fmt.Printf("%4d  %s\n", frame.Line, lines[frame.Line-1])
+	}
+}
+
+// Show the lines around the selected frame's line.
+func (d *debugSession) list() {
+	frame := vm.StackFrames()[d.frame]
+	lines := d.source(frame.Path)
+	for n := max(1, frame.Line-5); n <= min(len(lines), frame.Line+5); n++ {
+		marker := " "
+		if n == frame.Line {
+			marker = ">"
+		}
+		fmt.Printf("%s%4d  %s\n", marker, n, lines[n-1])
+	}
+}
+
+func (d *debugSession) source(path string) []string {
+	if lines, ok := d.sources[path]; ok {
+		return lines
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(string(data), "\n")
+	d.sources[path] = lines
+	return lines
+}
+
+// Paths are shown relative to the working directory where they can be.
+func (d *debugSession) displayPath(path string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return path
+}
+
+func (d *debugSession) evaluate(expr string) string {
+	if expr == "" {
+		return "Usage: print <expr>"
+	}
+	val, err := vm.Evaluate(d.frame, expr)
+	if err != nil {
+		return err.Error()
+	}
+	return objval.ValueToString(val)
+}
+
+func printVariables(variables []vm.Variable) {
+	for _, variable := range variables {
+		fmt.Printf("%s = %s\n", variable.Name, objval.ValueToString(variable.Value))
+	}
+}
@@ -15,6 +15,9 @@ func DisassembleChunk(chun *chunk.Chunk, name string) {
 	for offset := 0; offset < len(chun.Code); {
 		offset = DisassembleInstruction(chun, offset)
 	}
+	for _, handler := range chun.Handlers {
+		fmt.Printf("handler %04d-%04d -> %04d depth %d\n", handler.Start, handler.End, handler.Target, handler.StackDepth)
+	}
 }
 
 func constantInstruction(name string, chun *chunk.Chunk, offset int) int {
@@ -45,6 +48,12 @@ func DisassembleInstruction(chun *chunk.Chunk, offset int) int {
 		return simpleInstruction("OP_FALSE", offset)
 	case chunk.OP_POP:
 		return simpleInstruction("OP_POP", offset)
+	case chunk.OP_DUP:
+		return simpleInstruction("OP_DUP", offset)
+	case chunk.OP_DUP2:
+		return simpleInstruction("OP_DUP2", offset)
+	case chunk.OP_BURY:
+		return byteInstruction("OP_BURY", chun, offset)
 	case chunk.OP_GET_LOCAL:
 		return byteInstruction("OP_GET_LOCAL", chun, offset)
 	case chunk.OP_SET_LOCAL:
@@ -53,6 +62,8 @@ func DisassembleInstruction(chun *chunk.Chunk, offset int) int {
 		return constantInstruction("OP_GET_GLOBAL", chun, offset)
 	case chunk.OP_DEFINE_GLOBAL:
 		return constantInstruction("OP_DEFINE_GLOBAL", chun, offset)
+	case chunk.OP_DEFINE_CONST:
+		return constantInstruction("OP_DEFINE_CONST", chun, offset)
 	case chunk.OP_SET_GLOBAL:
 		return constantInstruction("OP_SET_GLOBAL", chun, offset)
 	case chunk.OP_GET_UPVALUE:
@@ -63,12 +74,26 @@ func DisassembleInstruction(chun *chunk.Chunk, offset int) int {
 		return constantInstruction("OP_GET_PROPERTY", chun, offset)
 	case chunk.OP_SET_PROPERTY:
 		return constantInstruction("OP_SET_PROPERTY", chun, offset)
+	case chunk.OP_BUILD_LIST:
+		return byteInstruction("OP_BUILD_LIST", chun, offset)
+	case chunk.OP_BUILD_MAP:
+		return byteInstruction("OP_BUILD_MAP", chun, offset)
+	case chunk.OP_GET_INDEX:
+		return simpleInstruction("OP_GET_INDEX", offset)
+	case chunk.OP_SET_INDEX:
+		return simpleInstruction("OP_SET_INDEX", offset)
 	case chunk.OP_EQUAL:
 		return simpleInstruction("OP_EQUAL", offset)
+	case chunk.OP_NOT_EQUAL:
+		return simpleInstruction("OP_NOT_EQUAL", offset)
 	case chunk.OP_GREATER:
 		return simpleInstruction("OP_GREATER", offset)
+	case chunk.OP_GREATER_EQUAL:
+		return simpleInstruction("OP_GREATER_EQUAL", offset)
 	case chunk.OP_LESS:
 		return simpleInstruction("OP_LESS", offset)
+	case chunk.OP_LESS_EQUAL:
+		return simpleInstruction("OP_LESS_EQUAL", offset)
 	case chunk.OP_ADD:
 		return simpleInstruction("OP_ADD", offset)
 	case chunk.OP_SUBTRACT:
@@ -77,10 +102,28 @@ func DisassembleInstruction(chun *chunk.Chunk, offset int) int {
 		return simpleInstruction("OP_MULTIPLY", offset)
 	case chunk.OP_DIVIDE:
 		return simpleInstruction("OP_DIVIDE", offset)
+	case chunk.OP_MODULO:
+		return simpleInstruction("OP_MODULO", offset)
+	case chunk.OP_INT_DIVIDE:
+		return simpleInstruction("OP_INT_DIVIDE", offset)
+	case chunk.OP_BIT_AND:
+		return simpleInstruction("OP_BIT_AND", offset)
+	case chunk.OP_BIT_OR:
+		return simpleInstruction("OP_BIT_OR", offset)
+	case chunk.OP_BIT_XOR:
+		return simpleInstruction("OP_BIT_XOR", offset)
+	case chunk.OP_BIT_NOT:
+		return simpleInstruction("OP_BIT_NOT", offset)
+	case chunk.OP_SHIFT_LEFT:
+		return simpleInstruction("OP_SHIFT_LEFT", offset)
+	case chunk.OP_SHIFT_RIGHT:
+		return simpleInstruction("OP_SHIFT_RIGHT", offset)
 	case chunk.OP_NOT:
 		return simpleInstruction("OP_NOT", offset)
 	case chunk.OP_NEGATE:
 		return simpleInstruction("OP_NEGATE", offset)
+	case chunk.OP_TO_STRING:
+		return simpleInstruction("OP_TO_STRING", offset)
 	case chunk.OP_PRINT:
 		return simpleInstruction("OP_PRINT", offset)
 	case chunk.OP_JUMP:
@@ -89,8 +132,20 @@ func DisassembleInstruction(chun *chunk.Chunk, offset int) int {
 		return jumpInstruction("OP_JUMP_IF_FALSE", 1, chun, offset)
 	case chunk.OP_LOOP:
 		return jumpInstruction("OP_LOOP", -1, chun, offset)
+	case chunk.OP_JUMP_TABLE:
+		return jumpTableInstruction("OP_JUMP_TABLE", chun, offset)
+	case chunk.OP_JUMP_IF_PASSED:
+		return slotJumpInstruction("OP_JUMP_IF_PASSED", chun, offset)
+	case chunk.OP_ITERATOR:
+		return simpleInstruction("OP_ITERATOR", offset)
+	case chunk.OP_ITER_NEXT:
+		return byteInstruction("OP_ITER_NEXT", chun, offset)
+	case chunk.OP_JUMP_IF_DONE:
+		return slotJumpInstruction("OP_JUMP_IF_DONE", chun, offset)
 	case chunk.OP_CALL:
 		return byteInstruction("OP_CALL", chun, offset)
+	case chunk.OP_CALL_NAMED:
+		return callNamedInstruction("OP_CALL_NAMED", chun, offset)
 	case chunk.OP_CLOSURE:
 		offset++
 		constant := chun.Code[offset]
@@ -119,10 +174,16 @@ func DisassembleInstruction(chun *chunk.Chunk, offset int) int {
 		return simpleInstruction("OP_CLOSE_UPVALUE", offset)
 	case chunk.OP_RETURN:
 		return simpleInstruction("OP_RETURN", offset)
+	case chunk.OP_YIELD:
+		return simpleInstruction("OP_YIELD", offset)
+	case chunk.OP_THROW:
+		return simpleInstruction("OP_THROW", offset)
 	case chunk.OP_CLASS:
 		return constantInstruction("OP_CLASS", chun, offset)
 	case chunk.OP_METHOD:
 		return constantInstruction("OP_METHOD", chun, offset)
+	case chunk.OP_IMPORT:
+		return constantInstruction("OP_IMPORT", chun, offset)
 	default:
 		fmt.Printf("unknown opcode %d\n", instruction)
 		return offset + 1
@@ -140,6 +201,42 @@ func byteInstruction(name string, chun *chunk.Chunk, offset int) int {
 	return offset + 2
 }
 
+// The jump table is a list constant.  Its first item is the smallest
+// case value, followed by the jump offset for each consecutive value,
+// or nil where there is no case for the value.
+func jumpTableInstruction(name string, chun *chunk.Chunk, offset int) int {
+	constant := chun.Code[offset+1]
+	fmt.Printf("%-16s %4d\n", name, constant)
+	items := objval.AS_LIST(chun.Constants.Values[constant]).Items
+	low := int(objval.AS_NUMBER(items[0]))
+	for i, target := range items[1:] {
+		if objval.IS_NUMBER(target) {
+			fmt.Printf("%04d      |                     %d -> %d\n", offset, low+i, offset+2+int(objval.AS_NUMBER(target)))
+		}
+	}
+	return offset + 2
+}
+
+// The operands are a local's slot and the jump offset.
+func slotJumpInstruction(name string, chun *chunk.Chunk, offset int) int {
+	slot := chun.Code[offset+1]
+	var jump uint16 = uint16(chun.Code[offset+2]) << 8
+	jump |= uint16(chun.Code[offset+3])
+	fmt.Printf("%-16s %4d %4d -> %d\n", name, slot, offset, offset+4+int(jump))
+	return offset + 4
+}
+
+// The operands are the argument count and a list constant holding the
+// names of the named arguments, which come last.
+func callNamedInstruction(name string, chun *chunk.Chunk, offset int) int {
+	argCount := chun.Code[offset+1]
+	constant := chun.Code[offset+2]
+	fmt.Printf("%-16s %4d %4d ", name, argCount, constant)
+	objval.PrintValue(chun.Constants.Values[constant])
+	fmt.Println()
+	return offset + 3
+}
+
 func jumpInstruction(name string, sign int, chun *chunk.Chunk, offset int) int {
 	var jump uint16 = uint16(chun.Code[offset+1]) << 8
 	jump |= uint16(chun.Code[offset+2])
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/davidfung/glox/ast"
+)
+
+// glox fmt [-w] [-check] files...
+//
+// Print each file in the canonical layout of ast.Print().  With -w the
+// files are rewritten instead, and with -check the names of the files
+// which are not already formatted are listed and the exit status is 1
+// if there are any, so that CI can insist on formatted code.  A file
+// with syntax errors is reported and left alone, and the exit status
+// is then 65 as for a script which does not compile.
+func formatFiles(args []string) int {
+	write, check := false, false
+	var paths []string
+	for _, arg := range args {
+		switch arg {
+		case "-w":
+			write = true
+		case "-check":
+			check = true
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: glox fmt [-w] [-check] path...")
+		return 64
+	}
+
+	status := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 66
+			continue
+		}
+		source := string(data)
+		file, err := ast.Parse(source)
+		if err != nil {
+			for _, e := range err.(ast.ErrorList) {
+				fmt.Fprintf(os.Stderr, "%s:%d:%d: Error%s: %s\n", path, e.Pos.Line, e.Pos.Column, e.Where, e.Message)
+			}
+			status = 65
+			continue
+		}
+		formatted := ast.Print(file)
+		if check && formatted != source {
+			fmt.Println(path)
+			if status == 0 {
+				status = 1
+			}
+		}
+		if write {
+			if formatted != source {
+				if err := os.WriteFile(path, []byte(formatted), 0644); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					status = 74
+				}
+			}
+		} else if !check {
+			fmt.Print(formatted)
+		}
+	}
+	return status
+}
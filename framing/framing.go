@@ -0,0 +1,58 @@
+// Package framing reads and writes messages in the base protocol
+// shared by the Language Server Protocol and the Debug Adapter
+// Protocol, which is JSON content after a header giving its length
+// and a blank line:
+//
+//	Content-Length: 42\r\n
+//	\r\n
+//	{"seq":1,"type":"request","command":"next"}
+//
+// The servers in the lsp and dap packages, and the clients in their
+// tests, use it for the framing and only deal with the content.
+package framing
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Read a message from r and return its content.  Header fields other
+// than Content-Length are skipped.  The error is io.EOF if r ends
+// before the message starts.
+func Read(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("framing: bad Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("framing: message without Content-Length")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Write a message with content to w.
+func Write(w io.Writer, content []byte) error {
+	_, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	return err
+}
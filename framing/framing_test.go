@@ -0,0 +1,50 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	for _, content := range []string{`{"a":1}`, `{}`, `{"text":"two\r\nlines"}`} {
+		if err := Write(&buf, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&buf)
+	for _, want := range []string{`{"a":1}`, `{}`, `{"text":"two\r\nlines"}`} {
+		got, err := Read(r)
+		if err != nil || string(got) != want {
+			t.Errorf("Read() = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := Read(r); err != io.EOF {
+		t.Errorf("Read() at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		input, want, err string
+	}{
+		{"Content-Type: application/json\r\nContent-Length: 2\r\n\r\n{}", "{}", ""},
+		{"Content-Length:2\n\n{}", "{}", ""},
+		{"Content-Type: application/json\r\n\r\n{}", "", "framing: message without Content-Length"},
+		{"Content-Length: two\r\n\r\n{}", "", `framing: bad Content-Length " two"`},
+		{"Content-Length: 5\r\n\r\n{}", "", "unexpected EOF"},
+	}
+	for _, test := range tests {
+		got, err := Read(bufio.NewReader(strings.NewReader(test.input)))
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if string(got) != test.want || msg != test.err {
+			t.Errorf("Read(%q) = %q, %q, want %q, %q", test.input, got, msg, test.want, test.err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Package lineedit reads lines from a terminal with simple editing
+// and a history, for the REPL.  The terminal is put into raw mode
+// only while a line is being read, so the output of the code run in
+// between goes through the terminal as usual.  When the input is not
+// a terminal, or raw mode is not supported on this platform, lines
+// are read as they are.
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// The most lines kept in the history file.
+const HISTORY_MAX = 1000
+
+// Returned by ReadLine() when the user types ctrl-c.
+var ErrInterrupt = errors.New("interrupt")
+
+type Editor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int  // file descriptor of the terminal
+	terminal bool // whether to edit lines, or just read them
+
+	history     []string
+	historyPath string // where the history is kept, if anywhere
+}
+
+// Return an editor reading from stdin, with the history kept in the
+// file at historyPath.  An empty path keeps the history in memory.
+func New(historyPath string) *Editor {
+	fd := int(os.Stdin.Fd())
+	e := newEditor(os.Stdin, os.Stdout, isTerminal(fd))
+	e.fd = fd
+	e.historyPath = historyPath
+	e.loadHistory()
+	return e
+}
+
+func newEditor(in io.Reader, out io.Writer, terminal bool) *Editor {
+	return &Editor{in: bufio.NewReader(in), out: out, fd: -1, terminal: terminal}
+}
+
+// Show the prompt and read a line, without its newline.  Return
+// io.EOF when the input ends, or ctrl-d is typed on an empty line.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	if !e.terminal {
+		return e.readPlainLine()
+	}
+	if e.fd >= 0 {
+		restore, err := makeRaw(e.fd)
+		if err != nil {
+			return e.readPlainLine()
+		}
+		defer restore()
+	}
+	return e.editLine(prompt)
+}
+
+func (e *Editor) readPlainLine() (string, error) {
+	line, err := e.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// The line being edited, and the cursor's position in it.
+type lineState struct {
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+func (e *Editor) editLine(prompt string) (string, error) {
+	line := lineState{prompt: prompt}
+	// Where we are in the history, and the line being typed before
+	// moving into it.
+	index := len(e.history)
+	saved := ""
+
+	recall := func(i int) {
+		if index == len(e.history) {
+			saved = string(line.buf)
+		}
+		if i == len(e.history) {
+			line.buf = []rune(saved)
+		} else {
+			line.buf = []rune(e.history[i])
+		}
+		line.pos = len(line.buf)
+		index = i
+	}
+	previous := func() {
+		if index > 0 {
+			recall(index - 1)
+		}
+	}
+	next := func() {
+		if index < len(e.history) {
+			recall(index + 1)
+		}
+	}
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(line.buf) > 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return string(line.buf), nil
+			}
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line.buf), nil
+		case 3: // ctrl-c
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", ErrInterrupt
+		case 4: // ctrl-d
+			if len(line.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			line.delete()
+		case 127, 8: // backspace, ctrl-h
+			if line.pos > 0 {
+				line.pos--
+				line.delete()
+			}
+		case 1: // ctrl-a
+			line.pos = 0
+		case 5: // ctrl-e
+			line.pos = len(line.buf)
+		case 2: // ctrl-b
+			line.left()
+		case 6: // ctrl-f
+			line.right()
+		case 11: // ctrl-k
+			line.buf = line.buf[:line.pos]
+		case 21: // ctrl-u
+			line.buf = line.buf[line.pos:]
+			line.pos = 0
+		case 16: // ctrl-p
+			previous()
+		case 14: // ctrl-n
+			next()
+		case 27: // escape sequence
+			switch e.readEscape() {
+			case "[A", "OA": // up
+				previous()
+			case "[B", "OB": // down
+				next()
+			case "[C", "OC": // right
+				line.right()
+			case "[D", "OD": // left
+				line.left()
+			case "[H", "OH", "[1~", "[7~": // home
+				line.pos = 0
+			case "[F", "OF", "[4~", "[8~": // end
+				line.pos = len(line.buf)
+			case "[3~": // delete
+				line.delete()
+			}
+		default:
+			if unicode.IsPrint(r) || r == '\t' {
+				line.insert(r)
+			}
+		}
+		e.refresh(&line)
+	}
+}
+
+// Read the rest of an escape sequence after the ESC, such as "[A"
+// for the up arrow.  A CSI sequence ends with a letter or '~'.
+func (e *Editor) readEscape() string {
+	var seq strings.Builder
+	r, _, err := e.in.ReadRune()
+	if err != nil {
+		return ""
+	}
+	seq.WriteRune(r)
+	if r != '[' && r != 'O' {
+		return seq.String()
+	}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return seq.String()
+		}
+		seq.WriteRune(r)
+		if r == '~' || unicode.IsLetter(r) || r == 27 {
+			return seq.String()
+		}
+	}
+}
+
+func (line *lineState) insert(r rune) {
+	line.buf = append(line.buf, 0)
+	copy(line.buf[line.pos+1:], line.buf[line.pos:])
+	line.buf[line.pos] = r
+	line.pos++
+}
+
+// Delete the rune under the cursor.
+func (line *lineState) delete() {
+	if line.pos < len(line.buf) {
+		line.buf = append(line.buf[:line.pos], line.buf[line.pos+1:]...)
+	}
+}
+
+func (line *lineState) left() {
+	if line.pos > 0 {
+		line.pos--
+	}
+}
+
+func (line *lineState) right() {
+	if line.pos < len(line.buf) {
+		line.pos++
+	}
+}
+
+// Redraw the line and put the cursor back where it belongs.  Every
+// rune is taken to be one column wide.
+func (e *Editor) refresh(line *lineState) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", line.prompt, string(line.buf))
+	if back := len(line.buf) - line.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+// Add a line to the history, and to the history file if there is
+// one.  Empty lines and repeats of the last line are left out.
+func (e *Editor) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if e.historyPath == "" {
+		return
+	}
+	file, err := os.OpenFile(e.historyPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, line)
+}
+
+// Read the history file, and trim it to the last HISTORY_MAX lines
+// so that it does not grow forever.  A missing file is an empty
+// history.
+func (e *Editor) loadHistory() {
+	if e.historyPath == "" {
+		return
+	}
+	data, err := os.ReadFile(e.historyPath)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > HISTORY_MAX {
+		lines = lines[len(lines)-HISTORY_MAX:]
+		os.WriteFile(e.historyPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	for _, line := range lines {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+}
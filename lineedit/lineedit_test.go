@@ -0,0 +1,81 @@
+package lineedit
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEditLine(t *testing.T) {
+	tests := []struct {
+		keys string
+		want string
+	}{
+		{"abc\r", "abc"},
+		{"ac\x1b[Db\r", "abc"},
+		{"abd\x7fc\r", "abc"},
+		{"bc\x01a\x05d\r", "abcd"},
+		{"abxc\x1b[D\x1b[D\x1b[3~\r", "abc"},
+		{"xyz\x15abc\r", "abc"},
+		{"abcxyz\x1b[D\x1b[D\x1b[D\x0b\r", "abc"},
+		{"héllo\x1b[D\x7f\r", "hélo"},
+	}
+	for _, test := range tests {
+		e := newEditor(strings.NewReader(test.keys), io.Discard, true)
+		line, err := e.ReadLine("> ")
+		if err != nil || line != test.want {
+			t.Errorf("keys %q: got %q, %v; want %q", test.keys, line, err, test.want)
+		}
+	}
+}
+
+func TestEditLineEnds(t *testing.T) {
+	e := newEditor(strings.NewReader("\x04"), io.Discard, true)
+	if _, err := e.ReadLine("> "); err != io.EOF {
+		t.Errorf("ctrl-d: got %v, want io.EOF", err)
+	}
+	e = newEditor(strings.NewReader("abc\x03"), io.Discard, true)
+	if _, err := e.ReadLine("> "); err != ErrInterrupt {
+		t.Errorf("ctrl-c: got %v, want ErrInterrupt", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	os.WriteFile(path, []byte("first\n"), 0600)
+
+	e := newEditor(strings.NewReader("\x1b[A\x1b[A\r\x1b[A\x1b[B!\r"), io.Discard, true)
+	e.historyPath = path
+	e.loadHistory()
+	e.AddHistory("second")
+	e.AddHistory("second")
+	e.AddHistory("  ")
+
+	if line, _ := e.ReadLine("> "); line != "first" {
+		t.Errorf("got %q, want %q", line, "first")
+	}
+	// Going down past the last entry brings back what was typed.
+	if line, _ := e.ReadLine("> "); line != "!" {
+		t.Errorf("got %q, want %q", line, "!")
+	}
+
+	data, _ := os.ReadFile(path)
+	if got := strings.Split(strings.TrimSpace(string(data)), "\n"); !slices.Equal(got, []string{"first", "second"}) {
+		t.Errorf("history file: got %q", got)
+	}
+}
+
+func TestPlainLines(t *testing.T) {
+	e := newEditor(strings.NewReader("one\r\ntwo"), io.Discard, false)
+	for _, want := range []string{"one", "two"} {
+		if line, err := e.ReadLine("> "); err != nil || line != want {
+			t.Errorf("got %q, %v; want %q", line, err, want)
+		}
+	}
+	if _, err := e.ReadLine("> "); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package lineedit
+
+import "errors"
+
+// Raw mode is only implemented for Linux.  Elsewhere lines are read
+// without editing.
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw mode not supported")
+}
@@ -0,0 +1,559 @@
+// Package lsp is a Language Server Protocol server for glox, so that
+// editors can show the compile errors in Lox scripts as they are
+// typed, and find where names are declared and used.  Each document
+// the client opens is analyzed by the compiler whenever it changes,
+// and requests about it are answered from the analysis.  glox lsp
+// connects the server to stdin and stdout.
+//
+// The protocol counts lines and characters from 0, and characters in
+// UTF-16 code units, while the compiler counts lines from 1 and
+// columns in runes from 1.  Positions are converted using the text of
+// the line they are on.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/davidfung/glox/compiler"
+	"github.com/davidfung/glox/framing"
+	"github.com/davidfung/glox/vm"
+)
+
+// A request, response or notification.  Notifications have no ID.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type errorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   responseError   `json:"error"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	errorInvalidParams  = -32602
+	errorMethodNotFound = -32601
+	errorInvalidRequest = -32600
+)
+
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+// The parameters of the requests about a place in a document.
+type positionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position position `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+// Symbol kinds and completion item kinds of the protocol.
+const (
+	symbolClass    = 5
+	symbolMethod   = 6
+	symbolFunction = 12
+
+	completionMethod   = 2
+	completionFunction = 3
+	completionVariable = 6
+	completionClass    = 7
+	completionModule   = 9
+	completionKeyword  = 14
+	completionConstant = 21
+)
+
+var keywords = []string{
+	"and", "break", "case", "catch", "class", "const", "continue",
+	"default", "else", "false", "finally", "for", "fun", "if", "import",
+	"nil", "or", "print", "return", "super", "switch", "this", "throw",
+	"true", "try", "var", "while", "yield",
+}
+
+type document struct {
+	lines    []string
+	analysis *compiler.Analysis
+}
+
+type Server struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]*document
+}
+
+// Serve LSP requests from in, writing responses and notifications to
+// out, until the client sends exit or in ends.
+func Serve(in io.Reader, out io.Writer) error {
+	s := &Server{in: bufio.NewReader(in), out: out, documents: make(map[string]*document)}
+	for {
+		msg, err := s.readMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.handle(msg) {
+			return nil
+		}
+	}
+}
+
+// Read a message, whose JSON content comes framed as framing.Read()
+// expects.
+func (s *Server) readMessage() (*message, error) {
+	data, err := framing.Read(s.in)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(message)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Server) send(msg any) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	framing.Write(s.out, data)
+}
+
+func (s *Server) respond(msg *message, result any) {
+	s.send(&response{JSONRPC: "2.0", ID: msg.ID, Result: result})
+}
+
+func (s *Server) fail(msg *message, code int, text string) {
+	s.send(&errorResponse{JSONRPC: "2.0", ID: msg.ID, Error: responseError{Code: code, Message: text}})
+}
+
+func (s *Server) notify(method string, params any) {
+	s.send(map[string]any{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// Handle a message, and return false once the client has asked the
+// server to exit.
+func (s *Server) handle(msg *message) bool {
+	switch msg.Method {
+	case "initialize":
+		s.respond(msg, map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1, // the whole document is sent on each change
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]any{"triggerCharacters": []string{"."}},
+			},
+			"serverInfo": map[string]any{"name": "glox"},
+		})
+	case "shutdown":
+		s.respond(msg, nil)
+	case "exit":
+		return false
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		s.update(msg)
+	case "textDocument/definition", "textDocument/references", "textDocument/hover",
+		"textDocument/documentSymbol", "textDocument/completion":
+		var params positionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			s.fail(msg, errorInvalidParams, err.Error())
+			break
+		}
+		doc := s.documents[params.TextDocument.URI]
+		if doc == nil {
+			s.fail(msg, errorInvalidParams, "Unknown document.")
+			break
+		}
+		s.respond(msg, s.answer(msg.Method, params, doc))
+	default:
+		if msg.ID == nil {
+			// Notifications the server has no use for are ignored.
+			break
+		}
+		if msg.Method == "" {
+			s.fail(msg, errorInvalidRequest, "Not a request.")
+			break
+		}
+		s.fail(msg, errorMethodNotFound, fmt.Sprintf("Unsupported request '%s'.", msg.Method))
+	}
+	return true
+}
+
+// Keep the text of a document as it changes, and publish its errors.
+func (s *Server) update(msg *message) {
+	var params struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+	}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return
+	}
+	uri := params.TextDocument.URI
+	text := params.TextDocument.Text
+	switch msg.Method {
+	case "textDocument/didChange":
+		if len(params.ContentChanges) == 0 {
+			return
+		}
+		text = params.ContentChanges[len(params.ContentChanges)-1].Text
+	case "textDocument/didClose":
+		delete(s.documents, uri)
+		s.notify("textDocument/publishDiagnostics", map[string]any{"uri": uri, "diagnostics": []any{}})
+		return
+	}
+
+	doc := &document{lines: strings.Split(text, "\n"), analysis: compiler.Analyze(&text)}
+	s.documents[uri] = doc
+	diagnostics := []any{}
+	for _, d := range doc.analysis.Diagnostics {
+		diagnostics = append(diagnostics, map[string]any{
+			"range":    doc.toRange(d.Pos, d.End),
+			"severity": 1,
+			"source":   "glox",
+			"message":  d.Message,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]any{"uri": uri, "diagnostics": diagnostics})
+}
+
+func (s *Server) answer(method string, params positionParams, doc *document) any {
+	uri := params.TextDocument.URI
+	pos := doc.fromPosition(params.Position)
+	a := doc.analysis
+	switch method {
+	case "textDocument/definition":
+		locations := []location{}
+		for _, symbol := range doc.definitions(pos) {
+			locations = append(locations, location{URI: uri, Range: doc.nameRange(a.Symbols[symbol])})
+		}
+		return locations
+	case "textDocument/references":
+		locations := []location{}
+		definitions := doc.definitions(pos)
+		if params.Context.IncludeDeclaration {
+			for _, symbol := range definitions {
+				locations = append(locations, location{URI: uri, Range: doc.nameRange(a.Symbols[symbol])})
+			}
+		}
+		for _, ref := range a.References {
+			if refersTo(a, ref, definitions) {
+				locations = append(locations, location{URI: uri, Range: doc.referenceRange(ref)})
+			}
+		}
+		return locations
+	case "textDocument/hover":
+		definitions := doc.definitions(pos)
+		if len(definitions) == 0 {
+			return nil
+		}
+		var text []string
+		for _, symbol := range definitions {
+			text = append(text, "```lox\n"+describe(a, symbol)+"\n```")
+		}
+		return map[string]any{"contents": map[string]any{"kind": "markdown", "value": strings.Join(text, "\n")}}
+	case "textDocument/documentSymbol":
+		return doc.documentSymbols(-1)
+	case "textDocument/completion":
+		return doc.completions(pos)
+	}
+	return nil
+}
+
+// Return the symbols of the declarations the name at pos refers to.
+// A property may be any method with its name.
+func (doc *document) definitions(pos compiler.Position) []int {
+	a := doc.analysis
+	for i, symbol := range a.Symbols {
+		if within(pos, symbol.Pos, symbol.NameEnd()) {
+			if symbol.Kind == compiler.SYMBOL_METHOD {
+				return methods(a, symbol.Name)
+			}
+			return []int{i}
+		}
+	}
+	for _, ref := range a.References {
+		if !within(pos, ref.Pos, referenceEnd(ref)) {
+			continue
+		}
+		if ref.IsProperty {
+			return methods(a, ref.Name)
+		}
+		if ref.Symbol != -1 {
+			return []int{ref.Symbol}
+		}
+		return nil
+	}
+	return nil
+}
+
+func methods(a *compiler.Analysis, name string) []int {
+	var symbols []int
+	for i, symbol := range a.Symbols {
+		if symbol.Kind == compiler.SYMBOL_METHOD && symbol.Name == name {
+			symbols = append(symbols, i)
+		}
+	}
+	return symbols
+}
+
+func refersTo(a *compiler.Analysis, ref compiler.Reference, symbols []int) bool {
+	if ref.IsProperty {
+		return slices.ContainsFunc(symbols, func(symbol int) bool {
+			return a.Symbols[symbol].Kind == compiler.SYMBOL_METHOD && a.Symbols[symbol].Name == ref.Name
+		})
+	}
+	return ref.Symbol != -1 && slices.Contains(symbols, ref.Symbol)
+}
+
+// Report whether pos is in the name from start to end, counting the
+// position just after the name, where the cursor is after typing it.
+func within(pos, start, end compiler.Position) bool {
+	return !pos.Before(start) && !end.Before(pos)
+}
+
+func referenceEnd(ref compiler.Reference) compiler.Position {
+	return compiler.Position{Line: ref.Pos.Line, Column: ref.Pos.Column + utf8.RuneCountInString(ref.Name)}
+}
+
+// Describe a declaration for hover, as it might be written.  Functions
+// and methods are shown with their parameters and how many arguments
+// they take.
+func describe(a *compiler.Analysis, index int) string {
+	symbol := a.Symbols[index]
+	switch symbol.Kind {
+	case compiler.SYMBOL_CONSTANT:
+		return "const " + symbol.Name
+	case compiler.SYMBOL_PARAMETER:
+		return "(parameter) " + symbol.Name
+	case compiler.SYMBOL_CLASS:
+		return "class " + symbol.Name
+	case compiler.SYMBOL_MODULE:
+		return "import " + symbol.Name
+	case compiler.SYMBOL_FUNCTION, compiler.SYMBOL_METHOD:
+		return describeFunction(a, index)
+	}
+	return "var " + symbol.Name
+}
+
+func describeFunction(a *compiler.Analysis, index int) string {
+	symbol := a.Symbols[index]
+	var params []string
+	for _, param := range a.Symbols {
+		if param.Kind == compiler.SYMBOL_PARAMETER && param.Container == index {
+			params = append(params, param.Name)
+		}
+	}
+	for i := symbol.MinArity; i < len(params); i++ {
+		if i >= symbol.Arity {
+			params[i] = "..." + params[i]
+		} else {
+			params[i] += " = …"
+		}
+	}
+	name := symbol.Name
+	if symbol.Kind == compiler.SYMBOL_METHOD && symbol.Container != -1 {
+		name = a.Symbols[symbol.Container].Name + "." + name
+	}
+	fun := "fun "
+	if symbol.IsGenerator {
+		fun = "fun* "
+	}
+	return fmt.Sprintf("%s%s(%s)\n// %s", fun, name, strings.Join(params, ", "), arity(symbol))
+}
+
+func arity(symbol compiler.Symbol) string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+	switch {
+	case symbol.MaxArity == -1:
+		return "takes at least " + plural(symbol.MinArity)
+	case symbol.MinArity == symbol.MaxArity:
+		return "takes " + plural(symbol.MinArity)
+	default:
+		return fmt.Sprintf("takes %d to %s", symbol.MinArity, plural(symbol.MaxArity))
+	}
+}
+
+// Return the classes, functions and methods declared in container, or
+// at the top level if it is -1, each with those declared in it.
+func (doc *document) documentSymbols(container int) []any {
+	kinds := map[compiler.SymbolKind]int{
+		compiler.SYMBOL_CLASS:    symbolClass,
+		compiler.SYMBOL_FUNCTION: symbolFunction,
+		compiler.SYMBOL_METHOD:   symbolMethod,
+	}
+	symbols := []any{}
+	for i, symbol := range doc.analysis.Symbols {
+		kind, ok := kinds[symbol.Kind]
+		if !ok || symbol.Container != container {
+			continue
+		}
+		// Only the name's range is known, so it stands for the whole
+		// declaration.
+		r := doc.nameRange(symbol)
+		symbols = append(symbols, map[string]any{
+			"name":           symbol.Name,
+			"kind":           kind,
+			"range":          r,
+			"selectionRange": r,
+			"children":       doc.documentSymbols(i),
+		})
+	}
+	return symbols
+}
+
+// Return the completions at pos: after a dot, the names of methods,
+// and otherwise the keywords and the names in scope there.
+func (doc *document) completions(pos compiler.Position) []any {
+	items := []any{}
+	seen := make(map[string]bool)
+	add := func(label string, kind int) {
+		if !seen[label] {
+			seen[label] = true
+			items = append(items, map[string]any{"label": label, "kind": kind})
+		}
+	}
+
+	if doc.afterDot(pos) {
+		for _, symbol := range doc.analysis.Symbols {
+			if symbol.Kind == compiler.SYMBOL_METHOD {
+				add(symbol.Name, completionMethod)
+			}
+		}
+		return items
+	}
+
+	kinds := map[compiler.SymbolKind]int{
+		compiler.SYMBOL_VARIABLE:  completionVariable,
+		compiler.SYMBOL_CONSTANT:  completionConstant,
+		compiler.SYMBOL_PARAMETER: completionVariable,
+		compiler.SYMBOL_FUNCTION:  completionFunction,
+		compiler.SYMBOL_CLASS:     completionClass,
+		compiler.SYMBOL_MODULE:    completionModule,
+	}
+	// Inner declarations come later, so go backwards to find them
+	// before any they hide.
+	symbols := doc.analysis.Symbols
+	for i := len(symbols) - 1; i >= 0; i-- {
+		symbol := symbols[i]
+		kind, ok := kinds[symbol.Kind]
+		if !ok {
+			continue
+		}
+		if !symbol.Global && (pos.Before(symbol.Pos) || symbol.End != (compiler.Position{}) && !pos.Before(symbol.End)) {
+			continue
+		}
+		add(symbol.Name, kind)
+	}
+	for _, name := range vm.Natives() {
+		add(name, completionFunction)
+	}
+	for _, keyword := range keywords {
+		add(keyword, completionKeyword)
+	}
+	return items
+}
+
+// Report whether the identifier being typed at pos follows a dot.
+func (doc *document) afterDot(pos compiler.Position) bool {
+	if pos.Line < 1 || pos.Line > len(doc.lines) {
+		return false
+	}
+	line := []rune(doc.lines[pos.Line-1])
+	i := min(pos.Column-1, len(line)) - 1
+	for i >= 0 && (line[i] == '_' || unicode.IsLetter(line[i]) || unicode.IsDigit(line[i])) {
+		i--
+	}
+	return i >= 0 && line[i] == '.'
+}
+
+func (doc *document) nameRange(symbol compiler.Symbol) lspRange {
+	return doc.toRange(symbol.Pos, symbol.NameEnd())
+}
+
+func (doc *document) referenceRange(ref compiler.Reference) lspRange {
+	return doc.toRange(ref.Pos, referenceEnd(ref))
+}
+
+func (doc *document) toRange(start, end compiler.Position) lspRange {
+	return lspRange{Start: doc.toPosition(start), End: doc.toPosition(end)}
+}
+
+// Convert a position from the compiler's to the protocol's.
+func (doc *document) toPosition(pos compiler.Position) position {
+	if pos.Line < 1 || pos.Line > len(doc.lines) {
+		return position{Line: max(pos.Line-1, 0)}
+	}
+	character := 0
+	for i, r := range []rune(doc.lines[pos.Line-1]) {
+		if i >= pos.Column-1 {
+			break
+		}
+		character += utf16.RuneLen(r)
+	}
+	return position{Line: pos.Line - 1, Character: character}
+}
+
+// Convert a position from the protocol's to the compiler's.
+func (doc *document) fromPosition(pos position) compiler.Position {
+	if pos.Line < 0 || pos.Line >= len(doc.lines) {
+		return compiler.Position{Line: pos.Line + 1, Column: 1}
+	}
+	column, character := 1, 0
+	for _, r := range doc.lines[pos.Line] {
+		if character >= pos.Character {
+			break
+		}
+		character += utf16.RuneLen(r)
+		column++
+	}
+	return compiler.Position{Line: pos.Line + 1, Column: column}
+}
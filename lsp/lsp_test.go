@@ -0,0 +1,262 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidfung/glox/framing"
+	"github.com/davidfung/glox/vm"
+)
+
+// A scripted LSP client talking to a server over pipes.
+type client struct {
+	t           *testing.T
+	w           io.Writer
+	r           *bufio.Reader
+	id          int
+	diagnostics []diagnostic // from the last publishDiagnostics
+}
+
+type diagnostic struct {
+	Range   lspRange
+	Message string
+}
+
+type incoming struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+	Params json.RawMessage `json:"params"`
+}
+
+func (c *client) send(method string, params any, withID bool) int {
+	msg := map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
+	if withID {
+		c.id++
+		msg["id"] = c.id
+	}
+	data, _ := json.Marshal(msg)
+	framing.Write(c.w, data)
+	return c.id
+}
+
+func (c *client) read() incoming {
+	c.t.Helper()
+	data, err := framing.Read(c.r)
+	if err != nil {
+		c.t.Fatalf("reading message: %v", err)
+	}
+	var m incoming
+	if err := json.Unmarshal(data, &m); err != nil {
+		c.t.Fatalf("bad message %s: %v", data, err)
+	}
+	return m
+}
+
+// Make a request which must succeed, and decode its result into
+// result.
+func (c *client) request(method string, params any, result any) {
+	c.t.Helper()
+	id := c.send(method, params, true)
+	for {
+		m := c.read()
+		if m.ID == nil || *m.ID != id {
+			continue
+		}
+		if m.Error != nil {
+			c.t.Fatalf("%s failed: %s", method, m.Error.Message)
+		}
+		if result != nil {
+			json.Unmarshal(m.Result, result)
+		}
+		return
+	}
+}
+
+// Send a notification which changes the document, and wait for its
+// diagnostics.
+func (c *client) change(method string, params any) {
+	c.t.Helper()
+	c.send(method, params, false)
+	for {
+		m := c.read()
+		if m.Method == "textDocument/publishDiagnostics" {
+			var params struct{ Diagnostics []diagnostic }
+			json.Unmarshal(m.Params, &params)
+			c.diagnostics = params.Diagnostics
+			return
+		}
+	}
+}
+
+const uri = "file:///test.lox"
+
+func at(line, character int) map[string]any {
+	return map[string]any{
+		"textDocument": map[string]any{"uri": uri},
+		"position":     map[string]any{"line": line, "character": character},
+		"context":      map[string]any{"includeDeclaration": true},
+	}
+}
+
+// Return the locations as line:character pairs.
+func positions(locations []location) string {
+	var list []string
+	for _, l := range locations {
+		list = append(list, fmt.Sprintf("%d:%d", l.Range.Start.Line, l.Range.Start.Character))
+	}
+	return strings.Join(list, " ")
+}
+
+func TestServer(t *testing.T) {
+	vm.InitVM()
+	defer vm.FreeVM()
+
+	requests, toServer := io.Pipe()
+	fromServer, responses := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- Serve(requests, responses)
+		responses.Close()
+	}()
+	c := &client{t: t, w: toServer, r: bufio.NewReader(fromServer)}
+
+	var init struct {
+		Capabilities map[string]any
+	}
+	c.request("initialize", map[string]any{"capabilities": map[string]any{}}, &init)
+	if init.Capabilities["definitionProvider"] != true {
+		t.Errorf("capabilities: %v", init.Capabilities)
+	}
+	c.send("initialized", map[string]any{}, false)
+
+	c.change("textDocument/didOpen", map[string]any{"textDocument": map[string]any{
+		"uri": uri, "languageId": "lox", "version": 1,
+		"text": "var x = 1;\nprint x +;\n",
+	}})
+	if len(c.diagnostics) != 1 || c.diagnostics[0].Message != "Expect expression." ||
+		c.diagnostics[0].Range.Start != (position{Line: 1, Character: 9}) {
+		t.Errorf("diagnostics: %v", c.diagnostics)
+	}
+
+	source := `var x = 1;
+class Counter {
+  add(n, step = 1) { var total = n + step; return total + x; }
+}
+fun sum(a, ...rest) {
+  var é = "😀" 1;
+  for (var i in rest) a = a + i;
+  return a;
+}
+var c = Counter();
+print c.add(x) + sum(x, 2);
+`
+	c.change("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": uri, "version": 2},
+		"contentChanges": []any{map[string]any{"text": source}},
+	})
+	// The error is after an emoji, which is one rune but two UTF-16
+	// code units.
+	if len(c.diagnostics) != 1 || c.diagnostics[0].Range.Start != (position{Line: 5, Character: 15}) {
+		t.Errorf("diagnostics: %v", c.diagnostics)
+	}
+	source = strings.Replace(source, `"😀" 1;`, `"😀";`, 1)
+	c.change("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": uri, "version": 3},
+		"contentChanges": []any{map[string]any{"text": source}},
+	})
+	if len(c.diagnostics) != 0 {
+		t.Errorf("diagnostics: %v", c.diagnostics)
+	}
+
+	var locations []location
+	c.request("textDocument/definition", at(10, 21), &locations) // x in sum(x, 2)
+	if got := positions(locations); got != "0:4" {
+		t.Errorf("definition of x: %s", got)
+	}
+	c.request("textDocument/definition", at(6, 30), &locations) // i in a + i
+	if got := positions(locations); got != "6:11" {
+		t.Errorf("definition of i: %s", got)
+	}
+	c.request("textDocument/definition", at(10, 9), &locations) // add in c.add
+	if got := positions(locations); got != "2:2" {
+		t.Errorf("definition of add: %s", got)
+	}
+	c.request("textDocument/references", at(0, 4), &locations)
+	if got := positions(locations); got != "0:4 2:58 10:12 10:21" {
+		t.Errorf("references to x: %s", got)
+	}
+	c.request("textDocument/references", at(4, 8), &locations) // a in sum
+	if got := positions(locations); got != "4:8 6:22 6:26 7:9" {
+		t.Errorf("references to a: %s", got)
+	}
+	c.request("textDocument/references", at(2, 3), &locations)
+	if got := positions(locations); got != "2:2 10:8" {
+		t.Errorf("references to add: %s", got)
+	}
+
+	var hover struct {
+		Contents struct{ Value string }
+	}
+	c.request("textDocument/hover", at(10, 18), &hover)
+	if want := "fun sum(a, ...rest)\n// takes at least 1 argument"; !strings.Contains(hover.Contents.Value, want) {
+		t.Errorf("hover on sum: %q", hover.Contents.Value)
+	}
+	c.request("textDocument/hover", at(10, 9), &hover)
+	if want := "fun Counter.add(n, step = …)\n// takes 1 to 2 arguments"; !strings.Contains(hover.Contents.Value, want) {
+		t.Errorf("hover on add: %q", hover.Contents.Value)
+	}
+
+	type documentSymbol struct {
+		Name     string
+		Kind     int
+		Children []documentSymbol
+	}
+	var symbols []documentSymbol
+	c.request("textDocument/documentSymbol", at(0, 0), &symbols)
+	if got := fmt.Sprint(symbols); got != "[{Counter 5 [{add 6 []}]} {sum 12 []}]" {
+		t.Errorf("document symbols: %s", got)
+	}
+
+	var items []struct{ Label string }
+	labels := func() []string {
+		var labels []string
+		for _, item := range items {
+			labels = append(labels, item.Label)
+		}
+		return labels
+	}
+	c.request("textDocument/completion", at(7, 2), &items) // in sum
+	for _, want := range []string{"a", "rest", "é", "x", "sum", "Counter", "clock", "while"} {
+		if !slices.Contains(labels(), want) {
+			t.Errorf("completion in sum has no %s: %v", want, labels())
+		}
+	}
+	for _, hidden := range []string{"i", "total", "add"} {
+		if slices.Contains(labels(), hidden) {
+			t.Errorf("completion in sum has %s", hidden)
+		}
+	}
+	c.request("textDocument/completion", at(10, 9), &items) // after c.
+	if got := labels(); !slices.Equal(got, []string{"add"}) {
+		t.Errorf("completion after a dot: %v", got)
+	}
+
+	c.request("shutdown", nil, nil)
+	c.send("exit", nil, false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() did not return after exit")
+	}
+}
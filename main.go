@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"log"
 	"os"
 
+	"github.com/davidfung/glox/dap"
+	"github.com/davidfung/glox/lsp"
 	"github.com/davidfung/glox/vm"
 )
 
@@ -13,21 +14,6 @@ const versionMajor = 25
 const versionMinor = 3
 const versionPatch = 0
 
-func repl() {
-	input := bufio.NewScanner(os.Stdin)
-	fmt.Println()
-	fmt.Println("Type ctrl-d to exit.")
-	for {
-		fmt.Printf("> ")
-		if !input.Scan() {
-			break
-		}
-		source := input.Text()
-		vm.Interpret(&source)
-	}
-	fmt.Println("terminating...")
-}
-
 func readFile(path string) string {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -38,7 +24,10 @@ func readFile(path string) string {
 
 func runFile(path string) {
 	source := readFile(path)
-	result := vm.Interpret(&source)
+	result := vm.InterpretFile(&source, path)
+	if result == vm.INTERPRET_OK {
+		result = runScheduled()
+	}
 	if result == vm.INTERPRET_COMPILE_ERROR {
 		os.Exit(65)
 	}
@@ -48,11 +37,40 @@ func runFile(path string) {
 
 }
 
+// Step the fibers the script scheduled until they finish.
+func runScheduled() vm.InterpretResult {
+	result := vm.INTERPRET_OK
+	for vm.Scheduled() > 0 {
+		if vm.Tick() == vm.INTERPRET_RUNTIME_ERROR {
+			result = vm.INTERPRET_RUNTIME_ERROR
+		}
+	}
+	return result
+}
+
 func printVersion() {
 	fmt.Printf("glox version %d.%d.%d\n", versionMajor, versionMinor, versionPatch)
 }
 
 func main() {
+	if len(os.Args) == 2 && (os.Args[1] == "dap" || os.Args[1] == "lsp") {
+		// The protocol goes over stdout, so nothing else may be
+		// printed there.
+		vm.InitVM()
+		serve := dap.Serve
+		if os.Args[1] == "lsp" {
+			serve = lsp.Serve
+		}
+		if err := serve(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		vm.FreeVM()
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "fmt" {
+		os.Exit(formatFiles(os.Args[2:]))
+	}
+
 	printVersion()
 
 	vm.InitVM()
@@ -61,8 +79,14 @@ func main() {
 		repl()
 	} else if len(os.Args) == 2 {
 		runFile(os.Args[1])
+	} else if len(os.Args) == 3 && os.Args[1] == "debug" {
+		debugFile(os.Args[2])
 	} else {
 		fmt.Fprintln(os.Stderr, "Usage: glox [path]")
+		fmt.Fprintln(os.Stderr, "       glox debug path")
+		fmt.Fprintln(os.Stderr, "       glox fmt [-w] [-check] path...")
+		fmt.Fprintln(os.Stderr, "       glox dap")
+		fmt.Fprintln(os.Stderr, "       glox lsp")
 	}
 
 	vm.FreeVM()
@@ -14,9 +14,16 @@ const (
 	OBJ_BOUND_METHOD
 	OBJ_CLASS
 	OBJ_CLOSURE
+	OBJ_FIBER
 	OBJ_FUNCTION
+	OBJ_GENERATOR
 	OBJ_INSTANCE
+	OBJ_ITERATOR
+	OBJ_LIST
+	OBJ_MAP
+	OBJ_MODULE
 	OBJ_NATIVE
+	OBJ_NATIVE_METHOD
 	OBJ_STRING
 	OBJ_UPVALUE
 )
@@ -26,13 +33,42 @@ type Obj struct {
 	Val   any
 }
 
+// Arity is the number of parameters, not counting a rest parameter,
+// and so the number of stack slots that a call fills with arguments
+// before the rest list.  A call must pass at least MinArity arguments,
+// since the parameters after those have default values, and at most
+// MaxArity, which is -1 if there is a rest parameter.  Params are the
+// names of the parameters, for calls with named arguments.  Calling
+// a generator function, declared with fun*, creates a generator
+// instead of running the body.
 type ObjFunction struct {
 	Arity        int
+	MinArity     int
+	MaxArity     int
+	Params       []ObjString
 	UpvalueCount int
+	IsGenerator  bool
 	Chun         chunk.Chunk
 	Name         ObjString
 }
 
+// A list is held by pointer so that all references to it
+// see the same items when it is mutated.
+type ObjList struct {
+	Items []value.Value
+}
+
+// A map is held by pointer too.  Keys and Values are kept in the
+// order in which the keys were first added, which is the order in
+// which a map is printed and iterated, and Index gives the position
+// of each key.  Index is keyed on the Val of the key, so the VM only
+// allows strings, numbers and booleans as keys.
+type ObjMap struct {
+	Keys   []value.Value
+	Values []value.Value
+	Index  map[any]int
+}
+
 type NativeFn func(argCount int, args []value.Value) value.Value
 
 type ObjNative NativeFn
@@ -62,11 +98,14 @@ func PrintObjectType(obj Obj) {
 }
 
 func PrintFunction(function ObjFunction) {
+	fmt.Printf("%s", FormatFunction(function))
+}
+
+func FormatFunction(function ObjFunction) string {
 	if function.Name == "" {
-		fmt.Printf("<script>")
-	} else {
-		fmt.Printf("<fn %s>", function.Name)
+		return "<script>"
 	}
+	return fmt.Sprintf("<fn %s>", function.Name)
 }
 
 // FNV-1a hash algorithm
@@ -79,6 +118,61 @@ func hashString(s string, length int) uint32 {
 	return hash
 }
 
+// An iterator steps through the items of a string, list or range for
+// a for-in loop.  Next returns the next item, or false once there are
+// none left.
+type ObjIterator struct {
+	Next func() (value.Value, bool)
+}
+
+func NewList(items []value.Value) *ObjList {
+	list := new(ObjList)
+	list.Items = items
+	return list
+}
+
+func NewMap() *ObjMap {
+	m := new(ObjMap)
+	m.Index = make(map[any]int)
+	return m
+}
+
+// Return the value for key, and whether the map has the key.
+func (m *ObjMap) Get(key value.Value) (value.Value, bool) {
+	i, ok := m.Index[key.Val]
+	if !ok {
+		return value.Value{}, false
+	}
+	return m.Values[i], true
+}
+
+// Set the value for key, adding the key at the end if it is new.
+func (m *ObjMap) Set(key value.Value, val value.Value) {
+	if i, ok := m.Index[key.Val]; ok {
+		m.Values[i] = val
+		return
+	}
+	m.Index[key.Val] = len(m.Keys)
+	m.Keys = append(m.Keys, key)
+	m.Values = append(m.Values, val)
+}
+
+// Remove key from the map, returning whether it was there.  The keys
+// after it move up one place, so the order of the others is kept.
+func (m *ObjMap) Delete(key value.Value) bool {
+	i, ok := m.Index[key.Val]
+	if !ok {
+		return false
+	}
+	delete(m.Index, key.Val)
+	m.Keys = append(m.Keys[:i], m.Keys[i+1:]...)
+	m.Values = append(m.Values[:i], m.Values[i+1:]...)
+	for j := i; j < len(m.Keys); j++ {
+		m.Index[m.Keys[j].Val] = j
+	}
+	return true
+}
+
 func NewFunction() ObjFunction {
 	fn := new(ObjFunction)
 	fn.Arity = 0        // actually not necessary in glox
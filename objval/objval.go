@@ -31,6 +31,39 @@ type ObjClosure struct {
 	Function     object.ObjFunction
 	Upvalues     []*ObjUpvalue
 	UpvalueCount int
+	Module       *ObjModule // whose globals the function uses
+}
+
+// A generator is created by calling a generator function.  While it
+// is suspended, the slots of its call frame are kept here rather than
+// on the VM's stack, along with the open upvalues which point into
+// them, and IP is where the body resumes.
+type ObjGenerator struct {
+	Closure  *ObjClosure
+	IP       int
+	Slots    []value.Value
+	Upvalues []*ObjUpvalue
+	Running  bool
+	Done     bool
+}
+
+// A method of a built-in object, such as the next() method of a
+// generator, bound to the object it was looked up on.  The VM
+// dispatches a call to it on the receiver's type and the name.
+type ObjNativeMethod struct {
+	Receiver value.Value
+	Name     object.ObjString
+}
+
+// A module is a Lox source file that has been imported.  Every
+// module has its own table of global variables, and the module
+// object exposes them to the importer as properties.
+type ObjModule struct {
+	Name    object.ObjString
+	Path    string // absolute path of the source file
+	Globals *table.Table
+	Consts  map[object.ObjString]bool // globals declared with const
+	Loaded  bool                      // false while the module's top-level code is running
 }
 
 type ObjUpvalue struct {
@@ -55,6 +88,30 @@ func OBJ_VAL(obj object.Obj) value.Value {
 	return value.Value{Type_: value.VAL_OBJ, Val: obj}
 }
 
+func STRING_VAL(s string) value.Value {
+	return OBJ_VAL(object.Obj{Type_: object.OBJ_STRING, Val: object.ObjString(s)})
+}
+
+func LIST_VAL(list *object.ObjList) value.Value {
+	return OBJ_VAL(object.Obj{Type_: object.OBJ_LIST, Val: list})
+}
+
+func MAP_VAL(m *object.ObjMap) value.Value {
+	return OBJ_VAL(object.Obj{Type_: object.OBJ_MAP, Val: m})
+}
+
+func ITERATOR_VAL(iterator *object.ObjIterator) value.Value {
+	return OBJ_VAL(object.Obj{Type_: object.OBJ_ITERATOR, Val: iterator})
+}
+
+func GENERATOR_VAL(generator *ObjGenerator) value.Value {
+	return OBJ_VAL(object.Obj{Type_: object.OBJ_GENERATOR, Val: generator})
+}
+
+func NATIVE_METHOD_VAL(method *ObjNativeMethod) value.Value {
+	return OBJ_VAL(object.Obj{Type_: object.OBJ_NATIVE_METHOD, Val: method})
+}
+
 func IS_BOOL(v value.Value) bool {
 	return v.Type_ == value.VAL_BOOL
 }
@@ -71,6 +128,10 @@ func IS_OBJ(v value.Value) bool {
 	return v.Type_ == value.VAL_OBJ
 }
 
+func IS_BOUND_METHOD(v value.Value) bool {
+	return IsObjType(v, object.OBJ_BOUND_METHOD)
+}
+
 func IS_CLASS(v value.Value) bool {
 	return IsObjType(v, object.OBJ_CLASS)
 }
@@ -79,14 +140,40 @@ func IS_CLOSURE(v value.Value) bool {
 	return IsObjType(v, object.OBJ_CLOSURE)
 }
 
+// A fiber's state belongs to the VM, so only the VM can look inside
+// one.
+func IS_FIBER(v value.Value) bool {
+	return IsObjType(v, object.OBJ_FIBER)
+}
+
 func IS_FUNCTION(v value.Value) bool {
 	return IsObjType(v, object.OBJ_FUNCTION)
 }
 
+func IS_GENERATOR(v value.Value) bool {
+	return IsObjType(v, object.OBJ_GENERATOR)
+}
+
 func IS_INSTANCE(v value.Value) bool {
 	return IsObjType(v, object.OBJ_INSTANCE)
 }
 
+func IS_ITERATOR(v value.Value) bool {
+	return IsObjType(v, object.OBJ_ITERATOR)
+}
+
+func IS_LIST(v value.Value) bool {
+	return IsObjType(v, object.OBJ_LIST)
+}
+
+func IS_MAP(v value.Value) bool {
+	return IsObjType(v, object.OBJ_MAP)
+}
+
+func IS_MODULE(v value.Value) bool {
+	return IsObjType(v, object.OBJ_MODULE)
+}
+
 func IS_NATIVE(v value.Value) bool {
 	return IsObjType(v, object.OBJ_NATIVE)
 }
@@ -155,6 +242,18 @@ func AS_FUNCTION(v value.Value) object.ObjFunction {
 	return objFunction
 }
 
+func AS_GENERATOR(v value.Value) *ObjGenerator {
+	obj, ok := v.Val.(object.Obj)
+	if !ok {
+		panic("Error: AS_GENERATOR() expects an object in a value.Value")
+	}
+	generator, ok := obj.Val.(*ObjGenerator)
+	if !ok {
+		panic("Error: AS_GENERATOR() expects a generator object")
+	}
+	return generator
+}
+
 func AS_INSTANCE(v value.Value) ObjInstance {
 	obj, ok := v.Val.(object.Obj)
 	if !ok {
@@ -167,6 +266,54 @@ func AS_INSTANCE(v value.Value) ObjInstance {
 	return *objInstance
 }
 
+func AS_ITERATOR(v value.Value) *object.ObjIterator {
+	obj, ok := v.Val.(object.Obj)
+	if !ok {
+		panic("Error: AS_ITERATOR() expects an object in a value.Value")
+	}
+	iterator, ok := obj.Val.(*object.ObjIterator)
+	if !ok {
+		panic("Error: AS_ITERATOR() expects an iterator object")
+	}
+	return iterator
+}
+
+func AS_LIST(v value.Value) *object.ObjList {
+	obj, ok := v.Val.(object.Obj)
+	if !ok {
+		panic("Error: AS_LIST() expects an object in a value.Value")
+	}
+	list, ok := obj.Val.(*object.ObjList)
+	if !ok {
+		panic("Error: AS_LIST() expects a list object")
+	}
+	return list
+}
+
+func AS_MAP(v value.Value) *object.ObjMap {
+	obj, ok := v.Val.(object.Obj)
+	if !ok {
+		panic("Error: AS_MAP() expects an object in a value.Value")
+	}
+	m, ok := obj.Val.(*object.ObjMap)
+	if !ok {
+		panic("Error: AS_MAP() expects a map object")
+	}
+	return m
+}
+
+func AS_MODULE(v value.Value) *ObjModule {
+	obj, ok := v.Val.(object.Obj)
+	if !ok {
+		panic("Error: AS_MODULE() expects an object in a value.Value")
+	}
+	module, ok := obj.Val.(*ObjModule)
+	if !ok {
+		panic("Error: AS_MODULE() expects a module object")
+	}
+	return module
+}
+
 func AS_NATIVE(v value.Value) object.NativeFn {
 	obj, ok := v.Val.(object.Obj)
 	if !ok {
@@ -179,6 +326,18 @@ func AS_NATIVE(v value.Value) object.NativeFn {
 	return native
 }
 
+func AS_NATIVE_METHOD(v value.Value) *ObjNativeMethod {
+	obj, ok := v.Val.(object.Obj)
+	if !ok {
+		panic("Error: AS_NATIVE_METHOD() expects an object in a value.Value")
+	}
+	method, ok := obj.Val.(*ObjNativeMethod)
+	if !ok {
+		panic("Error: AS_NATIVE_METHOD() expects a native method object")
+	}
+	return method
+}
+
 func AS_STRING(v value.Value) object.ObjString {
 	obj, ok := v.Val.(object.Obj)
 	if !ok {
@@ -212,20 +371,27 @@ func OBJ_TYPE(val value.Value) object.ObjType {
 }
 
 func PrintValue(val value.Value) {
+	fmt.Printf("%s", ValueToString(val))
+}
+
+// Return the textual form of a value, exactly as the print
+// statement would show it.
+func ValueToString(val value.Value) string {
 	switch val.Type_ {
 	case value.VAL_BOOL:
 		if AS_BOOL(val) {
-			fmt.Printf("true")
+			return "true"
 		} else {
-			fmt.Printf("false")
+			return "false"
 		}
 	case value.VAL_NIL:
-		fmt.Printf("nil")
+		return "nil"
 	case value.VAL_NUMBER:
-		fmt.Printf("%g", AS_NUMBER(val))
+		return fmt.Sprintf("%g", AS_NUMBER(val))
 	case value.VAL_OBJ:
-		printObject(val)
+		return objectToString(val)
 	}
+	return ""
 }
 
 func ValuesEqual(a value.Value, b value.Value) bool {
@@ -240,33 +406,85 @@ func ValuesEqual(a value.Value, b value.Value) bool {
 	case value.VAL_NUMBER:
 		return AS_NUMBER(a) == AS_NUMBER(b)
 	case value.VAL_OBJ:
-		s1 := AS_STRING(a)
-		s2 := AS_STRING(b)
-		return s1 == s2
+		if OBJ_TYPE(a) != OBJ_TYPE(b) {
+			return false
+		}
+		switch OBJ_TYPE(a) {
+		case object.OBJ_STRING:
+			return AS_STRING(a) == AS_STRING(b)
+		case object.OBJ_FUNCTION, object.OBJ_NATIVE:
+			// Neither is comparable in Go, and neither can be
+			// reached from Lox code as a bare value anyway.
+			return false
+		default:
+			// Everything else is held by pointer, so this is
+			// an identity comparison.
+			return AS_OBJ(a).Val == AS_OBJ(b).Val
+		}
 	default:
 		return false
 	}
 }
 
-func printObject(val value.Value) {
+func objectToString(val value.Value) string {
 	switch OBJ_TYPE(val) {
 	case object.OBJ_BOUND_METHOD:
-		object.PrintFunction(AS_BOUND_METHOD(val).Method.Function)
+		return object.FormatFunction(AS_BOUND_METHOD(val).Method.Function)
 	case object.OBJ_CLASS:
-		fmt.Printf("%s", AS_CLASS(val).Name)
+		return string(AS_CLASS(val).Name)
 	case object.OBJ_CLOSURE:
-		object.PrintFunction(AS_CLOSURE(val).Function)
+		return object.FormatFunction(AS_CLOSURE(val).Function)
+	case object.OBJ_FIBER:
+		return "<fiber>"
 	case object.OBJ_FUNCTION:
-		object.PrintFunction(AS_FUNCTION(val))
+		return object.FormatFunction(AS_FUNCTION(val))
+	case object.OBJ_GENERATOR:
+		return fmt.Sprintf("<generator %s>", AS_GENERATOR(val).Closure.Function.Name)
 	case object.OBJ_INSTANCE:
-		fmt.Printf("%s instance", AS_INSTANCE(val).Klass.Name)
+		return fmt.Sprintf("%s instance", AS_INSTANCE(val).Klass.Name)
+	case object.OBJ_ITERATOR:
+		return "<iterator>"
+	case object.OBJ_LIST:
+		list := AS_LIST(val)
+		s := "["
+		for i, item := range list.Items {
+			if i > 0 {
+				s += ", "
+			}
+			s += elementToString(item)
+		}
+		return s + "]"
+	case object.OBJ_MAP:
+		m := AS_MAP(val)
+		s := "{"
+		for i, key := range m.Keys {
+			if i > 0 {
+				s += ", "
+			}
+			s += elementToString(key) + ": " + elementToString(m.Values[i])
+		}
+		return s + "}"
+	case object.OBJ_MODULE:
+		return fmt.Sprintf("<module %s>", AS_MODULE(val).Name)
 	case object.OBJ_NATIVE:
-		fmt.Printf("<native fn>") // can we also print the native function name?
+		return "<native fn>" // can we also print the native function name?
+	case object.OBJ_NATIVE_METHOD:
+		return fmt.Sprintf("<native fn %s>", AS_NATIVE_METHOD(val).Name)
 	case object.OBJ_STRING:
-		fmt.Printf("%s", AS_STRING(val))
+		return string(AS_STRING(val))
 	case object.OBJ_UPVALUE:
-		fmt.Printf("upvalue")
+		return "upvalue"
 	}
+	return ""
+}
+
+// Strings inside a list or a map are quoted, so that ["a, b"] can be
+// told apart from ["a", "b"].
+func elementToString(val value.Value) string {
+	if IS_STRING(val) {
+		return fmt.Sprintf("%q", AS_STRING(val))
+	}
+	return ValueToString(val)
 }
 
 func NewClass(name object.ObjString) *ObjClass {
@@ -288,6 +506,17 @@ func NewClosure(function object.ObjFunction) *ObjClosure {
 	return closure
 }
 
+func NewModule(name object.ObjString, path string) *ObjModule {
+	module := new(ObjModule)
+	module.Name = name
+	module.Path = path
+	module.Globals = new(table.Table)
+	table.InitTable(module.Globals)
+	module.Consts = make(map[object.ObjString]bool)
+	module.Loaded = false
+	return module
+}
+
 func NewUpvalue(slot *value.Value) *ObjUpvalue {
 	upvalue := new(ObjUpvalue)
 	upvalue.Closed = NIL_VAL()
@@ -0,0 +1,463 @@
+package optimizer
+
+import (
+	"math"
+
+	"github.com/davidfung/glox/chunk"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/value"
+)
+
+// The optimizer rewrites the bytecode of a chunk once the compiler
+// has finished with it.  It folds arithmetic, comparisons and string
+// concatenation on literals into a single constant, e.g. 1 + 2 * 3
+// becomes 7, folds ! and - applied to literals, and removes the
+// unreachable code following an unconditional jump or a return.
+//
+// The code is first decoded into a list of instructions, each of
+// which remembers its offset in the original code.  Jumps refer to
+// their targets by original offset too, so that once the list has
+// been rewritten the jump offsets, jump tables, exception handlers,
+// scopes of locals and line numbers can all be recomputed when
+// encoding it again.
+// Finally the constants which are no longer used, such as the operands
+// of folded arithmetic, are dropped from the constant table.
+
+type instruction struct {
+	op       chunk.OpCode
+	operands []uint8
+	line     int
+	offset   int   // offset in the original code
+	target   int   // original offset jumped to by a jump or loop
+	targets  []int // original offsets in a jump table, -1 for none
+	constant value.Value
+}
+
+func Optimize(chun *chunk.Chunk) {
+	code := decode(chun)
+	code = foldConstants(chun, code, findBarriers(chun, code))
+
+	// Removing dead code can remove jumps, and so the labels that
+	// made the code they jumped to reachable.  Repeat until there
+	// is nothing more to remove.
+	for {
+		n := len(code)
+		code = removeDeadCode(code, findLabels(chun, code))
+		if len(code) == n {
+			break
+		}
+	}
+
+	compactConstants(chun, code)
+	encode(chun, code)
+}
+
+// Return the length of the instruction at offset, including its
+// operands.
+func instructionLength(chun *chunk.Chunk, offset int) int {
+	switch chunk.OpCode(chun.Code[offset]) {
+	case chunk.OP_CONSTANT, chunk.OP_BURY, chunk.OP_GET_LOCAL, chunk.OP_SET_LOCAL,
+		chunk.OP_GET_GLOBAL, chunk.OP_DEFINE_GLOBAL, chunk.OP_DEFINE_CONST, chunk.OP_SET_GLOBAL,
+		chunk.OP_GET_UPVALUE, chunk.OP_SET_UPVALUE,
+		chunk.OP_GET_PROPERTY, chunk.OP_SET_PROPERTY, chunk.OP_BUILD_LIST, chunk.OP_BUILD_MAP,
+		chunk.OP_JUMP_TABLE, chunk.OP_ITER_NEXT, chunk.OP_CALL, chunk.OP_CLASS, chunk.OP_METHOD,
+		chunk.OP_IMPORT:
+		return 2
+	case chunk.OP_JUMP, chunk.OP_JUMP_IF_FALSE, chunk.OP_LOOP, chunk.OP_CALL_NAMED:
+		return 3
+	case chunk.OP_JUMP_IF_PASSED, chunk.OP_JUMP_IF_DONE:
+		return 4
+	case chunk.OP_CLOSURE:
+		function := objval.AS_FUNCTION(chun.Constants.Values[chun.Code[offset+1]])
+		return 2 + 2*function.UpvalueCount
+	default:
+		return 1
+	}
+}
+
+func decode(chun *chunk.Chunk) []instruction {
+	var code []instruction
+	for offset := 0; offset < len(chun.Code); {
+		length := instructionLength(chun, offset)
+		ins := instruction{
+			op:       chunk.OpCode(chun.Code[offset]),
+			operands: chun.Code[offset+1 : offset+length],
+			line:     chun.Lines[offset],
+			offset:   offset,
+			target:   -1,
+		}
+		switch ins.op {
+		case chunk.OP_JUMP, chunk.OP_JUMP_IF_FALSE:
+			ins.target = offset + 3 + jumpOperand(ins)
+		case chunk.OP_LOOP:
+			ins.target = offset + 3 - jumpOperand(ins)
+		case chunk.OP_JUMP_IF_PASSED, chunk.OP_JUMP_IF_DONE:
+			ins.target = offset + 4 + jumpOperand(ins)
+		case chunk.OP_JUMP_TABLE:
+			items := objval.AS_LIST(chun.Constants.Values[ins.operands[0]]).Items
+			for _, item := range items[1:] {
+				target := -1
+				if objval.IS_NUMBER(item) {
+					target = offset + 2 + int(objval.AS_NUMBER(item))
+				}
+				ins.targets = append(ins.targets, target)
+			}
+		case chunk.OP_CONSTANT:
+			ins.constant = chun.Constants.Values[ins.operands[0]]
+		}
+		code = append(code, ins)
+		offset += length
+	}
+	return code
+}
+
+// The jump offset is the last two operand bytes.
+func jumpOperand(ins instruction) int {
+	n := len(ins.operands)
+	return int(ins.operands[n-2])<<8 | int(ins.operands[n-1])
+}
+
+// A label is an offset which control can reach other than by falling
+// through from the instruction before: the target of a jump, or where
+// an exception handler goes to.  Dead code ends at a label.
+func findLabels(chun *chunk.Chunk, code []instruction) map[int]bool {
+	labels := make(map[int]bool)
+	for _, ins := range code {
+		if ins.target != -1 {
+			labels[ins.target] = true
+		}
+		for _, target := range ins.targets {
+			if target != -1 {
+				labels[target] = true
+			}
+		}
+	}
+	for _, handler := range chun.Handlers {
+		labels[handler.Target] = true
+	}
+	return labels
+}
+
+// Folding must not merge instructions across a label, or across the
+// start or end of the range of instructions covered by a handler.
+func findBarriers(chun *chunk.Chunk, code []instruction) map[int]bool {
+	barriers := findLabels(chun, code)
+	for _, handler := range chun.Handlers {
+		barriers[handler.Start] = true
+		barriers[handler.End] = true
+	}
+	return barriers
+}
+
+// Return the value pushed by an instruction which loads a literal.
+func literal(ins instruction) (value.Value, bool) {
+	switch ins.op {
+	case chunk.OP_CONSTANT:
+		if objval.IS_NUMBER(ins.constant) || objval.IS_STRING(ins.constant) {
+			return ins.constant, true
+		}
+	case chunk.OP_NIL:
+		return objval.NIL_VAL(), true
+	case chunk.OP_TRUE:
+		return objval.BOOL_VAL(true), true
+	case chunk.OP_FALSE:
+		return objval.BOOL_VAL(false), true
+	}
+	return value.Value{}, false
+}
+
+// Fold as the instructions are copied to the output, so that folding
+// an operator can expose another literal operand to the next one.
+func foldConstants(chun *chunk.Chunk, code []instruction, barriers map[int]bool) []instruction {
+	var out []instruction
+	for _, ins := range code {
+		out = append(out, ins)
+		n := len(out)
+		if n >= 2 && isUnary(ins.op) && !barriers[ins.offset] {
+			if a, ok := literal(out[n-2]); ok {
+				if result, ok := foldUnary(ins.op, a); ok {
+					if folded, ok := load(chun, result, out[n-2]); ok {
+						out = append(out[:n-2], folded)
+					}
+				}
+			}
+		} else if n >= 3 && isBinary(ins.op) && !barriers[ins.offset] && !barriers[out[n-2].offset] {
+			a, okA := literal(out[n-3])
+			b, okB := literal(out[n-2])
+			if okA && okB {
+				if result, ok := foldBinary(ins.op, a, b); ok {
+					if folded, ok := load(chun, result, out[n-3]); ok {
+						out = append(out[:n-3], folded)
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+func isUnary(op chunk.OpCode) bool {
+	return op == chunk.OP_NOT || op == chunk.OP_NEGATE || op == chunk.OP_BIT_NOT
+}
+
+func isBinary(op chunk.OpCode) bool {
+	switch op {
+	case chunk.OP_ADD, chunk.OP_SUBTRACT, chunk.OP_MULTIPLY, chunk.OP_DIVIDE, chunk.OP_MODULO,
+		chunk.OP_EQUAL, chunk.OP_NOT_EQUAL, chunk.OP_GREATER, chunk.OP_GREATER_EQUAL,
+		chunk.OP_LESS, chunk.OP_LESS_EQUAL, chunk.OP_INT_DIVIDE, chunk.OP_BIT_AND,
+		chunk.OP_BIT_OR, chunk.OP_BIT_XOR, chunk.OP_SHIFT_LEFT, chunk.OP_SHIFT_RIGHT:
+		return true
+	}
+	return false
+}
+
+// Operations which would be a runtime error, such as negating a
+// string, are left for the VM to report.
+func foldUnary(op chunk.OpCode, a value.Value) (value.Value, bool) {
+	switch op {
+	case chunk.OP_NOT:
+		return objval.BOOL_VAL(objval.IS_NIL(a) || objval.IS_BOOL(a) && !objval.AS_BOOL(a)), true
+	case chunk.OP_NEGATE:
+		if objval.IS_NUMBER(a) {
+			return objval.NUMBER_VAL(-objval.AS_NUMBER(a)), true
+		}
+	case chunk.OP_BIT_NOT:
+		if isInteger(a) {
+			return objval.NUMBER_VAL(float64(^int64(objval.AS_NUMBER(a)))), true
+		}
+	}
+	return value.Value{}, false
+}
+
+// The same test as the VM makes for the operands of bitwise operators.
+func isInteger(val value.Value) bool {
+	if !objval.IS_NUMBER(val) {
+		return false
+	}
+	n := objval.AS_NUMBER(val)
+	return n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64
+}
+
+func foldBinary(op chunk.OpCode, a value.Value, b value.Value) (value.Value, bool) {
+	switch op {
+	case chunk.OP_EQUAL:
+		return objval.BOOL_VAL(objval.ValuesEqual(a, b)), true
+	case chunk.OP_NOT_EQUAL:
+		return objval.BOOL_VAL(!objval.ValuesEqual(a, b)), true
+	}
+	if op == chunk.OP_ADD && objval.IS_STRING(a) && objval.IS_STRING(b) {
+		return objval.STRING_VAL(string(objval.AS_STRING(a) + objval.AS_STRING(b))), true
+	}
+	if isInteger(a) && isInteger(b) {
+		i, j := int64(objval.AS_NUMBER(a)), int64(objval.AS_NUMBER(b))
+		switch op {
+		case chunk.OP_BIT_AND:
+			return objval.NUMBER_VAL(float64(i & j)), true
+		case chunk.OP_BIT_OR:
+			return objval.NUMBER_VAL(float64(i | j)), true
+		case chunk.OP_BIT_XOR:
+			return objval.NUMBER_VAL(float64(i ^ j)), true
+		case chunk.OP_SHIFT_LEFT:
+			if j >= 0 {
+				return objval.NUMBER_VAL(float64(i << j)), true
+			}
+		case chunk.OP_SHIFT_RIGHT:
+			if j >= 0 {
+				return objval.NUMBER_VAL(float64(i >> j)), true
+			}
+		}
+	}
+	if !objval.IS_NUMBER(a) || !objval.IS_NUMBER(b) {
+		return value.Value{}, false
+	}
+	x, y := objval.AS_NUMBER(a), objval.AS_NUMBER(b)
+	switch op {
+	case chunk.OP_ADD:
+		return objval.NUMBER_VAL(x + y), true
+	case chunk.OP_SUBTRACT:
+		return objval.NUMBER_VAL(x - y), true
+	case chunk.OP_MULTIPLY:
+		return objval.NUMBER_VAL(x * y), true
+	case chunk.OP_DIVIDE:
+		return objval.NUMBER_VAL(x / y), true
+	case chunk.OP_MODULO:
+		return objval.NUMBER_VAL(math.Mod(x, y)), true
+	case chunk.OP_INT_DIVIDE:
+		if y != 0 {
+			return objval.NUMBER_VAL(math.Trunc(x / y)), true
+		}
+	case chunk.OP_GREATER:
+		return objval.BOOL_VAL(x > y), true
+	case chunk.OP_GREATER_EQUAL:
+		return objval.BOOL_VAL(x >= y), true
+	case chunk.OP_LESS:
+		return objval.BOOL_VAL(x < y), true
+	case chunk.OP_LESS_EQUAL:
+		return objval.BOOL_VAL(x <= y), true
+	}
+	return value.Value{}, false
+}
+
+// Return an instruction which loads the folded value, taking the
+// place of the first of the instructions it replaces.  A chunk has
+// room for only 256 constants, so folding gives up if there is no
+// room for a new one.
+func load(chun *chunk.Chunk, val value.Value, first instruction) (instruction, bool) {
+	ins := instruction{line: first.line, offset: first.offset, target: -1}
+	switch {
+	case objval.IS_NIL(val):
+		ins.op = chunk.OP_NIL
+	case objval.IS_BOOL(val) && objval.AS_BOOL(val):
+		ins.op = chunk.OP_TRUE
+	case objval.IS_BOOL(val):
+		ins.op = chunk.OP_FALSE
+	default:
+		constant := findConstant(chun, val)
+		if constant == -1 {
+			if len(chun.Constants.Values) > math.MaxUint8 {
+				return instruction{}, false
+			}
+			constant = chunk.AddConstant(chun, val)
+		}
+		ins.op = chunk.OP_CONSTANT
+		ins.operands = []uint8{uint8(constant)}
+		ins.constant = val
+	}
+	return ins, true
+}
+
+// Look for an identical number or string already in the constant
+// table.  Numbers are compared bit for bit so that 0 and -0 are kept
+// apart.
+func findConstant(chun *chunk.Chunk, val value.Value) int {
+	for i, constant := range chun.Constants.Values {
+		if objval.IS_NUMBER(val) && objval.IS_NUMBER(constant) &&
+			math.Float64bits(objval.AS_NUMBER(val)) == math.Float64bits(objval.AS_NUMBER(constant)) {
+			return i
+		}
+		if objval.IS_STRING(val) && objval.IS_STRING(constant) && objval.AS_STRING(val) == objval.AS_STRING(constant) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Drop the instructions which follow an unconditional transfer of
+// control, up to the next label.
+func removeDeadCode(code []instruction, labels map[int]bool) []instruction {
+	var out []instruction
+	reachable := true
+	for _, ins := range code {
+		if labels[ins.offset] {
+			reachable = true
+		}
+		if !reachable {
+			continue
+		}
+		out = append(out, ins)
+		switch ins.op {
+		case chunk.OP_JUMP, chunk.OP_LOOP, chunk.OP_RETURN, chunk.OP_THROW:
+			reachable = false
+		}
+	}
+	return out
+}
+
+// Return which operand of the instruction is an index into the
+// constant table, or -1 if none is.
+func constantOperand(op chunk.OpCode) int {
+	switch op {
+	case chunk.OP_CONSTANT, chunk.OP_GET_GLOBAL, chunk.OP_DEFINE_GLOBAL, chunk.OP_DEFINE_CONST, chunk.OP_SET_GLOBAL,
+		chunk.OP_GET_PROPERTY, chunk.OP_SET_PROPERTY, chunk.OP_JUMP_TABLE, chunk.OP_CLOSURE,
+		chunk.OP_CLASS, chunk.OP_METHOD, chunk.OP_IMPORT:
+		return 0
+	case chunk.OP_CALL_NAMED:
+		return 1
+	}
+	return -1
+}
+
+// Drop the constants which no instruction refers to any more, and
+// renumber the operands of the instructions which refer to the rest.
+func compactConstants(chun *chunk.Chunk, code []instruction) {
+	renumbered := make(map[uint8]uint8)
+	var constants []value.Value
+	for i := range code {
+		ins := &code[i]
+		operand := constantOperand(ins.op)
+		if operand == -1 {
+			continue
+		}
+		old := ins.operands[operand]
+		index, ok := renumbered[old]
+		if !ok {
+			index = uint8(len(constants))
+			renumbered[old] = index
+			constants = append(constants, chun.Constants.Values[old])
+		}
+		ins.operands = append([]uint8(nil), ins.operands...)
+		ins.operands[operand] = index
+	}
+	chun.Constants.Values = constants
+}
+
+// Write the instructions back into the chunk, mapping every original
+// offset still referred to onto its new offset.  An offset whose
+// instruction was removed maps to the next instruction that is left,
+// which is where the end of a handler's range may have moved to.
+func encode(chun *chunk.Chunk, code []instruction) {
+	offsets := make(map[int]int)
+	offset := 0
+	i := 0
+	for old := 0; old <= len(chun.Code); old++ {
+		for i < len(code) && code[i].offset < old {
+			offset += 1 + len(code[i].operands)
+			i++
+		}
+		offsets[old] = offset
+	}
+
+	newCode := make([]uint8, 0, offset)
+	newLines := make([]int, 0, offset)
+	for _, ins := range code {
+		offset := len(newCode)
+		operands := append([]uint8(nil), ins.operands...)
+		switch ins.op {
+		case chunk.OP_JUMP, chunk.OP_JUMP_IF_FALSE:
+			jump := offsets[ins.target] - (offset + 3)
+			operands[0], operands[1] = uint8(jump>>8), uint8(jump)
+		case chunk.OP_LOOP:
+			jump := (offset + 3) - offsets[ins.target]
+			operands[0], operands[1] = uint8(jump>>8), uint8(jump)
+		case chunk.OP_JUMP_IF_PASSED, chunk.OP_JUMP_IF_DONE:
+			jump := offsets[ins.target] - (offset + 4)
+			operands[1], operands[2] = uint8(jump>>8), uint8(jump)
+		case chunk.OP_JUMP_TABLE:
+			items := objval.AS_LIST(chun.Constants.Values[ins.operands[0]]).Items
+			for i, target := range ins.targets {
+				if target != -1 {
+					items[i+1] = objval.NUMBER_VAL(float64(offsets[target] - (offset + 2)))
+				}
+			}
+		}
+		newCode = append(newCode, uint8(ins.op))
+		newCode = append(newCode, operands...)
+		for range 1 + len(operands) {
+			newLines = append(newLines, ins.line)
+		}
+	}
+
+	for i := range chun.Handlers {
+		handler := &chun.Handlers[i]
+		handler.Start = offsets[handler.Start]
+		handler.End = offsets[handler.End]
+		handler.Target = offsets[handler.Target]
+	}
+	for i := range chun.Locals {
+		local := &chun.Locals[i]
+		local.Start = offsets[local.Start]
+		local.End = offsets[local.End]
+	}
+	chun.Code = newCode
+	chun.Lines = newLines
+}
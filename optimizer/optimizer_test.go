@@ -0,0 +1,82 @@
+package optimizer_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/davidfung/glox/chunk"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/optimizer"
+)
+
+func TestFoldConstants(t *testing.T) {
+	var chun chunk.Chunk
+	chunk.InitChunk(&chun)
+	emitConstant := func(val float64, line int) {
+		constant := chunk.AddConstant(&chun, objval.NUMBER_VAL(val))
+		chunk.WriteChunk(&chun, chunk.OP_CONSTANT, line)
+		chunk.WriteChunk(&chun, uint8(constant), line)
+	}
+
+	// print -(1 + 2 * 3); print !true;
+	emitConstant(1, 1)
+	emitConstant(2, 1)
+	emitConstant(3, 1)
+	chunk.WriteChunk(&chun, chunk.OP_MULTIPLY, 1)
+	chunk.WriteChunk(&chun, chunk.OP_ADD, 1)
+	chunk.WriteChunk(&chun, chunk.OP_NEGATE, 1)
+	chunk.WriteChunk(&chun, chunk.OP_PRINT, 1)
+	chunk.WriteChunk(&chun, chunk.OP_TRUE, 2)
+	chunk.WriteChunk(&chun, chunk.OP_NOT, 2)
+	chunk.WriteChunk(&chun, chunk.OP_PRINT, 2)
+
+	optimizer.Optimize(&chun)
+
+	wantCode := []uint8{uint8(chunk.OP_CONSTANT), 0, uint8(chunk.OP_PRINT), uint8(chunk.OP_FALSE), uint8(chunk.OP_PRINT)}
+	if !slices.Equal(chun.Code, wantCode) {
+		t.Errorf("code = %v, want %v", chun.Code, wantCode)
+	}
+	if !slices.Equal(chun.Lines, []int{1, 1, 1, 2, 2}) {
+		t.Errorf("lines = %v", chun.Lines)
+	}
+	if len(chun.Constants.Values) != 1 || objval.AS_NUMBER(chun.Constants.Values[0]) != -7 {
+		t.Errorf("constants = %v", chun.Constants.Values)
+	}
+}
+
+func TestRemoveDeadCode(t *testing.T) {
+	var chun chunk.Chunk
+	chunk.InitChunk(&chun)
+	write := func(line int, bytes ...uint8) {
+		for _, b := range bytes {
+			chunk.WriteChunk(&chun, b, line)
+		}
+	}
+
+	// 0: JUMP_IF_FALSE -> 9, 3: NIL, 4: RETURN, 5: NIL, 6: JUMP -> 10
+	// 9: NIL, 10: RETURN, with a handler covering 5-9 and going to 9.
+	write(1, uint8(chunk.OP_JUMP_IF_FALSE), 0, 6)
+	write(2, uint8(chunk.OP_NIL), uint8(chunk.OP_RETURN))
+	write(3, uint8(chunk.OP_NIL), uint8(chunk.OP_JUMP), 0, 1)
+	write(4, uint8(chunk.OP_NIL))
+	write(5, uint8(chunk.OP_RETURN))
+	chunk.AddHandler(&chun, chunk.Handler{Start: 5, End: 9, Target: 9})
+
+	optimizer.Optimize(&chun)
+
+	wantCode := []uint8{
+		uint8(chunk.OP_JUMP_IF_FALSE), 0, 2,
+		uint8(chunk.OP_NIL), uint8(chunk.OP_RETURN),
+		uint8(chunk.OP_NIL), uint8(chunk.OP_RETURN),
+	}
+	if !slices.Equal(chun.Code, wantCode) {
+		t.Errorf("code = %v, want %v", chun.Code, wantCode)
+	}
+	if !slices.Equal(chun.Lines, []int{1, 1, 1, 2, 2, 4, 5}) {
+		t.Errorf("lines = %v", chun.Lines)
+	}
+	want := chunk.Handler{Start: 5, End: 5, Target: 5}
+	if chun.Handlers[0] != want {
+		t.Errorf("handler = %v, want %v", chun.Handlers[0], want)
+	}
+}
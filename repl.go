@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidfung/glox/debugger"
+	"github.com/davidfung/glox/lineedit"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/scanner"
+	"github.com/davidfung/glox/vm"
+)
+
+const historyFile = ".glox_history"
+
+// The inputs which have run without error since the REPL started, or
+// was reset, for :save to write out.
+var session []string
+
+const replHelp = `Enter Lox code to run it.  The value of an expression on its own
+is printed, and its semicolon can be left out.  Input carries on over
+several lines while brackets or a string are left open.
+
+:help           show this help
+:globals        list the global variables and their values
+:disasm <fn>    disassemble the function bound to the global fn
+:load <file>    run a Lox file
+:save <file>    save the inputs which ran without error to a file
+:reset          forget all the global variables and the saved inputs
+
+Type ctrl-c to discard the input, ctrl-d to exit.`
+
+func repl() {
+	editor := lineedit.New(historyPath())
+	fmt.Println()
+	fmt.Println("Type :help for help, ctrl-d to exit.")
+	for {
+		source, ok := readInput(editor)
+		if !ok {
+			break
+		}
+		if command, ok := strings.CutPrefix(strings.TrimSpace(source), ":"); ok {
+			runCommand(command)
+			continue
+		}
+		if result, saved := vm.InterpretRepl(&source); result == vm.INTERPRET_OK {
+			session = append(session, saved)
+			runScheduled()
+		}
+	}
+	fmt.Println("terminating...")
+}
+
+// The history is kept in the user's home directory, or only for the
+// session if there is none.
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, historyFile)
+}
+
+// Read lines until they make up a complete input.  Return false when
+// the input ends.
+func readInput(editor *lineedit.Editor) (string, bool) {
+	var lines []string
+	for {
+		prompt := "> "
+		if len(lines) > 0 {
+			prompt = "... "
+		}
+		line, err := editor.ReadLine(prompt)
+		if err == lineedit.ErrInterrupt {
+			lines = nil
+			continue
+		}
+		if err != nil {
+			return "", false
+		}
+		editor.AddHistory(line)
+		lines = append(lines, line)
+		source := strings.Join(lines, "\n")
+		if strings.HasPrefix(strings.TrimSpace(source), ":") || isComplete(source) {
+			return source, true
+		}
+	}
+}
+
+// Return whether the source leaves no bracket or string open, so that
+// there is no need to ask for more lines.
+func isComplete(source string) bool {
+	scanner.InitScanner(&source)
+	depth := 0
+	for {
+		token := scanner.ScanToken()
+		switch token.Type {
+		case scanner.TOKEN_LEFT_PAREN, scanner.TOKEN_LEFT_BRACE, scanner.TOKEN_LEFT_BRACKET:
+			depth++
+		case scanner.TOKEN_RIGHT_PAREN, scanner.TOKEN_RIGHT_BRACE, scanner.TOKEN_RIGHT_BRACKET:
+			depth--
+		case scanner.TOKEN_ERROR:
+			if (*token.Source)[token.Start:token.Start+token.Length] == "Unterminated string." {
+				return false
+			}
+		case scanner.TOKEN_EOF:
+			// Too many closing brackets is an error for the compiler
+			// to report.
+			return depth <= 0
+		}
+	}
+}
+
+func runCommand(command string) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(command), " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "help":
+		fmt.Println(replHelp)
+	case "globals":
+		for _, name := range vm.Globals() {
+			val, _ := vm.Global(name)
+			fmt.Printf("%s = %s\n", name, objval.ValueToString(val))
+		}
+	case "disasm":
+		disassemble(arg)
+	case "load":
+		load(arg)
+	case "save":
+		save(arg)
+	case "reset":
+		vm.ResetGlobals()
+		session = nil
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command ':%s'.  Type :help for help.\n", name)
+	}
+}
+
+func disassemble(name string) {
+	if name == "" {
+		fmt.Fprintln(os.Stderr, "Usage: :disasm <fn>")
+		return
+	}
+	val, ok := vm.Global(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Undefined variable '%s'.\n", name)
+		return
+	}
+	if !objval.IS_CLOSURE(val) {
+		fmt.Fprintf(os.Stderr, "'%s' is not a Lox function.\n", name)
+		return
+	}
+	debugger.DisassembleChunk(&objval.AS_CLOSURE(val).Function.Chun, name)
+}
+
+func load(path string) {
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "Usage: :load <file>")
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	source := string(data)
+	if vm.InterpretFile(&source, path) == vm.INTERPRET_OK {
+		session = append(session, fmt.Sprintf("// :load %s\n%s", path, strings.TrimRight(source, "\n")))
+		runScheduled()
+	}
+}
+
+func save(path string) {
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "Usage: :save <file>")
+		return
+	}
+	var data strings.Builder
+	for _, input := range session {
+		data.WriteString(input)
+		data.WriteString("\n")
+	}
+	if err := os.WriteFile(path, []byte(data.String()), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Printf("Saved %d inputs to %s.\n", len(session), path)
+}
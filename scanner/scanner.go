@@ -1,5 +1,12 @@
 package scanner
 
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
 type TokenType int
 
 const (
@@ -7,49 +14,84 @@ const (
 	TOKEN_RIGHT_PAREN
 	TOKEN_LEFT_BRACE
 	TOKEN_RIGHT_BRACE
+	TOKEN_LEFT_BRACKET
+	TOKEN_RIGHT_BRACKET
 	TOKEN_COMMA
 	TOKEN_DOT
 	TOKEN_MINUS
 	TOKEN_PLUS
 	TOKEN_SEMICOLON
+	TOKEN_COLON
+	TOKEN_QUESTION
 	TOKEN_SLASH
 	TOKEN_STAR
+	TOKEN_PERCENT
+	TOKEN_AMPERSAND
+	TOKEN_PIPE
+	TOKEN_CARET
 
 	// One or two character tokens
-	TOKEN_BANG // 11
+	TOKEN_BANG // 19
 	TOKEN_BANG_EQUAL
+	TOKEN_DOT_DOT_DOT
 	TOKEN_EQUAL
 	TOKEN_EQUAL_EQUAL
+	TOKEN_ARROW
 	TOKEN_GREATER
 	TOKEN_GREATER_EQUAL
+	TOKEN_GREATER_GREATER
 	TOKEN_LESS
 	TOKEN_LESS_EQUAL
+	TOKEN_LESS_LESS
+	TOKEN_MINUS_EQUAL
+	TOKEN_MINUS_MINUS
+	TOKEN_PERCENT_EQUAL
+	TOKEN_PLUS_EQUAL
+	TOKEN_PLUS_PLUS
+	TOKEN_SLASH_EQUAL
+	TOKEN_STAR_EQUAL
+	TOKEN_TILDE
+	TOKEN_TILDE_SLASH
 
 	// Literals
 
-	TOKEN_IDENTIFIER // 19
+	TOKEN_IDENTIFIER // 40
 	TOKEN_STRING
+	TOKEN_INTERPOLATION
 	TOKEN_NUMBER
 
 	// Keywords
-	TOKEN_AND // 22
+	TOKEN_AND // 44
+	TOKEN_BREAK
+	TOKEN_CASE
+	TOKEN_CATCH
 	TOKEN_CLASS
+	TOKEN_CONST
+	TOKEN_CONTINUE
+	TOKEN_DEFAULT
 	TOKEN_ELSE
 	TOKEN_FALSE
+	TOKEN_FINALLY
 	TOKEN_FOR
 	TOKEN_FUN
 	TOKEN_IF
+	TOKEN_IMPORT
 	TOKEN_NIL
 	TOKEN_OR
 	TOKEN_PRINT
 	TOKEN_RETURN
 	TOKEN_SUPER
+	TOKEN_SWITCH
 	TOKEN_THIS
+	TOKEN_THROW
 	TOKEN_TRUE
+	TOKEN_TRY
 	TOKEN_VAR
 	TOKEN_WHILE
+	TOKEN_YIELD
 
-	TOKEN_ERROR // 38
+	TOKEN_COMMENT // only if KeepComments() was called
+	TOKEN_ERROR   // 73
 	TOKEN_EOF
 )
 
@@ -59,37 +101,90 @@ type Token struct {
 	Start  int
 	Length int
 	Line   int
+	Column int // in runes, starting from 1
 }
 
+// The source is UTF-8.  start and current are byte offsets into
+// the source so that tokens can be sliced out of it directly, but
+// the scanner always advances by a whole rune, and columns are
+// counted in runes.
 type Scanner struct {
-	source  *string
-	start   int
-	current int
-	line    int
+	source      *string
+	start       int
+	current     int
+	line        int
+	lineStart   int // byte offset of the first character of the line
+	startColumn int // column of the token being scanned
+
+	// One entry for each string interpolation "${...}" that we
+	// are currently inside of, counting the '{' seen within the
+	// interpolated expression that are not yet closed.  A '}'
+	// seen when the count is zero ends the interpolation.
+	braces []int
+
+	// Return comments as tokens rather than skipping them.
+	comments bool
 }
 
 var scanner Scanner
 
+// Return the scanner's current position.  Together with
+// RestoreState(), this lets the compiler look ahead at tokens
+// further than the one token the parser keeps.
+func SaveState() Scanner {
+	state := scanner
+	state.braces = append([]int(nil), scanner.braces...)
+	return state
+}
+
+func RestoreState(state Scanner) {
+	scanner = state
+}
+
 func InitScanner(source *string) {
 	scanner.source = source
 	scanner.start = 0
 	scanner.current = 0
 	scanner.line = 1
+	scanner.lineStart = 0
+	scanner.startColumn = 1
+	scanner.braces = nil
+	scanner.comments = false
+}
+
+// Make the scanner return each comment as a TOKEN_COMMENT, which
+// runs to the end of its line, until InitScanner() is next called.
+// Formatters need the comments; the compiler does not.
+func KeepComments() {
+	scanner.comments = true
 }
 
-func isAlpha(c byte) bool {
-	return (c >= 'a' && c <= 'z') ||
-		(c >= 'A' && c <= 'Z') ||
-		c == '_'
+// Identifiers may use letters from any script.
+func isAlpha(c rune) bool {
+	return unicode.IsLetter(c) || c == '_'
 }
 
-func isDigit(c byte) bool {
+// Number literals only use the ASCII digits.
+func isDigit(c rune) bool {
 	return c >= '0' && c <= '9'
 }
 
+// Besides letters and digits, an identifier may continue with
+// combining marks so that decomposed accented letters work.
+func isIdentifierPart(c rune) bool {
+	return isAlpha(c) || unicode.IsDigit(c) || unicode.IsMark(c)
+}
+
+// Called after consuming a newline.
+func newLine() {
+	scanner.line++
+	scanner.lineStart = scanner.current
+}
+
 func ScanToken() Token {
 	skipWhitespace()
 	scanner.start = scanner.current
+	scanner.startColumn = utf8.RuneCountInString((*scanner.source)[scanner.lineStart:scanner.start]) + 1
 	if isAtEnd() {
 		return makeToken(TOKEN_EOF)
 	}
@@ -108,23 +203,81 @@ func ScanToken() Token {
 	case ')':
 		return makeToken(TOKEN_RIGHT_PAREN)
 	case '{':
+		if len(scanner.braces) > 0 {
+			scanner.braces[len(scanner.braces)-1]++
+		}
 		return makeToken(TOKEN_LEFT_BRACE)
 	case '}':
+		if len(scanner.braces) > 0 {
+			top := len(scanner.braces) - 1
+			if scanner.braces[top] == 0 {
+				// The end of an interpolated expression, so
+				// resume scanning the rest of the string.
+				scanner.braces = scanner.braces[:top]
+				return quotedString()
+			}
+			scanner.braces[top]--
+		}
 		return makeToken(TOKEN_RIGHT_BRACE)
+	case '[':
+		return makeToken(TOKEN_LEFT_BRACKET)
+	case ']':
+		return makeToken(TOKEN_RIGHT_BRACKET)
 	case ';':
 		return makeToken(TOKEN_SEMICOLON)
+	case ':':
+		return makeToken(TOKEN_COLON)
+	case '?':
+		return makeToken(TOKEN_QUESTION)
 	case ',':
 		return makeToken(TOKEN_COMMA)
 	case '.':
+		if peek() == '.' && peekNext() == '.' {
+			advance()
+			advance()
+			return makeToken(TOKEN_DOT_DOT_DOT)
+		}
 		return makeToken(TOKEN_DOT)
 	case '-':
-		return makeToken(TOKEN_MINUS)
+		if match('=') {
+			return makeToken(TOKEN_MINUS_EQUAL)
+		} else if match('-') {
+			return makeToken(TOKEN_MINUS_MINUS)
+		} else {
+			return makeToken(TOKEN_MINUS)
+		}
 	case '+':
-		return makeToken(TOKEN_PLUS)
+		if match('=') {
+			return makeToken(TOKEN_PLUS_EQUAL)
+		} else if match('+') {
+			return makeToken(TOKEN_PLUS_PLUS)
+		} else {
+			return makeToken(TOKEN_PLUS)
+		}
 	case '/':
-		return makeToken(TOKEN_SLASH)
+		if match('/') {
+			for peek() != '\n' && !isAtEnd() {
+				advance()
+			}
+			return makeToken(TOKEN_COMMENT)
+		}
+		if match('=') {
+			return makeToken(TOKEN_SLASH_EQUAL)
+		} else {
+			return makeToken(TOKEN_SLASH)
+		}
 	case '*':
-		return makeToken(TOKEN_STAR)
+		if match('=') {
+			return makeToken(TOKEN_STAR_EQUAL)
+		} else {
+			return makeToken(TOKEN_STAR)
+		}
+	case '%':
+		if match('=') {
+			return makeToken(TOKEN_PERCENT_EQUAL)
+		} else {
+			return makeToken(TOKEN_PERCENT)
+		}
 	case '!':
 		if match('=') {
 			return makeToken(TOKEN_BANG_EQUAL)
@@ -134,21 +287,39 @@ func ScanToken() Token {
 	case '=':
 		if match('=') {
 			return makeToken(TOKEN_EQUAL_EQUAL)
+		} else if match('>') {
+			return makeToken(TOKEN_ARROW)
 		} else {
 			return makeToken(TOKEN_EQUAL)
 		}
 	case '<':
 		if match('=') {
 			return makeToken(TOKEN_LESS_EQUAL)
+		} else if match('<') {
+			return makeToken(TOKEN_LESS_LESS)
 		} else {
 			return makeToken(TOKEN_LESS)
 		}
 	case '>':
 		if match('=') {
 			return makeToken(TOKEN_GREATER_EQUAL)
+		} else if match('>') {
+			return makeToken(TOKEN_GREATER_GREATER)
 		} else {
 			return makeToken(TOKEN_GREATER)
 		}
+	case '&':
+		return makeToken(TOKEN_AMPERSAND)
+	case '|':
+		return makeToken(TOKEN_PIPE)
+	case '^':
+		return makeToken(TOKEN_CARET)
+	case '~':
+		if match('/') {
+			return makeToken(TOKEN_TILDE_SLASH)
+		} else {
+			return makeToken(TOKEN_TILDE)
+		}
 	case '"':
 		return quotedString()
 	}
@@ -160,19 +331,20 @@ func isAtEnd() bool {
 	return scanner.current >= len(*scanner.source)
 }
 
-func advance() byte {
-	scanner.current++
-	return (*scanner.source)[scanner.current-1]
+func advance() rune {
+	c, size := utf8.DecodeRuneInString((*scanner.source)[scanner.current:])
+	scanner.current += size
+	return c
 }
 
-func match(expected byte) bool {
+func match(expected rune) bool {
 	if isAtEnd() {
 		return false
 	}
-	if (*scanner.source)[scanner.current] != expected {
+	if peek() != expected {
 		return false
 	}
-	scanner.current++
+	advance()
 	return true
 }
 
@@ -183,6 +355,7 @@ func makeToken(typ TokenType) Token {
 	token.Start = scanner.start
 	token.Length = scanner.current - scanner.start
 	token.Line = scanner.line
+	token.Column = scanner.startColumn
 
 	if typ == TOKEN_EOF {
 		s := ""
@@ -201,6 +374,7 @@ func errorToken(msg string) Token {
 	token.Start = 0
 	token.Length = len(msg)
 	token.Line = scanner.line
+	token.Column = scanner.startColumn
 	return token
 }
 
@@ -218,10 +392,10 @@ func skipWhitespace() {
 		case '\t':
 			advance()
 		case '\n':
-			scanner.line++
 			advance()
+			newLine()
 		case '/':
-			if peekNext() == '/' {
+			if peekNext() == '/' && !scanner.comments {
 				for peek() != '\n' && !isAtEnd() {
 					advance()
 				}
@@ -246,8 +420,33 @@ func identifierType() TokenType {
 	switch (*scanner.source)[scanner.start] {
 	case 'a':
 		return checkKeyword(1, 2, "nd", TOKEN_AND)
+	case 'b':
+		return checkKeyword(1, 4, "reak", TOKEN_BREAK)
 	case 'c':
-		return checkKeyword(1, 4, "lass", TOKEN_CLASS)
+		if scanner.current-scanner.start > 1 {
+			switch (*scanner.source)[scanner.start+1] {
+			case 'a':
+				if scanner.current-scanner.start > 2 {
+					switch (*scanner.source)[scanner.start+2] {
+					case 's':
+						return checkKeyword(3, 1, "e", TOKEN_CASE)
+					case 't':
+						return checkKeyword(3, 2, "ch", TOKEN_CATCH)
+					}
+				}
+			case 'l':
+				return checkKeyword(2, 3, "ass", TOKEN_CLASS)
+			case 'o':
+				if scanner.current-scanner.start > 3 && (*scanner.source)[scanner.start+2] == 'n' {
+					switch (*scanner.source)[scanner.start+3] {
+					case 's':
+						return checkKeyword(4, 1, "t", TOKEN_CONST)
+					case 't':
+						return checkKeyword(4, 4, "inue", TOKEN_CONTINUE)
+					}
+				}
+			}
+		}
 	case 'e':
 		return checkKeyword(1, 3, "lse", TOKEN_ELSE)
 	case 'f':
@@ -255,6 +454,8 @@ func identifierType() TokenType {
 			switch (*scanner.source)[scanner.start+1] {
 			case 'a':
 				return checkKeyword(2, 3, "lse", TOKEN_FALSE)
+			case 'i':
+				return checkKeyword(2, 5, "nally", TOKEN_FINALLY)
 			case 'o':
 				return checkKeyword(2, 1, "r", TOKEN_FOR)
 			case 'u':
@@ -262,7 +463,14 @@ func identifierType() TokenType {
 			}
 		}
 	case 'i':
-		return checkKeyword(1, 1, "f", TOKEN_IF)
+		if scanner.current-scanner.start > 1 {
+			switch (*scanner.source)[scanner.start+1] {
+			case 'f':
+				return checkKeyword(2, 0, "", TOKEN_IF)
+			case 'm':
+				return checkKeyword(2, 4, "port", TOKEN_IMPORT)
+			}
+		}
 	case 'n':
 		return checkKeyword(1, 2, "il", TOKEN_NIL)
 	case 'o':
@@ -271,27 +479,52 @@ func identifierType() TokenType {
 		return checkKeyword(1, 4, "rint", TOKEN_PRINT)
 	case 'r':
 		return checkKeyword(1, 5, "eturn", TOKEN_RETURN)
+	case 'd':
+		return checkKeyword(1, 6, "efault", TOKEN_DEFAULT)
 	case 's':
-		return checkKeyword(1, 4, "uper", TOKEN_SUPER)
+		if scanner.current-scanner.start > 1 {
+			switch (*scanner.source)[scanner.start+1] {
+			case 'u':
+				return checkKeyword(2, 3, "per", TOKEN_SUPER)
+			case 'w':
+				return checkKeyword(2, 4, "itch", TOKEN_SWITCH)
+			}
+		}
 	case 't':
 		if scanner.current-scanner.start > 1 {
 			switch (*scanner.source)[scanner.start+1] {
 			case 'h':
-				return checkKeyword(2, 2, "is", TOKEN_THIS)
+				if scanner.current-scanner.start > 2 {
+					switch (*scanner.source)[scanner.start+2] {
+					case 'i':
+						return checkKeyword(3, 1, "s", TOKEN_THIS)
+					case 'r':
+						return checkKeyword(3, 2, "ow", TOKEN_THROW)
+					}
+				}
 			case 'r':
-				return checkKeyword(2, 2, "ue", TOKEN_TRUE)
+				if scanner.current-scanner.start > 2 {
+					switch (*scanner.source)[scanner.start+2] {
+					case 'u':
+						return checkKeyword(3, 1, "e", TOKEN_TRUE)
+					case 'y':
+						return checkKeyword(3, 0, "", TOKEN_TRY)
+					}
+				}
 			}
 		}
 	case 'v':
 		return checkKeyword(1, 2, "ar", TOKEN_VAR)
 	case 'w':
 		return checkKeyword(1, 4, "hile", TOKEN_WHILE)
+	case 'y':
+		return checkKeyword(1, 4, "ield", TOKEN_YIELD)
 	}
 	return TOKEN_IDENTIFIER
 }
 
 func identifier() Token {
-	for isAlpha(peek()) || isDigit(peek()) {
+	for isIdentifierPart(peek()) {
 		advance()
 	}
 	return makeToken(identifierType())
@@ -315,12 +548,32 @@ func number() Token {
 	return makeToken(TOKEN_NUMBER)
 }
 
+// Scan a string literal up to its closing quote.  If the string
+// contains an interpolation "${", we stop there instead and return
+// the part scanned so far as a TOKEN_INTERPOLATION.  The scanner
+// then returns the tokens of the interpolated expression, and the
+// '}' which ends the expression comes back here to scan the rest
+// of the string.  So "a${x}b" is scanned as the three tokens
+// INTERPOLATION("a${), IDENTIFIER(x) and STRING(}b").
+//
+// Escape sequences are left in the token as written; the compiler
+// translates them with Unescape() when it creates the string object.
 func quotedString() Token {
 	for !isAtEnd() && peek() != '"' {
-		if peek() == '\n' {
-			scanner.line++
+		if peek() == '\\' {
+			advance()
+			if isAtEnd() {
+				break
+			}
+		} else if peek() == '$' && peekNext() == '{' {
+			advance()
+			advance()
+			scanner.braces = append(scanner.braces, 0)
+			return makeToken(TOKEN_INTERPOLATION)
+		}
+		if advance() == '\n' {
+			newLine()
 		}
-		advance()
 	}
 
 	if isAtEnd() {
@@ -331,16 +584,78 @@ func quotedString() Token {
 	return makeToken(TOKEN_STRING)
 }
 
-func peek() byte {
+func peek() rune {
 	if isAtEnd() {
 		return 0
 	}
-	return byte((*scanner.source)[scanner.current])
+	c, _ := utf8.DecodeRuneInString((*scanner.source)[scanner.current:])
+	return c
 }
 
-func peekNext() byte {
+func peekNext() rune {
 	if isAtEnd() {
 		return 0
 	}
-	return byte((*scanner.source)[scanner.current+1])
+	_, size := utf8.DecodeRuneInString((*scanner.source)[scanner.current:])
+	if scanner.current+size >= len(*scanner.source) {
+		return 0
+	}
+	c, _ := utf8.DecodeRuneInString((*scanner.source)[scanner.current+size:])
+	return c
+}
+
+// Translate the escape sequences \n, \t, \r, \0, \\, \", \$,
+// \uXXXX and \u{X...} into the characters they stand for, and
+// report whether they were all valid.
+func Unescape(s string) (string, bool) {
+	if !strings.ContainsRune(s, '\\') {
+		return s, true
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", false
+		}
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case '0':
+			sb.WriteByte(0)
+		case '\\', '"', '$':
+			sb.WriteByte(s[i])
+		case 'u':
+			var digits string
+			if i+1 < len(s) && s[i+1] == '{' {
+				close := strings.IndexByte(s[i:], '}')
+				if close == -1 {
+					return "", false
+				}
+				digits = s[i+2 : i+close]
+				i += close
+			} else {
+				if i+4 >= len(s) {
+					return "", false
+				}
+				digits = s[i+1 : i+5]
+				i += 4
+			}
+			code, err := strconv.ParseUint(digits, 16, 32)
+			if err != nil || len(digits) == 0 || !utf8.ValidRune(rune(code)) {
+				return "", false
+			}
+			sb.WriteRune(rune(code))
+		default:
+			return "", false
+		}
+	}
+	return sb.String(), true
 }
@@ -0,0 +1,58 @@
+package scanner_test
+
+import (
+	"testing"
+
+	"github.com/davidfung/glox/scanner"
+)
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	source := "var café = π;\n  print 日本;"
+	want := []struct {
+		typ    scanner.TokenType
+		text   string
+		line   int
+		column int
+	}{
+		{scanner.TOKEN_VAR, "var", 1, 1},
+		{scanner.TOKEN_IDENTIFIER, "café", 1, 5},
+		{scanner.TOKEN_EQUAL, "=", 1, 10},
+		{scanner.TOKEN_IDENTIFIER, "π", 1, 12},
+		{scanner.TOKEN_SEMICOLON, ";", 1, 13},
+		{scanner.TOKEN_PRINT, "print", 2, 3},
+		{scanner.TOKEN_IDENTIFIER, "日本", 2, 9},
+		{scanner.TOKEN_SEMICOLON, ";", 2, 11},
+		{scanner.TOKEN_EOF, "", 2, 12},
+	}
+
+	scanner.InitScanner(&source)
+	for _, w := range want {
+		token := scanner.ScanToken()
+		text := (*token.Source)[token.Start : token.Start+token.Length]
+		if token.Type != w.typ || text != w.text || token.Line != w.line || token.Column != w.column {
+			t.Errorf("got %d %q at %d:%d, expect %d %q at %d:%d",
+				token.Type, text, token.Line, token.Column, w.typ, w.text, w.line, w.column)
+		}
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	source := "// first\nprint 1; // second\n"
+	scanner.InitScanner(&source)
+	scanner.KeepComments()
+	var comments []string
+	for token := scanner.ScanToken(); token.Type != scanner.TOKEN_EOF; token = scanner.ScanToken() {
+		if token.Type == scanner.TOKEN_COMMENT {
+			comments = append(comments, (*token.Source)[token.Start:token.Start+token.Length])
+		}
+	}
+	if len(comments) != 2 || comments[0] != "// first" || comments[1] != "// second" {
+		t.Errorf("got comments %q", comments)
+	}
+
+	// InitScanner() goes back to skipping them.
+	scanner.InitScanner(&source)
+	if token := scanner.ScanToken(); token.Type != scanner.TOKEN_PRINT {
+		t.Errorf("got token %d, expect print", token.Type)
+	}
+}
@@ -1,6 +1,8 @@
 package table
 
 import (
+	"slices"
+
 	"github.com/davidfung/glox/object"
 	"github.com/davidfung/glox/value"
 )
@@ -46,3 +48,13 @@ func TableDelete(table *Table, key object.ObjString) bool {
 func TableAddAll(from *Table, to *Table) {
 	to.entries = from.entries
 }
+
+// Return the keys of the table in sorted order.
+func TableKeys(table *Table) []object.ObjString {
+	keys := make([]object.ObjString, 0, len(table.entries))
+	for key := range table.entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
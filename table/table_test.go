@@ -1,8 +1,10 @@
 package table
 
 import (
+	"slices"
 	"testing"
 
+	"github.com/davidfung/glox/object"
 	"github.com/davidfung/glox/value"
 )
 
@@ -53,4 +55,9 @@ func TestTable(t *testing.T) {
 	if !ok || len(table2.entries) != 1 {
 		t.Error("table entry deletion error")
 	}
+
+	// table: world
+	if keys := TableKeys(&table); !slices.Equal(keys, []object.ObjString{"world"}) {
+		t.Errorf("table keys error: %v", keys)
+	}
 }
@@ -0,0 +1,52 @@
+package vm
+
+import (
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/value"
+)
+
+// Async natives.  A native which can't produce its result straight
+// away, say because it is waiting on I/O, returns Pending() instead.
+// The VM then parks the script, and Interpret() returns
+// INTERPRET_PENDING to the host, which calls Resume() with the result
+// once it is ready.  The script carries on from the instruction after
+// the native's call, with the result as the value of the call.
+
+// Define a native function for scripts to call.  This lets a host
+// add natives of its own, including async ones.
+func DefineNative(name string, function object.NativeFn) {
+	defineNative(name, function)
+}
+
+// Return the value a native returns to park the script until the host
+// calls Resume().  Like nativeRuntimeError(), this records the reason
+// in the VM and returns the undefined value.
+func Pending() value.Value {
+	vm.pending = true
+	return value.Value{Type_: value.VAL_UNDEFINED}
+}
+
+// Pop the native and its arguments, where Resume() will push the
+// result, and park the VM.
+func parkForResult(argCount int) bool {
+	if vm.ticking {
+		vm.pending = false
+		runtimeError("Can't wait for a pending result in a scheduled fiber.")
+		return false
+	}
+	vm.stackTop -= argCount + 1
+	vm.parked = true
+	return true
+}
+
+// Carry on with the script parked by a native which returned
+// Pending(), with result as the value of the native's call.  The
+// result is as for Interpret(), and may be INTERPRET_PENDING again.
+func Resume(result value.Value) InterpretResult {
+	if !vm.pending {
+		panic("vm: Resume() called with no script waiting")
+	}
+	vm.pending = false
+	push(result)
+	return run()
+}
@@ -0,0 +1,374 @@
+package vm
+
+import (
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/davidfung/glox/chunk"
+	"github.com/davidfung/glox/compiler"
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/table"
+	"github.com/davidfung/glox/value"
+)
+
+// Support for source-level debuggers.  Once a host has called
+// SetDebugHook(), execute() checks before each instruction whether
+// the program should stop there, which is when it starts a new line
+// with a breakpoint, a function with a breakpoint is entered, or a
+// step has finished.  The hook is then called, and can look at the
+// stack with StackFrames(), Locals() and the rest.  Before it returns
+// it picks how to carry on with Continue() or one of the steps.
+//
+// A line is started when an instruction has a different line from
+// the one run before it in the same frame, or when a jump goes back
+// to an earlier instruction on the same line, as a loop on a single
+// line does.  So coming back to a frame from a call does not start
+// its line again.  A step does not stop on a line which starts with
+// the end of a declaration: the closure of a function declaration or
+// a method, or the pop of a class after its methods.  The compiler
+// puts those on the line of the '}', and stopping there would show
+// the end of a function which has not run.  So the first stop of a
+// script which begins with functions and classes is on the statement
+// after them.
+//
+// The breakpoints may be changed from another goroutine while the
+// program runs.  Each change makes a new set of breakpoints, which
+// replaces the old one atomically.
+
+type StopReason int
+
+const (
+	STOP_ENTRY StopReason = iota
+	STOP_BREAKPOINT
+	STOP_STEP
+)
+
+type stepMode int
+
+const (
+	STEP_NONE stepMode = iota // run until a breakpoint
+	STEP_INTO
+	STEP_OVER
+	STEP_OUT
+)
+
+type debugState struct {
+	hook        func(reason StopReason)
+	stopped     bool // the hook is running
+	breakpoints atomic.Pointer[breakpointSet]
+	mode        stepMode
+	stepFiber   *fiber
+	stepDepth   int // frame count when the step began
+}
+
+type breakpointSet struct {
+	lines     map[string]map[int]bool // lines by absolute path
+	functions map[string]bool         // names of functions to stop in
+}
+
+// Return a copy of the breakpoints for a change to be made to.
+func copyBreakpoints() *breakpointSet {
+	set := &breakpointSet{lines: make(map[string]map[int]bool), functions: make(map[string]bool)}
+	if old := vm.debug.breakpoints.Load(); old != nil {
+		maps.Copy(set.lines, old.lines)
+		maps.Copy(set.functions, old.functions)
+	}
+	return set
+}
+
+// A call frame as the debugger sees it.  Frames are numbered from the
+// innermost, which is frame 0.
+type StackFrame struct {
+	Function string // "script" for top-level code
+	Path     string // the file of the script or module, if any
+	Line     int
+}
+
+// A variable and its value.
+type Variable struct {
+	Name  string
+	Value value.Value
+}
+
+// Start debugging.  The hook will be called when the program stops,
+// which is first on the first line it runs.
+func SetDebugHook(hook func(reason StopReason)) {
+	vm.debug.hook = hook
+	vm.debug.mode = STEP_INTO
+	vm.debug.stepFiber = nil
+	if vm.debug.breakpoints.Load() == nil {
+		vm.debug.breakpoints.Store(copyBreakpoints())
+	}
+}
+
+// Replace the line breakpoints in the file at path.
+func SetBreakpoints(path string, lines []int) {
+	set := copyBreakpoints()
+	path = absPath(path)
+	set.lines[path] = make(map[int]bool)
+	for _, line := range lines {
+		set.lines[path][line] = true
+	}
+	vm.debug.breakpoints.Store(set)
+}
+
+// Return the lines with breakpoints in the file at path, in order.
+func Breakpoints(path string) []int {
+	var lines []int
+	for line := range vm.debug.breakpoints.Load().lines[absPath(path)] {
+		lines = append(lines, line)
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// Scripts and modules are known by their absolute paths.  Code which
+// does not come from a file has an empty path.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Replace the function breakpoints.  A function breakpoint stops the
+// program on entering any function with the name.
+func SetFunctionBreakpoints(names []string) {
+	set := copyBreakpoints()
+	set.functions = make(map[string]bool)
+	for _, name := range names {
+		set.functions[name] = true
+	}
+	vm.debug.breakpoints.Store(set)
+}
+
+// Carry on until a breakpoint.
+func Continue() {
+	vm.debug.mode = STEP_NONE
+}
+
+// Carry on to the next line, going into any function called.
+func StepInto() {
+	startStep(STEP_INTO)
+}
+
+// Carry on to the next line of the current function or its callers.
+func StepOver() {
+	startStep(STEP_OVER)
+}
+
+// Carry on until the current function returns.
+func StepOut() {
+	startStep(STEP_OUT)
+}
+
+func startStep(mode stepMode) {
+	vm.debug.mode = mode
+	vm.debug.stepFiber = vm.fiber
+	vm.debug.stepDepth = vm.frameCount
+}
+
+// Called by execute() before each instruction of the frame while a
+// debugger is attached.
+func debugCheck(frame *CallFrame) {
+	if vm.debug.stopped {
+		// The hook is evaluating an expression.
+		return
+	}
+	line := frame.closure.Function.Chun.Lines[frame.ip]
+	newLine := line != frame.lastLine || frame.ip <= frame.lastIP
+	declaration := newLine && endsDeclaration(frame)
+	frame.lastLine = line
+	frame.lastIP = frame.ip
+
+	breakpoints := vm.debug.breakpoints.Load()
+	reason := STOP_STEP
+	stop := false
+	if newLine {
+		stop = stepDone() && !declaration
+		if breakpoints.lines[frame.closure.Module.Path][line] {
+			reason, stop = STOP_BREAKPOINT, true
+		}
+	}
+	if frame.ip == 0 && breakpoints.functions[string(frame.closure.Function.Name)] {
+		reason, stop = STOP_BREAKPOINT, true
+	}
+	if !stop {
+		return
+	}
+	if vm.debug.stepFiber == nil && vm.debug.mode == STEP_INTO && reason == STOP_STEP {
+		// The first stop of the program.
+		reason = STOP_ENTRY
+	}
+
+	vm.debug.mode = STEP_NONE
+	vm.debug.stopped = true
+	vm.debug.hook(reason)
+	vm.debug.stopped = false
+}
+
+// Report whether the next instruction of the frame ends a declaration.
+// A closure is a function declaration's or a method's when its
+// function has a name, and the instruction run before it in the frame
+// tells a class's pop from any other.
+func endsDeclaration(frame *CallFrame) bool {
+	chun := &frame.closure.Function.Chun
+	switch chunk.OpCode(chun.Code[frame.ip]) {
+	case chunk.OP_CLOSURE:
+		function := objval.AS_FUNCTION(chun.Constants.Values[chun.Code[frame.ip+1]])
+		return !strings.HasPrefix(string(function.Name), "anonymous@")
+	case chunk.OP_POP:
+		return frame.lastIP < frame.ip && chunk.OpCode(chun.Code[frame.lastIP]) == chunk.OP_METHOD
+	}
+	return false
+}
+
+// Return whether the step under way has finished, now that a new line
+// is starting.
+func stepDone() bool {
+	switch vm.debug.mode {
+	case STEP_INTO:
+		return true
+	case STEP_OVER, STEP_OUT:
+		step := vm.debug.stepFiber
+		if vm.fiber != step {
+			// Stop once the fiber being stepped is finished with.
+			return step.state == FIBER_DONE
+		}
+		if vm.debug.mode == STEP_OVER {
+			return vm.frameCount <= vm.debug.stepDepth
+		}
+		return vm.frameCount < vm.debug.stepDepth
+	}
+	return false
+}
+
+// Return the frames of the running fiber, innermost first.
+func StackFrames() []StackFrame {
+	var frames []StackFrame
+	for i := vm.frameCount - 1; i >= 0; i-- {
+		frame := &vm.frames[i]
+		function := frame.closure.Function
+		name := "script"
+		if function.Name != "" {
+			name = string(function.Name) + "()"
+		}
+		frames = append(frames, StackFrame{
+			Function: name,
+			Path:     frame.closure.Module.Path,
+			Line:     function.Chun.Lines[frameIP(i)],
+		})
+	}
+	return frames
+}
+
+// Return the call frame numbered n by StackFrames().
+func debugFrame(n int) *CallFrame {
+	return &vm.frames[vm.frameCount-1-n]
+}
+
+// Return the offset of the instruction the frame at index i is at.
+// That is the next one to run for the top frame, and the call being
+// made for the others.
+func frameIP(i int) int {
+	if i == vm.frameCount-1 {
+		return vm.frames[i].ip
+	}
+	return vm.frames[i].ip - 1
+}
+
+// Return the locals in scope in frame n, in the order they were
+// declared.  Where a name is declared again in an inner block, only
+// the inner variable is shown.
+func Locals(n int) []Variable {
+	frame := debugFrame(n)
+	ip := frameIP(vm.frameCount - 1 - n)
+	var locals []Variable
+	for _, local := range frame.closure.Function.Chun.Locals {
+		if ip < local.Start || ip >= local.End {
+			continue
+		}
+		variable := Variable{Name: local.Name, Value: frame.slots[local.Slot]}
+		index := slices.IndexFunc(locals, func(v Variable) bool { return v.Name == local.Name })
+		if index != -1 {
+			locals[index] = variable
+		} else {
+			locals = append(locals, variable)
+		}
+	}
+	return locals
+}
+
+// Return the variables captured by the closure of frame n.
+func Upvalues(n int) []Variable {
+	closure := debugFrame(n).closure
+	var upvalues []Variable
+	for i, name := range closure.Function.Chun.UpvalueNames {
+		upvalues = append(upvalues, Variable{Name: name, Value: *closure.Upvalues[i].Location})
+	}
+	return upvalues
+}
+
+// Return the globals of the module frame n is running in.
+func FrameGlobals(n int) []Variable {
+	globals := debugFrame(n).closure.Module.Globals
+	var variables []Variable
+	for _, name := range table.TableKeys(globals) {
+		val, _ := table.TableGet(globals, name)
+		variables = append(variables, Variable{Name: string(name), Value: val})
+	}
+	return variables
+}
+
+// Evaluate an expression as if it were in frame n, where it can use
+// the locals and upvalues of the frame as well as globals.  The
+// variables are passed to it by value, so assigning to them has no
+// effect on the program.  A compile error is also reported on stderr,
+// as usual.
+func Evaluate(n int, source string) (value.Value, error) {
+	if !vm.debug.stopped {
+		panic("vm: Evaluate() called while the program is running")
+	}
+	var names []string
+	var values []value.Value
+	for _, variable := range append(Upvalues(n), Locals(n)...) {
+		if i := slices.Index(names, variable.Name); i != -1 {
+			// A local hides an upvalue with the same name.
+			values[i] = variable.Value
+			continue
+		}
+		names = append(names, variable.Name)
+		values = append(values, variable.Value)
+	}
+
+	function := compiler.CompileExpression(&source, names)
+	if function.Arity == -1 {
+		return value.Value{}, errors.New("Invalid expression.")
+	}
+	closure := objval.NewClosure(function)
+	closure.Module = debugFrame(n).closure.Module
+
+	// Run it in a fiber of its own, so that the program's stack is
+	// left alone whatever happens.
+	running := vm.fiber
+	f := newFiber(closure)
+	f.state = FIBER_RUNNING
+	vm.fiber = f
+	defer func() { vm.fiber = running }()
+	push(objval.OBJ_VAL(object.Obj{Type_: object.OBJ_CLOSURE, Val: closure}))
+	for _, val := range values {
+		push(val)
+	}
+	if !call(closure, uint(len(values))) || run() != INTERPRET_OK {
+		return value.Value{}, errors.New(exceptionMessage())
+	}
+	return f.result, nil
+}
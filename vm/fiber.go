@@ -0,0 +1,209 @@
+package vm
+
+import (
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/value"
+)
+
+// Fibers.  Fiber(fn) creates a fiber which will run fn with a value
+// stack and call frames of its own.  fiber.resume(value) runs it until
+// it calls Fiber.yield(value) or fn returns, and the value yielded or
+// returned becomes the result of resume().  On the first resume the
+// value is passed to fn, if fn takes a parameter, and after that it
+// becomes the result of the Fiber.yield() call the fiber resumes from.
+//
+// Switching fibers is just a matter of pointing vm.fiber at another
+// one, after which execute() carries on with that fiber's top frame.
+//
+// Fibers passed to schedule() are stepped by the host calling Tick().
+// A fiber being stepped has no caller, so its Fiber.yield() parks the
+// VM, and execute() returns to Tick().
+
+type fiberState int
+
+const (
+	FIBER_NEW fiberState = iota
+	FIBER_RUNNING
+	FIBER_SUSPENDED
+	FIBER_DONE
+)
+
+type fiber struct {
+	frames       []CallFrame
+	frameCount   int
+	stack        []value.Value
+	stackTop     int
+	openUpvalues *objval.ObjUpvalue
+
+	closure *objval.ObjClosure // the function the fiber runs
+	caller  *fiber             // the fiber which resumed this one
+	state   fiberState
+	result  value.Value // what the function returned, once it has
+}
+
+func newFiber(closure *objval.ObjClosure) *fiber {
+	f := new(fiber)
+	f.frames = make([]CallFrame, FRAMES_INIT)
+	f.stack = make([]value.Value, STACK_INIT)
+	f.closure = closure
+	return f
+}
+
+func fiberVal(f *fiber) value.Value {
+	return objval.OBJ_VAL(object.Obj{Type_: object.OBJ_FIBER, Val: f})
+}
+
+func asFiber(v value.Value) *fiber {
+	return objval.AS_OBJ(v).Val.(*fiber)
+}
+
+func defineFiberNatives() {
+	defineNative("schedule", scheduleNative)
+}
+
+// Fiber(fn) replaces the class and its argument on the stack.
+func createFiber(argCount int) bool {
+	if argCount != 1 {
+		runtimeError("Expected 1 argument but got %d.", argCount)
+		return false
+	}
+	if !objval.IS_CLOSURE(peek(0)) {
+		runtimeError("Argument of Fiber() must be a function.")
+		return false
+	}
+	closure := objval.AS_CLOSURE(peek(0))
+	if closure.Function.MinArity > 1 {
+		runtimeError("Function of a fiber can take at most one argument.")
+		return false
+	}
+	if closure.Function.IsGenerator {
+		runtimeError("Function of a fiber can't be a generator.")
+		return false
+	}
+	vm.stackTop -= 2
+	push(fiberVal(newFiber(closure)))
+	return true
+}
+
+// Switch to the fiber, leaving value as the result of the call to
+// Fiber.yield() it is suspended in, or passing it to the fiber's
+// function if it has not started yet.
+func resumeFiber(f *fiber, val value.Value) bool {
+	switch f.state {
+	case FIBER_RUNNING:
+		runtimeError("Fiber is already running.")
+		return false
+	case FIBER_DONE:
+		runtimeError("Can't resume a finished fiber.")
+		return false
+	}
+	return enterFiber(f, vm.fiber, val)
+}
+
+func enterFiber(f *fiber, caller *fiber, val value.Value) bool {
+	f.caller = caller
+	vm.fiber = f
+	if f.state == FIBER_SUSPENDED {
+		f.state = FIBER_RUNNING
+		push(val)
+		return true
+	}
+
+	f.state = FIBER_RUNNING
+	push(objval.OBJ_VAL(object.Obj{Type_: object.OBJ_CLOSURE, Val: f.closure}))
+	argCount := 0
+	if f.closure.Function.Arity > 0 {
+		push(val)
+		argCount = 1
+	}
+	return call(f.closure, uint(argCount))
+}
+
+// Fiber.yield(value) suspends the running fiber, and switches back to
+// the fiber which resumed it, for which value is the result of
+// resume().  A fiber stepped by Tick() instead parks the VM.
+func yieldFiber(val value.Value) bool {
+	if vm.fiber == vm.mainFiber {
+		runtimeError("Can't yield from the main fiber.")
+		return false
+	}
+	caller := vm.caller
+	vm.caller = nil
+	vm.state = FIBER_SUSPENDED
+	if caller == nil {
+		vm.parked = true
+		return true
+	}
+	vm.fiber = caller
+	push(val)
+	return true
+}
+
+// The function of the running fiber has returned val.  Switch back to
+// the fiber which resumed it, if any, and return whether there was one.
+func finishFiber(val value.Value) bool {
+	vm.state = FIBER_DONE
+	vm.result = val
+	caller := vm.caller
+	vm.caller = nil
+	if caller == nil {
+		return false
+	}
+	vm.fiber = caller
+	push(val)
+	return true
+}
+
+// schedule(fiber) adds a fiber to those stepped by Tick().
+func scheduleNative(argCount int, args []value.Value) value.Value {
+	if msg := checkArity("schedule", argCount, 1); msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	if !objval.IS_FIBER(args[0]) {
+		return nativeRuntimeError("Argument of schedule() must be a fiber.")
+	}
+	vm.scheduled = append(vm.scheduled, asFiber(args[0]))
+	return args[0]
+}
+
+// Return the number of fibers waiting to be stepped by Tick().
+func Scheduled() int {
+	return len(vm.scheduled)
+}
+
+// Step each scheduled fiber in turn, running it until it yields or
+// finishes.  Fibers which have finished are taken off the schedule.
+// Return INTERPRET_RUNTIME_ERROR if any fiber failed with an uncaught
+// exception, after reporting it.
+func Tick() InterpretResult {
+	result := INTERPRET_OK
+	fibers := vm.scheduled
+	vm.scheduled = nil
+	vm.ticking = true
+	defer func() { vm.ticking = false }()
+	var kept []*fiber
+	for _, f := range fibers {
+		if f.state == FIBER_RUNNING {
+			// It is in the middle of resuming another fiber.
+			kept = append(kept, f)
+			continue
+		}
+		if f.state == FIBER_DONE {
+			continue
+		}
+		// This can't fail, since createFiber() checked the arity of
+		// the fiber's function.
+		enterFiber(f, nil, objval.NIL_VAL())
+		if run() == INTERPRET_RUNTIME_ERROR {
+			result = INTERPRET_RUNTIME_ERROR
+		}
+		vm.fiber = vm.mainFiber
+		if f.state != FIBER_DONE {
+			kept = append(kept, f)
+		}
+	}
+	// Fibers scheduled during this tick come after the others.
+	vm.scheduled = append(kept, vm.scheduled...)
+	return result
+}
@@ -0,0 +1,128 @@
+package vm
+
+import (
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/value"
+)
+
+// Generators.  Calling a generator function runs none of its body.
+// Instead call() moves the callee and the arguments off the stack into
+// a new generator.  Each call of the generator's next() method pushes
+// a frame which carries on with the body from where it left off, and
+// OP_YIELD suspends it again by moving the frame's slots back into the
+// generator, leaving the value yielded as the result of next().  The
+// argument of the next() which resumes it is then pushed as the value
+// of the yield expression.
+//
+// Closures may have captured locals of the generator.  While it is
+// suspended, their open upvalues point into the generator's saved
+// slots, and they are pointed back at the stack when it resumes.
+
+func newGenerator(closure *objval.ObjClosure, argCount int) {
+	base := vm.stackTop - argCount - 1
+	generator := &objval.ObjGenerator{
+		Closure: closure,
+		Slots:   append([]value.Value(nil), vm.stack[base:vm.stackTop]...),
+	}
+	vm.stackTop = base
+	push(objval.GENERATOR_VAL(generator))
+}
+
+// Push a frame which resumes the generator.  The value it yields will
+// be left where the stack top is now.  If the generator is suspended
+// at a yield, arg becomes the value of the yield expression; on the
+// first call it is dropped, as there is no yield yet to receive it.  A
+// generator which has finished just produces nil, and isDone() tells
+// that apart from yielding nil.
+func resumeGenerator(generator *objval.ObjGenerator, arg value.Value) bool {
+	if generator.Done {
+		push(objval.NIL_VAL())
+		return true
+	}
+	if generator.Running {
+		runtimeError("Generator is already running.")
+		return false
+	}
+	if vm.frameCount == FRAMES_MAX {
+		runtimeError("Stack overflow.")
+		return false
+	}
+
+	frame := pushFrame()
+	frame.closure = *generator.Closure
+	frame.ip = generator.IP
+	frame.base = vm.stackTop
+	frame.slots = vm.stack[frame.base:]
+	frame.module = nil
+	frame.generator = generator
+	frame.lastLine = 0
+	for _, slot := range generator.Slots {
+		push(slot)
+	}
+
+	// The frame is above every other frame, so its upvalues go at the
+	// head of the open upvalue list, which is sorted by stack slot.
+	for i := len(generator.Upvalues) - 1; i >= 0; i-- {
+		upvalue := generator.Upvalues[i]
+		upvalue.Location = &frame.slots[savedSlot(generator, upvalue)]
+		upvalue.Next = vm.openUpvalues
+		vm.openUpvalues = upvalue
+	}
+
+	if generator.IP > 0 {
+		push(arg)
+	}
+
+	generator.Slots = nil
+	generator.Upvalues = nil
+	generator.Running = true
+	return true
+}
+
+// Save the slots of the generator's frame, which is the top one, and
+// pop the frame.
+func suspendGenerator(frame *CallFrame) {
+	generator := frame.generator
+	generator.Slots = append([]value.Value(nil), vm.stack[frame.base:vm.stackTop]...)
+	generator.IP = frame.ip
+	for vm.openUpvalues != nil {
+		upvalue := vm.openUpvalues
+		slot := frameSlot(frame, upvalue.Location)
+		if slot == -1 {
+			break
+		}
+		upvalue.Location = &generator.Slots[slot]
+		generator.Upvalues = append(generator.Upvalues, upvalue)
+		vm.openUpvalues = upvalue.Next
+	}
+	generator.Running = false
+	vm.frameCount--
+	vm.stackTop = frame.base
+}
+
+// Mark the generator of a frame which is returning or being unwound
+// by an exception as finished.
+func finishGenerator(frame *CallFrame) {
+	frame.generator.Running = false
+	frame.generator.Done = true
+}
+
+// Return the index of the frame's slot that location points to, or
+// -1 if it points to none of them.
+func frameSlot(frame *CallFrame, location *value.Value) int {
+	for i := range vm.stackTop - frame.base {
+		if location == &frame.slots[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+func savedSlot(generator *objval.ObjGenerator, upvalue *objval.ObjUpvalue) int {
+	for i := range generator.Slots {
+		if upvalue.Location == &generator.Slots[i] {
+			return i
+		}
+	}
+	panic("upvalue does not point into the generator's slots")
+}
@@ -0,0 +1,152 @@
+package vm
+
+import (
+	"unicode/utf8"
+
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/table"
+	"github.com/davidfung/glox/value"
+)
+
+// The iterator protocol behind for-in loops.  Strings, lists, maps
+// and ranges have built-in iterators, and a generator is resumed for
+// each item until it finishes.  An instance of a user class is
+// iterated by calling its iterator() method, if it has one, and then
+// calling next() on the result until it returns nil.  An instance
+// with a next() method but no iterator() method is its own iterator.
+
+func defineIteratorNatives() {
+	defineNative("range", rangeNative)
+}
+
+// Replace the value on top of the stack with an iterator over it.
+// For an instance with an iterator() method this calls the method,
+// and the iterator is on the stack once the call returns.
+func makeIterator() bool {
+	val := peek(0)
+	var iterator *object.ObjIterator
+	switch {
+	case objval.IS_STRING(val):
+		iterator = stringIterator(string(objval.AS_STRING(val)))
+	case objval.IS_LIST(val):
+		iterator = listIterator(objval.AS_LIST(val))
+	case objval.IS_MAP(val):
+		iterator = mapIterator(objval.AS_MAP(val))
+	case objval.IS_ITERATOR(val), objval.IS_GENERATOR(val):
+		return true
+	case objval.IS_INSTANCE(val):
+		klass := objval.AS_INSTANCE(val).Klass
+		if _, ok := table.TableGet(&klass.Methods, "iterator"); ok {
+			return bindMethod(klass, "iterator") && callValue(peek(0), 0)
+		}
+		if _, ok := table.TableGet(&klass.Methods, "next"); ok {
+			return true
+		}
+		runtimeError("Instance of %s has no iterator() or next() method.", klass.Name)
+		return false
+	default:
+		runtimeError("Can only iterate over strings, lists, maps, ranges, generators and iterators.")
+		return false
+	}
+	pop()
+	push(objval.ITERATOR_VAL(iterator))
+	return true
+}
+
+// Push the next item from the iterator, or undefined if there are
+// no more.  For an instance this calls its next() method, which
+// signals the end by returning nil instead.
+func iteratorNext(iterator value.Value) bool {
+	if objval.IS_ITERATOR(iterator) {
+		item, ok := objval.AS_ITERATOR(iterator).Next()
+		if !ok {
+			item = value.Value{Type_: value.VAL_UNDEFINED}
+		}
+		push(item)
+		return true
+	}
+	if objval.IS_GENERATOR(iterator) {
+		return resumeGenerator(objval.AS_GENERATOR(iterator), objval.NIL_VAL())
+	}
+	if !objval.IS_INSTANCE(iterator) {
+		runtimeError("Iterator must be an instance with a next() method.")
+		return false
+	}
+	push(iterator)
+	return bindMethod(objval.AS_INSTANCE(iterator).Klass, "next") && callValue(peek(0), 0)
+}
+
+// Return whether item, pushed by iteratorNext(), marks the end of
+// the iteration.
+func iteratorDone(iterator value.Value, item value.Value) bool {
+	if objval.IS_GENERATOR(iterator) {
+		return objval.AS_GENERATOR(iterator).Done
+	}
+	if objval.IS_INSTANCE(iterator) {
+		return objval.IS_NIL(item)
+	}
+	return item.Type_ == value.VAL_UNDEFINED
+}
+
+// A string is iterated one code point at a time.
+func stringIterator(s string) *object.ObjIterator {
+	return &object.ObjIterator{Next: func() (value.Value, bool) {
+		if s == "" {
+			return value.Value{}, false
+		}
+		_, size := utf8.DecodeRuneInString(s)
+		item := objval.STRING_VAL(s[:size])
+		s = s[size:]
+		return item, true
+	}}
+}
+
+// The length of a list is checked on every step, so items appended
+// by the loop body are iterated too.
+func listIterator(list *object.ObjList) *object.ObjIterator {
+	i := 0
+	return &object.ObjIterator{Next: func() (value.Value, bool) {
+		if i >= len(list.Items) {
+			return value.Value{}, false
+		}
+		i++
+		return list.Items[i-1], true
+	}}
+}
+
+// range(end), range(start, end) or range(start, end, step) returns an
+// iterator over the integers from start up to but not including end.
+// A negative step counts down instead.
+func rangeNative(argCount int, args []value.Value) value.Value {
+	if argCount < 1 || argCount > 3 {
+		return nativeRuntimeError("Expected 1 to 3 arguments but got %d in range().", argCount)
+	}
+	var bounds [3]int
+	for i := range argCount {
+		n, msg := numberArg("range", args, i)
+		if msg != "" {
+			return nativeRuntimeError("%s", msg)
+		}
+		bounds[i] = n
+	}
+	start, end, step := 0, bounds[0], 1
+	if argCount > 1 {
+		start, end = bounds[0], bounds[1]
+	}
+	if argCount > 2 {
+		step = bounds[2]
+	}
+	if step == 0 {
+		return nativeRuntimeError("Step of range() must not be zero.")
+	}
+
+	i := start
+	return objval.ITERATOR_VAL(&object.ObjIterator{Next: func() (value.Value, bool) {
+		if (step > 0 && i >= end) || (step < 0 && i <= end) {
+			return value.Value{}, false
+		}
+		i += step
+		return objval.NUMBER_VAL(float64(i - step)), true
+	}})
+}
@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/value"
+)
+
+// Maps are built by map literals {key: value, ...} and indexed like
+// lists, m[key] and m[key] = value.  Looking up a missing key gives
+// nil.  The rest of the map library is plain native functions taking
+// the map as their first argument, like the string library:
+// keys(m), has(m, key) and remove(m, key), with len(m) shared with
+// strings and lists.  A for-in loop over a map iterates its keys.
+
+func defineMapNatives() {
+	defineNative("keys", keysNative)
+	defineNative("has", hasNative)
+	defineNative("remove", removeNative)
+}
+
+// Return an error message if key can't be used as a map key,
+// otherwise return an empty string.  A key is looked up by its Val,
+// which only identifies it for strings, numbers and booleans, and
+// NaN is not equal to itself so it could never be found again.
+func checkMapKey(key value.Value) string {
+	switch {
+	case objval.IS_STRING(key), objval.IS_BOOL(key):
+		return ""
+	case objval.IS_NUMBER(key):
+		if math.IsNaN(objval.AS_NUMBER(key)) {
+			return "Map key must not be NaN."
+		}
+		return ""
+	}
+	return "Map key must be a string, a number or a boolean."
+}
+
+// Replace the keys and values of the top entryCount pairs on the
+// stack with a map of them.  A key given twice keeps its first
+// position and its last value.
+func buildMap(entryCount int) InterpretResult {
+	m := object.NewMap()
+	base := vm.stackTop - 2*entryCount
+	for i := 0; i < entryCount; i++ {
+		key := vm.stack[base+2*i]
+		if msg := checkMapKey(key); msg != "" {
+			runtimeError("%s", msg)
+			return INTERPRET_RUNTIME_ERROR
+		}
+		m.Set(key, vm.stack[base+2*i+1])
+	}
+	vm.stackTop = base
+	push(objval.MAP_VAL(m))
+	return INTERPRET_OK
+}
+
+// The keys are copied when the iteration starts, so the loop body
+// can add and remove entries without upsetting it.
+func mapIterator(m *object.ObjMap) *object.ObjIterator {
+	return listIterator(object.NewList(append([]value.Value(nil), m.Keys...)))
+}
+
+// Check the arity and that the first argument is a map, and the
+// second, if there is one, a valid key.
+func mapArgs(name string, argCount int, args []value.Value, arity int) (*object.ObjMap, string) {
+	if msg := checkArity(name, argCount, arity); msg != "" {
+		return nil, msg
+	}
+	if !objval.IS_MAP(args[0]) {
+		return nil, fmt.Sprintf("Argument 1 of %s() must be a map.", name)
+	}
+	if arity > 1 {
+		if msg := checkMapKey(args[1]); msg != "" {
+			return nil, msg
+		}
+	}
+	return objval.AS_MAP(args[0]), ""
+}
+
+// keys(m) returns a new list of the keys of m, in the order in which
+// they were added.
+func keysNative(argCount int, args []value.Value) value.Value {
+	m, msg := mapArgs("keys", argCount, args, 1)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.LIST_VAL(object.NewList(append([]value.Value(nil), m.Keys...)))
+}
+
+// has(m, key) returns whether m has an entry for key, which tells a
+// missing key from one whose value is nil.
+func hasNative(argCount int, args []value.Value) value.Value {
+	m, msg := mapArgs("has", argCount, args, 2)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	_, ok := m.Get(args[1])
+	return objval.BOOL_VAL(ok)
+}
+
+// remove(m, key) removes the entry for key and returns its value, or
+// nil if there was none.
+func removeNative(argCount int, args []value.Value) value.Value {
+	m, msg := mapArgs("remove", argCount, args, 2)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	val, ok := m.Get(args[1])
+	if !ok {
+		return objval.NIL_VAL()
+	}
+	m.Delete(args[1])
+	return val
+}
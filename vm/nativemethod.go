@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"slices"
+
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/value"
+)
+
+// Methods of built-in objects.  Looking one up binds it to the object
+// in an ObjNativeMethod, and callNativeMethod() dispatches the call on
+// the receiver's kind and the method's name.
+
+func nativeMethodNames(receiver value.Value) []object.ObjString {
+	switch {
+	case objval.IS_GENERATOR(receiver):
+		return []object.ObjString{"next", "isDone"}
+	case objval.IS_FIBER(receiver):
+		return []object.ObjString{"resume", "isDone"}
+	case objval.IS_CLASS(receiver) && objval.AS_CLASS(receiver) == vm.fiberClass:
+		return []object.ObjString{"yield"}
+	}
+	return nil
+}
+
+func hasNativeMethods(receiver value.Value) bool {
+	return nativeMethodNames(receiver) != nil
+}
+
+// Replace the receiver on top of the stack with its method.
+func getNativeMethod(receiver value.Value, name object.ObjString) bool {
+	if !slices.Contains(nativeMethodNames(receiver), name) {
+		runtimeError("Undefined property '%s'.", name)
+		return false
+	}
+	method := &objval.ObjNativeMethod{Receiver: receiver, Name: name}
+	pop() // receiver
+	push(objval.NATIVE_METHOD_VAL(method))
+	return true
+}
+
+// The method and its arguments are on top of the stack.  A method
+// either replaces them with its result, or, like next() and resume(),
+// switches to code which will leave its result there.
+func callNativeMethod(method *objval.ObjNativeMethod, argCount int) bool {
+	maxArgs := 0
+	if method.Name == "next" || method.Name == "resume" || method.Name == "yield" {
+		maxArgs = 1
+	}
+	if argCount > maxArgs {
+		runtimeError("Expected at most %s but got %d in %s().", arguments(maxArgs), argCount, method.Name)
+		return false
+	}
+	arg := objval.NIL_VAL()
+	if argCount == 1 {
+		arg = peek(0)
+	}
+	vm.stackTop -= argCount + 1
+
+	switch method.Name {
+	case "next":
+		return resumeGenerator(objval.AS_GENERATOR(method.Receiver), arg)
+	case "resume":
+		return resumeFiber(asFiber(method.Receiver), arg)
+	case "isDone":
+		if objval.IS_GENERATOR(method.Receiver) {
+			push(objval.BOOL_VAL(objval.AS_GENERATOR(method.Receiver).Done))
+		} else {
+			push(objval.BOOL_VAL(asFiber(method.Receiver).state == FIBER_DONE))
+		}
+		return true
+	case "yield":
+		return yieldFiber(arg)
+	}
+	return true
+}
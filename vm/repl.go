@@ -0,0 +1,51 @@
+package vm
+
+import (
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/table"
+	"github.com/davidfung/glox/value"
+)
+
+// Looking into the VM from the REPL.
+
+// Return the names of the script's globals in sorted order.
+func Globals() []string {
+	var names []string
+	for _, name := range table.TableKeys(&vm.globals) {
+		names = append(names, string(name))
+	}
+	return names
+}
+
+// Return the value of a global of the script, or of a native
+// function if there is no such global.
+func Global(name string) (value.Value, bool) {
+	if val, ok := table.TableGet(&vm.globals, object.ObjString(name)); ok {
+		return val, true
+	}
+	return table.TableGet(&vm.builtins, object.ObjString(name))
+}
+
+// Forget the globals of the script, the modules it has imported and
+// the fibers it has scheduled, so that the REPL can start afresh.
+// Natives, including those the host has defined, are kept.
+func ResetGlobals() {
+	vm.fiber = vm.mainFiber
+	vm.scheduled = nil
+	vm.pending = false
+	resetStack()
+	table.InitTable(&vm.globals)
+	table.InitTable(&vm.modules)
+	vm.mainModule.Path = ""
+	vm.mainModule.Consts = make(map[object.ObjString]bool)
+}
+
+// Return the names of the natives, including those the host has
+// defined, in sorted order.
+func Natives() []string {
+	var names []string
+	for _, name := range table.TableKeys(&vm.builtins) {
+		names = append(names, string(name))
+	}
+	return names
+}
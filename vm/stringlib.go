@@ -0,0 +1,240 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/davidfung/glox/object"
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/value"
+)
+
+// The string standard library.  Lox has no methods on strings, so
+// these are all plain native functions taking the string as their
+// first argument, e.g. upper("abc").
+//
+// Lengths and indexes are counted in code points, not in the bytes
+// of the UTF-8 encoding, so len("né") is 2.
+
+func defineStringNatives() {
+	defineNative("len", lenNative)
+	defineNative("substr", substrNative)
+	defineNative("indexOf", indexOfNative)
+	defineNative("split", splitNative)
+	defineNative("join", joinNative)
+	defineNative("trim", trimNative)
+	defineNative("upper", upperNative)
+	defineNative("lower", lowerNative)
+	defineNative("replace", replaceNative)
+	defineNative("startsWith", startsWithNative)
+	defineNative("contains", containsNative)
+	defineNative("toString", toStringNative)
+	defineNative("parseNumber", parseNumberNative)
+}
+
+// Return an error message if argCount is not what the native expects,
+// otherwise return an empty string.
+func checkArity(name string, argCount int, arity int) string {
+	if argCount != arity {
+		return fmt.Sprintf("Expected %s but got %d in %s().", arguments(arity), argCount, name)
+	}
+	return ""
+}
+
+// Check the arity and that every argument is a string, then return
+// the arguments as Go strings.
+func stringArgs(name string, argCount int, args []value.Value, arity int) ([]string, string) {
+	if msg := checkArity(name, argCount, arity); msg != "" {
+		return nil, msg
+	}
+	strs := make([]string, arity)
+	for i, arg := range args {
+		if !objval.IS_STRING(arg) {
+			return nil, fmt.Sprintf("Argument %d of %s() must be a string.", i+1, name)
+		}
+		strs[i] = string(objval.AS_STRING(arg))
+	}
+	return strs, ""
+}
+
+func numberArg(name string, args []value.Value, i int) (int, string) {
+	if !objval.IS_NUMBER(args[i]) {
+		return 0, fmt.Sprintf("Argument %d of %s() must be a number.", i+1, name)
+	}
+	n := objval.AS_NUMBER(args[i])
+	if float64(int(n)) != n {
+		return 0, fmt.Sprintf("Argument %d of %s() must be an integer.", i+1, name)
+	}
+	return int(n), ""
+}
+
+func lenNative(argCount int, args []value.Value) value.Value {
+	if msg := checkArity("len", argCount, 1); msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	if objval.IS_STRING(args[0]) {
+		return objval.NUMBER_VAL(float64(utf8.RuneCountInString(string(objval.AS_STRING(args[0])))))
+	}
+	if objval.IS_LIST(args[0]) {
+		return objval.NUMBER_VAL(float64(len(objval.AS_LIST(args[0]).Items)))
+	}
+	if objval.IS_MAP(args[0]) {
+		return objval.NUMBER_VAL(float64(len(objval.AS_MAP(args[0]).Keys)))
+	}
+	return nativeRuntimeError("Argument of len() must be a string, a list or a map.")
+}
+
+// substr(str, start, length) returns length characters of str
+// beginning at start.  If length runs past the end of the string
+// the result stops at the end.  The length may be omitted.
+func substrNative(argCount int, args []value.Value) value.Value {
+	if argCount != 2 && argCount != 3 {
+		return nativeRuntimeError("Expected 2 or 3 arguments but got %d in substr().", argCount)
+	}
+	if !objval.IS_STRING(args[0]) {
+		return nativeRuntimeError("Argument 1 of substr() must be a string.")
+	}
+	s := []rune(string(objval.AS_STRING(args[0])))
+	start, msg := numberArg("substr", args, 1)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	if start < 0 || start > len(s) {
+		return nativeRuntimeError("Start index %d out of bounds in substr().", start)
+	}
+	end := len(s)
+	if argCount == 3 {
+		length, msg := numberArg("substr", args, 2)
+		if msg != "" {
+			return nativeRuntimeError("%s", msg)
+		}
+		if length < 0 {
+			return nativeRuntimeError("Length must not be negative in substr().")
+		}
+		end = min(start+length, len(s))
+	}
+	return objval.STRING_VAL(string(s[start:end]))
+}
+
+// indexOf(str, sub) returns the index of the first occurrence of
+// sub in str, or -1 if there is none.
+func indexOfNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("indexOf", argCount, args, 2)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	i := strings.Index(strs[0], strs[1])
+	if i > 0 {
+		i = utf8.RuneCountInString(strs[0][:i])
+	}
+	return objval.NUMBER_VAL(float64(i))
+}
+
+// split(str, sep) returns a list of the substrings between each
+// occurrence of sep.  An empty sep splits str into characters.
+func splitNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("split", argCount, args, 2)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	parts := strings.Split(strs[0], strs[1])
+	items := make([]value.Value, len(parts))
+	for i, part := range parts {
+		items[i] = objval.STRING_VAL(part)
+	}
+	return objval.LIST_VAL(object.NewList(items))
+}
+
+// join(list, sep) concatenates the elements of list, converting
+// each to a string as toString() would, with sep between them.
+func joinNative(argCount int, args []value.Value) value.Value {
+	if msg := checkArity("join", argCount, 2); msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	if !objval.IS_LIST(args[0]) {
+		return nativeRuntimeError("Argument 1 of join() must be a list.")
+	}
+	if !objval.IS_STRING(args[1]) {
+		return nativeRuntimeError("Argument 2 of join() must be a string.")
+	}
+	items := objval.AS_LIST(args[0]).Items
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = objval.ValueToString(item)
+	}
+	return objval.STRING_VAL(strings.Join(parts, string(objval.AS_STRING(args[1]))))
+}
+
+func trimNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("trim", argCount, args, 1)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.STRING_VAL(strings.TrimSpace(strs[0]))
+}
+
+func upperNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("upper", argCount, args, 1)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.STRING_VAL(strings.ToUpper(strs[0]))
+}
+
+func lowerNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("lower", argCount, args, 1)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.STRING_VAL(strings.ToLower(strs[0]))
+}
+
+// replace(str, old, new) replaces every occurrence of old with new.
+func replaceNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("replace", argCount, args, 3)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.STRING_VAL(strings.ReplaceAll(strs[0], strs[1], strs[2]))
+}
+
+func startsWithNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("startsWith", argCount, args, 2)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.BOOL_VAL(strings.HasPrefix(strs[0], strs[1]))
+}
+
+func containsNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("contains", argCount, args, 2)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.BOOL_VAL(strings.Contains(strs[0], strs[1]))
+}
+
+// toString(value) converts any value to the string that the
+// print statement would display for it.
+func toStringNative(argCount int, args []value.Value) value.Value {
+	if msg := checkArity("toString", argCount, 1); msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	return objval.STRING_VAL(objval.ValueToString(args[0]))
+}
+
+// parseNumber(str) returns the number written in str, or nil if
+// str is not a number.
+func parseNumberNative(argCount int, args []value.Value) value.Value {
+	strs, msg := stringArgs("parseNumber", argCount, args, 1)
+	if msg != "" {
+		return nativeRuntimeError("%s", msg)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(strs[0]), 64)
+	if err != nil {
+		return objval.NIL_VAL()
+	}
+	return objval.NUMBER_VAL(n)
+}
@@ -2,7 +2,11 @@ package vm
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/davidfung/glox/chunk"
@@ -16,21 +20,64 @@ import (
 )
 
 const FRAMES_MAX = 64
-const STACK_MAX = (FRAMES_MAX * common.UINT8_COUNT)
+
+// A fiber's value stack and call frames start this small and double
+// when they fill up, so that a program can afford many fibers.  The
+// stack has room for the slots of one function to begin with.
+const STACK_INIT = common.UINT8_COUNT
+const FRAMES_INIT = 8
 
 type VM struct {
-	frames       [FRAMES_MAX]CallFrame
-	frameCount   int
-	stack        [STACK_MAX]value.Value
-	stackTop     int
-	globals      table.Table
-	openUpvalues *objval.ObjUpvalue
+	// The fiber running now.  Embedding it means that vm.stack,
+	// vm.frames and the rest are always those of the running fiber.
+	*fiber
+	mainFiber *fiber
+	scheduled []*fiber // fibers for Tick() to step, in round-robin order
+
+	// Set when the running fiber gives control back to the host, so
+	// that execute() returns after the instruction doing it.  pending
+	// is also set if that is to wait for the result of a native, and
+	// ticking while Tick() is stepping fibers.
+	parked  bool
+	pending bool
+	ticking bool
+
+	globals     table.Table
+	nativeError string
+
+	// Native functions live in their own table so that every module
+	// can see them, while each module has its own globals.  The main
+	// script is a module too, whose globals are vm.globals.
+	builtins   table.Table
+	modules    table.Table // imported modules by absolute path
+	mainModule *objval.ObjModule
+
+	// The value being thrown while the stack unwinds, and the stack
+	// trace at the point it was thrown.  Runtime errors are thrown as
+	// instances of errorClass.
+	exception      value.Value
+	exceptionTrace []string
+	errorClass     *objval.ObjClass
+	fiberClass     *objval.ObjClass
+
+	debug debugState
 }
 
+// In clox, slots is a pointer into the VM's value stack.  In glox,
+// slots is a slice of the stack starting at the frame's first slot,
+// and base is the index of that slot in the stack.
 type CallFrame struct {
-	closure objval.ObjClosure
-	ip      int
-	slots   []value.Value
+	closure   objval.ObjClosure
+	ip        int
+	slots     []value.Value
+	base      int
+	module    *objval.ObjModule    // set if the frame runs an imported module's top-level code
+	generator *objval.ObjGenerator // set if the frame runs the body of a generator
+
+	// The line and offset of the instruction run last, for the
+	// debugger to tell when a new line starts.
+	lastLine int
+	lastIP   int
 }
 
 type InterpretResult int
@@ -39,6 +86,7 @@ const (
 	INTERPRET_OK InterpretResult = iota
 	INTERPRET_COMPILE_ERROR
 	INTERPRET_RUNTIME_ERROR
+	INTERPRET_PENDING // waiting for Resume() with the result of a native
 )
 
 type BinaryOp int
@@ -48,8 +96,17 @@ const (
 	BINARY_OP_SUBTRACT
 	BINARY_OP_MULTIPLY
 	BINARY_OP_DIVIDE
+	BINARY_OP_MODULO
+	BINARY_OP_INT_DIVIDE
+	BINARY_OP_BIT_AND
+	BINARY_OP_BIT_OR
+	BINARY_OP_BIT_XOR
+	BINARY_OP_SHIFT_LEFT
+	BINARY_OP_SHIFT_RIGHT
 	BINARY_OP_GREATER
+	BINARY_OP_GREATER_EQUAL
 	BINARY_OP_LESS
+	BINARY_OP_LESS_EQUAL
 )
 
 var vm VM
@@ -84,49 +141,210 @@ func resetStack() {
 	vm.openUpvalues = nil
 }
 
+// A runtime error is thrown as an instance of the built-in Error
+// class, with the message and stack trace as its fields, so that
+// Lox code can catch it like any other thrown value.  The caller
+// must then return INTERPRET_RUNTIME_ERROR from execute().
 func runtimeError(format string, args ...any) {
-	fmt.Fprintf(os.Stderr, format, args...)
-	fmt.Fprintln(os.Stderr)
+	instance := objval.NewInstance(vm.errorClass)
+	message := objval.STRING_VAL(fmt.Sprintf(format, args...))
+	table.TableSet(&instance.Fields, "message", message)
+	throwValue(objval.OBJ_VAL(object.Obj{Type_: object.OBJ_INSTANCE, Val: instance}))
+}
 
-	// stack trace
+// Record the value being thrown and the current stack trace.  An
+// Error instance thrown by Lox code gets its stack field filled in
+// here if it does not have one yet.
+func throwValue(val value.Value) {
+	vm.exception = val
+	vm.exceptionTrace = nil
 	for i := vm.frameCount - 1; i >= 0; i-- {
 		frame := &vm.frames[i]
 		function := frame.closure.Function
 		instruction := frame.ip - 1
-		fmt.Fprintf(os.Stderr, "[line %d] in ", function.Chun.Lines[instruction])
-		if function.Name == "" {
-			fmt.Fprintf(os.Stderr, "script\n")
-		} else {
-			fmt.Fprintf(os.Stderr, "%s()\n", function.Name)
+		name := "script"
+		if function.Name != "" {
+			name = string(function.Name) + "()"
+		}
+		vm.exceptionTrace = append(vm.exceptionTrace, fmt.Sprintf("[line %d] in %s", function.Chun.Lines[instruction], name))
+	}
+
+	if objval.IS_INSTANCE(val) && objval.AS_INSTANCE(val).Klass == vm.errorClass {
+		instance := objval.AS_INSTANCE(val)
+		if _, ok := table.TableGet(&instance.Fields, "stack"); !ok {
+			items := make([]value.Value, len(vm.exceptionTrace))
+			for i, line := range vm.exceptionTrace {
+				items[i] = objval.STRING_VAL(line)
+			}
+			table.TableSet(&instance.Fields, "stack", objval.LIST_VAL(object.NewList(items)))
+		}
+	}
+}
+
+// Unwind the call frames looking for an exception handler which
+// covers the instruction that threw.  If there is one, the stack is
+// cut back to the depth of the try statement, the exception is pushed
+// for the catch clause, and execution resumes at the handler.  Return
+// false if nothing catches the exception, after reporting it.
+func handleException() bool {
+	for {
+		for vm.frameCount > 0 {
+			frame := &vm.frames[vm.frameCount-1]
+			instruction := frame.ip - 1
+			for _, handler := range frame.closure.Function.Chun.Handlers {
+				if instruction >= handler.Start && instruction < handler.End {
+					closeUpvalues(&vm.stack[frame.base+handler.StackDepth])
+					vm.stackTop = frame.base + handler.StackDepth
+					push(vm.exception)
+					frame.ip = handler.Target
+					return true
+				}
+			}
+
+			closeUpvalues(&frame.slots[0])
+			if frame.module != nil {
+				// Forget the module being imported, so that a later
+				// import retries it rather than seeing a circular import.
+				table.TableDelete(&vm.modules, object.ObjString(frame.module.Path))
+			}
+			if frame.generator != nil {
+				finishGenerator(frame)
+			}
+			vm.frameCount--
+		}
+
+		// An exception which escapes a fiber carries on unwinding the
+		// fiber which resumed it, from its call to resume().
+		if vm.caller == nil {
+			break
+		}
+		vm.state = FIBER_DONE
+		vm.fiber, vm.caller = vm.caller, nil
+	}
+	if vm.fiber != vm.mainFiber {
+		// A fiber stepped by Tick() has failed.
+		vm.state = FIBER_DONE
+	}
+
+	if !vm.debug.stopped {
+		// Errors in expressions evaluated by the debugger go back to
+		// the debugger instead.
+		fmt.Fprintln(os.Stderr, exceptionMessage())
+		for _, line := range vm.exceptionTrace {
+			fmt.Fprintln(os.Stderr, line)
 		}
 	}
 
 	resetStack()
+	return false
+}
+
+// Return the message reporting the exception being thrown.
+func exceptionMessage() string {
+	if objval.IS_INSTANCE(vm.exception) && objval.AS_INSTANCE(vm.exception).Klass == vm.errorClass {
+		instance := objval.AS_INSTANCE(vm.exception)
+		message, ok := table.TableGet(&instance.Fields, "message")
+		if !ok {
+			message = objval.STRING_VAL("Error")
+		}
+		return objval.ValueToString(message)
+	}
+	return fmt.Sprintf("Uncaught exception: %s", objval.ValueToString(vm.exception))
+}
+
+// A native function reports a runtime error by returning the
+// result of nativeRuntimeError().  The undefined value can never
+// be produced by Lox code, so callValue() treats it as the signal
+// to raise the recorded message.
+func nativeRuntimeError(format string, args ...any) value.Value {
+	vm.nativeError = fmt.Sprintf(format, args...)
+	return value.Value{Type_: value.VAL_UNDEFINED}
 }
 
 func defineNative(name string, function object.NativeFn) {
 	objNat := object.Obj{Type_: object.OBJ_NATIVE, Val: function}
 	valNat := objval.OBJ_VAL(objNat)
-	table.TableSet(&vm.globals, object.ObjString(name), valNat)
+	table.TableSet(&vm.builtins, object.ObjString(name), valNat)
 }
 
 func InitVM() {
+	vm.mainFiber = newFiber(nil)
+	vm.mainFiber.state = FIBER_RUNNING
+	vm.fiber = vm.mainFiber
+	vm.scheduled = nil
+	vm.debug.hook = nil
+	vm.debug.breakpoints.Store(nil)
 	resetStack()
 	table.InitTable(&vm.globals)
+	table.InitTable(&vm.builtins)
+	table.InitTable(&vm.modules)
+	vm.mainModule = &objval.ObjModule{Globals: &vm.globals, Consts: make(map[object.ObjString]bool)}
+
+	vm.errorClass = objval.NewClass("Error")
+	errorVal := objval.OBJ_VAL(object.Obj{Type_: object.OBJ_CLASS, Val: vm.errorClass})
+	table.TableSet(&vm.builtins, "Error", errorVal)
+
+	vm.fiberClass = objval.NewClass("Fiber")
+	fiberVal := objval.OBJ_VAL(object.Obj{Type_: object.OBJ_CLASS, Val: vm.fiberClass})
+	table.TableSet(&vm.builtins, "Fiber", fiberVal)
 
 	defineNative("clock", clockNative)
 	defineNative("fibnative", fibNative)
+	defineStringNatives()
+	defineIteratorNatives()
+	defineMapNatives()
+	defineFiberNatives()
 }
 
 func FreeVM() {
 	table.FreeTable(&vm.globals)
+	table.FreeTable(&vm.builtins)
+	table.FreeTable(&vm.modules)
 }
 
 func push(value value.Value) {
+	if vm.stackTop == len(vm.stack) {
+		growStack()
+	}
 	vm.stack[vm.stackTop] = value
 	vm.stackTop++
 }
 
+// Move the running fiber's stack into one twice the size.  The frames
+// hold slices of the stack and open upvalues point into it, so they
+// are moved across too.  The open upvalues are sorted by slot, from
+// the top of the stack down, so one pass down the stack finds them.
+func growStack() {
+	old := vm.stack
+	vm.stack = make([]value.Value, 2*len(old))
+	copy(vm.stack, old)
+	for i := range vm.frameCount {
+		vm.frames[i].slots = vm.stack[vm.frames[i].base:]
+	}
+	slot := vm.stackTop - 1
+	for upvalue := vm.openUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		for upvalue.Location != &old[slot] {
+			slot--
+		}
+		upvalue.Location = &vm.stack[slot]
+	}
+}
+
+// Return a new frame on top of the running fiber's call frames, which
+// grow up to FRAMES_MAX.  The caller checks for a stack overflow.
+// Growing moves the frames, so a *CallFrame held from before is stale
+// afterwards, which is why execute() looks up the top frame again
+// after every instruction which may call.
+func pushFrame() *CallFrame {
+	if vm.frameCount == len(vm.frames) {
+		frames := make([]CallFrame, min(2*len(vm.frames), FRAMES_MAX))
+		copy(frames, vm.frames)
+		vm.frames = frames
+	}
+	vm.frameCount++
+	return &vm.frames[vm.frameCount-1]
+}
+
 func pop() value.Value {
 	vm.stackTop--
 	return vm.stack[vm.stackTop]
@@ -137,25 +355,117 @@ func peek(distance int) value.Value {
 }
 
 func call(closure *objval.ObjClosure, argCount uint) bool {
-	if argCount != uint(closure.Function.Arity) {
-		runtimeError("Expected %d arguments but got %d", closure.Function.Arity, argCount)
+	function := &closure.Function
+	args := int(argCount)
+	if args < function.MinArity || (function.MaxArity != -1 && args > function.MaxArity) {
+		arityError(function, args)
 		return false
 	}
 
+	// The slots of parameters left out are filled with undefined, which
+	// the function's prologue replaces with their default values.  Any
+	// extra arguments are collected into the list for a rest parameter.
+	for ; args < function.Arity; args++ {
+		push(value.Value{Type_: value.VAL_UNDEFINED})
+	}
+	if function.MaxArity == -1 {
+		extra := args - function.Arity
+		rest := append([]value.Value{}, vm.stack[vm.stackTop-extra:vm.stackTop]...)
+		vm.stackTop -= extra
+		push(objval.LIST_VAL(object.NewList(rest)))
+		args = function.Arity + 1
+	}
+
+	if function.IsGenerator {
+		newGenerator(closure, args)
+		return true
+	}
+
 	if vm.frameCount == FRAMES_MAX {
 		runtimeError("Stack overflow.")
 		return false
 	}
 
-	frame := &vm.frames[vm.frameCount]
-	vm.frameCount++
+	frame := pushFrame()
 	frame.closure = *closure
 	frame.ip = 0
 	// frame.slots = uint(vm.stackTop) - uint(argCount) - 1
-	frame.slots = vm.stack[vm.stackTop-int(argCount)-1:]
+	frame.base = vm.stackTop - args - 1
+	frame.slots = vm.stack[frame.base:]
+	frame.module = nil
+	frame.generator = nil
+	frame.lastLine = 0
 	return true
 }
 
+func arityError(function *object.ObjFunction, argCount int) {
+	switch function.MaxArity {
+	case function.MinArity:
+		runtimeError("Expected %s but got %d.", arguments(function.MinArity), argCount)
+	case -1:
+		runtimeError("Expected at least %s but got %d.", arguments(function.MinArity), argCount)
+	default:
+		runtimeError("Expected %d to %d arguments but got %d.", function.MinArity, function.MaxArity, argCount)
+	}
+}
+
+// Return "1 argument" or "n arguments" for an arity error.
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+// Move the named arguments at the top of the stack into the positions
+// of the parameters they name, leaving undefined in the positions of
+// optional parameters that were not passed, and return the new number
+// of arguments for call() to check and pad as usual.
+func bindNamedArguments(callee value.Value, argCount int, names []value.Value) (int, bool) {
+	var function *object.ObjFunction
+	switch {
+	case objval.IS_CLOSURE(callee):
+		function = &objval.AS_CLOSURE(callee).Function
+	case objval.IS_BOUND_METHOD(callee):
+		function = &objval.AS_BOUND_METHOD(callee).Method.Function
+	default:
+		runtimeError("Can only pass named arguments to functions.")
+		return 0, false
+	}
+
+	positional := argCount - len(names)
+	named := append([]value.Value{}, vm.stack[vm.stackTop-len(names):vm.stackTop]...)
+	params := make([]value.Value, max(function.Arity, positional))
+	copy(params, vm.stack[vm.stackTop-argCount:])
+	for i := positional; i < len(params); i++ {
+		params[i] = value.Value{Type_: value.VAL_UNDEFINED}
+	}
+	for i, name := range names {
+		index := slices.Index(function.Params, objval.AS_STRING(name))
+		if index == -1 {
+			runtimeError("Unexpected argument '%s' in %s().", objval.AS_STRING(name), function.Name)
+			return 0, false
+		}
+		if params[index].Type_ != value.VAL_UNDEFINED {
+			runtimeError("Argument '%s' passed more than once.", objval.AS_STRING(name))
+			return 0, false
+		}
+		params[index] = named[i]
+	}
+	for i := range function.MinArity {
+		if params[i].Type_ == value.VAL_UNDEFINED {
+			runtimeError("Missing argument '%s' in %s().", function.Params[i], function.Name)
+			return 0, false
+		}
+	}
+
+	vm.stackTop -= argCount
+	for _, param := range params {
+		push(param)
+	}
+	return len(params), true
+}
+
 func callValue(callee value.Value, argCount uint) bool {
 	if objval.IS_OBJ(callee) {
 		switch objval.OBJ_TYPE(callee) {
@@ -164,16 +474,32 @@ func callValue(callee value.Value, argCount uint) bool {
 			return call(bound.Method, argCount)
 		case object.OBJ_CLASS:
 			klass := objval.AS_CLASS(callee)
+			if klass == vm.fiberClass {
+				return createFiber(int(argCount))
+			}
 			instanceObj := objval.NewInstance(klass)
+			if klass == vm.errorClass && argCount == 1 {
+				// Error(message) creates an error with the given message.
+				table.TableSet(&instanceObj.Fields, "message", peek(0))
+			}
 			instanceVal := objval.OBJ_VAL(object.Obj{Type_: object.OBJ_INSTANCE, Val: instanceObj})
 			vm.stackTop -= int(argCount + 1)
 			push(instanceVal)
 			return true
 		case object.OBJ_CLOSURE:
 			return call(objval.AS_CLOSURE(callee), argCount)
+		case object.OBJ_NATIVE_METHOD:
+			return callNativeMethod(objval.AS_NATIVE_METHOD(callee), int(argCount))
 		case object.OBJ_NATIVE:
 			native := objval.AS_NATIVE(callee)
-			result := native(int(argCount), vm.stack[vm.stackTop-int(argCount):])
+			result := native(int(argCount), vm.stack[vm.stackTop-int(argCount):vm.stackTop])
+			if result.Type_ == value.VAL_UNDEFINED {
+				if vm.pending {
+					return parkForResult(int(argCount))
+				}
+				runtimeError("%s", vm.nativeError)
+				return false
+			}
 			vm.stackTop -= int(argCount + 1)
 			push(result)
 			return true
@@ -185,6 +511,85 @@ func callValue(callee value.Value, argCount uint) bool {
 	return false
 }
 
+// Resolve the path of an imported module.  A relative path is looked
+// up first in the directory of the importing file, then in each of the
+// directories listed in the GLOX_PATH environment variable.  The ".lox"
+// extension may be omitted.
+func resolveModulePath(path string, importer string) (string, bool) {
+	if filepath.Ext(path) == "" {
+		path += ".lox"
+	}
+	var dirs []string
+	if filepath.IsAbs(path) {
+		dirs = []string{""}
+	} else {
+		if importer == "" {
+			dirs = append(dirs, ".")
+		} else {
+			dirs = append(dirs, filepath.Dir(importer))
+		}
+		dirs = append(dirs, filepath.SplitList(os.Getenv("GLOX_PATH"))...)
+	}
+
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, path)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			if abs, err := filepath.Abs(candidate); err == nil {
+				return abs, true
+			}
+		}
+	}
+	return "", false
+}
+
+// A module is compiled and run only once.  Later imports of the same
+// file push the cached module object.  Otherwise we push a call frame
+// for the module's top-level code and let run() execute it like any
+// other function.  When that frame returns, OP_RETURN marks the module
+// loaded and leaves the module object on the stack instead of nil.
+func importModule(path object.ObjString, importer *objval.ObjModule) bool {
+	resolved, ok := resolveModulePath(string(path), importer.Path)
+	if !ok {
+		runtimeError("Could not find module '%s'.", path)
+		return false
+	}
+
+	if cached, ok := table.TableGet(&vm.modules, object.ObjString(resolved)); ok {
+		if !objval.AS_MODULE(cached).Loaded {
+			runtimeError("Circular import of module '%s'.", path)
+			return false
+		}
+		push(cached)
+		return true
+	}
+
+	data, err := os.ReadFile(resolved)
+	if err != nil {
+		runtimeError("Could not read module '%s'.", path)
+		return false
+	}
+	source := string(data)
+	function := compiler.Compile(&source)
+	if function.Arity == (-1) {
+		runtimeError("Could not compile module '%s'.", path)
+		return false
+	}
+
+	name := strings.TrimSuffix(filepath.Base(resolved), filepath.Ext(resolved))
+	module := objval.NewModule(object.ObjString(name), resolved)
+	moduleVal := objval.OBJ_VAL(object.Obj{Type_: object.OBJ_MODULE, Val: module})
+	table.TableSet(&vm.modules, object.ObjString(resolved), moduleVal)
+
+	closure := objval.NewClosure(function)
+	closure.Module = module
+	push(objval.OBJ_VAL(object.Obj{Type_: object.OBJ_CLOSURE, Val: closure}))
+	if !call(closure, 0) {
+		return false
+	}
+	vm.frames[vm.frameCount-1].module = module
+	return true
+}
+
 func bindMethod(klass *objval.ObjClass, name object.ObjString) bool {
 	methodVal, ok := table.TableGet(&klass.Methods, name)
 	if !ok {
@@ -211,7 +616,6 @@ func captureUpvalue(local *value.Value) *objval.ObjUpvalue {
 	for upvalue != nil {
 		s1 := fmt.Sprintf("%p", upvalue.Location)
 		s2 := fmt.Sprintf("%p", local)
-		fmt.Printf("S1=%s, s2=%s\n", s1, s2)
 		if s1 <= s2 {
 			break
 		}
@@ -224,6 +628,7 @@ func captureUpvalue(local *value.Value) *objval.ObjUpvalue {
 	}
 
 	createdUpvalue := objval.NewUpvalue(local)
+	createdUpvalue.Next = upvalue
 
 	if prevUpvalue == nil {
 		vm.openUpvalues = createdUpvalue
@@ -269,6 +674,145 @@ func concatenate() InterpretResult {
 	return INTERPRET_OK
 }
 
+func buildList(itemCount int) {
+	items := make([]value.Value, itemCount)
+	copy(items, vm.stack[vm.stackTop-itemCount:vm.stackTop])
+	vm.stackTop -= itemCount
+	push(objval.LIST_VAL(object.NewList(items)))
+}
+
+// Check that an index is a whole number within [0, length) and
+// return it as an int.
+func checkIndex(index value.Value, length int) (int, bool) {
+	if !objval.IS_NUMBER(index) {
+		runtimeError("Index must be a number.")
+		return 0, false
+	}
+	n := objval.AS_NUMBER(index)
+	i := int(n)
+	if float64(i) != n {
+		runtimeError("Index must be an integer.")
+		return 0, false
+	}
+	if i < 0 || i >= length {
+		runtimeError("Index %d out of bounds.", i)
+		return 0, false
+	}
+	return i, true
+}
+
+func getIndex() InterpretResult {
+	index := peek(0)
+	receiver := peek(1)
+	if objval.IS_STRING(receiver) {
+		// Strings are indexed by code point.
+		s := []rune(string(objval.AS_STRING(receiver)))
+		i, ok := checkIndex(index, len(s))
+		if !ok {
+			return INTERPRET_RUNTIME_ERROR
+		}
+		pop()
+		pop()
+		push(objval.STRING_VAL(string(s[i])))
+		return INTERPRET_OK
+	}
+	if objval.IS_LIST(receiver) {
+		list := objval.AS_LIST(receiver)
+		i, ok := checkIndex(index, len(list.Items))
+		if !ok {
+			return INTERPRET_RUNTIME_ERROR
+		}
+		pop()
+		pop()
+		push(list.Items[i])
+		return INTERPRET_OK
+	}
+	if objval.IS_MAP(receiver) {
+		if msg := checkMapKey(index); msg != "" {
+			runtimeError("%s", msg)
+			return INTERPRET_RUNTIME_ERROR
+		}
+		val, ok := objval.AS_MAP(receiver).Get(index)
+		if !ok {
+			val = objval.NIL_VAL()
+		}
+		pop()
+		pop()
+		push(val)
+		return INTERPRET_OK
+	}
+	runtimeError("Only lists, maps and strings can be indexed.")
+	return INTERPRET_RUNTIME_ERROR
+}
+
+func setIndex() InterpretResult {
+	if objval.IS_MAP(peek(2)) {
+		if msg := checkMapKey(peek(1)); msg != "" {
+			runtimeError("%s", msg)
+			return INTERPRET_RUNTIME_ERROR
+		}
+		objval.AS_MAP(peek(2)).Set(peek(1), peek(0))
+		value := pop() // assigned value
+		pop()          // key
+		pop()          // map
+		push(value)
+		return INTERPRET_OK
+	}
+	if !objval.IS_LIST(peek(2)) {
+		runtimeError("Only lists and maps support index assignment.")
+		return INTERPRET_RUNTIME_ERROR
+	}
+	list := objval.AS_LIST(peek(2))
+	i, ok := checkIndex(peek(1), len(list.Items))
+	if !ok {
+		return INTERPRET_RUNTIME_ERROR
+	}
+	list.Items[i] = peek(0)
+	value := pop() // assigned value
+	pop()          // index
+	pop()          // list
+	push(value)
+	return INTERPRET_OK
+}
+
+// Numbers are float64, but the bitwise operators work on integers.
+// An operand must be a whole number within the range of an int64.
+func isInteger(val value.Value) bool {
+	if !objval.IS_NUMBER(val) {
+		return false
+	}
+	n := objval.AS_NUMBER(val)
+	return n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64
+}
+
+func integer_op(op BinaryOp) InterpretResult {
+	if !isInteger(peek(0)) || !isInteger(peek(1)) {
+		runtimeError("Operands must be integers.")
+		return INTERPRET_RUNTIME_ERROR
+	}
+	if (op == BINARY_OP_SHIFT_LEFT || op == BINARY_OP_SHIFT_RIGHT) && objval.AS_NUMBER(peek(0)) < 0 {
+		runtimeError("Shift count must not be negative.")
+		return INTERPRET_RUNTIME_ERROR
+	}
+	b := int64(objval.AS_NUMBER(pop()))
+	a := int64(objval.AS_NUMBER(pop()))
+	var result int64
+	switch op {
+	case BINARY_OP_BIT_AND:
+		result = a & b
+	case BINARY_OP_BIT_OR:
+		result = a | b
+	case BINARY_OP_BIT_XOR:
+		result = a ^ b
+	case BINARY_OP_SHIFT_LEFT:
+		result = a << b
+	case BINARY_OP_SHIFT_RIGHT:
+		result = a >> b
+	}
+	push(objval.NUMBER_VAL(float64(result)))
+	return INTERPRET_OK
+}
+
 func binary_op(op BinaryOp) InterpretResult {
 	if !objval.IS_NUMBER(peek(0)) || !objval.IS_NUMBER(peek(1)) {
 		runtimeError("Operands must be numbers.")
@@ -285,16 +829,78 @@ func binary_op(op BinaryOp) InterpretResult {
 		push(objval.NUMBER_VAL(a * b))
 	case BINARY_OP_DIVIDE:
 		push(objval.NUMBER_VAL(a / b))
+	case BINARY_OP_MODULO:
+		// The result has the sign of the dividend, as in C's fmod().
+		push(objval.NUMBER_VAL(math.Mod(a, b)))
+	case BINARY_OP_INT_DIVIDE:
+		// The quotient is truncated towards zero.
+		if b == 0 {
+			runtimeError("Division by zero.")
+			return INTERPRET_RUNTIME_ERROR
+		}
+		push(objval.NUMBER_VAL(math.Trunc(a / b)))
 	case BINARY_OP_GREATER:
 		push(objval.BOOL_VAL(a > b))
+	case BINARY_OP_GREATER_EQUAL:
+		push(objval.BOOL_VAL(a >= b))
 	case BINARY_OP_LESS:
 		push(objval.BOOL_VAL(a < b))
+	case BINARY_OP_LESS_EQUAL:
+		push(objval.BOOL_VAL(a <= b))
 	}
 	return INTERPRET_OK
 }
 
 func Interpret(source *string) InterpretResult {
-	var function object.ObjFunction = compiler.Compile(source)
+	return InterpretFile(source, "")
+}
+
+// Interpret the source of the script at path.  The path is where
+// relative imports are resolved from, and may be empty for code
+// which does not come from a file.
+func InterpretFile(source *string, path string) InterpretResult {
+	return interpret(source, path, compiler.Compile)
+}
+
+// Interpret a line of input to the REPL, printing the value of an
+// expression statement which ends it.  The input is returned as the
+// REPL should save it; see compiler.CompileRepl().
+func InterpretRepl(source *string) (InterpretResult, string) {
+	saved := *source
+	result := interpret(source, "", func(source *string) object.ObjFunction {
+		var function object.ObjFunction
+		function, saved = compiler.CompileRepl(source)
+		return function
+	})
+	return result, saved
+}
+
+func interpret(source *string, path string, compile func(*string) object.ObjFunction) InterpretResult {
+	if vm.pending {
+		// Abandon the script waiting for Resume().
+		vm.pending = false
+		vm.fiber = vm.mainFiber
+		resetStack()
+	}
+	if path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	if vm.mainModule.Path != "" {
+		// The script run before, by :load in the REPL, is no longer
+		// the main script, so importing it must load it afresh.
+		table.TableDelete(&vm.modules, object.ObjString(vm.mainModule.Path))
+	}
+	vm.mainModule.Path = path
+	if path != "" {
+		// Register the script so that importing it back from one
+		// of its modules is reported as a circular import.
+		mainVal := objval.OBJ_VAL(object.Obj{Type_: object.OBJ_MODULE, Val: vm.mainModule})
+		table.TableSet(&vm.modules, object.ObjString(path), mainVal)
+	}
+
+	var function object.ObjFunction = compile(source)
 	if function.Arity == (-1) {
 		return INTERPRET_COMPILE_ERROR
 	}
@@ -305,6 +911,7 @@ func Interpret(source *string) InterpretResult {
 	// call(function, 0)
 
 	closure := objval.NewClosure(function)
+	closure.Module = vm.mainModule
 	obj := object.Obj{Type_: object.OBJ_CLOSURE, Val: closure}
 	val := objval.OBJ_VAL(obj)
 	push(val)
@@ -313,7 +920,22 @@ func Interpret(source *string) InterpretResult {
 	return run()
 }
 
+// Execute bytecode until the script finishes.  Whenever execute()
+// stops because something was thrown, we unwind to the nearest
+// exception handler and carry on from there.
 func run() InterpretResult {
+	for {
+		result := execute()
+		if result != INTERPRET_RUNTIME_ERROR {
+			return result
+		}
+		if !handleException() {
+			return INTERPRET_RUNTIME_ERROR
+		}
+	}
+}
+
+func execute() InterpretResult {
 	var result InterpretResult
 
 	var frame *CallFrame = &vm.frames[vm.frameCount-1]
@@ -349,6 +971,9 @@ func run() InterpretResult {
 			fmt.Printf("\n")
 			debugger.DisassembleInstruction(&frame.closure.Function.Chun, int(frame.ip))
 		}
+		if vm.debug.hook != nil {
+			debugCheck(frame)
+		}
 
 		instruction := chunk.OpCode(readByte())
 		switch instruction {
@@ -363,6 +988,21 @@ func run() InterpretResult {
 			push(objval.BOOL_VAL(false))
 		case chunk.OP_POP:
 			pop()
+		case chunk.OP_DUP:
+			push(peek(0))
+		case chunk.OP_DUP2:
+			// Duplicate the top two values, such as the list and
+			// index of a compound assignment to an element.
+			push(peek(1))
+			push(peek(1))
+		case chunk.OP_BURY:
+			// Move the value on top of the stack down under the
+			// n values below it, such as the old value of a postfix
+			// ++ under the receiver of the property it changes.
+			n := int(readByte())
+			top := peek(0)
+			copy(vm.stack[vm.stackTop-n:vm.stackTop], vm.stack[vm.stackTop-1-n:vm.stackTop-1])
+			vm.stack[vm.stackTop-1-n] = top
 		case chunk.OP_GET_LOCAL:
 			// Load the value from the local index and then
 			// push it on top of the stack where later
@@ -382,21 +1022,37 @@ func run() InterpretResult {
 			frame.slots[slot] = peek(0)
 		case chunk.OP_GET_GLOBAL:
 			name := readString()
-			val, ok := table.TableGet(&vm.globals, name)
+			val, ok := table.TableGet(frame.closure.Module.Globals, name)
+			if !ok {
+				val, ok = table.TableGet(&vm.builtins, name)
+			}
 			if !ok {
 				runtimeError("Undefined variable '%s'.", name)
 				return INTERPRET_RUNTIME_ERROR
 			}
 			push(val)
-		case chunk.OP_DEFINE_GLOBAL:
+		case chunk.OP_DEFINE_GLOBAL, chunk.OP_DEFINE_CONST:
 			name := readString()
-			table.TableSet(&vm.globals, name, peek(0))
+			module := frame.closure.Module
+			if module.Consts[name] {
+				runtimeError("Can't redefine constant '%s'.", name)
+				return INTERPRET_RUNTIME_ERROR
+			}
+			table.TableSet(module.Globals, name, peek(0))
+			if instruction == chunk.OP_DEFINE_CONST {
+				module.Consts[name] = true
+			}
 			pop()
 		case chunk.OP_SET_GLOBAL:
 			name := readString()
-			if table.TableSet(&vm.globals, name, peek(0)) {
+			if frame.closure.Module.Consts[name] {
+				runtimeError("Can't assign to constant '%s'.", name)
+				return INTERPRET_RUNTIME_ERROR
+			}
+			globals := frame.closure.Module.Globals
+			if table.TableSet(globals, name, peek(0)) {
 				// Lox doesn't support implicit variable declaration
-				table.TableDelete(&vm.globals, name)
+				table.TableDelete(globals, name)
 				runtimeError("Undefined variable '%s'.", name)
 				return INTERPRET_RUNTIME_ERROR
 			}
@@ -407,6 +1063,26 @@ func run() InterpretResult {
 			slot := readByte()
 			*frame.closure.Upvalues[slot].Location = peek(0)
 		case chunk.OP_GET_PROPERTY:
+			if objval.IS_MODULE(peek(0)) {
+				module := objval.AS_MODULE(peek(0))
+				name := readString()
+				value, ok := table.TableGet(module.Globals, name)
+				if !ok {
+					runtimeError("Module '%s' has no member '%s'.", module.Name, name)
+					return INTERPRET_RUNTIME_ERROR
+				}
+				pop() // module
+				push(value)
+				break
+			}
+
+			if hasNativeMethods(peek(0)) {
+				if !getNativeMethod(peek(0), readString()) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+				break
+			}
+
 			if !objval.IS_INSTANCE(peek(0)) {
 				runtimeError("Only instances have properties.")
 				return INTERPRET_RUNTIME_ERROR
@@ -435,20 +1111,51 @@ func run() InterpretResult {
 			value := pop() // field value
 			pop()          // instance
 			push(value)    // field value
+		case chunk.OP_BUILD_LIST:
+			buildList(int(readByte()))
+		case chunk.OP_BUILD_MAP:
+			result = buildMap(int(readByte()))
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_GET_INDEX:
+			result = getIndex()
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_SET_INDEX:
+			result = setIndex()
+			if result != INTERPRET_OK {
+				return result
+			}
 		case chunk.OP_EQUAL:
 			a := pop()
 			b := pop()
 			push(objval.BOOL_VAL(objval.ValuesEqual(a, b)))
+		case chunk.OP_NOT_EQUAL:
+			a := pop()
+			b := pop()
+			push(objval.BOOL_VAL(!objval.ValuesEqual(a, b)))
 		case chunk.OP_GREATER:
 			result = binary_op(BINARY_OP_GREATER)
 			if result != INTERPRET_OK {
 				return result
 			}
+		case chunk.OP_GREATER_EQUAL:
+			result = binary_op(BINARY_OP_GREATER_EQUAL)
+			if result != INTERPRET_OK {
+				return result
+			}
 		case chunk.OP_LESS:
 			result = binary_op(BINARY_OP_LESS)
 			if result != INTERPRET_OK {
 				return result
 			}
+		case chunk.OP_LESS_EQUAL:
+			result = binary_op(BINARY_OP_LESS_EQUAL)
+			if result != INTERPRET_OK {
+				return result
+			}
 		case chunk.OP_ADD:
 			if objval.IS_STRING(peek(0)) && objval.IS_STRING(peek(1)) {
 				result = concatenate()
@@ -477,13 +1184,59 @@ func run() InterpretResult {
 			if result != INTERPRET_OK {
 				return result
 			}
+		case chunk.OP_MODULO:
+			result = binary_op(BINARY_OP_MODULO)
+			if result != INTERPRET_OK {
+				return result
+			}
 		case chunk.OP_NOT:
 			push(objval.BOOL_VAL(isFalsey(pop())))
 		case chunk.OP_NEGATE:
 			if !objval.IS_NUMBER(peek(0)) {
 				runtimeError("Operand must be a number")
+				return INTERPRET_RUNTIME_ERROR
 			}
 			push(objval.NUMBER_VAL(-objval.AS_NUMBER(pop())))
+		case chunk.OP_INT_DIVIDE:
+			result = binary_op(BINARY_OP_INT_DIVIDE)
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_BIT_AND:
+			result = integer_op(BINARY_OP_BIT_AND)
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_BIT_OR:
+			result = integer_op(BINARY_OP_BIT_OR)
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_BIT_XOR:
+			result = integer_op(BINARY_OP_BIT_XOR)
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_BIT_NOT:
+			if !isInteger(peek(0)) {
+				runtimeError("Operand must be an integer.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			push(objval.NUMBER_VAL(float64(^int64(objval.AS_NUMBER(pop())))))
+		case chunk.OP_SHIFT_LEFT:
+			result = integer_op(BINARY_OP_SHIFT_LEFT)
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_SHIFT_RIGHT:
+			result = integer_op(BINARY_OP_SHIFT_RIGHT)
+			if result != INTERPRET_OK {
+				return result
+			}
+		case chunk.OP_TO_STRING:
+			if !objval.IS_STRING(peek(0)) {
+				push(objval.STRING_VAL(objval.ValueToString(pop())))
+			}
 		case chunk.OP_PRINT:
 			objval.PrintValue(pop())
 			fmt.Println()
@@ -495,19 +1248,68 @@ func run() InterpretResult {
 			if isFalsey(peek(0)) {
 				frame.ip += int(offset)
 			}
+		case chunk.OP_ITERATOR:
+			if !makeIterator() {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[vm.frameCount-1]
+		case chunk.OP_ITER_NEXT:
+			if !iteratorNext(frame.slots[readByte()]) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[vm.frameCount-1]
+		case chunk.OP_JUMP_IF_DONE:
+			slot := readByte()
+			offset := readShort()
+			if iteratorDone(frame.slots[slot], peek(0)) {
+				pop()
+				frame.ip += int(offset)
+			}
+		case chunk.OP_JUMP_IF_PASSED:
+			slot := readByte()
+			offset := readShort()
+			if frame.slots[slot].Type_ != value.VAL_UNDEFINED {
+				frame.ip += int(offset)
+			}
 		case chunk.OP_LOOP:
 			offset := readShort()
 			frame.ip -= int(offset)
+		case chunk.OP_JUMP_TABLE:
+			table := objval.AS_LIST(readConstant()).Items
+			if objval.IS_NUMBER(peek(0)) {
+				n := objval.AS_NUMBER(peek(0))
+				i := int(n) - int(objval.AS_NUMBER(table[0])) + 1
+				if float64(int(n)) == n && i >= 1 && i < len(table) && objval.IS_NUMBER(table[i]) {
+					frame.ip += int(objval.AS_NUMBER(table[i]))
+				}
+			}
 		case chunk.OP_CALL:
 			argCount := readByte()
 			fn := peek(int(argCount))
 			if !callValue(fn, uint(argCount)) {
 				return INTERPRET_RUNTIME_ERROR
 			}
+			if vm.parked {
+				vm.parked = false
+				if vm.pending {
+					return INTERPRET_PENDING
+				}
+				return INTERPRET_OK
+			}
+			frame = &vm.frames[vm.frameCount-1]
+		case chunk.OP_CALL_NAMED:
+			argCount := int(readByte())
+			names := objval.AS_LIST(readConstant()).Items
+			fn := peek(argCount)
+			argCount, ok := bindNamedArguments(fn, argCount, names)
+			if !ok || !callValue(fn, uint(argCount)) {
+				return INTERPRET_RUNTIME_ERROR
+			}
 			frame = &vm.frames[vm.frameCount-1]
 		case chunk.OP_CLOSURE:
 			objFn := objval.AS_FUNCTION(readConstant())
 			objClosure := objval.NewClosure(objFn)
+			objClosure.Module = frame.closure.Module
 			obj := object.Obj{Type_: object.OBJ_CLOSURE, Val: objClosure}
 			push(objval.OBJ_VAL(obj))
 			for i := 0; i < objClosure.UpvalueCount; i++ {
@@ -528,18 +1330,43 @@ func run() InterpretResult {
 			vm.frameCount--
 			if vm.frameCount == 0 {
 				pop()
-				return INTERPRET_OK
+				if vm.fiber == vm.mainFiber || !finishFiber(result) {
+					return INTERPRET_OK
+				}
+				frame = &vm.frames[vm.frameCount-1]
+				break
 			}
 			// vm.stackTop = frame->slots // clox
-			vm.stackTop = vm.stackTop - frame.closure.Function.Arity - 1 // discard the parameters and the function object
+			vm.stackTop = frame.base // discard the locals, the parameters and the function object
+			if frame.module != nil {
+				// The end of an imported module's top-level code.
+				frame.module.Loaded = true
+				result = objval.OBJ_VAL(object.Obj{Type_: object.OBJ_MODULE, Val: frame.module})
+			}
+			if frame.generator != nil {
+				finishGenerator(frame)
+			}
+			push(result)
+			frame = &vm.frames[vm.frameCount-1]
+		case chunk.OP_YIELD:
+			result := pop()
+			suspendGenerator(frame)
 			push(result)
 			frame = &vm.frames[vm.frameCount-1]
+		case chunk.OP_THROW:
+			throwValue(pop())
+			return INTERPRET_RUNTIME_ERROR
 		case chunk.OP_CLASS:
 			klass := objval.NewClass(readString())
 			obj := object.Obj{Type_: object.OBJ_CLASS, Val: klass}
 			push(objval.OBJ_VAL(obj))
 		case chunk.OP_METHOD:
 			defineMethod(readString())
+		case chunk.OP_IMPORT:
+			if !importModule(readString(), frame.closure.Module) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[vm.frameCount-1]
 		}
 	}
 }
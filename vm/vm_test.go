@@ -1,7 +1,15 @@
 package vm
 
 import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/davidfung/glox/objval"
+	"github.com/davidfung/glox/value"
 )
 
 type tests struct {
@@ -161,6 +169,979 @@ func initTestTable() []tests {
         	print i;
 		}
 		`, INTERPRET_OK},
+		{`
+		fun f(a) { var x = a + 1; return x; }
+		{ var y = 10; if (f(y) + y != 21) throw f(y) + y; }
+		`, INTERPRET_OK},
+		{`
+		var s = "  Hello, World  ";
+		if (len(s) != 16 or trim(s) != "Hello, World") throw "len/trim";
+		if (upper(s) != "  HELLO, WORLD  " or lower(s) != "  hello, world  ") throw "case";
+		if (substr("hello", 1, 3) != "ell" or substr("hello", 2) != "llo") throw "substr";
+		if (indexOf("hello", "ll") != 2 or indexOf("hello", "z") != -1) throw "indexOf";
+		if (replace("aaa", "a", "bb") != "bbbbbb") throw "replace";
+		if (!startsWith("hello", "he") or startsWith("hello", "lo")) throw "startsWith";
+		if (!contains("hello", "ell") or contains("hello", "le")) throw "contains";
+		if (toString(1.5) + toString(nil) + toString(true) != "1.5niltrue") throw "toString";
+		if (parseNumber("3.25") + 1 != 4.25 or parseNumber("abc") != nil) throw "parseNumber";
+		if ("abc"[2] != "c") throw "index";
+		`, INTERPRET_OK},
+		{`
+		var parts = split("a,b,c", ",");
+		if (len(parts) != 3 or parts[0] != "a" or parts[2] != "c") throw "split";
+		parts[1] = 42;
+		if (join(parts, "-") != "a-42-c") throw join(parts, "-");
+		if (len([1, 2, 3]) != 3 or len(split("ab", "")) != 2) throw "len";
+		`, INTERPRET_OK},
+		{`
+		print "abc"[3];
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var s = "abc";
+		s[0] = "x";
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		print upper(1);
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		print substr("abc");
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var s = "tab\there\nquote \" backslash \\ dollar \$ \u00e9 \u{1F600}";
+		if (len(s) != 41) throw len(s);
+		if (s[3] != "\u{9}" or s[8] != "\u000a" or s[15] != "\u{22}") throw "control";
+		if (s[27] != "\u005c" or s[36] != "\u{24}" or s[37] != " " or s[38] != "é" or s[40] != "😀") throw "escapes";
+		if (len("\r\0") != 2) throw "cr nul";
+		`, INTERPRET_OK},
+		{`
+		print "bad \q escape";
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var name = "World";
+		var n = 3;
+		var s = "Hello ${name}, ${n} + 1 = ${n + 1}${"!"}";
+		if (s != "Hello World, 3 + 1 = 4!") throw s;
+		s = "nested ${"inner ${name} string"} and ${ [1, 2] } ${nil}";
+		if (s != "nested inner World string and [1, 2] nil") throw s;
+		if ("${""}" != "" or "\${n}" != "$" + "{n}") throw "edges";
+		`, INTERPRET_OK},
+		{`
+		print "unterminated ${1 + 2";
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var café = "naïve 日本語";
+		if (len(café) != 9 or indexOf(café, "本") != 7) throw "counts";
+		if (café[2] != "ï" or substr(café, 6, 2) != "日本") throw "indexes";
+		var π = 3;
+		if (π + 1 != 4) throw "identifier";
+		`, INTERPRET_OK},
+		{`
+		print "日本"[2];
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var sum = 0;
+		for (var i = 0; i < 10; i = i + 1) {
+			var sq = i * i;
+			if (i == 2) continue;
+			if (sq > 20) break;
+			sum = sum + sq;
+		}
+		if (sum != 0 + 1 + 9 + 16) throw sum;
+		var n = 0;
+		var skipped = 0;
+		while (true) {
+			n = n + 1;
+			{ var t = n; if (t < 3) { skipped = skipped + 1; continue; } }
+			if (n >= 5) break;
+		}
+		if (n != 5 or skipped != 2) throw n;
+		`, INTERPRET_OK},
+		{`
+		var j = 0;
+		var last;
+		while (j < 3) {
+			var k = j;
+			fun g() { return k; }
+			last = g;
+			j = j + 1;
+			if (j == 2) break;
+		}
+		if (j != 2 or last() != 1) throw j;
+		`, INTERPRET_OK},
+		{`
+		break;
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		while (true) { fun f() { continue; } }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		fun name(n) {
+			switch (n) {
+				case 1: return "one";
+				case 2, 3: var x = "two or three"; return x;
+				case 4: return "four";
+				default: return "many";
+			}
+		}
+		var names = "";
+		for (var i = 0; i < 6; i = i + 1) names = names + name(i) + " ";
+		if (names != "many one two or three two or three four many ") throw names;
+		var s = "";
+		switch ("b") { case "a": s = "A"; case "b", "c": s = "B or C"; }
+		if (s != "B or C") throw s;
+		var k = 2;
+		switch (k) { case 1: s = "one"; case k: s = "dynamic"; }
+		if (s != "dynamic") throw s;
+		switch (7) { case 1: s = "one"; }
+		if (s != "dynamic") throw "no match";
+		`, INTERPRET_OK},
+		{`
+		var s = "";
+		for (var i = 0; i < 5; i = i + 1) {
+			switch (i) {
+				case 1: continue;
+				case 3: break;
+				default: s = s + toString(i);
+			}
+			s = s + ".";
+		}
+		if (s != "0.2..4.") throw s;
+		`, INTERPRET_OK},
+		{`
+		switch (1) { default: print 1; case 1: print 2; }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		switch (1) { print 1; }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var caught;
+		try { caught = "no"; undefinedVariable; } catch (e) { caught = e.message; }
+		if (caught != "Undefined variable 'undefinedVariable'.") throw caught;
+		try { throw 42; } catch (e) { caught = e; }
+		if (caught != 42) throw "caught " + toString(caught);
+		try { -"a"; } catch (e) { caught = len(e.stack); }
+		if (caught != 1) throw "stack";
+		`, INTERPRET_OK},
+		{`
+		var log = "";
+		fun f() {
+			try { return "r"; } finally { log = log + "f"; }
+		}
+		fun g() {
+			try { throw "t"; } finally { log = log + "g"; }
+		}
+		var r = f();
+		try { g(); } catch (e) { log = log + e; }
+		for (var i = 0; i < 3; i = i + 1) {
+			try {
+				if (i == 1) continue;
+				if (i == 2) break;
+				log = log + toString(i);
+			} finally {
+				log = log + ".";
+			}
+		}
+		if (r + log != "rfgt0...") throw log;
+		`, INTERPRET_OK},
+		{`
+		var log = "";
+		try {
+			try { throw "inner"; }
+			catch (e) { log = log + e; throw "outer"; }
+			finally { log = log + " finally"; }
+		} catch (e) {
+			log = log + " " + e;
+		}
+		fun h(n) { if (n == 0) throw "deep"; var a = n; return h(n - 1); }
+		try { h(5); } catch (e) { log = log + " " + e; }
+		if (log != "inner finally outer deep") throw log;
+		`, INTERPRET_OK},
+		{`
+		fun f() { throw Error("bad"); }
+		f();
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		try { print 1; }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		try { print 1; } catch { print 2; }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var add = fun (a, b) { return a + b; };
+		var twice = (f, x) => f(f(x));
+		var inc = (n) => n + 1;
+		var nothing = () => { return nil; };
+		fun makeCounter() { var n = 0; return () => n = n + 1; }
+		var counter = makeCounter();
+		counter();
+		if (add(1, 2) != 3 or twice(inc, 1) != 3 or nothing() != nil or counter() != 2) throw "bad";
+		if (toString(inc) != "<fn anonymous@4>") throw toString(inc);
+		if ((1 + 2) * 3 != 9) throw "grouping";
+		`, INTERPRET_OK},
+		{`
+		var f = (a, 1) => a;
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var f = (a, b) => a + b;
+		f(1);
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var g = 10;
+		g += 5; g -= 3; g *= 2; g /= 4; g %= 4;
+		if (g != 2 or 7 % 3 != 1 or -7 % 3 != -1) throw g;
+		class P {}
+		var p = P();
+		var calls = 0;
+		fun getP() { calls += 1; return p; }
+		p.x = 1;
+		getP().x += 10;
+		getP().x++;
+		if (++getP().x != 13 or calls != 3) throw calls;
+		var l = [1, 2, 3];
+		var i = 0;
+		l[i++] += 5;
+		if (l[0] != 6 or i != 1 or l[1]++ != 2 or --l[2] != 2) throw l;
+		fun f() {
+			var a = 1;
+			var b = a++;
+			fun inner() { a *= 3; return a; }
+			return toString(inner()) + toString(b) + toString(a--) + toString(a);
+		}
+		if (f() != "6165") throw f();
+		var s = "a";
+		s += "b";
+		if (s != "ab") throw s;
+		`, INTERPRET_OK},
+		{`
+		var x = 0.1;
+		if (x++ != 0.1 or x != 1.1) throw x;
+		var big = 9007199254740992;
+		if (big++ != 9007199254740992 or big-- != 9007199254740992) throw big;
+		class P {}
+		var p = P();
+		p.x = 0.1;
+		if (p.x++ != 0.1 or p.x-- != 1.1 or p.x != 0.10000000000000009) throw p.x;
+		var l = [0.1, 9007199254740992];
+		if (l[0]++ != 0.1 or l[1]++ != 9007199254740992 or l[0] != 1.1) throw l;
+		`, INTERPRET_OK},
+		{`
+		var a = 1; var b = 2;
+		a + b += 1;
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		fun f() {}
+		++f();
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		++1;
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var s = "a";
+		s++;
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var nan = 0 / 0;
+		var one = 1;
+		if (nan >= one or nan <= one or nan == nan or !(nan != nan)) throw "nan";
+		if (!(2 >= 2) or !(1 <= 2) or 1 + 2 * 3 != 7 or "a" + "b" != "ab" or !true) throw "fold";
+		fun f(x) {
+			if (x) { return 1; print "dead"; } else { return 2; }
+			print "dead";
+		}
+		if (f(true) + f(false) != 3) throw "dead code";
+		`, INTERPRET_OK},
+		{`
+		print 1 + "a";
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var a = 12; var b = 10;
+		if ((a & b) != 8 or (a | b) != 14 or (a ^ b) != 6 or ~a != -13) throw "bitwise";
+		if (a << 2 != 48 or -a >> 1 != -6) throw "shift";
+		if (7 ~/ 2 != 3 or -7 ~/ 2 != -3 or a ~/ 5 != 2) throw "int divide";
+		if (!(1 | 2 == 3) or 6 & 3 + 1 != 4 or 1 << 2 + 1 != 8) throw "precedence";
+		`, INTERPRET_OK},
+		{`
+		var x = 1.5;
+		print x & 1;
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var x = 1;
+		print x << -1;
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var x = 0;
+		print 1 ~/ x;
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var x = 5;
+		if ((x > 3 ? "big" : "small") != "big") throw "simple";
+		if ((x > 10 ? "huge" : x > 3 ? "big" : "small") != "big") throw "nested";
+		fun sign(n) { return n < 0 ? -1 : n == 0 ? 0 : 1; }
+		if (sign(-4) != -1 or sign(0) != 0 or sign(9) != 1) throw "sign";
+		var y;
+		y = x == 5 ? 1 : 2;
+		if (y != 1 or (nil or false ? "a" : "b") != "b") throw "precedence";
+		`, INTERPRET_OK},
+		{`
+		var x = true ? 1;
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		const limit = 10;
+		{
+			const step = 2;
+			fun next(n) { return n + step < limit ? n + step : limit; }
+			if (next(3) != 5 or next(9) != limit) throw "const";
+		}
+		var continued = 0;
+		for (var i = 0; i < 3; i++) { if (i == 1) continue; continued++; }
+		if (continued != 2) throw "continue";
+		`, INTERPRET_OK},
+		{`
+		{ const x = 1; x = 2; }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		{ const x = 1; fun f() { x += 1; } }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		{ const x = 1; fun f() { fun g() { x++; } } }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		const x;
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		const x = 1;
+		fun f() { x = 2; }
+		f();
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		const x = 1;
+		var x = 2;
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun greet(name, greeting = "Hello", mark = name == "" ? "?" : "!") {
+			return greeting + ", " + name + mark;
+		}
+		if (greet("Bob") != "Hello, Bob!") throw "defaults";
+		if (greet("Bob", "Hi", ".") != "Hi, Bob.") throw "passed";
+		if (greet("", mark: ".") != "Hello, .") throw "named";
+		if (greet(greeting: "Yo", name: "Al") != "Yo, Al!") throw "reordered";
+		fun count(first, ...rest) { return 1 + len(rest); }
+		if (count(1) != 1 or count(1, 2, 3) != 3) throw "rest";
+		var pair = (a, b = a * 2) => [a, b];
+		if (pair(3)[1] != 6 or pair(3, 1)[1] != 1) throw "lambda";
+		class C { m(x, y = 10) { return x - y; } }
+		if (C().m(1) != -9 or C().m(y: 2, x: 1) != -1) throw "method";
+		`, INTERPRET_OK},
+		{`
+		fun expect(f, message) {
+			try { f(); } catch (e) { if (e.message != message) throw e.message; return; }
+			throw "no error";
+		}
+		fun one(a) {}
+		fun atLeastOne(a, ...rest) {}
+		fun oneOrTwo(a, b = 1) {}
+		expect(() => one(), "Expected 1 argument but got 0.");
+		expect(() => atLeastOne(), "Expected at least 1 argument but got 0.");
+		expect(() => oneOrTwo(), "Expected 1 to 2 arguments but got 0.");
+		expect(() => len(), "Expected 1 argument but got 0 in len().");
+		expect(() => Fiber(), "Expected 1 argument but got 0.");
+		`, INTERPRET_OK},
+		{`
+		fun f(a, b = 1) {}
+		f();
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun f(a, b = 1) {}
+		f(1, 2, 3);
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun f(a, b = 1) {}
+		f(1, c: 2);
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun f(a, b = 1) {}
+		f(1, a: 2);
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun f(a, b = 1) {}
+		f(b: 2);
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun f(a = 1, b) {}
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		fun f(...a, b) {}
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		fun f(a, b) {}
+		f(a: 1, 2);
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var s = "";
+		for (var c in "né!") s += c + ".";
+		if (s != "n.é.!.") throw "string";
+		var n = 0;
+		var x = "before";
+		for (x in [1, nil, 3]) n++;
+		if (n != 3 or x != 3) throw "list";
+		fun last(items) { var item; for (item in items) {} return item; }
+		if (last("ab") != "b" or last([]) != nil) throw "existing variable";
+		var total = 0;
+		for (var i in range(10)) { if (i == 2) continue; if (i == 5) break; total += i; }
+		if (total != 8) throw "range";
+		for (var i in range(10, 0, -4)) total += i;
+		if (total != 26) throw "step";
+		var fns = [nil, nil, nil];
+		for (var i in range(3)) fns[i] = () => i;
+		if (fns[0]() != 0 or fns[2]() != 2) throw "fresh";
+		fun Countdown(n) {
+			class Iterator { next() { if (n == 0) return nil; n--; return n + 1; } }
+			class Countdown { iterator() { return Iterator(); } }
+			return Countdown();
+		}
+		s = "";
+		for (var k in Countdown(3)) s += toString(k);
+		if (s != "321") throw "protocol";
+		`, INTERPRET_OK},
+		{`
+		var m = {"a": 1, 2: "two", true: nil};
+		if (m["a"] != 1 or m[2] != "two" or m[true] != nil or m["zz"] != nil) throw "index";
+		if (!has(m, true) or has(m, "zz")) throw "has";
+		m["b"] = 3;
+		m["a"] += 10;
+		m[2] += "1";
+		if (toString(m) != "{\"a\": 11, 2: \"two1\", true: nil, \"b\": 3}") throw toString(m);
+		if (remove(m, 2) != "two1" or remove(m, 2) != nil or len(m) != 3) throw "remove";
+		var s = "";
+		for (var k in m) { s += toString(k) + ","; m["new"] = 1; }
+		if (s != "a,true,b," or join(keys(m), ",") != "a,true,b,new") throw s;
+		if ({} == {} or len({}) != 0) throw "empty";
+		var nested = {"list": [1, {"x": 2}]};
+		if (nested["list"][1]["x"] != 2 or "${ {1: "one"}[1] }" != "one") throw "nested";
+		`, INTERPRET_OK},
+		{`
+		var m = {[1]: 2};
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var m = {};
+		m[nil] = 1;
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		has({}, clock);
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var m = {"a" 1};
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		for (var x in 5) {}
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		for (undeclared in [1]) {}
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		{ const k = 1; for (k in [1]) {} }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		class C {}
+		for (var x in C()) {}
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		for (var i in range(0, 5, 0)) {}
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun* count(n) {
+			for (var i = 0; i < n; i++) yield i;
+		}
+		var g = count(2);
+		if (g.next() != 0 or g.next() != 1 or g.next() != nil or g.next() != nil) throw "next";
+		var s = "";
+		for (var x in count(3)) s += toString(x);
+		if (s != "012") throw "for-in";
+		fun* counter() { var n = 0; yield () => n; n = 10; yield nil; n = 20; }
+		var c = counter();
+		var get = c.next();
+		c.next();
+		if (get() != 10) throw "suspended upvalue";
+		c.next();
+		if (get() != 20) throw "closed upvalue";
+		var pair = fun* (a, b = 5) { yield a; yield b; };
+		s = "";
+		for (var v in pair(1)) s += toString(v);
+		if (s != "15") throw "anonymous";
+		fun* fails() { yield 1; throw "oops"; }
+		var f = fails();
+		f.next();
+		try { f.next(); throw "no exception"; } catch (e) { if (e != "oops") throw e; }
+		if (f.next() != nil) throw "finished";
+		fun* nils() { yield nil; }
+		var z = nils();
+		if (z.next() != nil or z.isDone()) throw "yielded nil";
+		if (z.next() != nil or !z.isDone()) throw "done";
+		fun* echo() { var total = 0; while (true) total += yield total; }
+		var e = echo();
+		e.next("dropped");
+		if (e.next(2) != 2 or e.next(3) != 5 or e.isDone()) throw "sent values";
+		fun* pairs() { var a = [yield, yield]; yield a; }
+		var p = pairs();
+		p.next();
+		p.next("x");
+		if (toString(p.next("y")) != "[\"x\", \"y\"]") throw "yield in list";
+		`, INTERPRET_OK},
+		{`
+		fun* self() { yield me.next(); }
+		var me = self();
+		me.next();
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun f() { yield 1; }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		fun* f() { return 1; }
+		`, INTERPRET_COMPILE_ERROR},
+		{`
+		var log = "";
+		var f = Fiber(fun (first) {
+			log += first;
+			var x = Fiber.yield(1);
+			log += x;
+			return 3;
+		});
+		if (f.resume("a") != 1 or f.isDone()) throw "yield";
+		if (f.resume("b") != 3 or !f.isDone()) throw "return";
+		if (log != "ab") throw "resume values";
+		var inner = Fiber(fun () { Fiber.yield(1); throw "boom"; });
+		var outer = Fiber(fun () { inner.resume(); inner.resume(); });
+		try { outer.resume(); throw "no exception"; } catch (e) { if (e != "boom") throw e; }
+		if (!inner.isDone() or !outer.isDone()) throw "unwound";
+		fun* g() { yield 1; Fiber.yield(2); yield 3; }
+		var sum = 0;
+		var h = Fiber(fun () { for (var v in g()) sum += v; });
+		if (h.resume() != 2 or sum != 1) throw "generator";
+		h.resume();
+		if (sum != 4) throw "generator resumed";
+		`, INTERPRET_OK},
+		{`
+		var f = Fiber(fun () {});
+		f.resume();
+		f.resume();
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		Fiber.yield();
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		var f = Fiber(fun () { f.resume(); });
+		f.resume();
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		Fiber(fun (a, b) {});
+		`, INTERPRET_RUNTIME_ERROR},
 	}
 	return tests
 }
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	searchDir := t.TempDir()
+	files := map[string]string{
+		filepath.Join(dir, "lib", "util.lox"): `
+			var counter = 0;
+			fun next() { counter = counter + 1; return counter; }
+		`,
+		filepath.Join(dir, "cycle1.lox"):      `import "cycle2";`,
+		filepath.Join(dir, "cycle2.lox"):      `import "cycle1";`,
+		filepath.Join(searchDir, "extra.lox"): `var value = len("abc");`,
+	}
+	for path, source := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("GLOX_PATH", searchDir)
+
+	tests := []tests{
+		{`
+		import "lib/util.lox";
+		import "lib/util" as again;
+		if (util.next() != 1) throw "first";
+		if (again.next() != 2 or util != again) throw "cache";
+		`, INTERPRET_OK},
+		{`
+		import "extra" as ex;
+		if (ex.value != 3) throw ex.value;
+		`, INTERPRET_OK},
+		{`
+		import "lib/util";
+		print util.missing;
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		import "cycle1";
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		import "nowhere";
+		`, INTERPRET_RUNTIME_ERROR},
+		{`
+		fun f() { import "lib/util"; }
+		`, INTERPRET_COMPILE_ERROR},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			InitVM()
+			if result := InterpretFile(&test.input, filepath.Join(dir, "main.lox")); result != test.want {
+				t.Errorf("Script error: %q", test.input)
+			}
+			FreeVM()
+		})
+	}
+}
+
+func TestTick(t *testing.T) {
+	InitVM()
+	defer FreeVM()
+	source := `
+	var log = "";
+	fun worker(name, n) {
+		return Fiber(fun () {
+			for (var i in range(n)) {
+				log += name;
+				Fiber.yield();
+			}
+		});
+	}
+	schedule(worker("a", 3));
+	schedule(worker("b", 2));
+	`
+	if result := Interpret(&source); result != INTERPRET_OK {
+		t.Fatalf("Interpret() = %v", result)
+	}
+
+	ticks := 0
+	for Scheduled() > 0 {
+		if result := Tick(); result != INTERPRET_OK {
+			t.Fatalf("Tick() = %v", result)
+		}
+		ticks++
+	}
+	if ticks != 4 {
+		t.Errorf("ticks = %d, want 4", ticks)
+	}
+	check := `if (log != "ababa") throw log;`
+	if result := Interpret(&check); result != INTERPRET_OK {
+		t.Errorf("fibers did not run round-robin")
+	}
+}
+
+// A fiber starts with a small stack and few frames, and they grow as
+// calls nest, with the locals captured by closures moving along.
+func TestFiberStack(t *testing.T) {
+	InitVM()
+	defer FreeVM()
+	f := newFiber(nil)
+	if len(f.stack) != STACK_INIT || len(f.frames) != FRAMES_INIT {
+		t.Errorf("new fiber has %d slots and %d frames", len(f.stack), len(f.frames))
+	}
+	source := `
+	fun deep(n) {
+		var a = n;
+		var set = (v) => a = v;
+		var b = a;
+		var c = b;
+		if (n > 0) deep(n - 1);
+		set(n * 2);
+		if (a != n * 2) throw "upvalue left behind";
+	}
+	deep(60);
+	var f = Fiber(fun () { deep(60); });
+	f.resume();
+	if (!f.isDone()) throw "fiber";
+	`
+	if result := Interpret(&source); result != INTERPRET_OK {
+		t.Fatalf("Interpret() = %v", result)
+	}
+	if len(vm.stack) <= STACK_INIT || len(vm.frames) != FRAMES_MAX {
+		t.Errorf("main fiber grew to %d slots and %d frames", len(vm.stack), len(vm.frames))
+	}
+}
+
+func TestPending(t *testing.T) {
+	InitVM()
+	defer FreeVM()
+	var requests []string
+	DefineNative("fetch", func(argCount int, args []value.Value) value.Value {
+		requests = append(requests, string(objval.AS_STRING(args[0])))
+		return Pending()
+	})
+	source := `
+	fun get(name) { return fetch(name) * 10; }
+	var a = get("a");
+	var f = Fiber(fun () { return fetch("b"); });
+	if (a + f.resume() != 12) throw "results";
+	schedule(Fiber(fun () { fetch("c"); }));
+	`
+	if result := Interpret(&source); result != INTERPRET_PENDING {
+		t.Fatalf("Interpret() = %v, want INTERPRET_PENDING", result)
+	}
+	if result := Resume(objval.NUMBER_VAL(1)); result != INTERPRET_PENDING {
+		t.Fatalf("first Resume() = %v, want INTERPRET_PENDING", result)
+	}
+	if result := Resume(objval.NUMBER_VAL(2)); result != INTERPRET_OK {
+		t.Fatalf("second Resume() = %v, want INTERPRET_OK", result)
+	}
+	if !slices.Equal(requests, []string{"a", "b"}) {
+		t.Errorf("requests = %v", requests)
+	}
+
+	// A fiber stepped by Tick() can't wait for a result.
+	if result := Tick(); result != INTERPRET_RUNTIME_ERROR {
+		t.Errorf("Tick() = %v, want INTERPRET_RUNTIME_ERROR", result)
+	}
+}
+
+func TestInterpretRepl(t *testing.T) {
+	InitVM()
+	defer FreeVM()
+	inputs := []struct {
+		input string
+		want  InterpretResult
+	}{
+		{"1 + 2", INTERPRET_OK},
+		{"var x = 1; x", INTERPRET_OK},
+		{"x = x + 1;", INTERPRET_OK},
+		{"fun f() {\n  return x;\n}\nf()", INTERPRET_OK},
+		{"if (f() != 2) throw \"globals\";", INTERPRET_OK},
+		{"{ x }", INTERPRET_COMPILE_ERROR},
+		{"x var y = 1;", INTERPRET_COMPILE_ERROR},
+	}
+	for _, test := range inputs {
+		if result, _ := InterpretRepl(&test.input); result != test.want {
+			t.Errorf("InterpretRepl(%q) = %v, want %v", test.input, result, test.want)
+		}
+	}
+
+	// Outside the REPL an expression still needs its semicolon.
+	source := "1 + 2"
+	if result := Interpret(&source); result != INTERPRET_COMPILE_ERROR {
+		t.Errorf("Interpret(%q) = %v, want INTERPRET_COMPILE_ERROR", source, result)
+	}
+	if names := Globals(); !slices.Equal(names, []string{"f", "x"}) {
+		t.Errorf("Globals() = %v", names)
+	}
+}
+
+func TestReplSession(t *testing.T) {
+	InitVM()
+	defer FreeVM()
+
+	// An echoed expression gets back its semicolon, so that the input
+	// can be saved as part of a script.
+	for input, want := range map[string]string{
+		"1 + 2":        "1 + 2;",
+		"1 + 2;":       "1 + 2;",
+		"const c = 1;": "const c = 1;",
+		"{ 1 + 2; }":   "{ 1 + 2; }",
+	} {
+		source := input
+		if result, saved := InterpretRepl(&source); result != INTERPRET_OK || saved != want || source != input {
+			t.Errorf("InterpretRepl(%q) = %v, %q and source %q; want %q", input, result, saved, source, want)
+		}
+	}
+	source := "1 +"
+	if _, saved := InterpretRepl(&source); saved != "1 +" {
+		t.Errorf("source of a compile error saved as %q", saved)
+	}
+
+	ResetGlobals()
+	if names := Globals(); len(names) != 0 {
+		t.Errorf("Globals() after ResetGlobals() = %v", names)
+	}
+	source = "const c = 2; if (len(\"ab\") != c) throw \"natives\";"
+	if result, _ := InterpretRepl(&source); result != INTERPRET_OK {
+		t.Errorf("after ResetGlobals(): %v", result)
+	}
+}
+
+// A script run by :load stops being the main script when the next one
+// runs, or the REPL is reset, and can then be imported like any other.
+func TestLoadMainScript(t *testing.T) {
+	InitVM()
+	defer FreeVM()
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.lox")
+	if err := os.WriteFile(first, []byte("var value = 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	source := "var value = 1;"
+	if result := InterpretFile(&source, first); result != INTERPRET_OK {
+		t.Fatalf("first script: %v", result)
+	}
+	source = `import "first"; if (first.value != 1) throw "import";`
+	if result := InterpretFile(&source, filepath.Join(dir, "second.lox")); result != INTERPRET_OK {
+		t.Errorf("importing the first script after it ran: %v", result)
+	}
+
+	source = "var value = 1;"
+	InterpretFile(&source, first)
+	ResetGlobals()
+	source = `import "` + filepath.ToSlash(first) + `" as f; if (f.value != 1) throw "import";`
+	if result, _ := InterpretRepl(&source); result != INTERPRET_OK {
+		t.Errorf("importing the first script after a reset: %v", result)
+	}
+}
+
+// Return what f writes to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	return <-output
+}
+
+func TestDebugger(t *testing.T) {
+	InitVM()
+	defer FreeVM()
+	source := `var x = 1;
+	fun add(a, b) {
+	  var sum = a + b;
+	  return sum;
+	}
+	var y = add(x, 2);
+	for (var i = 0; i < 2; i = i + 1) {
+	  x = x + i;
+	}
+	`
+	type stop struct {
+		reason StopReason
+		line   int
+	}
+	var stops []stop
+	step := 0
+	SetDebugHook(func(reason StopReason) {
+		frames := StackFrames()
+		stops = append(stops, stop{reason, frames[0].Line})
+		step++
+		switch step {
+		case 1:
+			StepOver()
+		case 2:
+			StepInto()
+		case 3:
+			if len(frames) != 2 || frames[0].Function != "add()" || frames[1].Line != 6 {
+				t.Errorf("frames = %v", frames)
+			}
+			locals := Locals(0)
+			if len(locals) != 2 || locals[0].Name != "a" || locals[1].Name != "b" {
+				t.Errorf("locals = %v", locals)
+			}
+			var val value.Value
+			var err error
+			output := captureStdout(t, func() { val, err = Evaluate(0, "((n) => n * 10)(a) + b + x") })
+			if err != nil || !objval.ValuesEqual(val, objval.NUMBER_VAL(13)) {
+				t.Errorf("Evaluate() = %v, %v", val, err)
+			}
+			if output != "" {
+				t.Errorf("Evaluate() printed %q", output)
+			}
+			if _, err := Evaluate(0, "missing"); err == nil {
+				t.Error("Evaluate() of an undefined variable succeeded")
+			}
+			StepOut()
+		case 4:
+			SetBreakpoints("", []int{8})
+			Continue()
+		case 5:
+			if val, _ := Evaluate(0, "i"); !objval.ValuesEqual(val, objval.NUMBER_VAL(0)) {
+				t.Errorf("i = %v", val)
+			}
+			Continue()
+		default:
+			Continue()
+		}
+	})
+	if result := Interpret(&source); result != INTERPRET_OK {
+		t.Fatalf("Interpret() = %v", result)
+	}
+	want := []stop{
+		{STOP_ENTRY, 1},
+		{STOP_STEP, 6}, // not 5, where the closure for add() is made
+		{STOP_STEP, 3},
+		{STOP_STEP, 7},
+		{STOP_BREAKPOINT, 8},
+		{STOP_BREAKPOINT, 8},
+	}
+	if !slices.Equal(stops, want) {
+		t.Errorf("stops = %v, want %v", stops, want)
+	}
+
+	// The first stop is on the first statement after the functions and
+	// classes a script starts with, and a step does not stop on the '}'
+	// of a method either.
+	InitVM()
+	source = `fun first() {
+	  return 1;
+	}
+	class C {
+	  m() {
+	    return 2;
+	  }
+	}
+	print first() + C().m();
+	`
+	stops = nil
+	SetBreakpoints("", nil)
+	SetDebugHook(func(reason StopReason) {
+		stops = append(stops, stop{reason, StackFrames()[0].Line})
+		if len(stops) < 2 {
+			StepOver()
+		} else {
+			Continue()
+		}
+	})
+	output := captureStdout(t, func() {
+		if result := Interpret(&source); result != INTERPRET_OK {
+			t.Errorf("Interpret() = %v", result)
+		}
+	})
+	if want := []stop{{STOP_ENTRY, 4}, {STOP_STEP, 9}}; !slices.Equal(stops, want) {
+		t.Errorf("stops = %v, want %v", stops, want)
+	}
+	if !strings.HasSuffix(output, "3\n") {
+		t.Errorf("output = %q", output)
+	}
+
+	// A function breakpoint stops on entering the function.
+	InitVM()
+	source = `fun f() {
+	  fun g() { return 1; }
+	  return g();
+	}
+	f();
+	`
+	var functions []string
+	SetDebugHook(func(reason StopReason) {
+		if reason == STOP_BREAKPOINT {
+			functions = append(functions, StackFrames()[0].Function)
+		}
+		Continue()
+	})
+	SetFunctionBreakpoints([]string{"g"})
+	if result := Interpret(&source); result != INTERPRET_OK {
+		t.Fatalf("Interpret() = %v", result)
+	}
+	if !slices.Equal(functions, []string{"g()"}) {
+		t.Errorf("stopped in %v", functions)
+	}
+}